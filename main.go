@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"mongosync/utils"
 	"os"
@@ -11,7 +15,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"gopkg.in/fatih/set.v0"
@@ -35,6 +39,7 @@ func main() {
 		mongosync --replayoplog [--src_op_ns "syncoplog.oplog.rs"] --op_start arg [--op_end arg ] [--db arg ，--nsExclude|nsInclude arg ,--dbFrom_To arg ,--nsFrom_To arg] // 手动进行oplog重放
 		mongosync --syncoplog
 		mongosync --overwrite  对于"_id"已经存在的数据，采用覆盖的方式还是采用跳过的方式，默认跳过。
+		mongosync --conflict_policy skip|overwrite|fail|merge  "_id"已经存在时的处理方式，同时用于全量同步和重放insert类型的oplog，指定时忽略--overwrite
 		mongosync --no_index 是否创建索引，如果索引已经存在，再创建会失败
 		mongosync --threadNum arg 指定进行通过的线程数量，默认是20个线程。可以用来控制流量
 		mongosync --dbFrom_To arg 数据库名称映射（这些db必须存在于-db参数列表中）
@@ -47,98 +52,806 @@ func main() {
 		src_port                                       int
 		dst_host, dst_user, dst_passwd, dst_auth_db    string
 		dst_port                                       int
+		src_replica_set, dst_replica_set               string
+		src_auth_mechanism, src_aws_session_token      string
+		dst_auth_mechanism, dst_aws_session_token      string
+		src_gssapi_service, src_gssapi_realm           string
+		dst_gssapi_service, dst_gssapi_realm           string
+		krb5_keytab                                    string
+		src_read_preference, src_read_preference_tags  string
+		dst_write_concern, oplog_write_concern         string
+		src_compressors, dst_compressors               string
+		src_proxy, dst_proxy                           string
+		src_tls, dst_tls                               bool
+		src_tls_ca_file, dst_tls_ca_file               string
+		src_tls_cert_key_file, dst_tls_cert_key_file   string
+		src_tls_insecure, dst_tls_insecure             bool
+		src_connect_timeout_ms, dst_connect_timeout_ms int
+		src_socket_timeout_ms, dst_socket_timeout_ms   int
+		src_heartbeat_ms, dst_heartbeat_ms             int
+		src_keepalive_ms, dst_keepalive_ms             int
+		ssh_key, ssh_known_hosts                       string
 		oplog, sync_oplog, replayoplog                 bool
 		db, nsExclude, nsInclude, dbFrom_To, nsFrom_To string
 		op_start, op_end, src_op_ns                    string
 		overwrite, no_index                            bool
+		conflict_policy                                string
+		index_build                                    string
+		index_build_threads                            int
 		threadNum                                      int
+		range_threads                                  int
+		range_min_docs                                 int64
+		doc_log_limit                                  int
+		error_artifacts_dir                            string
+		oversized_docs                                 string
+		oversized_truncate_fields                      string
+		insert_ordered                                 bool
+		hooks_file                                     string
+		chunk_cache                                    bool
+		chunk_size                                     int
+		ns_collision                                   string
+		ns_invalid                                     string
+		heartbeat_interval                             int
+		capacity_check_interval                        int
+		capacity_margin                                float64
+		find_timeout, write_timeout, command_timeout   int
+		max_retries, retry_backoff_max                 int
+		src_retry_reads, dst_retry_writes              bool
+		validate                                       bool
+		check                                          bool
+		verify                                         bool
+		reset_manifest                                 bool
+		retry_failed                                   bool
+		sync_system_js                                 bool
+		causal_copy                                    bool
+		fetch_missing_docs                             bool
+		batch_docs                                     int
+		batch_bytes                                    int64
+		catalog_ttl, catalog_rate_limit                int
+		src_read_docs_per_sec, src_read_mb_per_sec     float64
+		dst_write_docs_per_sec, dst_write_mb_per_sec   float64
+		rate_limit_file                                string
+		schedule, history_addr                         string
+		report_retention_days                          int
+		allow_broad_deletes                            bool
+		bypass_document_validation                     bool
+		replace_diff_min_kb                            int
+		low_memory                                     bool
+		offline_buffer_dir                             string
+		offline_buffer_mb                              int
+		offline_buffer_policy                          string
+		drop_dst                                       string
+		read_strategy                                  string
+		replay_hint                                    string
+		from_last                                      bool
+		sync_oplog_replay                              bool
+		delta                                          string
+		dump                                           string
+		gridfs                                         bool
+		shard_dst                                      string
+		sync_users                                     string
+		export                                         string
+		export_archive, export_gzip, export_oplog      bool
+		include_system_ns                              bool
+		src_full_sync_member                           string
+		src_max_lag                                    int
+		max_memory_mb                                  int
+		count_check                                    string
+		filters_file, projections_file                 string
+		ns_overrides_file                              string
+		verify_buckets                                 int
+		change_stream                                  bool
+		change_stream_scope                            string
+		change_stream_update_lookup                    bool
+		resume_token_interval                          int
+		checkpoint_ns                                  string
+		checkpoint_interval                            int
+		resume                                         bool
+		resync_on_rollover                             bool
+		resume_token_file                              string
+		validate_db                                    string
+		validate_sample, validate_window               int
+		low_priority_ns                                string
+		low_priority_workers, low_priority_batch       int
+		replay_batch                                   int
+		apply_ops                                      bool
+		credentials_file                               string
+		verify_src_user, verify_src_passwd             string
+		verify_dst_user, verify_dst_passwd             string
+		verify_src_auth_db, verify_dst_auth_db         string
+		yes                                            bool
 	)
 
 	// 连接mongodb相关参数
-	flag.StringVar(&src_host, "sh", "0.0.0.0", "the source mongodb server's ip")
+	flag.StringVar(&src_host, "sh", "0.0.0.0", "the source mongodb server's ip, or a list of seed hosts. Format:<host[:port],...>, the port defaults to --sP")
 	flag.IntVar(&src_port, "sP", 27017, "the source mongodb server's port")
 	flag.StringVar(&src_user, "su", "", "the source mongodb server's logging user")
-	flag.StringVar(&src_passwd, "sp", "", "the source mongodb server's logging password")
+	flag.StringVar(&src_passwd, "sp", "", "the source mongodb server's logging password, \"-\" to read it from stdin. Defaults to $MONGOSYNC_SRC_PASSWORD or --credentials_file")
 	flag.StringVar(&src_auth_db, "sd", "", "the source mongodb server's auth db")
 
-	flag.StringVar(&dst_host, "dh", "", "the destination mongodb server's ip")
+	flag.StringVar(&dst_host, "dh", "", "the destination mongodb server's ip, or a list of seed hosts. Format:<host[:port],...>, the port defaults to --dP")
 	flag.IntVar(&dst_port, "dP", 27017, "the destination mongodb server's port")
+	flag.StringVar(&src_replica_set, "src_replica_set", "", "the replica set name of the source, only members of this replica set are used")
+	flag.StringVar(&dst_replica_set, "dst_replica_set", "", "the replica set name of the destination, only members of this replica set are used")
 	flag.StringVar(&dst_user, "du", "", "the destination mongodb server's logging user")
-	flag.StringVar(&dst_passwd, "dp", "", "the destination mongodb server's logging password")
+	flag.StringVar(&dst_passwd, "dp", "", "the destination mongodb server's logging password, \"-\" to read it from stdin. Defaults to $MONGOSYNC_DST_PASSWORD or --credentials_file")
 	flag.StringVar(&dst_auth_db, "dd", "", "the destination mongodb server's auth db")
 
+	// 用户名、密码未通过命令行指定时，依次从环境变量、凭据文件中读取，避免密码出现在shell历史和进程列表中
+	flag.StringVar(&credentials_file, "credentials_file", "", "a file of src_user=, src_password=, dst_user=, dst_password= lines used when the corresponding options and environment variables are not set; the same keys after a [verify] line are the read-only accounts used by --verify")
+
+	// 认证机制相关参数。MONGODB-AWS认证时，--su/--sp(--du/--dp)分别表示AWS的access key id和secret access key，均为空时使用实例角色
+	flag.StringVar(&src_auth_mechanism, "src_auth_mechanism", "", "the source mongodb server's auth mechanism, e.g. SCRAM-SHA-1, SCRAM-SHA-256, MONGODB-AWS, GSSAPI, PLAIN, MONGODB-X509 (default SCRAM-SHA-1)")
+	flag.StringVar(&src_aws_session_token, "src_aws_session_token", "", "the source AWS session token used by MONGODB-AWS auth")
+	flag.StringVar(&dst_auth_mechanism, "dst_auth_mechanism", "", "the destination mongodb server's auth mechanism, e.g. SCRAM-SHA-1, SCRAM-SHA-256, MONGODB-AWS, GSSAPI, PLAIN, MONGODB-X509 (default SCRAM-SHA-1)")
+	flag.StringVar(&dst_aws_session_token, "dst_aws_session_token", "", "the destination AWS session token used by MONGODB-AWS auth")
+	// PLAIN(LDAP)认证：认证库固定为$external，无需指定--sd/--dd
+	// GSSAPI(Kerberos)认证：--su/--du为principal，需要使用"-tags gssapi"编译
+	flag.StringVar(&src_gssapi_service, "src_gssapi_service", "", "the source kerberos service name used by GSSAPI auth (default mongodb)")
+	flag.StringVar(&src_gssapi_realm, "src_gssapi_realm", "", "the source kerberos service realm used by GSSAPI auth")
+	flag.StringVar(&dst_gssapi_service, "dst_gssapi_service", "", "the destination kerberos service name used by GSSAPI auth (default mongodb)")
+	flag.StringVar(&dst_gssapi_realm, "dst_gssapi_realm", "", "the destination kerberos service realm used by GSSAPI auth")
+	flag.StringVar(&krb5_keytab, "krb5_keytab", "", "the client keytab used by GSSAPI auth, exported as KRB5_CLIENT_KTNAME")
+
+	// 源端读偏好，用于将全量同步和oplog读取的压力转移到从节点
+	flag.StringVar(&src_read_preference, "src_read_preference", "", "the source read preference: primary, primaryPreferred, secondary, secondaryPreferred, nearest (default primary)")
+	flag.StringVar(&src_read_preference_tags, "src_read_preference_tags", "", "the source read preference tag sets. Format:<\"k1:v1,k2:v2;k3:v3\">")
+	// 全量同步从从节点或隐藏节点读取，保护繁忙的主节点
+	flag.StringVar(&src_full_sync_member, "src_full_sync_member", "", "read the full sync from a replica set member other than the primary: \"secondary\" picks the secondary with the least lag, <host:port> connects directly to that member (hidden members included). oplog is still read through the normal connection. With a mongos source only \"secondary\" is supported. Empty reads as configured by --src_read_preference")
+	flag.IntVar(&src_max_lag, "src_max_lag", 30, "with --src_full_sync_member, the max replication lag in seconds of the member; copying the next collection waits until the lag is below it. 0 disables the check")
+
+	// 目标端写关注：dst_write_concern用于全量同步阶段，oplog_write_concern用于oplog重放阶段（缺省时与dst_write_concern相同）
+	flag.StringVar(&dst_write_concern, "dst_write_concern", "", "the destination write concern for full sync. Format:<\"w:<number|majority|tag>,j:<true|false>,wtimeout:<ms>\">")
+	flag.StringVar(&oplog_write_concern, "oplog_write_concern", "", "the destination write concern for oplog replay, defaults to --dst_write_concern. Format:<\"w:<number|majority|tag>,j:<true|false>,wtimeout:<ms>\">")
+
+	// 网络压缩，跨机房同步时可以明显减少传输的数据量
+	flag.StringVar(&src_compressors, "src_compressors", "", "the network compressors used to communicate with the source mongodb server, in order of preference. Format:<snappy,zlib,zstd>")
+	flag.StringVar(&dst_compressors, "dst_compressors", "", "the network compressors used to communicate with the destination mongodb server, in order of preference. Format:<snappy,zlib,zstd>")
+	// TLS，源端和目标端分别设置。MONGODB-X509认证需要同时指定客户端证书
+	flag.BoolVar(&src_tls, "src_tls", false, "connect to the source with TLS, implied by --src_tls_ca_file or --src_tls_cert_key_file")
+	flag.StringVar(&src_tls_ca_file, "src_tls_ca_file", "", "the CA certificates (PEM) used to verify the source, empty means the system CAs")
+	flag.StringVar(&src_tls_cert_key_file, "src_tls_cert_key_file", "", "the client certificate and unencrypted private key (one PEM file) presented to the source, required by --src_auth_mechanism MONGODB-X509")
+	flag.BoolVar(&src_tls_insecure, "src_tls_insecure", false, "do not verify the source's certificate and hostname")
+	flag.BoolVar(&dst_tls, "dst_tls", false, "connect to the destination with TLS, implied by --dst_tls_ca_file or --dst_tls_cert_key_file")
+	flag.StringVar(&dst_tls_ca_file, "dst_tls_ca_file", "", "the CA certificates (PEM) used to verify the destination, empty means the system CAs")
+	flag.StringVar(&dst_tls_cert_key_file, "dst_tls_cert_key_file", "", "the client certificate and unencrypted private key (one PEM file) presented to the destination, required by --dst_auth_mechanism MONGODB-X509")
+	flag.BoolVar(&dst_tls_insecure, "dst_tls_insecure", false, "do not verify the destination's certificate and hostname")
+	// 驱动的socket参数，为0时使用驱动的默认值。经过不稳定的网络长时间读取oplog时可以调小keepalive和心跳间隔
+	flag.IntVar(&src_connect_timeout_ms, "src_connect_timeout_ms", 0, "connectTimeoutMS of the source connections, 0 means the driver default (30000)")
+	flag.IntVar(&dst_connect_timeout_ms, "dst_connect_timeout_ms", 0, "connectTimeoutMS of the destination connections, 0 means the driver default (30000)")
+	flag.IntVar(&src_socket_timeout_ms, "src_socket_timeout_ms", 0, "socketTimeoutMS of the source connections, 0 means no timeout; must be longer than the slowest single operation")
+	flag.IntVar(&dst_socket_timeout_ms, "dst_socket_timeout_ms", 0, "socketTimeoutMS of the destination connections, 0 means no timeout; must be longer than the slowest single operation such as an index build")
+	flag.IntVar(&src_heartbeat_ms, "src_heartbeat_frequency_ms", 0, "heartbeatFrequencyMS of the source server monitoring, 0 means the driver default (10000)")
+	flag.IntVar(&dst_heartbeat_ms, "dst_heartbeat_frequency_ms", 0, "heartbeatFrequencyMS of the destination server monitoring, 0 means the driver default (10000)")
+	flag.IntVar(&src_keepalive_ms, "src_keepalive_ms", 0, "the TCP keepalive interval of the source connections, 0 means the default")
+	flag.IntVar(&dst_keepalive_ms, "dst_keepalive_ms", 0, "the TCP keepalive interval of the destination connections, 0 means the default")
+	// 通过SSH跳板机或SOCKS5代理连接源端、目标端
+	flag.StringVar(&src_proxy, "src_proxy", "", "dial the source through an SSH jump host or a SOCKS5 proxy. Format:<ssh://[user[:password]@]host[:port]|socks5://[user[:password]@]host[:port]>")
+	flag.StringVar(&dst_proxy, "dst_proxy", "", "dial the destination through an SSH jump host or a SOCKS5 proxy. Format:<ssh://[user[:password]@]host[:port]|socks5://[user[:password]@]host[:port]>")
+	flag.StringVar(&ssh_key, "ssh_key", os.ExpandEnv("$HOME/.ssh/id_rsa"), "the private key file used to authenticate to SSH jump hosts; ssh-agent is also used when SSH_AUTH_SOCK is set")
+	flag.StringVar(&ssh_known_hosts, "ssh_known_hosts", os.ExpandEnv("$HOME/.ssh/known_hosts"), "the known_hosts file used to verify SSH jump hosts, empty means not to verify")
+
 	// 是否启用oplog进行增量同步；是否将oplog同步到目标mongodb实例中；oplog和sync_oplog互斥
 	flag.BoolVar(&oplog, "oplog", false, "whether to enable oplog for incremental synchronization")
 	flag.BoolVar(&sync_oplog, "sync_oplog", false, "whether to synchronize oplog to the destination mongodb")
+	flag.BoolVar(&sync_oplog_replay, "sync_oplog_replay", false, "with --sync_oplog, once the full sync is done automatically replay the copied syncoplog.oplog.rs into the destination from the oplog start point captured before the copy, with the same ns filters and mappings, instead of running --replayoplog --op_start by hand")
+	flag.BoolVar(&from_last, "from_last", false, "with --sync_oplog, skip the full sync and continue copying oplog from the last ts recorded in the destination's syncoplog.checkpoint by a previous --sync_oplog run")
+	flag.StringVar(&change_stream_scope, "change_stream_scope", "cluster", "with --change_stream, the scope of the change streams: cluster (one cluster-wide stream), db (one stream per synced database) or collection (one stream per synced collection, collections created later are not followed). db and collection only need the changeStream privilege on those databases or collections")
+	flag.BoolVar(&change_stream_update_lookup, "change_stream_update_lookup", true, "with --change_stream, fetch the current full document of update events (fullDocument: updateLookup) and replace it on the destination. With false updates are applied from the updated and removed fields of the event")
+	flag.StringVar(&checkpoint_ns, "checkpoint_ns", "mongosync.replay_checkpoint", "destination collection where the oplog replay saves the ts of the last applied oplog of each oplog source (replica set, shard or syncoplog)")
+	flag.IntVar(&checkpoint_interval, "checkpoint_interval", 10, "seconds between saves of the oplog replay progress to --checkpoint_ns. 0 disables saving")
+	flag.BoolVar(&resume, "resume", false, "resume the oplog replay from the progress saved in --checkpoint_ns: with --oplog the full sync is skipped when progress exists, with --replayoplog --op_start is not needed")
+	flag.BoolVar(&resync_on_rollover, "resync_on_rollover", false, "with --oplog, when the oplog entries needed by the replay have been overwritten (the replay fell too far behind), run the full sync of all synced namespaces again and continue replaying from the new position instead of exiting. The destination collections are dropped before the full sync, so documents deleted on the source in the meantime do not remain")
+	flag.IntVar(&resume_token_interval, "resume_token_interval", 100, "with --change_stream, save the resume token of each change stream every N events (and when idle), so a restarted run of the same task resumes exactly where it stopped. 0 disables saving")
+	flag.StringVar(&resume_token_file, "resume_token_file", "", "with --change_stream, save the resume tokens to this local file instead of the destination's mongosync.resume_tokens collection")
+	flag.BoolVar(&change_stream, "change_stream", false, "read incremental changes from a cluster-wide change stream and take the start point from $clusterTime, for hosted deployments such as Atlas where the local database and replSetGetStatus are not accessible. Requires MongoDB 4.0+")
 
 	// 名称空间过滤及映射相关参数,生效顺序：db>nsExclude、nsInclude>dbFrom_To>nsFrom_To
 	flag.StringVar(&db, "db", "", "databases to sync.Default for all dbs in instance. Format:<database-name,...>. Namespace control sub-parameters: --nsExclude,--nsInclude,--nsFrom_To")
-	flag.StringVar(&nsExclude, "nsExclude", "", "exclude matching namespaces. Format:<namespace,...>")
-	flag.StringVar(&nsInclude, "nsInclude", "", "include matching namespaces. Format:<namespace,...>")
+	flag.StringVar(&nsExclude, "nsExclude", "", "exclude matching namespaces, takes precedence over --nsInclude. Format:<pattern,...>, a pattern is an exact namespace, a glob such as \"analytics.*\" or \"*.audit_*\", or a regular expression on the full namespace enclosed in slashes such as \"/^logs\\.\\d+$/\"")
+	flag.StringVar(&nsInclude, "nsInclude", "", "include matching namespaces. Format:<pattern,...>, patterns as in --nsExclude")
+	flag.BoolVar(&include_system_ns, "include_system_ns", false, "also sync the system namespaces skipped by default: collections named system.* (such as system.profile, and system.js with --sync_system_js=false) and the config database of a replica set. system.views, system.indexes, system.namespaces, system.buckets.* and the admin and local databases are never copied")
 	flag.StringVar(&dbFrom_To, "dbFrom_To", "", "rename matching databasename. Format:<src_dbname:dst_dbname,...>")
 	flag.StringVar(&nsFrom_To, "nsFrom_To", "", "rename matching namespaces. Format:<src_namespace:dst_namespace,...>")
+	flag.StringVar(&ns_collision, "ns_collision", utils.NsCollisionError, "how to handle multiple source namespaces mapped to one destination namespace: error, merge, suffix-by-source")
+	flag.StringVar(&ns_invalid, "ns_invalid", utils.NsInvalidError, "how to handle destination namespaces exceeding the length limits or containing invalid characters: error, rename (replace invalid characters, truncate and append a hash of the original name)")
+
+	// 单次操作的超时时间（秒），避免源端或目标端无响应时程序一直阻塞。索引创建可能耗时很长，command_timeout默认不超时
+	flag.IntVar(&find_timeout, "find_timeout", 600, "timeout in seconds of a single find or getMore on the source, 0 means no timeout")
+	flag.IntVar(&write_timeout, "write_timeout", 600, "timeout in seconds of a single insert, update, replace or delete on the destination, 0 means no timeout")
+	flag.IntVar(&command_timeout, "command_timeout", 0, "timeout in seconds of other commands such as index builds, listing databases/collections and hooks, 0 means no timeout")
+
+	// 网络断开、源端或目标端重启时，重试失败的操作并从中断处重新打开游标
+	flag.IntVar(&max_retries, "max_retries", 10, "max consecutive retries of an operation or cursor after a network error or server restart, 0 means no retry")
+	flag.IntVar(&retry_backoff_max, "retry_backoff_max", 30, "max seconds to wait between retries, the wait starts at 1 second and doubles on each retry")
+	// 驱动的可重试读写：主从切换期间驱动先自动重试一次，重复执行的写操作由服务端去重
+	flag.BoolVar(&src_retry_reads, "src_retry_reads", true, "enable the driver's retryable reads on the source, so a read interrupted by a primary election is retried once by the driver before --max_retries applies")
+	flag.BoolVar(&dst_retry_writes, "dst_retry_writes", true, "enable the driver's retryable writes on the destination, so a write interrupted by a primary election is retried once by the driver without being applied twice")
 
 	// oplog的replay操作参数
 	flag.BoolVar(&replayoplog, "replayoplog", false, "repaly oplog,must have matching op_start")
 	flag.StringVar(&op_start, "op_start", "0,0", "the start timestamp to sync oplog. Format:<\"m,n\">")
 	flag.StringVar(&op_end, "op_end", "0,0", "the end timestamp to sync oplog,the default value of \"0,0\" indicates the current latest oplog. Format:<\"m,n\">")
 	flag.StringVar(&src_op_ns, "src_op_ns", "local.oplog.rs", "the namespace of the source of oplog. Format:<namespace,...>")
+	// 低优先级ns的oplog由后台通道以较低的并发、较大的批次重放，突发写入时优先保证其他ns的重放延迟
+	flag.StringVar(&low_priority_ns, "low_priority_ns", "", "source namespaces whose oplog is replayed by a background lane with lower concurrency and larger batches. Format:<db.coll|db,...>")
+	flag.IntVar(&low_priority_workers, "low_priority_workers", 1, "number of workers of the low priority lane")
+	flag.IntVar(&replay_batch, "replay_batch", 1000, "max number of consecutive insert/update/delete oplog entries of one collection applied in one ordered BulkWrite during oplog replay. 1 applies them one by one")
+	flag.BoolVar(&apply_ops, "apply_ops", false, "apply each oplog replay batch with the destination's applyOps command (namespaces rewritten by the mappings) instead of translating the entries into ReplaceOne/UpdateOne/DeleteOne, so the server applies them with exact oplog semantics. Batches may span collections. The destination must not be a mongos and the user needs the applyOps privilege")
+	flag.IntVar(&low_priority_batch, "low_priority_batch", 1000, "max number of oplog entries applied in one batch by the low priority lane")
+	flag.IntVar(&heartbeat_interval, "heartbeat_interval", 0, "interval in seconds to write a heartbeat noop into the source oplog via appendOplogNote while tailing, so progress advances when the source is idle. 0 means disabled")
+	// 目标端磁盘容量检查：剩余导入量超过目标端剩余空间时暂停全量导入
+	flag.IntVar(&capacity_check_interval, "capacity_check_interval", 60, "interval in seconds to compare the projected remaining copy volume with the free disk space on the destination and pause copying when it does not fit. 0 means disabled")
+	flag.Float64Var(&capacity_margin, "capacity_margin", 0.1, "fraction of the destination filesystem to keep free when checking capacity, e.g., 0.1")
+	// 校验模式：将样本数据和oplog写入目标端的临时库并与源端比较，不写入真正的目标ns
+	// 预检查：检查连通性、权限和oplog时间窗口后退出
+	flag.BoolVar(&check, "check", false, "preflight check: ping both endpoints, verify replSetGetStatus and local.oplog.rs read access on the source and write access on the destination, print the oplog window, then exit")
+	flag.BoolVar(&validate, "validate", false, "dry run: copy a sample of documents and replay recent oplog of the selected namespaces into a scratch database on the destination, then compare them with the source. The real target namespaces are not touched")
+	flag.StringVar(&validate_db, "validate_db", utils.DefaultValidateDbName, "the scratch database used by --validate, the target namespace db.coll is written to the collection named db.coll in it")
+	flag.IntVar(&validate_sample, "validate_sample", 1000, "the number of documents sampled from each namespace by --validate")
+	flag.IntVar(&validate_window, "validate_window", 300, "replay the source oplog of the last N seconds into the scratch database by --validate, 0 means not to replay oplog")
+	// 服务端哈希校验：只传输哈希值，比较源端和目标端的内容是否一致
+	flag.BoolVar(&verify, "verify", false, "compare the selected namespaces between the source and the destination by document counts and content hashes computed with server-side aggregation, so only hashes are transferred, then exit")
+	// --verify可以使用与同步任务分开的只读账号，由其他角色（如安全团队）独立校验，不需要同步任务的账号
+	flag.StringVar(&verify_src_user, "verify_src_user", "", "with --verify, the source user used instead of --su, only read access is required. Defaults to $MONGOSYNC_VERIFY_SRC_USER or src_user in the [verify] section of --credentials_file")
+	flag.StringVar(&verify_src_passwd, "verify_src_password", "", "with --verify, the password of --verify_src_user, \"-\" to read it from stdin. Defaults to $MONGOSYNC_VERIFY_SRC_PASSWORD or src_password in the [verify] section of --credentials_file")
+	flag.StringVar(&verify_src_auth_db, "verify_src_auth_db", "", "with --verify, the auth db of --verify_src_user, defaults to --sd")
+	flag.StringVar(&verify_dst_user, "verify_dst_user", "", "with --verify, the destination user used instead of --du, only read access is required. Defaults to $MONGOSYNC_VERIFY_DST_USER or dst_user in the [verify] section of --credentials_file")
+	flag.StringVar(&verify_dst_passwd, "verify_dst_password", "", "with --verify, the password of --verify_dst_user, \"-\" to read it from stdin. Defaults to $MONGOSYNC_VERIFY_DST_PASSWORD or dst_password in the [verify] section of --credentials_file")
+	flag.StringVar(&verify_dst_auth_db, "verify_dst_auth_db", "", "with --verify, the auth db of --verify_dst_user, defaults to --dd")
+	flag.IntVar(&verify_buckets, "verify_buckets", 100, "when a namespace differs, split it into this many _id ranges by the source's _id distribution and report the ranges that differ, 0 means not to split")
+	// 重放时upsert使用的索引
+	flag.StringVar(&replay_hint, "replay_hint", "", "index hint for the upserts (ReplaceOne/UpdateOne) issued while replaying oplog, as a comma separated list of <index name> for every namespace or <dst db.coll>=<index name>, e.g. \"_id_\" or \"GlobalDB.users=_id_\"; requires a 4.2+ destination. Upsert filters without a supporting destination index are always reported")
+	// 增量补齐：只复制目标端缺少或内容不同的文档，部分失败后重新执行时开销很小
+	flag.StringVar(&delta, "delta", "", "copy only the documents missing from the destination or differing from the source instead of rewriting every document, comparing _id sets (id), server-side document hashes (hash) or the value of a field such as updatedAt (field:<name>); extra destination documents are kept. Empty copies everything")
+	flag.StringVar(&dump, "dump", "", "use a mongodump archive file (--archive, optionally --gzip) or output directory (<db>/<coll>.bson and .metadata.json, optionally gzipped) as the source instead of --sh: the selected collections are created with their options and indexes and loaded into the destination with the same namespace mapping, projections and hooks as the full sync, then the oplog.bson of a dump taken with --oplog is replayed. Continue from the printed position with --replayoplog")
+	flag.StringVar(&export, "export", "", "write the selected collections, their options and indexes to this mongodump-compatible output directory (<db>/<coll>.bson and .metadata.json) instead of a destination, applying the same namespace mapping and projections as the full sync; restore it with mongorestore or --dump. --dh is not needed")
+	flag.BoolVar(&export_archive, "export_archive", false, "with --export, write a single mongodump archive file instead of a directory")
+	flag.BoolVar(&export_gzip, "export_gzip", false, "with --export, gzip the written files, like mongodump --gzip")
+	flag.BoolVar(&export_oplog, "export_oplog", false, "with --export, also write the source oplog of the selected collections from the start to the end of the export into oplog.bson, like mongodump --oplog, so restoring it with --oplogReplay gives a consistent point in time; combine with --src_full_sync_member to export from a secondary")
+	flag.StringVar(&count_check, "count_check", utils.CountCheckWarn, "after each collection is copied, compare the document counts of the source and the destination: off, warn (log mismatches), fail (also exit with an error after the full sync if any collection mismatches while its source count did not change during the copy)")
+	// 全量复制读取源集合的方式
+	flag.StringVar(&read_strategy, "read_strategy", "auto", "how the full sync reads source collections: id (hint the _id index and read in _id order), natural (scan in $natural order and de-duplicate by _id, for collections without an _id index), snapshot (_id order within a snapshot read concern session, MongoDB 5.0+), or auto (snapshot on 5.0+, id otherwise, natural for collections without an _id index)")
+	// 全量同步前删除或重命名目标集合
+	flag.StringVar(&drop_dst, "drop_dst", "", "before the full sync copies a collection or creates a view, drop the destination namespace (drop) or rename it aside to <coll>_bak_<time> (rename) so repeated migrations start clean instead of merging into stale data; collections whose copy is being resumed are kept. Empty keeps existing data")
 	// 其他TODO参数
 	flag.BoolVar(&no_index, "no_index", false, "whether to clone the db or collection corresponding index")
-	flag.IntVar(&threadNum, "threadNum", 20, "Number of threads performing collection synchronization")
+	// 低内存模式：在内存很小的边缘设备上运行
+	flag.BoolVar(&low_memory, "low_memory", false, "low-memory profile for small edge machines: sync at most 2 collections concurrently, do not split collections into _id ranges, cap cursor and write batches to a few hundred documents / 4MB, and make the Go runtime collect garbage more aggressively")
+	flag.IntVar(&max_memory_mb, "max_memory_mb", 0, "the memory limit in MB: documents read by the full sync but not yet written to the destination may use half of it, beyond which the source cursors pause until pending batches are written; it is also set as the Go runtime's soft memory limit. 0 means unlimited")
+	// 目标端不可达期间将oplog写入本地磁盘缓冲区
+	flag.StringVar(&offline_buffer_dir, "offline_buffer_dir", "", "when the destination becomes unreachable during oplog or change stream replay, buffer the ops in this local directory and replay them in order once it is reachable again, before resuming live replay; leftover buffers are replayed on restart. Empty disables buffering")
+	flag.IntVar(&offline_buffer_mb, "offline_buffer_mb", 1024, "the maximum size in MB of --offline_buffer_dir")
+	flag.StringVar(&offline_buffer_policy, "offline_buffer_policy", "block", "what to do when --offline_buffer_dir is full: block (pause reading the source oplog until space is freed) or drop_oldest (discard the oldest buffered ops; the destination then needs a new full sync)")
+	flag.IntVar(&threadNum, "threadNum", 20, "Number of collections synchronized concurrently, each by its own thread; the progress of every collection is logged periodically")
+	// 大集合按_id范围切分后并发复制，总并发数最多为threadNum*range_threads
+	flag.IntVar(&range_threads, "range_threads", 1, "split each collection with at least --range_min_docs documents into _id ranges and copy them with this many threads, 1 means a single cursor per collection")
+	flag.Int64Var(&range_min_docs, "range_min_docs", 1000000, "the minimum estimated document count of a collection to be split by --range_threads")
+	flag.StringVar(&shard_dst, "shard_dst", "", "when both sides are sharded clusters, shard each target collection with the source collection's shard key (from config.collections) before copying: key (only shard it), presplit (also split at the source's chunk boundaries and move the chunks round-robin to every destination shard, or pre-split hashed keys with numInitialChunks). Collections unsharded on the source, or already sharded or non-empty on the destination, are left as they are. Empty disables it")
+	flag.StringVar(&sync_users, "sync_users", "", "before the full sync, copy the users and custom roles from the source's admin.system.users and admin.system.roles with --dbFrom_To applied to their databases, keeping the password credentials: db (those defined in the synced databases) or all (also those defined in admin, except the destination user of this job). Requires the backup role on the source and the restore role on the destination. Empty disables it")
+	flag.BoolVar(&gridfs, "gridfs", true, "copy the <bucket>.files and <bucket>.chunks collections of a GridFS bucket as a unit, file by file: the chunks first, then the file document after the chunk count, length and md5 are verified, so the destination never holds a file document with missing chunks; dangling chunks left by an interrupted sync are removed. Disabled by --delta and --chunk_cache")
 	flag.BoolVar(&overwrite, "overwrite", false, "whether to overwrite documents whose \"_id\" field already exists")
+	flag.StringVar(&index_build, "index_build", "before", "when to create the indexes of a collection in the full sync: before (before copying its documents) or after (record the source indexes, copy all collections first, then build each collection's indexes in one createIndexes). Use before when capped collections or TTL indexes must behave as on the source while loading")
+	flag.IntVar(&index_build_threads, "index_build_threads", 4, "the number of collections whose indexes are built in parallel with --index_build after")
+	flag.StringVar(&conflict_policy, "conflict_policy", "", "how to write a document whose \"_id\" already exists on the destination, in both the full sync and the replay of insert oplog entries: skip (keep the destination document), overwrite (replace it), fail (count it as a failed write) or merge ($set the fields other than \"_id\"). Overrides --overwrite; empty means --overwrite for the full sync and overwrite for the oplog replay. Can be set per namespace with \"conflict_policy\" in --ns_overrides_file")
+	// chunk缓存：重复同步基本不变的数据时，跳过内容未变化的_id范围
+	flag.BoolVar(&chunk_cache, "chunk_cache", false, "whether to skip unchanged _id chunks by comparing content hashes recorded in the destination's mongosync.chunk_cache during the previous sync")
+	flag.IntVar(&chunk_size, "chunk_size", 1000, "the average number of documents per chunk when --chunk_cache is enabled")
+	// 日志相关参数：失败doc的日志内容超过doc_log_limit时截断，完整内容压缩保存到error_artifacts_dir
+	flag.IntVar(&doc_log_limit, "doc_log_limit", 4096, "the max bytes of a failed document written to the log, 0 means no limit")
+	flag.StringVar(&error_artifacts_dir, "error_artifacts_dir", "./mongosync_artifacts", "directory to save the gzipped full content of truncated failed documents, empty means not to save")
+	// 超过16MB的文档：跳过并记录到运行报告、删除指定字段后写入或按写入失败处理
+	flag.StringVar(&oversized_docs, "oversized_docs", "skip", "how to handle a document larger than the destination's 16MB limit instead of failing its whole batch: skip (skip it and record it in the run report, with its full content saved to --error_artifacts_dir), truncate (remove the --oversized_truncate_fields in order until it fits, skipping it if it still does not) or fail (count it as a failed write). Batches over the 48MB message limit are always split")
+	flag.BoolVar(&insert_ordered, "insert_ordered", true, "write each full sync batch with an ordered InsertMany (stops at the first failed document and rewrites the rest). With false the batch is unordered: every other document is written and only documents that failed with a duplicate key or a transient error are rewritten. Failed documents are counted per collection by class (duplicate_key, document_too_large, validation_failed, transient, other) and reported at the end")
+	flag.StringVar(&oversized_truncate_fields, "oversized_truncate_fields", "", "comma separated fields (dotted paths allowed, e.g. payload,attachments.data) removed in order from an oversized document with --oversized_docs truncate")
+	// 目标端hook：在索引同步后、单个集合导入后、全部同步完成时执行的命令或聚合管道
+	flag.StringVar(&hooks_file, "hooks_file", "", "a JSON file of commands or aggregation pipelines to run on the destination at the after_schema, after_copy and finalize phases")
+	// 任务清单：继续未完成的任务时检查配置是否与任务开始时相同
+	flag.BoolVar(&retry_failed, "retry_failed", false, "re-sync only the collections that did not succeed in the previous job from the same source, as recorded in the destination's mongosync.manifest (failed writes, count mismatches, or interrupted before finishing), keeping the others. Requires the same namespace filtering and mapping options as that job")
+	flag.BoolVar(&reset_manifest, "reset_manifest", false, "discard the manifest and copy progress of an unfinished previous job from the same source in the destination's mongosync database and start a new job, instead of resuming it or refusing to resume it with a different configuration")
+	// 复制各个库的system.js中保存的函数
+	flag.BoolVar(&sync_system_js, "sync_system_js", true, "copy the stored JavaScript functions in each synced database's system.js to the mapped destination database before the full sync, replacing functions of the same name, and replay their changes from the oplog. When false, system.js is handled like other system collections by --include_system_ns")
+	// 全量复制读取源端时等待源端节点应用增量同步的起点
+	flag.BoolVar(&causal_copy, "causal_copy", true, "read each _id range of the full sync in a causally consistent session whose reads wait until the source node has applied the oplog replay start point (snapshot reads taken before it are retried), so that reading from a lagging secondary or shard cannot miss changes between the start point and the copy")
+	// 全量复制每批写入的文档条数和字节数
+	flag.IntVar(&batch_docs, "batch_docs", 10000, "the maximum number of documents in each batch inserted into the destination during the full copy")
+	flag.Int64Var(&batch_bytes, "batch_bytes", 64*1024*1024, "the maximum total BSON bytes of each batch inserted into the destination during the full copy, 0 means no limit")
+	// 源端库、集合列表的缓存和限流
+	flag.IntVar(&catalog_ttl, "catalog_ttl", 300, "seconds to cache the database and collection lists of an instance before listing them again, 0 means no cache")
+	flag.IntVar(&catalog_rate_limit, "catalog_rate_limit", 10, "the maximum number of listDatabases/listCollections calls per second to an instance, 0 means no limit")
+	// 吞吐量限制，运行中可以通过--rate_limit_file修改
+	flag.Float64Var(&src_read_docs_per_sec, "src_read_docs_per_sec", 0, "the maximum number of documents read from the source per second during the full copy, 0 means no limit")
+	flag.Float64Var(&src_read_mb_per_sec, "src_read_mb_per_sec", 0, "the maximum MB of documents read from the source per second during the full copy, 0 means no limit")
+	flag.Float64Var(&dst_write_docs_per_sec, "dst_write_docs_per_sec", 0, "the maximum number of documents or oplog entries written to the destination per second, 0 means no limit")
+	flag.Float64Var(&dst_write_mb_per_sec, "dst_write_mb_per_sec", 0, "the maximum MB of documents or oplog entries written to the destination per second, 0 means no limit")
+	flag.StringVar(&rate_limit_file, "rate_limit_file", "", "a JSON file of src_read_docs_per_sec, src_read_mb_per_sec, dst_write_docs_per_sec and dst_write_mb_per_sec overriding the rate limit flags, reloaded when modified while running")
+	// 按ns覆盖并发、批次、限流和冲突处理设置
+	flag.StringVar(&ns_overrides_file, "ns_overrides_file", "", "a JSON file of {\"<db>.<collection>\": {\"range_threads\": N, \"batch_docs\": N, \"batch_bytes\": N, \"src_read_docs_per_sec\": N, \"src_read_mb_per_sec\": N, \"dst_write_docs_per_sec\": N, \"dst_write_mb_per_sec\": N, \"conflict_policy\": \"skip|overwrite|fail|merge\"}} overriding the full sync's concurrency, batch, rate limit and conflict policy settings for these source namespaces; omitted fields keep the global settings, and a namespace with its own rate limit is not counted against the global one")
+	// 按ns的过滤条件，全量同步时只复制满足条件的文档
+	flag.StringVar(&filters_file, "filters_file", "", "a JSON file of {\"<db>.<collection>\": <extended JSON query filter>} to copy only the matching documents of these source namespaces during the full sync")
+	// 按ns的投影，同步时排除（或只保留）部分字段
+	flag.StringVar(&projections_file, "projections_file", "", "a JSON file of {\"<db>.<collection>\": {\"<field>\": 0 or 1, ...}} to exclude (or only keep) these fields of the source namespaces in both the full sync and the oplog replay")
+	// 定时同步：常驻运行，按cron表达式周期性地执行全量同步
+	flag.StringVar(&schedule, "schedule", "", "run as a daemon and repeat the full sync on a cron schedule (minute hour day-of-month month day-of-week), e.g. \"0 2 * * 6\"; use with --chunk_cache to only copy changed chunks")
+	flag.StringVar(&history_addr, "history_addr", "", "with --schedule, serve the run history recorded in the destination's mongosync.schedule_history as JSON at http://<addr>/history, e.g. \":8090\"")
+	// 目标集合按源端的validator创建，源端不满足校验规则的历史文档需要跳过校验才能写入
+	flag.BoolVar(&bypass_document_validation, "bypass_document_validation", false, "bypass the validator of destination collections (created with the source's validator) when copying documents, so existing documents that do not satisfy it are still copied")
+	// 重放替换形式的u操作时，大文档先读取目标端的文档计算差异，只写入$set/$unset
+	flag.IntVar(&replace_diff_min_kb, "replace_diff_min_kb", 0, "when replaying a replace-style update of a document of at least this many KB, read the destination's current document and apply only the changed fields with $set/$unset, reducing write volume at the cost of CPU and one read; 0 disables it")
+	// 重放不按_id的delete操作（按条件删除）可能误删目标端的大量文档，默认拒绝执行
+	flag.BoolVar(&allow_broad_deletes, "allow_broad_deletes", false, "when replaying a delete whose filter does not select documents by _id (e.g. emitted by other tools), delete all matching documents in the destination instead of refusing it as an error")
+	// 运行报告：保存在目标端的mongosync.reports中，通过 mongosync [参数] reports list|show <id> 查看
+	flag.IntVar(&report_retention_days, "report_retention_days", 30, "days to keep the per-run reports saved in the destination's mongosync.reports (removed by a TTL index), 0 keeps them forever; list them with \"mongosync --dst_host ... reports list [N]\" and inspect one with \"reports show <id>\"")
+	// 重放u操作时目标端不存在对应的文档，从源端读取完整文档写入，避免upsert生成不完整的文档
+	flag.BoolVar(&fetch_missing_docs, "fetch_missing_docs", false, "when replaying an update whose document does not exist in the destination, fetch the full document from the source by _id and upsert it, instead of upserting a partial document built from the update operators")
+	// 非交互运行（脚本、容器中执行）时跳过确认
+	flag.BoolVar(&yes, "yes", false, "skip the confirmation of the namespaces to sync and start immediately, for running non-interactively from scripts or containers without a terminal")
 	// flag.StringVar(&query, "query", "", "query filter, as a JSON string, e.g., '{x:{$gt:1}}'") // TODO
 
 	flag.Parse()
 
-	if dst_host == "" {
+	if dst_host == "" && export == "" {
 		fmt.Println("未指定--dst_host参数，请使用合理的参数:")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if nsExclude != "" && nsInclude != "" {
-		log.Fatalln("--nsExclude与--nsInclude参数互斥，不能同时使用")
+	utils.SetIncludeSystemNs(include_system_ns)
+	utils.SetSyncSystemJs(sync_system_js)
+	utils.SetGridFS(gridfs)
+	if err := utils.CustCheckSyncUsers(sync_users); err != nil {
+		log.Fatalln("--sync_users参数错误：", err)
+	}
+	if err := utils.SetShardDst(shard_dst); err != nil {
+		log.Fatalln("--shard_dst参数错误：", err)
+	}
+	// --nsExclude与--nsInclude可以同时使用，排除优先
+	if _, err := utils.CustParseNsMatcher(nil, nsInclude, nsExclude); err != nil {
+		log.Fatalln("--nsInclude或--nsExclude参数错误：", err)
 	}
 	if oplog != false && sync_oplog != false {
 		log.Fatalln("--oplog与--sync_oplog参数互斥，不能同时使用")
 	}
+	if from_last && !sync_oplog {
+		log.Fatalln("--from_last只能与--sync_oplog同时使用")
+	}
+	if sync_oplog_replay && !sync_oplog {
+		log.Fatalln("--sync_oplog_replay只能与--sync_oplog同时使用")
+	}
+	if resume && !oplog && !replayoplog && !sync_oplog_replay {
+		log.Fatalln("--resume只能与--oplog、--replayoplog或--sync_oplog_replay同时使用")
+	}
+	if resync_on_rollover && !oplog {
+		log.Fatalln("--resync_on_rollover只能与--oplog同时使用")
+	}
+	if resume && change_stream {
+		log.Fatalln("--change_stream模式自动从保存的resume token继续，不需要--resume")
+	}
+	if sync_oplog && change_stream {
+		log.Fatalln("--change_stream不支持--sync_oplog，请使用--oplog")
+	}
+	var cronSchedule *utils.CronSchedule
+	if schedule != "" {
+		if oplog || sync_oplog || replayoplog {
+			log.Fatalln("--schedule不能与--oplog、--sync_oplog、--replayoplog同时使用")
+		}
+		var err error
+		if cronSchedule, err = utils.CustParseCron(schedule); err != nil {
+			log.Fatalln("--schedule参数错误：", err)
+		}
+	}
+	utils.SetDocLogLimit(doc_log_limit)
+	utils.SetErrorArtifactsDir(error_artifacts_dir)
+	if err := utils.SetIndexBuild(index_build, index_build_threads); err != nil {
+		log.Fatalln("--index_build参数错误：", err)
+	}
+	conflictPolicy := utils.ConflictSkip
+	if overwrite {
+		conflictPolicy = utils.ConflictOverwrite
+	}
+	if conflict_policy != "" {
+		var err error
+		if conflictPolicy, err = utils.CustParseConflictPolicy(conflict_policy); err != nil {
+			log.Fatalln("--conflict_policy参数错误：", err)
+		}
+		utils.SetConflictPolicy(conflictPolicy)
+	}
+	var truncateFields []string
+	if oversized_truncate_fields != "" {
+		truncateFields = strings.Split(oversized_truncate_fields, ",")
+	}
+	if err := utils.SetOversizedDocs(oversized_docs, truncateFields); err != nil {
+		log.Fatalln("--oversized_docs参数错误：", err)
+	}
+	utils.SetInsertOrdered(insert_ordered)
+	utils.SetChunkCache(chunk_cache, chunk_size)
+	utils.SetRangeParallel(range_threads, range_min_docs)
+	utils.SetCopyBatch(batch_docs, batch_bytes)
+	utils.SetCatalogCache(time.Duration(catalog_ttl)*time.Second, catalog_rate_limit)
+	utils.SetRateLimits(utils.RateLimits{SrcReadDocs: src_read_docs_per_sec, SrcReadMB: src_read_mb_per_sec, DstWriteDocs: dst_write_docs_per_sec, DstWriteMB: dst_write_mb_per_sec})
+	utils.SetOplogHeartbeat(time.Duration(heartbeat_interval) * time.Second)
+	utils.SetSshAuth(ssh_key, ssh_known_hosts)
+	utils.SetChangeStreamMode(change_stream)
+	if err := utils.SetChangeStreamOptions(change_stream_scope, change_stream_update_lookup); err != nil {
+		log.Fatalln("--change_stream_scope参数错误：", err)
+	}
+	utils.SetResumeTokens(resume_token_interval, resume_token_file)
+	if err := utils.SetReplayCheckpoint(checkpoint_ns, time.Duration(checkpoint_interval)*time.Second, resume); err != nil {
+		log.Fatalln("--checkpoint_ns参数错误：", err)
+	}
+	utils.SetCapacityCheck(time.Duration(capacity_check_interval)*time.Second, capacity_margin)
+	utils.SetReplayBatch(replay_batch)
+	utils.SetReplayApplyOps(apply_ops)
+	if low_priority_ns != "" {
+		utils.SetLowPriorityNs(strings.Split(low_priority_ns, ","), low_priority_workers, low_priority_batch)
+	}
+	utils.SetRetry(max_retries, time.Duration(retry_backoff_max)*time.Second)
+	utils.SetBypassDocumentValidation(bypass_document_validation)
+	utils.SetReplaceDiff(replace_diff_min_kb * 1024)
+	utils.SetAllowBroadDeletes(allow_broad_deletes)
+	utils.SetReportRetention(time.Duration(report_retention_days) * 24 * time.Hour)
+	utils.SetOpTimeouts(time.Duration(find_timeout)*time.Second, time.Duration(write_timeout)*time.Second, time.Duration(command_timeout)*time.Second)
+	if err := utils.SetReplayHints(replay_hint); err != nil {
+		log.Fatalln("--replay_hint参数错误：", err)
+	}
+	if err := utils.SetReadStrategy(read_strategy); err != nil {
+		log.Fatalln("--read_strategy参数错误：", err)
+	}
+	if err := utils.SetDropDst(drop_dst); err != nil {
+		log.Fatalln("--drop_dst参数错误：", err)
+	}
+	if err := utils.SetCountCheck(count_check); err != nil {
+		log.Fatalln("--count_check参数错误：", err)
+	}
+	if err := utils.SetDelta(delta); err != nil {
+		log.Fatalln("--delta参数错误：", err)
+	}
+	if delta != "" && (drop_dst != "" || chunk_cache) {
+		log.Fatalln("--delta参数错误：不能与--drop_dst、--chunk_cache同时使用")
+	}
+	if dump != "" && (oplog || sync_oplog || replayoplog || change_stream || check || validate || verify || schedule != "" || delta != "" || chunk_cache) {
+		log.Fatalln("--dump参数错误：从备份导入时不能使用--oplog、--sync_oplog、--replayoplog、--change_stream、--check、--validate、--verify、--schedule、--delta、--chunk_cache")
+	}
+	if export != "" && (dump != "" || oplog || sync_oplog || replayoplog || change_stream || check || validate || verify || schedule != "" || delta != "" || chunk_cache || drop_dst != "") {
+		log.Fatalln("--export参数错误：导出时不能使用--dump、--oplog、--sync_oplog、--replayoplog、--change_stream、--check、--validate、--verify、--schedule、--delta、--chunk_cache、--drop_dst")
+	}
+	if retry_failed && (dump != "" || export != "" || oplog || sync_oplog || replayoplog || change_stream || check || validate || verify || schedule != "" || reset_manifest) {
+		log.Fatalln("--retry_failed参数错误：不能与--dump、--export、--oplog、--sync_oplog、--replayoplog、--change_stream、--check、--validate、--verify、--schedule、--reset_manifest同时使用")
+	}
+	if (export_archive || export_gzip || export_oplog) && export == "" {
+		log.Fatalln("--export_archive、--export_gzip、--export_oplog只能与--export同时使用")
+	}
+	if export_oplog && (dbFrom_To != "" || nsFrom_To != "") {
+		log.Fatalln("--export_oplog参数错误：oplog中的名称空间不做映射，不能与--dbFrom_To、--nsFrom_To同时使用")
+	}
+	if err := utils.SetOfflineBuffer(offline_buffer_dir, offline_buffer_mb, offline_buffer_policy); err != nil {
+		log.Fatalln("--offline_buffer_dir参数错误：", err)
+	}
+	// 低内存模式在其他设置之后启用，将并发数、批次大小限制在上限内
+	utils.SetLowMemory(low_memory)
+	utils.SetMaxMemory(max_memory_mb)
+	threadNum = utils.CustLowMemoryWorkers(threadNum)
+	if ns_overrides_file != "" {
+		overrides, err := utils.CustLoadNsOverrides(ns_overrides_file)
+		if err != nil {
+			log.Fatalln("--ns_overrides_file加载失败：", err)
+		}
+		utils.SetNsOverrides(overrides)
+	}
+	if filters_file != "" {
+		filters, err := utils.CustLoadNsFilters(filters_file)
+		if err != nil {
+			log.Fatalln("--filters_file加载失败：", err)
+		}
+		utils.SetNsFilters(filters)
+	}
+	if projections_file != "" {
+		projections, err := utils.CustLoadProjections(projections_file)
+		if err != nil {
+			log.Fatalln("--projections_file加载失败：", err)
+		}
+		if err := utils.SetProjections(projections); err != nil {
+			log.Fatalln("--projections_file参数错误：", err)
+		}
+	}
+	if hooks_file != "" {
+		hooks, err := utils.CustLoadHooks(hooks_file)
+		if err != nil {
+			log.Fatalln("--hooks_file加载失败：", err)
+		}
+		utils.SetHooks(hooks)
+	}
 
+	// 本次同步任务的上下文和日志
+	rt := utils.NewRuntime(context.Background(), utils.NewLogger())
+	if rate_limit_file != "" {
+		stopRateLimitWatcher, err := utils.CustWatchRateLimitFile(rt.Context(), rate_limit_file)
+		if err != nil {
+			log.Fatalln("--rate_limit_file参数错误：", err)
+		}
+		defer stopRateLimitWatcher()
+	}
+
+	// 用户名、密码：命令行参数 > 环境变量 > 凭据文件 > 交互输入
+	var credentials map[string]string
+	if credentials_file != "" {
+		var err error
+		if credentials, err = utils.CustLoadCredentialsFile(rt.Context(), credentials_file); err != nil {
+			log.Fatalln("--credentials_file加载失败：", err)
+		}
+	}
+	src_user = utils.CustResolveCredential(src_user, utils.EnvSrcUser, credentials, "src_user")
+	src_passwd = utils.CustResolveCredential(src_passwd, utils.EnvSrcPassword, credentials, "src_password")
+	dst_user = utils.CustResolveCredential(dst_user, utils.EnvDstUser, credentials, "dst_user")
+	dst_passwd = utils.CustResolveCredential(dst_passwd, utils.EnvDstPassword, credentials, "dst_password")
+	// --verify指定了只读账号时，使用只读账号代替同步任务的账号，不需要同步任务的密码
+	if verify {
+		if user := utils.CustResolveCredential(verify_src_user, utils.EnvVerifySrcUser, credentials, "verify_src_user"); user != "" {
+			src_user = user
+			src_passwd = utils.CustResolveCredential(verify_src_passwd, utils.EnvVerifySrcPassword, credentials, "verify_src_password")
+			if verify_src_auth_db != "" {
+				src_auth_db = verify_src_auth_db
+			}
+			log.Println("使用只读账号进行校验(src)：", src_user)
+		}
+		if user := utils.CustResolveCredential(verify_dst_user, utils.EnvVerifyDstUser, credentials, "verify_dst_user"); user != "" {
+			dst_user = user
+			dst_passwd = utils.CustResolveCredential(verify_dst_passwd, utils.EnvVerifyDstPassword, credentials, "verify_dst_password")
+			if verify_dst_auth_db != "" {
+				dst_auth_db = verify_dst_auth_db
+			}
+			log.Println("使用只读账号进行校验(dst)：", dst_user)
+		}
+	}
+	if src_passwd == utils.PasswordPrompt {
+		var err error
+		if src_passwd, err = utils.CustPromptPassword("请输入源端密码："); err != nil {
+			log.Fatalln("读取源端密码失败：", err)
+		}
+	}
+	if dst_passwd == utils.PasswordPrompt {
+		var err error
+		if dst_passwd, err = utils.CustPromptPassword("请输入目标端密码："); err != nil {
+			log.Fatalln("读取目标端密码失败：", err)
+		}
+	}
+
+	// keytab由Kerberos库通过环境变量读取，对src和dst同时生效
+	if krb5_keytab != "" {
+		os.Setenv("KRB5_CLIENT_KTNAME", krb5_keytab)
+	}
 
 	src := utils.NewMongoArgs()
+	src.SetRuntime(rt)
 	src.SetHost(src_host)
 	src.SetPort(src_port)
+	srcHosts, err := utils.CustParseHosts(src_host, src_port)
+	if err != nil {
+		log.Fatalln("--src_host参数错误：", err)
+	}
+	src.SetHosts(srcHosts)
+	src.SetReplicaSet(src_replica_set)
 	src.SetUsername(src_user)
 	src.SetPassword(src_passwd)
 	src.SetAuthenticationDatabase(src_auth_db)
+	src.SetAuthMechanism(src_auth_mechanism)
+	src.SetAwsSessionToken(src_aws_session_token)
+	src.SetGssapiService(src_gssapi_service, src_gssapi_realm)
+	srcReadPreference, err := utils.CustParseReadPreference(src_read_preference, src_read_preference_tags)
+	if err != nil {
+		log.Fatalln("--src_read_preference或--src_read_preference_tags参数错误：", err)
+	}
+	src.SetReadPreference(srcReadPreference)
+	srcCompressors, err := utils.CustParseCompressors(src_compressors)
+	if err != nil {
+		log.Fatalln("--src_compressors参数错误：", err)
+	}
+	src.SetCompressors(srcCompressors)
+	srcProxy, err := utils.CustParseProxy(src_proxy)
+	if err != nil {
+		log.Fatalln("--src_proxy参数错误：", err)
+	}
+	src.SetProxy(srcProxy)
+	srcTLSConfig, err := utils.CustParseTLS(src_tls, src_tls_ca_file, src_tls_cert_key_file, src_tls_insecure)
+	if err != nil {
+		log.Fatalln("--src_tls参数错误：", err)
+	}
+	if src_auth_mechanism == "MONGODB-X509" && (srcTLSConfig == nil || len(srcTLSConfig.Certificates) == 0) {
+		log.Fatalln("--src_auth_mechanism MONGODB-X509需要指定--src_tls_cert_key_file")
+	}
+	src.SetTLSConfig(srcTLSConfig)
+	src.SetRetryable(src_retry_reads, true)
+	src.SetSocketOptions(time.Duration(src_connect_timeout_ms)*time.Millisecond, time.Duration(src_socket_timeout_ms)*time.Millisecond,
+		time.Duration(src_heartbeat_ms)*time.Millisecond, time.Duration(src_keepalive_ms)*time.Millisecond)
 
 	dst := utils.NewMongoArgs()
+	dst.SetRuntime(rt)
 	dst.SetHost(dst_host)
 	dst.SetPort(dst_port)
+	dstHosts, err := utils.CustParseHosts(dst_host, dst_port)
+	if err != nil {
+		log.Fatalln("--dst_host参数错误：", err)
+	}
+	dst.SetHosts(dstHosts)
+	dst.SetReplicaSet(dst_replica_set)
 	dst.SetUsername(dst_user)
 	dst.SetPassword(dst_passwd)
 	dst.SetAuthenticationDatabase(dst_auth_db)
+	dst.SetAuthMechanism(dst_auth_mechanism)
+	dst.SetAwsSessionToken(dst_aws_session_token)
+	dst.SetGssapiService(dst_gssapi_service, dst_gssapi_realm)
+	dstWriteConcern, err := utils.CustParseWriteConcern(dst_write_concern)
+	if err != nil {
+		log.Fatalln("--dst_write_concern参数错误：", err)
+	}
+	dst.SetWriteConcern(dstWriteConcern)
+	dstCompressors, err := utils.CustParseCompressors(dst_compressors)
+	if err != nil {
+		log.Fatalln("--dst_compressors参数错误：", err)
+	}
+	dst.SetCompressors(dstCompressors)
+	dstProxy, err := utils.CustParseProxy(dst_proxy)
+	if err != nil {
+		log.Fatalln("--dst_proxy参数错误：", err)
+	}
+	dst.SetProxy(dstProxy)
+	dstTLSConfig, err := utils.CustParseTLS(dst_tls, dst_tls_ca_file, dst_tls_cert_key_file, dst_tls_insecure)
+	if err != nil {
+		log.Fatalln("--dst_tls参数错误：", err)
+	}
+	if dst_auth_mechanism == "MONGODB-X509" && (dstTLSConfig == nil || len(dstTLSConfig.Certificates) == 0) {
+		log.Fatalln("--dst_auth_mechanism MONGODB-X509需要指定--dst_tls_cert_key_file")
+	}
+	dst.SetTLSConfig(dstTLSConfig)
+	dst.SetRetryable(true, dst_retry_writes)
+	dst.SetSocketOptions(time.Duration(dst_connect_timeout_ms)*time.Millisecond, time.Duration(dst_socket_timeout_ms)*time.Millisecond,
+		time.Duration(dst_heartbeat_ms)*time.Millisecond, time.Duration(dst_keepalive_ms)*time.Millisecond)
+
+	// oplog重放阶段使用的dst，仅写关注与全量同步阶段不同
+	replayDst := dst
+	if oplog_write_concern != "" {
+		oplogWriteConcern, err := utils.CustParseWriteConcern(oplog_write_concern)
+		if err != nil {
+			log.Fatalln("--oplog_write_concern参数错误：", err)
+		}
+		replayDst = dst.Clone().SetWriteConcern(oplogWriteConcern)
+	}
+
+	// src、dst各自使用一个共享的连接池
+	defer src.Close()
+	defer dst.Close()
+	if replayDst != dst {
+		defer replayDst.Close()
+	}
+
+	// 查看目标端保存的运行报告：reports list [N] 列出最近N个（默认20），reports show <id> 输出单个报告
+	if args := flag.Args(); len(args) > 0 {
+		if args[0] != "reports" || len(args) < 2 {
+			log.Fatalln("未知的命令：", strings.Join(args, " "), "\n支持的命令：reports list [N]、reports show <id>")
+		}
+		switch args[1] {
+		case "list":
+			limit := int64(20)
+			if len(args) > 2 {
+				if limit, err = strconv.ParseInt(args[2], 10, 64); err != nil || limit <= 0 {
+					log.Fatalln("reports list的数量参数错误：", args[2])
+				}
+			}
+			reports, err := utils.CustListReports(dst, "", limit)
+			if err != nil {
+				log.Fatalln("读取运行报告失败：", err)
+			}
+			fmt.Printf("%-26s%-14s%-8s%-21s%-12s%-12s%-10s%-8s%s\n", "ID", "模式", "结果", "开始时间", "耗时", "导入文档数", "跳过", "错误", "源")
+			for _, report := range reports {
+				fmt.Printf("%-26s%-14s%-8s%-21s%-12s%-12d%-10d%-8d%s\n", report.ID.Hex(), report.Mode, report.State, report.StartTime.Local().Format("2006-01-02 15:04:05"),
+					report.EndTime.Sub(report.StartTime).Round(time.Second), report.CopiedNum, report.SkippedNum, report.ErrorNum, report.Source)
+			}
+		case "show":
+			if len(args) < 3 {
+				log.Fatalln("请指定报告id：reports show <id>")
+			}
+			report, err := utils.CustGetReport(dst, args[2])
+			if err != nil {
+				log.Fatalln("读取运行报告失败：", err)
+			}
+			content, _ := json.MarshalIndent(report, "", "  ")
+			fmt.Println(string(content))
+		default:
+			log.Fatalln("未知的命令：", strings.Join(args, " "), "\n支持的命令：reports list [N]、reports show <id>")
+		}
+		return
+	}
+
+	if check {
+		results := utils.CustPreflightCheck(src, dst)
+		var failed int
+		for _, result := range results {
+			status := "OK"
+			if !result.OK {
+				status = "FAIL"
+				failed++
+			}
+			fmt.Printf("%-6s%-50s%s\n", status, result.Name, result.Detail)
+		}
+		if failed > 0 {
+			fmt.Printf("预检查完成，%d项检查失败\n", failed)
+			os.Exit(1)
+		}
+		fmt.Println("预检查完成，全部通过")
+		return
+	}
+
+	if dump == "" {
+		utils.CustLogServerInfo("src", src)
+	}
+	if export == "" {
+		utils.CustLogServerInfo("dst", dst)
+	}
+	if fetch_missing_docs {
+		utils.SetFetchMissingDocs(src)
+	}
+	if apply_ops && dst.IsMongos() {
+		log.Fatalln("目标端为mongos时不支持--apply_ops")
+	}
+	if (sync_oplog || export_oplog) && src.IsMongos() {
+		log.Fatalln("源端为mongos时不支持--sync_oplog，请使用--oplog直接重放各个分片的oplog")
+	}
 
 	// 使用--oplog或--sync_oplog参数时：在所有连接src库进行操作之前，获取当前最新的oplog对应的timestamp
-	var (
-		start_ts, end_ts primitive.Timestamp
-		err              error
-	)
-	if sync_oplog || oplog {
+	var start_ts, end_ts primitive.Timestamp
+	if sync_oplog || oplog || export_oplog {
 		start_ts, err = utils.CustGetLatestOplogTimestamp(src)  //该函数执行需要访问admin库
 		if err != nil {
 			log.Fatalln("获取当前最新的oplog对应的timestamp失败,请确认用户是否可以访问admin库(src)：", err)
 		}
 	}
 
+	// 全量同步从从节点读取时，增量同步从该节点已经应用的位置开始，从节点落后于主节点的部分由oplog补齐
+	fullSrc, err := utils.CustFullSyncSource(src, src_full_sync_member, time.Duration(src_max_lag)*time.Second)
+	if err != nil {
+		log.Fatalln("--src_full_sync_member参数错误：", err)
+	}
+	if sync_oplog || oplog || export_oplog {
+		if memberTS, ok, err := utils.CustFullSyncMemberOptime(); err != nil {
+			log.Fatalln("获取从节点的oplog位置失败：", err)
+		} else if ok && primitive.CompareTimestamp(memberTS, start_ts) < 0 {
+			start_ts = memberTS
+		}
+	}
+	// 全量复制的读取至少包含start_ts之前的修改，start_ts即为重放oplog的起点
+	if err := utils.CustSetCausalCopy(src, causal_copy, start_ts); err != nil {
+		log.Fatalln("获取源端的clusterTime失败：", err)
+	}
+
 	//--------------------------------------------------------------------------------------------
+	// 源端的db和集合列表，使用--dump时为备份中的db和集合
+	getDbs := func() []string { return utils.CustGetDbs(src) }
+	getColls := func(db string) []string { return utils.CustGetColls(src, db) }
+	if dump != "" {
+		dumpNs, err := utils.CustDumpNamespaces(dump)
+		if err != nil {
+			log.Fatalln("--dump参数错误：", err)
+		}
+		dumpColls := make(map[string][]string)
+		var dumpDbs []string
+		for _, ns := range dumpNs {
+			parts := strings.SplitN(ns, ".", 2)
+			if dumpColls[parts[0]] == nil {
+				dumpDbs = append(dumpDbs, parts[0])
+			}
+			dumpColls[parts[0]] = append(dumpColls[parts[0]], parts[1])
+		}
+		getDbs = func() []string { return dumpDbs }
+		getColls = func(db string) []string { return dumpColls[db] }
+	}
+
 	// 分析db列表 ：dbSlice
 	var (
 		dbSlice []string // dbSlice是<最终>要同步的db切片
 		nsSlice []string // nsSlice是<最终>要同步的ns切片
 	)
 	if db != "" {   // db参数的的格式：<database-name,...>
-		srcAllDbs := utils.CustGetDbs(src)
+		srcAllDbs := getDbs()
 		cmdDbs := strings.Split(db, ",")
 		srcAllDbsSet := set.New(set.ThreadSafe)
 		for _, SrcDb := range srcAllDbs {
@@ -150,36 +863,34 @@ func main() {
 		}
 		dbSlice = set.StringSlice(set.Intersection(srcAllDbsSet, cmdDbsSet)) // 交集
 	} else {
-		dbSlice = utils.CustGetDbs(src) // dbSlice=srcAllDbs
+		dbSlice = getDbs() // dbSlice=srcAllDbs
 	}
 	// dbSlice是要同步的db切片
 	//--------------------------------------------------------------------------------------------
 
-	// 使用集合操作进行nsInclude和nsExclude参数过滤：nsSlice
+	// 使用nsInclude和nsExclude参数（支持glob和正则表达式）过滤：nsSlice
 	allNsSet := set.New(set.ThreadSafe)  // 未经过nsInclude和nsExclude参数过滤的所有的ns,放在集合allNsSet中
 	taskNsSet := set.New(set.ThreadSafe) // 经过nsInclude和nsExclude参数过滤的所有的ns,放在集合taskNsSet中
 
 	// 将dbSlicce转换为ns格式的集合－－>allNsSet
 	for _, SrcDb := range dbSlice {
-		for _, SrcColl := range utils.CustGetColls(src, SrcDb) {
+		for _, SrcColl := range getColls(SrcDb) {
 			allNsSet.Add(fmt.Sprintf("%s.%s", SrcDb, SrcColl))
 		}
 	}
 
-	if nsExclude != "" { // 对allNsSet使用--nsInclude和--nsExclude参数进行过滤过滤，最终有效ns放在nsSlice这个切片中。
-		nsExcludeSet := set.New(set.ThreadSafe)
-		for _, ns := range strings.Split(nsExclude, ",") {
-			nsExcludeSet.Add(ns)
+	nsMatcher, _ := utils.CustParseNsMatcher(dbSlice, nsInclude, nsExclude)
+	for _, ns := range set.StringSlice(allNsSet) {
+		if nsMatcher.Match(ns) {
+			taskNsSet.Add(ns)
 		}
-		taskNsSet = set.Difference(allNsSet, nsExcludeSet) // 差集
-	} else if nsInclude != "" {  // --nsExclude参数和--nsInclude参数互斥
-		nsIncludeSet := set.New(set.ThreadSafe)
-		for _, ns := range strings.Split(nsInclude, ",") {
-			nsIncludeSet.Add(ns)
-		}
-		taskNsSet = set.Intersection(allNsSet, nsIncludeSet) // 交集
-	} else {
-		taskNsSet = allNsSet
+	}
+	if unmatched := nsMatcher.UnmatchedIncludes(set.StringSlice(allNsSet)); len(unmatched) > 0 {
+		log.Println("以下--nsInclude模式没有匹配任何集合：", strings.Join(unmatched, ","))
+	}
+	// 同步开始后新建的、与模式匹配的集合在oplog重放时同样同步
+	if nsInclude != "" || nsExclude != "" {
+		utils.SetReplayNsMatcher(nsMatcher)
 	}
 	nsSlice = set.StringSlice(taskNsSet) // 元素格式为： db.coll
 	sort.Strings(nsSlice)
@@ -196,7 +907,7 @@ func main() {
 			if reg.MatchString(dbmap) {
 				dbFrom := strings.SplitN(dbmap, ":", 2)[0]
 				dbTo := strings.SplitN(dbmap, ":", 2)[1]
-				for _, coll := range utils.CustGetColls(src, dbFrom) {
+				for _, coll := range getColls(dbFrom) {
 					nsnsMap[fmt.Sprintf("%s.%s", dbFrom, coll)] = fmt.Sprintf("%s.%s", dbTo, coll)
 					nsnsMap[fmt.Sprintf("%s.$cmd", dbFrom)] = fmt.Sprintf("%s.$cmd", dbTo)
 				}
@@ -233,6 +944,21 @@ func main() {
 	for _, ns := range nsSlice { // ns格式：db.coll
 		nsStructSlice = append(nsStructSlice, utils.CustFilter(ns, nsnsMap))
 	}
+	// 处理多个源ns映射到同一个目标ns的情况
+	if err := utils.CustResolveNsCollisions(rt.Context(), nsStructSlice, nsnsMap, ns_collision); err != nil {
+		log.Fatalln(err, "\n请调整--dbFrom_To、--nsFrom_To参数，或使用--ns_collision merge|suffix-by-source")
+	}
+	// 检查目标ns的命名限制，改名后可能与其他目标ns冲突，再次检查
+	nsNamesDst := dst
+	if export != "" {
+		nsNamesDst = nil
+	}
+	if err := utils.CustCheckNsNames(nsNamesDst, nsStructSlice, nsnsMap, ns_invalid); err != nil {
+		log.Fatalln(err, "\n请调整--dbFrom_To、--nsFrom_To参数，或使用--ns_invalid rename")
+	}
+	if err := utils.CustResolveNsCollisions(rt.Context(), nsStructSlice, nsnsMap, utils.NsCollisionError); err != nil && ns_collision != utils.NsCollisionMerge {
+		log.Fatalln(err, "\n请调整--dbFrom_To、--nsFrom_To参数")
+	}
 	// nsStructSlice是最终要进行操作的对象
 
 	fmt.Println("即将对以下集合进行操作：")
@@ -240,65 +966,297 @@ func main() {
 		fmt.Printf("源:%-60s目标:%-s\n", fmt.Sprintf("%s.%s", task.SrcDb, task.SrcColl), fmt.Sprintf("%s.%s", task.DstDb, task.DstColl))
 	}
 
-	var answer string
-label:
-	fmt.Print("请确认以上信息是否正确，输入[yes|YES]继续，输入[no|NO]退出：")
-	fmt.Scanln(&answer)
-	if "YES" == strings.TrimSpace(answer) || "yes" == strings.TrimSpace(answer) {
-		//continue
-	} else if "NO" == strings.TrimSpace(answer) || "no" == strings.TrimSpace(answer) {
-		os.Exit(1)
-	} else {
-		goto label
+	// 非交互运行时使用--yes跳过确认
+	if !yes {
+		var answer string
+	label:
+		fmt.Print("请确认以上信息是否正确，输入[yes|YES]继续，输入[no|NO]退出：")
+		if _, err := fmt.Scanln(&answer); err == io.EOF {
+			// 标准输入已经关闭（没有终端），无法确认
+			log.Fatalln("\n无法读取确认信息，非交互运行时请使用--yes")
+		}
+		if "YES" == strings.TrimSpace(answer) || "yes" == strings.TrimSpace(answer) {
+			//continue
+		} else if "NO" == strings.TrimSpace(answer) || "no" == strings.TrimSpace(answer) {
+			os.Exit(1)
+		} else {
+			goto label
+		}
 	}
 
 	//-------------------------------------------------------------------------------------------
-	if !replayoplog {
-		// 生产者，不断地将nsStructSlice中的元素放入nsQueue
-		var nsQueue = make(chan *utils.NsMap, 20)
-		go func(taskQueue chan *utils.NsMap, nsStructSlice []*utils.NsMap) {
-			for _, nsmap := range nsStructSlice {
-				nsQueue <- nsmap
+	if export != "" {
+		log.Println("开始导出...")
+		exportOpts := utils.ExportOptions{Archive: export_archive, Gzip: export_gzip, Oplog: export_oplog, StartTS: start_ts, Workers: threadNum}
+		endTS, err := utils.CustExport(fullSrc, src, export, nsStructSlice, nsSlice, exportOpts)
+		if err != nil {
+			log.Fatalln("导出失败：", err)
+		}
+		log.Printf("导出完成，共%d个集合...\n", len(nsStructSlice))
+		if export_oplog {
+			fmt.Printf("备份中的数据重放oplog.bson后对应源端的oplog位置(%d,%d)，之后可以使用--replayoplog --op_start \"%d,%d\" 等参数从源端继续重放\n", endTS.T, endTS.I, endTS.T, endTS.I)
+		}
+		return
+	}
+
+	if dump != "" {
+		log.Println("开始从备份导入...")
+		lastTS, err := utils.CustLoadDump(dump, dst, nsStructSlice, nsSlice, nsnsMap, threadNum, conflictPolicy, no_index)
+		if err != nil {
+			log.Fatalln("从备份导入失败：", err)
+		}
+		log.Printf("从备份导入完成，共%d个集合...\n", len(nsStructSlice))
+		utils.CustRunHooks(utils.HookPhaseFinalize, dst, "", "")
+		if lastTS.T != 0 || lastTS.I != 0 {
+			fmt.Printf("请使用--replayoplog --op_start \"%d,%d\" 等参数从源端继续重放备份之后的oplog\n", lastTS.T, lastTS.I)
+		}
+		return
+	}
+
+	if validate {
+		log.Println("开始校验...")
+		results := utils.CustValidate(src, dst, nsStructSlice, validate_db, validate_sample, time.Duration(validate_window)*time.Second)
+		var failed int
+		for _, result := range results {
+			fmt.Printf("源:%-60s临时:%-60s样本:%-8d oplog:%-8d oplog失败:%-6d 不一致:%-6d 缺失:%-6d\n", result.SrcNs, result.ScratchNs, result.SampledNum, result.OpsNum, result.OpErrorNum, result.MismatchNum, result.MissingNum)
+			if result.OpErrorNum+result.MismatchNum+result.MissingNum > 0 {
+				failed++
+			}
+		}
+		fmt.Printf("校验完成，共%d个集合，存在问题的集合%d个。校验数据保存在目标端的%s库中，确认后请手动删除\n", len(results), failed, validate_db)
+		if failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if verify {
+		log.Println("开始校验...")
+		results := utils.CustVerify(src, dst, nsStructSlice, verify_buckets)
+		var failed int
+		for _, result := range results {
+			status := "一致"
+			if result.Err != nil {
+				status = "失败：" + result.Err.Error()
+			} else if !result.Match {
+				status = "不一致"
+			}
+			if result.Err != nil || !result.Match {
+				failed++
+			}
+			fmt.Printf("源:%-60s目标:%-60s源文档数:%-10d目标文档数:%-10d%-20s%s\n", result.SrcNs, result.DstNs, result.SrcCount, result.DstCount, result.Method, status)
+			for _, mismatch := range result.MismatchRanges {
+				fmt.Printf("\t_id范围不一致：%s\n", mismatch)
 			}
-			close(taskQueue)
-		}(nsQueue, nsStructSlice)
-
-		//消费者：不断地从nsQueue中获取task来运行CustSyncCollection函数，直到nsQueue关闭
-		worker := func(wg *sync.WaitGroup) {
-			defer wg.Done()
-			for NSMAP := range nsQueue {
-				utils.CustSyncCollection(src, NSMAP.SrcDb, NSMAP.SrcColl, dst, NSMAP.DstDb, NSMAP.DstColl, overwrite, no_index)
+		}
+		fmt.Printf("校验完成，共%d个集合，不一致或校验失败的集合%d个\n", len(results), failed)
+		if failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// 同步用户和角色，在全量同步之前完成，迁移后应用可以直接认证
+	if sync_users != "" && !replayoplog {
+		if err := utils.CustSyncUsers(src, dst, dbSlice, nsnsMap, sync_users); err != nil {
+			log.Fatalln("同步用户和角色失败：", err)
+		}
+	}
+
+	// 同步服务端保存的JavaScript函数
+	if sync_system_js && !replayoplog {
+		if err := utils.CustSyncSystemJs(src, dst, dbSlice, nsnsMap); err != nil {
+			log.Fatalln("同步system.js失败：", err)
+		}
+	}
+
+	// 记录任务清单，继续未完成的任务时配置必须相同
+	manifestConfig := utils.ManifestConfig{Db: db, NsInclude: nsInclude, NsExclude: nsExclude, DbFromTo: dbFrom_To, NsFromTo: nsFrom_To, NsCollision: ns_collision}
+	if ns_invalid != utils.NsInvalidError {
+		manifestConfig.NsInvalid = ns_invalid
+	}
+
+	// 定时同步：每次运行作为一个新的任务（上次运行中断时继续该任务）执行全量同步
+	if cronSchedule != nil {
+		if history_addr != "" {
+			go func() {
+				log.Fatalln("--history_addr服务退出：", utils.CustServeScheduleHistory(history_addr, src, dst))
+			}()
+		}
+		utils.CustRunSchedule(src, dst, cronSchedule, func() ([]utils.CollectionStatus, error) {
+			if _, err := utils.CustCheckManifest(src, dst, manifestConfig, nsStructSlice, primitive.Timestamp{}, reset_manifest); err != nil {
+				return nil, err
+			}
+			stopCapacityMonitor := utils.StartCapacityMonitor(src, dst, nsStructSlice)
+			statuses := utils.CustSyncCollections(fullSrc, dst, nsStructSlice, threadNum, conflictPolicy, no_index)
+			stopCapacityMonitor()
+			utils.CustPrintDocSizeReport()
+			utils.CustPrintWriteErrorReport()
+			utils.CustRunHooks(utils.HookPhaseFinalize, dst, "", "")
+			utils.CustFinishManifest(src, dst)
+			return statuses, utils.CustCheckCountMismatches(statuses)
+		})
+		return
+	}
+	// 实时重放源端的oplog。需要的oplog已经被覆盖时，--resync_on_rollover重新全量同步后从新的位置继续，否则退出
+	replayLiveOplog := func(startTS primitive.Timestamp) {
+		for {
+			err := utils.CustReplayOplog(src, replayDst, startTS, end_ts, "local.oplog.rs", nsSlice, nsnsMap)
+			if err == nil {
+				return
+			}
+			if !errors.Is(err, utils.ErrOplogRolledOver) || !resync_on_rollover {
+				log.Fatalln("oplog重放失败：", err, "\n请增大源端oplog的大小，或使用--resync_on_rollover在oplog被覆盖时自动重新全量同步，"+
+					"或使用--sync_oplog将oplog记录到目标mongodb中的syncoplog.oplog.rs中，然后使用--replayoplog参数手动重放")
+			}
+			log.Println("oplog重放失败：", err, "，重新进行全量同步...")
+			if startTS, err = utils.CustGetLatestOplogTimestamp(src); err != nil {
+				log.Fatalln("获取当前最新的oplog对应的timestamp失败：", err)
+			}
+			if memberTS, ok, err := utils.CustFullSyncMemberOptime(); err != nil {
+				log.Fatalln("获取从节点的oplog位置失败：", err)
+			} else if ok && primitive.CompareTimestamp(memberTS, startTS) < 0 {
+				startTS = memberTS
+			}
+			// 丢失的oplog中可能有源端的删除，删除所有目标集合后重新复制
+			if err := utils.CustDropDstColls(dst, nsStructSlice); err != nil {
+				log.Fatalln("重新全量同步前删除目标集合失败：", err)
 			}
+			// 作为新的任务开始，清空之前的复制进度
+			if _, err := utils.CustCheckManifest(src, dst, manifestConfig, nsStructSlice, startTS, true); err != nil {
+				log.Fatalln("检查任务清单失败：", err)
+			}
+			if err := utils.CustSetCausalCopy(src, causal_copy, startTS); err != nil {
+				log.Fatalln("获取源端的clusterTime失败：", err)
+			}
+			statuses := utils.CustSyncCollections(fullSrc, dst, nsStructSlice, threadNum, utils.ConflictOverwrite, no_index)
+			log.Printf("重新全量同步完成，共%d个集合，从(%d,%d)继续重放oplog...\n", len(statuses), startTS.T, startTS.I)
+		}
+	}
+	// --oplog --resume：存在重放进度时跳过全量同步，各个oplog来源从保存的进度继续重放
+	if oplog && resume {
+		if resumeTS, ok, err := utils.CustReplayCheckpointStart(src, dst, ""); err != nil {
+			log.Fatalln("读取oplog重放进度失败：", err)
+		} else if ok {
+			log.Printf("从保存的oplog重放进度(%d,%d)继续重放，跳过全量同步...\n", resumeTS.T, resumeTS.I)
+			replayLiveOplog(resumeTS)
+			return
 		}
+		log.Println("没有保存的oplog重放进度，开始全量同步")
+	}
+	// --from_last：跳过全量同步，从上次--sync_oplog记录的位置继续同步oplog
+	if from_last {
+		originTS, lastTS, err := utils.CustGetSyncOplogProgress(dst)
+		if err != nil {
+			log.Fatalln("获取syncoplog同步进度失败：", err)
+		}
+		if lastTS.T == 0 && lastTS.I == 0 {
+			log.Fatalln("目标端没有syncoplog同步进度，不能使用--from_last")
+		}
+		if originTS.T == 0 && originTS.I == 0 {
+			// 旧版本记录的同步进度中没有最初的位置
+			originTS = lastTS
+		}
+		log.Printf("从上次syncoplog同步进度(%d,%d)继续同步oplog至目标mongodb实例...\n", lastTS.T, lastTS.I)
+		fmt.Printf("请使用--replayoplog --src_op_ns \"syncoplog.oplog.rs\" --op_start \"%d,%d\" 等参数进行oplog重放\n", originTS.T, originTS.I)
+		go utils.CustSyncOplog(src, dst, lastTS)
+		if sync_oplog_replay {
+			// 没有记录重放进度，从最初开始同步的位置重新重放，已经重放的oplog重复执行的结果相同
+			go utils.CustReplaySyncOplog(dst, replayDst, originTS, nsSlice, nsnsMap)
+		}
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt)
+		<-c
+		printReplayHint(originTS)
+		os.Exit(1)
+	}
+	if retry_failed {
+		// 只重新同步之前的任务中没有成功的集合
+		if nsStructSlice, err = utils.CustRetryFailedManifest(src, dst, manifestConfig, nsStructSlice); err != nil {
+			log.Fatalln("--retry_failed读取任务清单失败：", err)
+		}
+		if len(nsStructSlice) == 0 {
+			log.Println("之前的任务中所有集合都已经同步成功，不需要重新同步")
+			utils.CustFinishManifest(src, dst)
+			return
+		}
+		log.Printf("重新同步之前没有成功的%d个集合...\n", len(nsStructSlice))
+	} else {
+		// 继续未完成的任务时，使用任务开始时的oplog位置
+		start_ts, err = utils.CustCheckManifest(src, dst, manifestConfig, nsStructSlice, start_ts, reset_manifest)
+		if err != nil {
+			log.Fatalln("检查任务清单失败：", err)
+		}
+		// 继续未完成的任务时，起点为任务开始时记录的位置
+		if err := utils.CustSetCausalCopy(src, causal_copy, start_ts); err != nil {
+			log.Fatalln("获取源端的clusterTime失败：", err)
+		}
+	}
 
-		// 协程池
-		var wg sync.WaitGroup
-		for i := 0; i < threadNum; i++ {
-			wg.Add(1)
-			go worker(&wg)
+	if !replayoplog {
+		// 运行报告记录全量同步阶段的结果，增量同步阶段持续运行，不在报告中
+		reportMode := utils.ReportModeFull
+		if oplog {
+			reportMode = utils.ReportModeOplog
+		} else if sync_oplog {
+			reportMode = utils.ReportModeSyncOplog
+		}
+		report := utils.CustStartReport(src, reportMode)
+
+		// 目标端磁盘容量检查
+		stopCapacityMonitor := utils.StartCapacityMonitor(src, dst, nsStructSlice)
+
+		// threadNum个集合并发同步
+		statuses := utils.CustSyncCollections(fullSrc, dst, nsStructSlice, threadNum, conflictPolicy, no_index)
+		stopCapacityMonitor()
+		log.Printf("基于快照的集合同步完成，共%d个集合...\n", len(statuses))
+		utils.CustPrintDocSizeReport()
+		utils.CustPrintWriteErrorReport()
+		utils.CustRunHooks(utils.HookPhaseFinalize, dst, "", "")
+		if !sync_oplog && !oplog {
+			utils.CustFinishManifest(src, dst)
+		}
+		report.AddCollections(statuses)
+		// --count_check fail：存在文档数不一致的集合时报错退出
+		if err := utils.CustCheckCountMismatches(statuses); err != nil {
+			utils.CustFinishReport(dst, report, err)
+			log.Fatalln("文档数核对失败：", err)
 		}
-		wg.Wait()
-		log.Println("基于快照的集合同步完成...")
+		utils.CustFinishReport(dst, report, nil)
 
 		if sync_oplog == true {
 			log.Println("开始进行oplog同步至目标mongodb实例...")
 			fmt.Printf("请使用--replayoplog --src_op_ns \"syncoplog.oplog.rs\" --op_start \"%d,%d\" 等参数进行oplog重放\n", start_ts.T, start_ts.I)
 			go utils.CustSyncOplog(src, dst, start_ts)
+			// 全量同步已经完成，从同一起点自动重放复制的oplog
+			if sync_oplog_replay {
+				go utils.CustReplaySyncOplog(dst, replayDst, start_ts, nsSlice, nsnsMap)
+			}
 			// 捕获ctrl+c，进行--replayoplog相关参数的提示并退出sync_oplog操作
 			func() {
 				c := make(chan os.Signal, 1)
 				signal.Notify(c, os.Interrupt) //signal包不会为了向c发送信息而阻塞（就是说如果发送时c阻塞了，signal包会直接放弃）.调用者应该保证c有足够的缓存空间可以跟上期望的信号频率。对使用单一信号用于通知的通道，缓存为1就足够了。
 				<-c                            // Block until a signal is received.
-				fmt.Printf("请使用--replayoplog --src_op_ns \"syncoplog.oplog.rs\" --op_start \"%d,%d\" 等参数进行oplog重放\n", start_ts.T, start_ts.I)
+				printReplayHint(start_ts)
 				os.Exit(1)
 			}()
 		} else if oplog {
 			log.Println("开始进行oplog重放...")
-			utils.CustReplayOplog(src, dst, start_ts, end_ts, "local.oplog.rs", nsSlice, nsnsMap)
+			replayLiveOplog(start_ts)
 		}
 	} else {
-		// 获取start_ts
-		if op_start == "0,0" {
+		// 获取start_ts，--resume时优先使用保存的重放进度
+		var resumeTS primitive.Timestamp
+		resumed := false
+		if resume {
+			if resumeTS, resumed, err = utils.CustReplayCheckpointStart(src, dst, src_op_ns); err != nil {
+				log.Fatalln("读取oplog重放进度失败：", err)
+			}
+		}
+		if resumed {
+			start_ts = resumeTS
+			log.Printf("从保存的oplog重放进度(%d,%d)继续重放...\n", resumeTS.T, resumeTS.I)
+		} else if op_start == "0,0" {
 			log.Fatalln("--op_start为必选参数，请正确指定--op_start参数")
 		} else {
 			T, err := strconv.Atoi(strings.SplitN(op_start, ",", 2)[0])
@@ -322,8 +1280,24 @@ label:
 		}
 		end_ts = primitive.Timestamp{uint32(T), uint32(I)}
 
-		utils.CustReplayOplog(src, dst, start_ts, end_ts, src_op_ns, nsSlice, nsnsMap)
+		report := utils.CustStartReport(src, utils.ReportModeReplay)
+		if err := utils.CustReplayOplog(src, replayDst, start_ts, end_ts, src_op_ns, nsSlice, nsnsMap); err != nil {
+			utils.CustFinishReport(dst, report, err)
+			log.Fatalln("oplog重放失败：", err)
+		}
+		utils.CustFinishReport(dst, report, nil)
 		log.Println("oplog重放完毕，如果需要，请手动删除dst实例中的syncoplog库！")
+		utils.CustRunHooks(utils.HookPhaseFinalize, dst, "", "")
+		utils.CustFinishManifest(src, dst)
 		// defer 删除syncoplog库
 	}
 }
+
+// 退出--sync_oplog时提示继续重放syncoplog.oplog.rs的参数：自动重放过的从已经重放到的位置继续，否则从originTS开始
+func printReplayHint(originTS primitive.Timestamp) {
+	if replayed := utils.CustSyncOplogReplayed(); replayed.T != 0 || replayed.I != 0 {
+		originTS = replayed
+		fmt.Printf("syncoplog已经自动重放至(%d,%d)\n", replayed.T, replayed.I)
+	}
+	fmt.Printf("请使用--replayoplog --src_op_ns \"syncoplog.oplog.rs\" --op_start \"%d,%d\" 等参数进行oplog重放\n", originTS.T, originTS.I)
+}
@@ -0,0 +1,456 @@
+//go:build integration
+
+// mongosync端到端集成测试：按版本启动docker compose环境，依次执行各个场景，用--verify和源、目标端的查询结果断言同步的结果。
+//
+//	VERSIONS        测试的MongoDB版本，默认"4.4 5.0 6.0 7.0"
+//	SCENARIOS       执行的场景，默认"full tail resume sharded"
+//	WAIT_SECONDS    增量同步的场景等待源和目标一致的时间，默认120
+//	KEEP            为1时测试结束后保留环境，便于排查
+//	MONGOSYNC_BIN   使用已经编译好的（CGO_ENABLED=0静态链接的）mongosync，为空时编译
+//
+// 用法：go test -tags integration -v -timeout 3h test/integration/integration_test.go
+package integration
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 仓库中没有go.mod，编译时在临时目录中以这些依赖版本创建模块
+var buildDeps = []string{
+	"go.mongodb.org/mongo-driver@v1.11.9",
+	"go.uber.org/zap@v1.24.0",
+	"golang.org/x/term@v0.10.0",
+	"gopkg.in/fatih/set.v0@v0.2.1",
+}
+
+var (
+	here        string // test/integration目录
+	waitTimeout = 120 * time.Second
+)
+
+func TestMain(m *testing.M) {
+	_, file, _, _ := runtime.Caller(0)
+	here = filepath.Dir(file)
+	if s := os.Getenv("WAIT_SECONDS"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "WAIT_SECONDS参数错误：", err)
+			os.Exit(1)
+		}
+		waitTimeout = time.Duration(seconds) * time.Second
+	}
+	if _, err := exec.LookPath("docker"); err != nil {
+		fmt.Fprintln(os.Stderr, "需要安装docker（含compose插件）：", err)
+		os.Exit(1)
+	}
+	// mongosync挂载到runner容器的/harness/bin中执行
+	bin := filepath.Join(here, "bin", "mongosync")
+	if err := installMongosync(bin); err != nil {
+		fmt.Fprintln(os.Stderr, "编译mongosync失败：", err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// 将MONGOSYNC_BIN复制到bin，或者编译仓库中的mongosync
+func installMongosync(bin string) error {
+	if err := os.MkdirAll(filepath.Dir(bin), 0755); err != nil {
+		return err
+	}
+	if src := os.Getenv("MONGOSYNC_BIN"); src != "" {
+		return copyFile(src, bin, 0755)
+	}
+	dir, err := os.MkdirTemp("", "mongosync-build")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(here, "..", "..")
+	for _, pkg := range []string{".", "utils"} {
+		files, err := filepath.Glob(filepath.Join(root, pkg, "*.go"))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Join(dir, pkg), 0755); err != nil {
+			return err
+		}
+		for _, f := range files {
+			if !strings.HasSuffix(f, "_test.go") {
+				if err := copyFile(f, filepath.Join(dir, pkg, filepath.Base(f)), 0644); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	steps := [][]string{
+		{"go", "mod", "init", "mongosync"},
+		append([]string{"go", "get"}, buildDeps...),
+		{"go", "mod", "tidy"},
+		{"go", "build", "-o", bin, "."},
+	}
+	for _, step := range steps {
+		cmd := exec.Command(step[0], step[1:]...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOFLAGS=-mod=mod")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s：%v\n%s", strings.Join(step, " "), err, out)
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func envList(name, def string) []string {
+	if s := os.Getenv(name); s != "" {
+		return strings.Fields(s)
+	}
+	return strings.Fields(def)
+}
+
+var scenarios = map[string]func(t *testing.T, e *env){
+	"full":    scenarioFull,
+	"tail":    scenarioTail,
+	"resume":  scenarioResume,
+	"sharded": scenarioSharded,
+}
+
+func TestIntegration(t *testing.T) {
+	names := envList("SCENARIOS", "full tail resume sharded")
+	for _, name := range names {
+		if scenarios[name] == nil {
+			t.Fatalf("不支持的场景%s", name)
+		}
+	}
+	for _, version := range envList("VERSIONS", "4.4 5.0 6.0 7.0") {
+		version := version
+		t.Run(version, func(t *testing.T) {
+			e := newEnv(t, version, contains(names, "sharded"))
+			for _, name := range names {
+				name := name
+				t.Run(name, func(t *testing.T) {
+					se := *e
+					se.t = t
+					scenarios[name](t, &se)
+				})
+			}
+		})
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 一个MongoDB版本的docker compose环境
+type env struct {
+	t       *testing.T
+	version string
+	project string
+	profile []string
+	shell   string // runner容器中的shell，4.4的镜像中只有mongo，5.0+使用mongosh
+}
+
+// 启动环境并初始化源端、目标端副本集，测试结束后销毁
+func newEnv(t *testing.T, version string, sharded bool) *env {
+	e := &env{t: t, version: version, project: "mongosync-it-" + strings.ReplaceAll(version, ".", "")}
+	if sharded {
+		e.profile = []string{"--profile", "sharded"}
+	}
+	t.Cleanup(func() {
+		if os.Getenv("KEEP") != "1" {
+			e.compose(append(e.profile, "down", "-v")...)
+		}
+	})
+	if out, err := e.compose(append(e.profile, "up", "-d", "--quiet-pull")...); err != nil {
+		t.Fatalf("环境启动失败：%v\n%s", err, out)
+	}
+	out, err := e.compose("exec", "-T", "runner", "sh", "-c", "command -v mongosh || command -v mongo")
+	if err != nil {
+		t.Fatalf("runner容器中没有mongo shell：%v\n%s", err, out)
+	}
+	e.shell = lastLine(out)
+	e.initRS("src:27017", "src", "")
+	e.initRS("dst:27017", "dst", "")
+	return e
+}
+
+func (e *env) compose(args ...string) (string, error) {
+	cmd := exec.Command("docker", append([]string{"compose", "-f", filepath.Join(here, "docker-compose.yml"), "-p", e.project}, args...)...)
+	cmd.Dir = here
+	cmd.Env = append(os.Environ(), "MONGO_VERSION="+e.version)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// 在runner容器中执行js，返回输出的最后一行
+func (e *env) eval(host, js string) (string, error) {
+	out, err := e.compose("exec", "-T", "runner", e.shell, "--quiet", "--host", host, "--eval", js)
+	if err != nil {
+		return "", fmt.Errorf("%v\n%s", err, out)
+	}
+	return lastLine(out), nil
+}
+
+func (e *env) mustEval(host, js string) string {
+	e.t.Helper()
+	out, err := e.eval(host, js)
+	if err != nil {
+		e.t.Fatalf("在%s上执行脚本失败：%v", host, err)
+	}
+	return out
+}
+
+// 在runner容器中执行mongosync，没有终端，使用--yes跳过确认
+func (e *env) mongosync(args ...string) (string, error) {
+	return e.compose(append([]string{"exec", "-T", "runner", "/harness/bin/mongosync", "--yes"}, args...)...)
+}
+
+func (e *env) mustMongosync(args ...string) {
+	e.t.Helper()
+	if out, err := e.mongosync(args...); err != nil {
+		e.t.Fatalf("mongosync %s失败：%v\n%s", strings.Join(args, " "), err, tail(out, 20))
+	}
+}
+
+// 在后台执行mongosync，pid写入/tmp/<name>.pid，输出写入/tmp/<name>.log
+func (e *env) mongosyncBg(name string, args ...string) {
+	e.t.Helper()
+	script := fmt.Sprintf("echo $$ > /tmp/%s.pid; exec /harness/bin/mongosync --yes %s > /tmp/%s.log 2>&1", name, strings.Join(args, " "), name)
+	if out, err := e.compose("exec", "-d", "runner", "sh", "-c", script); err != nil {
+		e.t.Fatalf("启动mongosync失败：%v\n%s", err, out)
+	}
+	time.Sleep(time.Second)
+}
+
+// 结束后台的mongosync，返回其日志的最后20行
+func (e *env) mongosyncKill(name, signal string) string {
+	out, _ := e.compose("exec", "-T", "runner", "sh", "-c", fmt.Sprintf("kill -%s $(cat /tmp/%s.pid) 2>/dev/null; sleep 2; tail -20 /tmp/%s.log", signal, name, name))
+	return out
+}
+
+// 初始化单节点副本集，等待成为primary
+func (e *env) initRS(host, name, extra string) {
+	e.t.Helper()
+	e.waitFor(host+"可以连接", 60*time.Second, func() bool {
+		_, err := e.eval(host, "db.adminCommand({ping: 1})")
+		return err == nil
+	})
+	e.mustEval(host, fmt.Sprintf("rs.initiate({_id: '%s', %s members: [{_id: 0, host: '%s'}]})", name, extra, host))
+	e.waitFor("副本集"+name+"成为primary", 60*time.Second, func() bool {
+		out, err := e.eval(host, "print(db.adminCommand({isMaster: 1}).ismaster)")
+		return err == nil && out == "true"
+	})
+}
+
+func (e *env) waitFor(desc string, timeout time.Duration, cond func() bool) {
+	e.t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			e.t.Fatalf("等待%s超时", desc)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// 在源端生成测试数据
+func (e *env) seed(host, db string, n int) {
+	e.t.Helper()
+	e.mustEval(host, fmt.Sprintf(`
+		var d = db.getSiblingDB('%s');
+		var batch = [];
+		for (var i = 0; i < %d; i++) {
+			batch.push({_id: i, name: 'user' + i, age: i %% 90, tags: ['a' + (i %% 7), 'b' + (i %% 11)], profile: {city: 'c' + (i %% 50), score: i * 1.5}, created: new Date(1600000000000 + i * 1000)});
+			if (batch.length == 1000) { d.users.insertMany(batch); batch = []; }
+		}
+		if (batch.length > 0) d.users.insertMany(batch);
+		d.users.createIndex({name: 1}, {unique: true});
+		d.users.createIndex({'profile.city': 1, age: -1});
+		d.createCollection('capped', {capped: true, size: 1048576});
+		d.capped.insertMany([{_id: 1, v: 'x'}, {_id: 2, v: 'y'}]);
+		print('ok');
+	`, db, n))
+}
+
+// 在源端执行一组增删改和DDL，用于增量同步的场景
+func (e *env) mutate(host, db string) {
+	e.t.Helper()
+	e.mustEval(host, fmt.Sprintf(`
+		var d = db.getSiblingDB('%s');
+		d.users.insertMany([{_id: 'new1', name: 'new1', age: 1}, {_id: 'new2', name: 'new2', age: 2}]);
+		d.users.updateMany({age: {$lt: 10}}, {$set: {flag: true}, $inc: {'profile.score': 1}});
+		d.users.replaceOne({_id: 5}, {name: 'replaced5', age: 5});
+		d.users.deleteMany({age: {$gte: 80}});
+		d.users.createIndex({created: -1});
+		d.orders.insertOne({_id: 1, user: 1, total: 10});
+		d.capped.insertOne({_id: 3, v: 'z'});
+		print('ok');
+	`, db))
+}
+
+// --verify比较源和目标的数据
+func (e *env) verify(src, dst, db string) error {
+	out, err := e.mongosync("--sh", src, "--dh", dst, "-db", db, "--verify")
+	if err != nil {
+		return fmt.Errorf("%v\n%s", err, tail(out, 20))
+	}
+	return nil
+}
+
+// 反复执行--verify直到源和目标一致
+func (e *env) verifyUntil(src, dst, db string) {
+	e.t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		err := e.verify(src, dst, db)
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			e.t.Fatalf("%s内源和目标仍不一致：%v", waitTimeout, err)
+		}
+		time.Sleep(3 * time.Second)
+	}
+}
+
+// 断言源和目标上js的输出相同，且等于want（want为空时不比较）
+func (e *env) assertSame(src, dst, want, js string) {
+	e.t.Helper()
+	srcOut, dstOut := e.mustEval(src, js), e.mustEval(dst, js)
+	if srcOut != dstOut {
+		e.t.Errorf("源和目标不一致：%s\n源：%s\n目标：%s", js, srcOut, dstOut)
+	}
+	if want != "" && dstOut != want {
+		e.t.Errorf("目标端结果不符合预期：%s\n预期：%s\n实际：%s", js, want, dstOut)
+	}
+}
+
+// 断言全量同步的文档、索引和集合选项
+func (e *env) assertSeeded(src, dst, db string, n int) {
+	e.t.Helper()
+	d := fmt.Sprintf("db.getSiblingDB('%s')", db)
+	e.assertSame(src, dst, strconv.Itoa(n), fmt.Sprintf("print(%s.users.countDocuments({}))", d))
+	e.assertSame(src, dst, "", fmt.Sprintf("print(%s.users.getIndexes().map(function(i) { return i.name; }).sort().join(','))", d))
+	e.assertSame(src, dst, "true", fmt.Sprintf("print(%s.capped.isCapped())", d))
+}
+
+func scenarioFull(t *testing.T, e *env) {
+	e.seed("src:27017", "it_full", 20000)
+	e.mustMongosync("--sh", "src:27017", "--dh", "dst:27017", "-db", "it_full")
+	if err := e.verify("src:27017", "dst:27017", "it_full"); err != nil {
+		t.Fatalf("全量同步后源和目标不一致：%v", err)
+	}
+	e.assertSeeded("src:27017", "dst:27017", "it_full", 20000)
+}
+
+func scenarioTail(t *testing.T, e *env) {
+	e.seed("src:27017", "it_tail", 20000)
+	e.mongosyncBg("tail", "--sh", "src:27017", "--dh", "dst:27017", "-db", "it_tail", "--oplog")
+	defer func() {
+		if log := e.mongosyncKill("tail", "TERM"); t.Failed() {
+			t.Log(log)
+		}
+	}()
+	e.verifyUntil("src:27017", "dst:27017", "it_tail")
+	e.mutate("src:27017", "it_tail")
+	e.verifyUntil("src:27017", "dst:27017", "it_tail")
+	assertMutated(e, "src:27017", "dst:27017", "it_tail")
+}
+
+// 全量复制过程中kill -9，再次执行时从中断处继续
+func scenarioResume(t *testing.T, e *env) {
+	e.seed("src:27017", "it_resume", 300000)
+	e.mongosyncBg("resume", "--sh", "src:27017", "--dh", "dst:27017", "-db", "it_resume", "--threadNum", "2")
+	time.Sleep(5 * time.Second)
+	e.mongosyncKill("resume", "KILL")
+	e.mustMongosync("--sh", "src:27017", "--dh", "dst:27017", "-db", "it_resume", "--threadNum", "2")
+	if err := e.verify("src:27017", "dst:27017", "it_resume"); err != nil {
+		t.Fatalf("继续全量同步后源和目标不一致：%v", err)
+	}
+	e.assertSeeded("src:27017", "dst:27017", "it_resume", 300000)
+}
+
+// 源端为分片集群：全量同步后从各个分片的oplog增量同步
+func scenarioSharded(t *testing.T, e *env) {
+	e.initRS("cfg:27019", "cfg", "configsvr: true,")
+	e.initRS("shard1:27018", "shard1", "")
+	e.initRS("shard2:27018", "shard2", "")
+	e.waitFor("mongos可以连接", 60*time.Second, func() bool {
+		_, err := e.eval("mongos:27017", "db.adminCommand({ping: 1})")
+		return err == nil
+	})
+	e.mustEval("mongos:27017", `
+		sh.addShard('shard1/shard1:27018');
+		sh.addShard('shard2/shard2:27018');
+		sh.enableSharding('it_sharded');
+		sh.shardCollection('it_sharded.users', {_id: 'hashed'});
+		print('ok');
+	`)
+	e.seed("mongos:27017", "it_sharded", 20000)
+	e.mongosyncBg("sharded", "--sh", "mongos:27017", "--dh", "dst:27017", "-db", "it_sharded", "--oplog")
+	defer func() {
+		if log := e.mongosyncKill("sharded", "TERM"); t.Failed() {
+			t.Log(log)
+		}
+	}()
+	e.verifyUntil("mongos:27017", "dst:27017", "it_sharded")
+	e.mutate("mongos:27017", "it_sharded")
+	e.verifyUntil("mongos:27017", "dst:27017", "it_sharded")
+	assertMutated(e, "mongos:27017", "dst:27017", "it_sharded")
+}
+
+// 断言mutate中的增删改和DDL已经重放到目标端
+func assertMutated(e *env, src, dst, db string) {
+	e.t.Helper()
+	d := fmt.Sprintf("db.getSiblingDB('%s')", db)
+	e.assertSame(src, dst, "", fmt.Sprintf("print(%s.users.countDocuments({}))", d))
+	e.assertSame(src, dst, "0", fmt.Sprintf("print(%s.users.countDocuments({age: {$gte: 80}}))", d))
+	e.assertSame(src, dst, "2", fmt.Sprintf("print(%s.users.countDocuments({_id: {$in: ['new1', 'new2']}}))", d))
+	e.assertSame(src, dst, "replaced5", fmt.Sprintf("print(%s.users.findOne({_id: 5}).name)", d))
+	e.assertSame(src, dst, "1", fmt.Sprintf("print(%s.orders.countDocuments({}))", d))
+	e.assertSame(src, dst, "3", fmt.Sprintf("print(%s.capped.countDocuments({}))", d))
+	e.assertSame(src, dst, "true", fmt.Sprintf("print(%s.users.getIndexes().some(function(i) { return i.name == 'created_-1'; }))", d))
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+func tail(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,16 @@
+#!/usr/bin/env bash
+# mongosync端到端集成测试，测试在integration_test.go中（//go:build integration），环境变量见其中的说明：
+#
+#   VERSIONS   测试的MongoDB版本，默认"4.4 5.0 6.0 7.0"
+#   SCENARIOS  执行的场景，默认"full tail resume sharded"
+#   KEEP       为1时测试结束后保留环境，便于排查
+#
+# 用法：test/integration/run.sh
+#       VERSIONS=6.0 SCENARIOS="full resume" test/integration/run.sh
+#       test/integration/run.sh -run 'TestIntegration/6.0/full'
+set -euo pipefail
+
+HERE=$(cd "$(dirname "$0")" && pwd)
+cd "$HERE"
+# 仓库中没有go.mod，以文件的方式执行测试，mongosync在测试中以临时模块编译
+exec go test -tags integration -v -count=1 -timeout 3h "$@" integration_test.go
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// 批量重放oplog：同一个目标集合连续的增删改oplog合并为一次有序的BulkWrite，按oplog的顺序执行，同一个_id的修改顺序不变。
+// 遇到其他集合、命令等无法合并的oplog，批次达到replayBatchSize条，或者游标中已经读取的oplog处理完（实时重放时不等待更多oplog）
+// 时执行当前批次。批量执行失败时从第一个失败的oplog开始逐条重新执行（之前的oplog已经执行成功），找出失败的oplog
+var replayBatchSize = 1000
+
+// --apply_ops：批次通过目标端的applyOps命令执行，oplog中的ns替换为映射后的目标ns，由服务端按oplog的原始语义执行，
+// 不需要转换为ReplaceOne、UpdateOne、DeleteOne；批次中可以包含不同集合的oplog。
+// 目标端需要为副本集或单机（mongos不支持applyOps），用户需要applyOps权限。--conflict_policy不是overwrite的集合的insert仍然逐条执行
+var replayApplyOps bool
+
+// 设置批量重放的批次大小，不大于1时逐条重放
+func SetReplayBatch(size int) {
+	replayBatchSize = size
+}
+
+// 设置是否通过applyOps执行批次
+func SetReplayApplyOps(enabled bool) {
+	replayApplyOps = enabled
+}
+
+// 等待执行的一批oplog
+type oplogBatch struct {
+	dstMongo  *MongoArgs
+	nsStruct  *NsMap
+	nsStructs []*NsMap
+	oplogs    []OPLOG
+	raws      []bson.Raw
+	models    []mongo.WriteModel
+	applyOps  bson.A // --apply_ops时的applyOps操作
+}
+
+func newOplogBatch(dstMongo *MongoArgs) *oplogBatch {
+	return &oplogBatch{dstMongo: dstMongo}
+}
+
+func (b *oplogBatch) empty() bool {
+	return len(b.oplogs) == 0
+}
+
+// 将oplog加入批次，返回false表示该oplog不能批量执行，调用方需要先执行当前批次再逐条执行该oplog
+func (b *oplogBatch) add(nsStruct *NsMap, oplog OPLOG, raw bson.Raw) bool {
+	if replayBatchSize <= 1 || offlineBufferActive() {
+		return false
+	}
+	projected, ok := projectOplog(nsStruct, oplog)
+	if !ok {
+		return false
+	}
+	if replayApplyOps {
+		op := applyOpsEntry(nsStruct, projected)
+		if op == nil {
+			return false
+		}
+		b.applyOps = append(b.applyOps, op)
+	} else {
+		model := oplogWriteModel(projected)
+		if model == nil {
+			return false
+		}
+		if !b.empty() && !sameNs(b.nsStruct, nsStruct) {
+			b.flush()
+		}
+		b.models = append(b.models, model)
+	}
+	b.nsStruct = nsStruct
+	b.nsStructs = append(b.nsStructs, nsStruct)
+	b.oplogs = append(b.oplogs, oplog)
+	b.raws = append(b.raws, append(bson.Raw(nil), raw...))
+	if len(b.oplogs) >= replayBatchSize {
+		b.flush()
+	}
+	return true
+}
+
+// 转换为applyOps中的一个操作，不能通过applyOps执行时返回nil。
+// 只保留op、ns、o、o2，ui（集合的UUID）等字段与目标端无关；update使用upsert（b），与逐条执行时一致
+func applyOpsEntry(nsStruct *NsMap, oplog OPLOG) bson.D {
+	ns := nsStruct.DstDb + "." + nsStruct.DstColl
+	switch oplog.OP {
+	case "i":
+		if oplogConflictPolicy(oplog.NS) != ConflictOverwrite {
+			return nil
+		}
+		return bson.D{{"op", "i"}, {"ns", ns}, {"o", oplog.O}}
+	case "u":
+		if missingDocSource != nil || oplog.truncate != nil {
+			return nil
+		}
+		return bson.D{{"op", "u"}, {"ns", ns}, {"o", oplog.O}, {"o2", oplog.O2}, {"b", true}}
+	case "d":
+		return bson.D{{"op", "d"}, {"ns", ns}, {"o", oplog.O}}
+	}
+	return nil
+}
+
+// 游标中已经读取的oplog处理完时执行当前批次，避免等待新的oplog时延迟写入
+func (b *oplogBatch) flushIfDrained(cur *mongo.Cursor) {
+	if !b.empty() && cur.RemainingBatchLength() == 0 {
+		b.flush()
+	}
+}
+
+// 执行当前批次
+func (b *oplogBatch) flush() {
+	if b.empty() {
+		return
+	}
+	ctx := b.dstMongo.Context()
+	var err error
+	applied := 0 // 已经执行成功的oplog数
+	if replayApplyOps {
+		err = doWithRetry(ctx, writeTimeout, "applyOps", func(ctx context.Context) error {
+			return b.dstMongo.Client().Database("admin").RunCommand(ctx, bson.D{{"applyOps", b.applyOps}}).Err()
+		})
+	} else {
+		applied, err = b.bulkWrite(ctx)
+	}
+	if err != nil {
+		// 目标端不可达时逐条执行会写入本地缓冲区
+		loggerFrom(ctx).Warn("oplog批量执行失败，转为逐条执行", zap.String("NS", b.nsStruct.DstDb+"."+b.nsStruct.DstColl), zap.Int("num", len(b.oplogs)-applied), zap.Int("applied", applied), zap.Error(err))
+		for i := applied; i < len(b.oplogs); i++ {
+			oplog := b.oplogs[i]
+			if err := applyOrBuffer(b.dstMongo, b.nsStructs[i], oplog); err != nil {
+				log.Println(fmt.Sprintf("oplog执行'%s'操作失败：", oplog.OP), err, "\toplog内容：", failedDocString(oplog.NS, b.raws[i]))
+				notifyProgress(func(listener ProgressListener) { listener.OnError(oplog.NS, err) })
+			}
+		}
+	}
+	b.nsStruct, b.nsStructs, b.oplogs, b.raws, b.models, b.applyOps = nil, nil, nil, nil, nil, nil
+}
+
+// 以一次有序的BulkWrite执行批次中同一个集合的oplog，返回执行成功的oplog数。
+// 有序的BulkWrite在第一个写入错误处停止，之前的oplog已经执行，重新执行可能产生重复键等错误，只需要从失败的oplog开始重新执行
+func (b *oplogBatch) bulkWrite(ctx context.Context) (int, error) {
+	coll := b.dstMongo.Client().Database(b.nsStruct.DstDb).Collection(b.nsStruct.DstColl)
+	for _, model := range b.models {
+		setModelHint(ctx, coll, model)
+	}
+	var deleted int64
+	applied := 0
+	err := doWithRetry(ctx, writeTimeout, "BulkWrite", func(ctx context.Context) error {
+		result, err := coll.BulkWrite(ctx, b.models, options.BulkWrite().SetOrdered(true))
+		var bulkErr mongo.BulkWriteException
+		applied = 0
+		if err == nil {
+			applied = len(b.models)
+		} else if errors.As(err, &bulkErr) && len(bulkErr.WriteErrors) > 0 {
+			applied = bulkErr.WriteErrors[0].Index // 驱动拆分为多个批次时也是在b.models中的下标
+		}
+		if result != nil {
+			deleted = result.DeletedCount
+		}
+		return err
+	})
+	if deleteNum := countDeleteModels(b.models[:applied]); deleteNum > 0 {
+		recordDeletes(deleteNum, deleteNum, deleted)
+	}
+	return applied, err
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// InsertMany失败后（通常是部分_id在目标端已经存在），以一次无序的BulkWrite重新写入出错文档及之后的文档，
+// 再按BulkWriteException中每个文档的错误分类：重复_id按--conflict_policy处理，主从切换、写冲突等临时错误只重试出错的文档，
+// 其余错误（文档校验失败、超过16MB等）按分类记录为失败，不再重试
+
+// 单个文档出现临时错误时最多写入的轮数
+const bulkRetryRounds = 3
+
+// 单个文档的写入错误是否可以通过重试恢复
+func isTransientWriteError(writeErr mongo.WriteError) bool {
+	if writeErr.Code == 112 { // WriteConflict
+		return true
+	}
+	for _, code := range retryableErrorCodes {
+		if writeErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// 以无序的BulkWrite按policy写入docs：overwrite按_id替换，merge按_id $set其他字段，skip只在_id不存在时插入，
+// fail插入并将重复_id视为失败
+func bulkWriteDocs(ctx context.Context, coll *mongo.Collection, docs []interface{}, policy ConflictPolicy) (sucessNum int64, failNum int64) {
+	ns := coll.Database().Name() + "." + coll.Name()
+	opts := options.BulkWrite().SetOrdered(false)
+	if policy == ConflictOverwrite || policy == ConflictMerge {
+		opts.SetBypassDocumentValidation(bypassValidation)
+	} else {
+		opts.SetBypassDocumentValidation(true)
+	}
+	fail := func(doc interface{}, code int, err error) {
+		failNum++
+		failWrite(ctx, ns, doc, code, err)
+	}
+
+	pending := docs
+	for round := 1; len(pending) > 0; round++ {
+		models := make([]mongo.WriteModel, len(pending))
+		for i, doc := range pending {
+			models[i] = conflictWriteModel(policy, doc)
+		}
+		err := doWithRetry(ctx, writeTimeout, "BulkWrite "+ns, func(ctx context.Context) error {
+			_, err := coll.BulkWrite(ctx, models, opts)
+			return err
+		})
+		if err == nil {
+			sucessNum += int64(len(pending))
+			break
+		}
+		var bulkErr mongo.BulkWriteException
+		if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 {
+			// 整批写入失败（重试次数用完、ctx被取消、写关注错误等），无法区分单个文档
+			loggerFrom(ctx).Error("BulkWrite批量写入失败", zap.String("NS", ns), zap.Int("docsNum", len(pending)), zap.Error(err))
+			failNum += int64(len(pending))
+			recordWriteError(ns, writeErrorCode(err), int64(len(pending)), err)
+			notifyProgress(func(listener ProgressListener) { listener.OnError(ns, err) })
+			break
+		}
+		if bulkErr.WriteConcernError != nil {
+			loggerFrom(ctx).Warn("BulkWrite写关注未满足", zap.String("NS", ns), zap.String("writeConcernError", bulkErr.WriteConcernError.Message))
+		}
+		var retry []interface{}
+		var retryCodes []int
+		for _, writeErr := range bulkErr.WriteErrors {
+			doc := pending[writeErr.Index]
+			switch {
+			case policy == ConflictSkip && writeErr.Code == 11000:
+				sucessNum++ // 目标端已经存在该_id（并发upsert）
+			case isTransientWriteError(writeErr.WriteError) && round < bulkRetryRounds:
+				retry = append(retry, doc)
+				retryCodes = append(retryCodes, writeErr.Code)
+			default:
+				fail(doc, writeErr.Code, fmt.Errorf("第%d轮写入失败：%w", round, writeErr))
+			}
+		}
+		sucessNum += int64(len(pending) - len(bulkErr.WriteErrors))
+		if len(retry) > 0 {
+			if !retryWait(ctx, round, "BulkWrite "+ns, bulkErr) {
+				for i, doc := range retry {
+					fail(doc, retryCodes[i], bulkErr)
+				}
+				break
+			}
+		}
+		pending = retry
+	}
+	return sucessNum, failNum
+}
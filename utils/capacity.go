@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+// 目标端磁盘容量检查：定期通过dbStats获取目标端数据目录所在文件系统的剩余空间，
+// 预计剩余导入量超过剩余空间时暂停全量导入并告警，释放空间后自动继续
+var (
+	capacityCheckInterval time.Duration // 检查间隔，为0表示不检查
+	capacityMarginRatio   = 0.1         // 预留的空闲空间比例（占文件系统总空间）
+
+	copiedBytes    int64 // 已经从源端读取的文档总字节数
+	capacityPaused int32 // 为1时暂停全量导入的写入
+)
+
+// 暂停期间检查是否可以继续的间隔
+const capacityPausePoll = time.Second
+
+// 设置目标端磁盘容量的检查间隔和预留比例，interval为0表示不检查
+func SetCapacityCheck(interval time.Duration, margin float64) {
+	capacityCheckInterval = interval
+	if margin >= 0 && margin < 1 {
+		capacityMarginRatio = margin
+	}
+}
+
+// 记录从源端读取的文档大小，用于估算剩余导入量
+func addCopiedBytes(size int64) {
+	atomic.AddInt64(&copiedBytes, size)
+}
+
+// 源端待同步集合的大小，dataSize为文档的逻辑大小，diskSize为压缩后的存储大小与索引大小之和
+type sourceVolume struct {
+	dataSize int64
+	diskSize int64
+}
+
+// 汇总源端待同步集合的大小
+func getSourceVolume(srcMongo *MongoArgs, nsStructSlice []*NsMap) sourceVolume {
+	var volume sourceVolume
+	for _, nsmap := range nsStructSlice {
+		if isView(srcMongo, nsmap.SrcDb, nsmap.SrcColl) {
+			continue
+		}
+		var stats struct {
+			Size           int64 `bson:"size"`
+			StorageSize    int64 `bson:"storageSize"`
+			TotalIndexSize int64 `bson:"totalIndexSize"`
+		}
+		db := srcMongo.Client().Database(nsmap.SrcDb)
+		err := doWithRetry(srcMongo.Context(), commandTimeout, "collStats", func(ctx context.Context) error {
+			return db.RunCommand(ctx, bson.D{{"collStats", nsmap.SrcColl}}).Decode(&stats)
+		})
+		if err != nil {
+			srcMongo.logger().Warn("获取源集合大小失败，容量检查时不计入该集合", zap.String("NS", nsmap.SrcDb+"."+nsmap.SrcColl), zap.Error(err))
+			continue
+		}
+		volume.dataSize += stats.Size
+		volume.diskSize += stats.StorageSize + stats.TotalIndexSize
+	}
+	return volume
+}
+
+// 获取目标端数据目录所在文件系统的总空间和已用空间（dbStats的fsTotalSize、fsUsedSize，3.6开始支持）
+func getTargetFsSize(dstMongo *MongoArgs) (total, used int64, err error) {
+	var stats struct {
+		FsTotalSize float64 `bson:"fsTotalSize"`
+		FsUsedSize  float64 `bson:"fsUsedSize"`
+	}
+	db := dstMongo.Client().Database(mongosyncDbName)
+	err = doWithRetry(dstMongo.Context(), commandTimeout, "dbStats", func(ctx context.Context) error {
+		return db.RunCommand(ctx, bson.D{{"dbStats", 1}}).Decode(&stats)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if stats.FsTotalSize == 0 {
+		return 0, 0, fmt.Errorf("dbStats未返回fsTotalSize，目标端版本可能低于3.6")
+	}
+	return int64(stats.FsTotalSize), int64(stats.FsUsedSize), nil
+}
+
+// 估算剩余导入量在目标端需要占用的磁盘空间：按源端的压缩比和索引占比折算尚未读取的数据量
+func (volume sourceVolume) remainingDiskSize() int64 {
+	remaining := volume.dataSize - atomic.LoadInt64(&copiedBytes)
+	if remaining <= 0 || volume.dataSize == 0 {
+		return 0
+	}
+	return int64(float64(remaining) / float64(volume.dataSize) * float64(volume.diskSize))
+}
+
+// 启动目标端磁盘容量检查，立即检查一次，之后每capacityCheckInterval检查一次。返回的函数用于停止检查并恢复写入
+func StartCapacityMonitor(srcMongo, dstMongo *MongoArgs, nsStructSlice []*NsMap) func() {
+	if capacityCheckInterval <= 0 {
+		return func() {}
+	}
+	volume := getSourceVolume(srcMongo, nsStructSlice)
+	if !checkCapacity(dstMongo, volume) {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(capacityCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-dstMongo.Context().Done():
+				return
+			case <-ticker.C:
+				if !checkCapacity(dstMongo, volume) {
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		atomic.StoreInt32(&capacityPaused, 0)
+	}
+}
+
+// 比较剩余导入量与目标端剩余空间，空间不足时暂停写入，空间恢复后继续。无法获取目标端空间时返回false，停止检查
+func checkCapacity(dstMongo *MongoArgs, volume sourceVolume) bool {
+	total, used, err := getTargetFsSize(dstMongo)
+	if err != nil {
+		dstMongo.logger().Warn("获取目标端磁盘空间失败，停止容量检查", zap.Error(err))
+		atomic.StoreInt32(&capacityPaused, 0)
+		return false
+	}
+	free := total - used - int64(float64(total)*capacityMarginRatio)
+	need := volume.remainingDiskSize()
+	if need > free {
+		if atomic.SwapInt32(&capacityPaused, 1) == 0 {
+			dstMongo.logger().Error("目标端磁盘空间不足，暂停全量导入，请扩容或清理目标端磁盘，空间足够后将自动继续",
+				zap.String("need", formatBytes(need)), zap.String("free", formatBytes(free)), zap.String("fsTotal", formatBytes(total)), zap.String("fsUsed", formatBytes(used)), zap.Float64("margin", capacityMarginRatio))
+		}
+	} else if atomic.SwapInt32(&capacityPaused, 0) == 1 {
+		dstMongo.logger().Info("目标端磁盘空间已足够，继续全量导入", zap.String("need", formatBytes(need)), zap.String("free", formatBytes(free)))
+	}
+	return true
+}
+
+// 目标端磁盘空间不足时阻塞，直到空间恢复或ctx被取消
+func waitForCapacity(ctx context.Context) error {
+	for atomic.LoadInt32(&capacityPaused) == 1 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(capacityPausePoll):
+		}
+	}
+	return nil
+}
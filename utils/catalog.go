@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// 库、集合列表的缓存。规划阶段按库、按集合多次获取列表和集合选项，集合数上千的集群上对源端造成较大压力：
+// 每个实例的结果缓存catalogTTL后重新获取，并限制每秒发起的listDatabases/listCollections次数
+var (
+	catalogTTL       = 5 * time.Minute // <=0表示不缓存
+	catalogRateLimit = 10              // 每秒最多发起的listDatabases/listCollections次数，<=0表示不限制
+)
+
+// 设置库、集合列表的缓存时间和每秒最多的请求次数
+func SetCatalogCache(ttl time.Duration, rateLimit int) {
+	catalogTTL = ttl
+	catalogRateLimit = rateLimit
+}
+
+// listCollections返回的集合信息
+type collSpec struct {
+	Name    string   `bson:"name"`
+	Type    string   `bson:"type"` // collection、view、timeseries
+	Options bson.Raw `bson:"options"`
+}
+
+// 同一个实例的库、集合列表缓存，与mongo.Client一起共享
+type catalogCache struct {
+	lock      sync.Mutex
+	dbs       []string
+	dbsTime   time.Time
+	colls     map[string][]collSpec
+	collsTime map[string]time.Time
+
+	limitLock sync.Mutex
+	next      time.Time // 下一次允许发起请求的时间
+}
+
+func (mc *MongoArgs) catalog() *catalogCache {
+	mc.conn.Lock()
+	defer mc.conn.Unlock()
+	if mc.conn.catalog == nil {
+		mc.conn.catalog = &catalogCache{colls: map[string][]collSpec{}, collsTime: map[string]time.Time{}}
+	}
+	return mc.conn.catalog
+}
+
+// 按catalogRateLimit等待发起请求的时机
+func (c *catalogCache) wait(ctx context.Context) error {
+	if catalogRateLimit <= 0 {
+		return nil
+	}
+	c.limitLock.Lock()
+	now := time.Now()
+	at := c.next
+	if at.Before(now) {
+		at = now
+	}
+	c.next = at.Add(time.Second / time.Duration(catalogRateLimit))
+	c.limitLock.Unlock()
+
+	timer := time.NewTimer(at.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func catalogFresh(fetched time.Time) bool {
+	return catalogTTL > 0 && time.Since(fetched) < catalogTTL
+}
+
+// 获取实例中的数据库列表，缓存未过期时直接返回
+func (mc *MongoArgs) listDatabaseNames() ([]string, error) {
+	c := mc.catalog()
+	c.lock.Lock()
+	if c.dbs != nil && catalogFresh(c.dbsTime) {
+		dbs := append([]string(nil), c.dbs...)
+		c.lock.Unlock()
+		return dbs, nil
+	}
+	c.lock.Unlock()
+
+	if err := c.wait(mc.Context()); err != nil {
+		return nil, err
+	}
+	var dbs []string
+	err := doWithRetry(mc.Context(), commandTimeout, "listDatabases", func(ctx context.Context) error {
+		var err error
+		dbs, err = mc.Client().ListDatabaseNames(ctx, bson.M{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.dbs, c.dbsTime = dbs, time.Now()
+	c.lock.Unlock()
+	return append([]string(nil), dbs...), nil
+}
+
+// 获取数据库中所有集合（包括视图）的信息，缓存未过期时直接返回
+func (mc *MongoArgs) listCollectionSpecs(dbName string) ([]collSpec, error) {
+	c := mc.catalog()
+	c.lock.Lock()
+	if specs, exists := c.colls[dbName]; exists && catalogFresh(c.collsTime[dbName]) {
+		c.lock.Unlock()
+		return specs, nil
+	}
+	c.lock.Unlock()
+
+	if err := c.wait(mc.Context()); err != nil {
+		return nil, err
+	}
+	var specs []collSpec
+	db := mc.Client().Database(dbName)
+	err := doWithRetry(mc.Context(), commandTimeout, "listCollections", func(ctx context.Context) error {
+		cur, err := db.ListCollections(ctx, bson.M{})
+		if err != nil {
+			return err
+		}
+		specs = nil
+		return cur.All(ctx, &specs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.colls[dbName], c.collsTime[dbName] = specs, time.Now()
+	c.lock.Unlock()
+	return specs, nil
+}
+
+// 获取单个集合的信息，集合不存在时返回nil
+func (mc *MongoArgs) collectionSpec(dbName, collName string) (*collSpec, error) {
+	specs, err := mc.listCollectionSpecs(dbName)
+	if err != nil {
+		return nil, err
+	}
+	for i := range specs {
+		if specs[i].Name == collName {
+			return &specs[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 因果一致的全量复制：增量同步的起点（start_ts）在全量复制之前从源端获取，全量复制可能从另一个节点（--src_full_sync_member、
+// 读偏好为从节点、mongos路由到各个分片的从节点）读取，该节点落后于起点时，起点之前的修改既不在复制的数据中，也不会被重放。
+// 每个_id范围的读取使用一个因果一致的会话，会话的operationTime推进到起点，所有读取都带有afterClusterTime，节点应用到起点之后
+// 才返回数据，同一范围内重新打开游标时读取的数据也不会回退；snapshot方式的会话检查读取的时间点，早于起点时等待后重新读取。
+// 因此起点（任务开始时记录的clusterTime）就是重放oplog的起点，与复制的先后顺序无关
+var causalCopy struct {
+	enabled     bool
+	afterTime   primitive.Timestamp // 读取的数据至少包含该时间点之前的修改，为空时只保证同一范围内的因果一致
+	clusterTime bson.Raw            // 获取afterTime之后源端的$clusterTime，随读取发送给各个节点
+}
+
+// snapshot读取的时间点早于起点时最多重新读取的次数，每次间隔1秒
+const staleSnapshotRetries = 60
+
+// 设置全量复制是否使用因果一致的会话读取，startTS为增量同步的起点，不同步oplog时为空
+func CustSetCausalCopy(srcMongo *MongoArgs, enabled bool, startTS primitive.Timestamp) error {
+	causalCopy.enabled, causalCopy.afterTime, causalCopy.clusterTime = enabled, startTS, nil
+	if !enabled || startTS.IsZero() {
+		return nil
+	}
+	sess, err := srcMongo.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(context.Background())
+	err = doWithRetry(srcMongo.Context(), commandTimeout, "ping", func(ctx context.Context) error {
+		return srcMongo.Client().Database("admin").RunCommand(mongo.NewSessionContext(ctx, sess), bson.D{{"ping", 1}}).Err()
+	})
+	if err != nil {
+		return err
+	}
+	causalCopy.clusterTime = sess.ClusterTime()
+	return nil
+}
+
+// 打开复制一个_id范围使用的会话：snapshot方式为snapshot会话，否则启用时为因果一致的会话，都不使用时返回nil
+func newCopySession(srcMongo *MongoArgs, strategy string) (mongo.Session, error) {
+	if strategy == ReadStrategySnapshot {
+		return srcMongo.Client().StartSession(options.Session().SetSnapshot(true))
+	}
+	if !causalCopy.enabled {
+		return nil, nil
+	}
+	sess, err := srcMongo.Client().StartSession(options.Session().SetCausalConsistency(true))
+	if err != nil {
+		return nil, err
+	}
+	if !causalCopy.afterTime.IsZero() {
+		afterTime := causalCopy.afterTime
+		if err := sess.AdvanceOperationTime(&afterTime); err != nil {
+			sess.EndSession(context.Background())
+			return nil, err
+		}
+		if causalCopy.clusterTime != nil {
+			if err := sess.AdvanceClusterTime(causalCopy.clusterTime); err != nil {
+				sess.EndSession(context.Background())
+				return nil, err
+			}
+		}
+	}
+	return sess, nil
+}
+
+// 检查snapshot会话读取的时间点是否不早于增量同步的起点
+func checkSnapshotTime(sess mongo.Session, strategy string) error {
+	if strategy != ReadStrategySnapshot || !causalCopy.enabled || causalCopy.afterTime.IsZero() || sess == nil {
+		return nil
+	}
+	readTime := sess.OperationTime()
+	if readTime == nil || primitive.CompareTimestamp(*readTime, causalCopy.afterTime) >= 0 {
+		return nil
+	}
+	return fmt.Errorf("snapshot读取的时间点(%d,%d)早于增量同步的起点(%d,%d)", readTime.T, readTime.I, causalCopy.afterTime.T, causalCopy.afterTime.I)
+}
@@ -0,0 +1,388 @@
+package utils
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// change stream模式：Atlas等托管服务通常不允许访问local库和执行replSetGetStatus，
+// 此时当前时间点通过命令返回的$clusterTime获取，增量同步通过集群级别的change stream（4.0+）读取变更，
+// 不需要admin、local库的权限（需要changeStream和find权限）。源端为mongos时同样适用
+var changeStreamMode bool
+
+// change stream的范围：cluster为一个集群级别的change stream（需要集群的changeStream权限），
+// db、collection为每个同步的库或集合一个change stream，只需要这些库或集合的权限
+const (
+	ChangeStreamScopeCluster    = "cluster"
+	ChangeStreamScopeDb         = "db"
+	ChangeStreamScopeCollection = "collection"
+)
+
+var (
+	changeStreamScope        = ChangeStreamScopeCluster
+	changeStreamUpdateLookup = true // update事件是否通过updateLookup获取完整文档进行替换，否则按修改的字段更新
+)
+
+// 启用change stream模式
+func SetChangeStreamMode(enabled bool) {
+	changeStreamMode = enabled
+}
+
+// 设置change stream的范围和update事件是否使用updateLookup
+func SetChangeStreamOptions(scope string, updateLookup bool) error {
+	if scope != ChangeStreamScopeCluster && scope != ChangeStreamScopeDb && scope != ChangeStreamScopeCollection {
+		return fmt.Errorf("不支持的范围%s，可选值为%s、%s、%s", scope, ChangeStreamScopeCluster, ChangeStreamScopeDb, ChangeStreamScopeCollection)
+	}
+	changeStreamScope, changeStreamUpdateLookup = scope, updateLookup
+	return nil
+}
+
+// change stream中的变更事件
+type changeEvent struct {
+	ID            bson.Raw            `bson:"_id"`
+	OperationType string              `bson:"operationType"`
+	ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+	Ns            struct {
+		Db   string `bson:"db"`
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+	To struct {
+		Db   string `bson:"db"`
+		Coll string `bson:"coll"`
+	} `bson:"to"` // rename事件的新集合
+	DocumentKey       bson.D `bson:"documentKey"`
+	FullDocument      bson.D `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields   bson.D   `bson:"updatedFields"`
+		RemovedFields   []string `bson:"removedFields"`
+		TruncatedArrays bson.A   `bson:"truncatedArrays"`
+	} `bson:"updateDescription"`
+	OperationDescription bson.D `bson:"operationDescription"` // modify等DDL事件的内容
+}
+
+// 通过hello（4.4.2以下版本为isMaster）返回的$clusterTime获取源端当前的时间点
+func latestClusterTime(srcMongo *MongoArgs) (primitive.Timestamp, error) {
+	adminDb := srcMongo.Client().Database("admin")
+	var res bson.Raw
+	err := doWithRetry(srcMongo.Context(), commandTimeout, "hello", func(ctx context.Context) error {
+		var err error
+		res, err = adminDb.RunCommand(ctx, bson.D{{"hello", 1}}).DecodeBytes()
+		if err != nil {
+			res, err = adminDb.RunCommand(ctx, bson.D{{"isMaster", 1}}).DecodeBytes()
+		}
+		return err
+	})
+	if err != nil {
+		return primitive.Timestamp{}, err
+	}
+	t, i, ok := res.Lookup("$clusterTime", "clusterTime").TimestampOK()
+	if !ok {
+		return primitive.Timestamp{}, errors.New("hello未返回$clusterTime，源端需要为3.6及以上版本的副本集或分片集群")
+	}
+	return primitive.Timestamp{T: t, I: i}, nil
+}
+
+// 将change stream事件转换为等价的oplog，第二个返回值为false表示该事件不需要重放
+func changeEventToOplog(ctx context.Context, srcMongo *MongoArgs, event *changeEvent) (OPLOG, bool) {
+	oplog := OPLOG{TS: event.ClusterTime, NS: event.Ns.Db + "." + event.Ns.Coll}
+	var id interface{}
+	if len(event.DocumentKey) > 0 {
+		id = event.DocumentKey.Map()["_id"]
+	}
+	switch event.OperationType {
+	case "insert":
+		oplog.OP, oplog.O = "i", event.FullDocument
+	case "update", "replace":
+		// 不使用updateLookup时，update事件按updateDescription中修改和删除的字段更新
+		if event.OperationType == "update" && !changeStreamUpdateLookup {
+			if len(event.UpdateDescription.TruncatedArrays) > 0 {
+				// 数组被截短（5.0+）无法用字段修改表示，从源端读取当前的完整文档进行替换
+				event.FullDocument = lookupChangedDoc(ctx, srcMongo, event, id)
+			} else {
+				update := bson.D{}
+				if len(event.UpdateDescription.UpdatedFields) > 0 {
+					update = append(update, bson.E{"$set", event.UpdateDescription.UpdatedFields})
+				}
+				if len(event.UpdateDescription.RemovedFields) > 0 {
+					unset := bson.D{}
+					for _, field := range event.UpdateDescription.RemovedFields {
+						unset = append(unset, bson.E{field, ""})
+					}
+					update = append(update, bson.E{"$unset", unset})
+				}
+				if len(update) == 0 {
+					return oplog, false
+				}
+				oplog.OP, oplog.O2, oplog.O = "u", bson.D{{"_id", id}}, update
+				return oplog, true
+			}
+		}
+		// 使用updateLookup获取的当前完整文档进行替换。文档已经被删除时跳过，之后的delete事件会删除目标端的文档
+		if event.FullDocument == nil {
+			return oplog, false
+		}
+		oplog.OP, oplog.O2, oplog.O = "u", bson.D{{"_id", id}}, event.FullDocument
+	case "delete":
+		oplog.OP, oplog.O = "d", bson.D{{"_id", id}}
+	case "drop":
+		oplog.OP, oplog.NS, oplog.O = "c", event.Ns.Db+".$cmd", bson.D{{"drop", event.Ns.Coll}}
+	case "dropDatabase":
+		oplog.OP, oplog.NS, oplog.O = "c", event.Ns.Db+".$cmd", bson.D{{"dropDatabase", 1}}
+	case "modify":
+		// 6.0+的expanded events，operationDescription中为collMod修改的内容
+		oplog.OP, oplog.NS = "c", event.Ns.Db+".$cmd"
+		oplog.O = append(bson.D{{"collMod", event.Ns.Coll}}, event.OperationDescription...)
+	case "rename":
+		// 事件中没有dropTarget，目标集合存在时源端已经将其替换
+		oplog.OP, oplog.NS = "c", event.Ns.Db+".$cmd"
+		oplog.O = bson.D{{"renameCollection", event.Ns.Db + "." + event.Ns.Coll}, {"to", event.To.Db + "." + event.To.Coll}, {"dropTarget", true}}
+	default:
+		return oplog, false
+	}
+	return oplog, true
+}
+
+// 从源端读取change stream事件对应的当前文档，文档已经被删除时返回nil
+func lookupChangedDoc(ctx context.Context, srcMongo *MongoArgs, event *changeEvent, id interface{}) bson.D {
+	coll := srcMongo.Client().Database(event.Ns.Db).Collection(event.Ns.Coll)
+	var doc bson.D
+	err := doWithRetry(ctx, findTimeout, "findOne "+event.Ns.Db+"."+event.Ns.Coll, func(ctx context.Context) error {
+		return coll.FindOne(ctx, bson.D{{"_id", id}}).Decode(&doc)
+	})
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			loggerFrom(ctx).Warn("读取change stream事件对应的文档失败", zap.String("NS", event.Ns.Db+"."+event.Ns.Coll), zap.Error(err))
+		}
+		return nil
+	}
+	return doc
+}
+
+// 通过change stream重放startTS之后的变更，endTS不为空时重放到endTS为止。
+// --change_stream_scope为cluster时打开一个集群级别的change stream，db、collection时每个库或集合打开一个change stream并发重放，
+// 只需要这些库或集合的changeStream权限。中断后使用最后处理的事件的resume token继续
+func CustWatchChangeStream(srcMongo, dstMongo *MongoArgs, startTS, endTS primitive.Timestamp, nsSlice []string, nsnsMap map[string]string) {
+	// 只读取需要同步的库的变更
+	var dbs []string
+	dbSet := make(map[string]bool)
+	for _, ns := range nsSlice {
+		db := CustFilter(ns, nil).SrcDb
+		if !dbSet[db] {
+			dbSet[db] = true
+			dbs = append(dbs, db)
+		}
+	}
+	// 库中开始时没有匹配的集合，之后新建的集合也可能与模式匹配
+	if replayNsMatcher != nil {
+		for db := range replayNsMatcher.dbs {
+			if !dbSet[db] {
+				dbSet[db] = true
+				dbs = append(dbs, db)
+			}
+		}
+	}
+	srcClient := srcMongo.Client()
+	var streams []changeStreamSource
+	switch changeStreamScope {
+	case ChangeStreamScopeDb:
+		for _, db := range dbs {
+			streams = append(streams, changeStreamSource{name: db, watch: srcClient.Database(db).Watch})
+		}
+	case ChangeStreamScopeCollection:
+		if replayNsMatcher != nil {
+			srcMongo.logger().Warn("集合级别的change stream不会读取同步开始后新建的集合的变更")
+		}
+		for _, ns := range nsSlice {
+			nsStruct := CustFilter(ns, nil)
+			streams = append(streams, changeStreamSource{name: ns, watch: srcClient.Database(nsStruct.SrcDb).Collection(nsStruct.SrcColl).Watch})
+		}
+	default:
+		pipeline := mongo.Pipeline{{{"$match", bson.D{{"ns.db", bson.D{{"$in", dbs}}}}}}}
+		streams = append(streams, changeStreamSource{name: "cluster", pipeline: pipeline, watch: srcClient.Watch})
+	}
+	startOfflineBuffer(dstMongo)
+	defer waitOfflineBuffer(dstMongo)
+	var wg sync.WaitGroup
+	for _, source := range streams {
+		wg.Add(1)
+		go func(source changeStreamSource) {
+			defer wg.Done()
+			watchChangeStream(srcMongo, dstMongo, source, startTS, endTS, nsSlice, nsnsMap)
+		}(source)
+	}
+	wg.Wait()
+}
+
+// 一个change stream的来源：集群、库或集合
+type changeStreamSource struct {
+	name     string
+	pipeline mongo.Pipeline
+	watch    func(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (*mongo.ChangeStream, error)
+}
+
+// 从一个change stream读取并重放变更
+func watchChangeStream(srcMongo, dstMongo *MongoArgs, source changeStreamSource, startTS, endTS primitive.Timestamp, nsSlice []string, nsnsMap map[string]string) {
+	srcCtx := srcMongo.Context()
+	dstCtx := dstMongo.Context()
+	logger := srcMongo.logger().With(zap.String("stream", source.name))
+	pipeline := source.pipeline
+	if pipeline == nil {
+		pipeline = mongo.Pipeline{}
+	}
+	streamOpts := options.ChangeStream().SetStartAtOperationTime(&startTS)
+	if changeStreamUpdateLookup {
+		streamOpts.SetFullDocument(options.UpdateLookup)
+	}
+	// 6.0+返回collMod对应的modify事件
+	if info, err := srcMongo.ServerInfo(); err == nil && info.AtLeast(6, 0) {
+		streamOpts.SetShowExpandedEvents(true)
+	}
+	// 重新启动时从保存的resume token继续
+	tracker := newResumeTokenTracker(srcMongo, dstMongo, source)
+	if token := tracker.resumeToken(startTS); token != nil {
+		streamOpts.SetStartAtOperationTime(nil)
+		streamOpts.SetResumeAfter(token)
+	}
+
+	var stream *mongo.ChangeStream
+	openStream := func() error {
+		return doWithRetry(srcCtx, findTimeout, "watch "+source.name, func(ctx context.Context) error {
+			var err error
+			stream, err = source.watch(ctx, pipeline, streamOpts)
+			return err
+		})
+	}
+	if err := openStream(); err != nil {
+		log.Fatalln("打开change stream失败：", err)
+	}
+	defer func() { stream.Close(context.Background()) }()
+
+	var (
+		lastTS     primitive.Timestamp
+		appliedNum int64
+		lastReport = time.Now()
+		bounded    = endTS.T != 0 || endTS.I != 0
+	)
+	apply := func(event *changeEvent) {
+		oplog, ok := changeEventToOplog(srcCtx, srcMongo, event)
+		if !ok {
+			return
+		}
+		dstDbName, dstCollName := CustGetOplogNs(oplog)
+		if !containsOplogNs(fmt.Sprintf("%s.%s", dstDbName, dstCollName), nsSlice) {
+			return
+		}
+		nsStruct := CustFilter(fmt.Sprintf("%s.%s", dstDbName, dstCollName), nsnsMap)
+		oplog = mapDDLOplog(nsStruct, oplog, nsnsMap)
+		appliedNum++
+		dstWriteLimiter.wait(dstCtx, 1, int64(len(stream.Current)))
+		if err := applyOrBuffer(dstMongo, nsStruct, oplog); err != nil {
+			log.Println(fmt.Sprintf("change stream执行'%s'操作失败：", event.OperationType), err, "\t事件内容：", truncateDoc(stream.Current.String()))
+			notifyProgress(func(listener ProgressListener) { listener.OnError(oplog.NS, err) })
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		for {
+			if !stream.TryNext(srcCtx) {
+				if stream.Err() != nil {
+					break
+				}
+				// 没有新的事件：库或集合没有变更时，通过resume token中的时间点判断是否已经到达endTS
+				tracker.idle(stream.ResumeToken(), lastTS)
+				if ts, ok := resumeTokenTime(stream.ResumeToken()); bounded && ok && primitive.CompareTimestamp(ts, endTS) > 0 {
+					return
+				}
+				continue
+			}
+			attempt = 1
+			var event changeEvent
+			if err := stream.Decode(&event); err != nil {
+				log.Fatal(err)
+			}
+			if bounded && primitive.CompareTimestamp(event.ClusterTime, endTS) > 0 {
+				return
+			}
+			lastTS = event.ClusterTime
+			if time.Since(lastReport) >= replayProgressInterval {
+				lastReport = time.Now()
+				lag := time.Now().Unix() - int64(lastTS.T)
+				if lag < 0 {
+					lag = 0
+				}
+				logger.Info("change stream重放进度", zap.Uint32("T", lastTS.T), zap.Uint32("I", lastTS.I), zap.Int64("lagSeconds", lag), zap.Int64("appliedNum", appliedNum))
+				logDeleteStats(logger)
+			}
+			if event.OperationType == "invalidate" {
+				if changeStreamScope == ChangeStreamScopeCluster {
+					log.Fatalln("change stream已失效（invalidate），请重新进行全量同步")
+				}
+				// 库或集合被删除、重命名后change stream失效，从失效事件之后重新打开，之后重新创建的库或集合继续同步（4.2+）
+				logger.Warn("change stream已失效（invalidate），重新打开", zap.Uint32("T", lastTS.T), zap.Uint32("I", lastTS.I))
+				stream.Close(context.Background())
+				streamOpts.SetStartAtOperationTime(nil)
+				streamOpts.SetResumeAfter(nil)
+				streamOpts.SetStartAfter(event.ID)
+				if err := openStream(); err != nil {
+					log.Fatalln("重新打开change stream失败：", err)
+				}
+				// 失效事件的token只能用于startAfter，不保存
+				tracker.skipToken(event.ID)
+				continue
+			}
+			apply(&event)
+			tracker.processed(stream.ResumeToken(), event.ClusterTime)
+		}
+		err := stream.Err()
+		stream.Close(context.Background())
+		if !isRetryableError(srcCtx, err) || !retryWait(srcCtx, attempt, "读取change stream", err) {
+			log.Fatalln("读取change stream失败：", err)
+		}
+		// 从最后处理的事件之后继续；还没有读取到事件时沿用startTS
+		if token := stream.ResumeToken(); token != nil {
+			streamOpts.SetStartAtOperationTime(nil)
+			streamOpts.SetStartAfter(nil)
+			streamOpts.SetResumeAfter(token)
+		}
+		if err := openStream(); err != nil {
+			log.Fatalln("重新打开change stream失败：", err)
+		}
+		logger.Info("重新打开change stream", zap.Uint32("T", lastTS.T), zap.Uint32("I", lastTS.I))
+	}
+}
+
+// resume token中的时间点：4.0.7以上版本的token为{_data: <十六进制字符串>}，以0x82开头时之后的8个字节为clusterTime
+func resumeTokenTime(token bson.Raw) (primitive.Timestamp, bool) {
+	data, ok := token.Lookup("_data").StringValueOK()
+	if !ok || len(data) < 18 || !strings.HasPrefix(data, "82") {
+		return primitive.Timestamp{}, false
+	}
+	b, err := hex.DecodeString(data[2:18])
+	if err != nil {
+		return primitive.Timestamp{}, false
+	}
+	return primitive.Timestamp{T: binary.BigEndian.Uint32(b[:4]), I: binary.BigEndian.Uint32(b[4:])}, true
+}
+
+// 检查是否可以在源端打开change stream
+func checkChangeStream(srcMongo *MongoArgs) error {
+	return doWithRetry(srcMongo.Context(), findTimeout, "watch", func(ctx context.Context) error {
+		stream, err := srcMongo.Client().Watch(ctx, mongo.Pipeline{})
+		if err != nil {
+			return err
+		}
+		return stream.Close(ctx)
+	})
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// 同步进度文档的格式版本。
+// 修改格式时：递增checkpointVersion，并在checkpointMigrations中增加从上一个版本迁移的函数；
+// 如果旧版本的mongosync无法正确读取新格式，同时将checkpointMinReaderVersion设置为新版本
+const (
+	checkpointVersion          = 4
+	checkpointMinReaderVersion = 1
+)
+
+// 同步进度文档
+//
+//	版本1（未记录version字段）：{_id, ts, updateTime}
+//	版本2：增加version、minReaderVersion和oplogNs字段
+//	版本3：增加startTs字段
+//	版本4：增加resumeToken字段，用于change stream的进度
+type Checkpoint struct {
+	ID               string              `bson:"_id"`
+	Version          int                 `bson:"version"`
+	MinReaderVersion int                 `bson:"minReaderVersion"`      // 能够读取该文档的最低mongosync进度格式版本
+	TS               primitive.Timestamp `bson:"ts"`                    // 最后一条已处理的oplog的ts
+	OplogNs          string              `bson:"oplogNs"`               // oplog的来源集合
+	StartTS          primitive.Timestamp `bson:"startTs,omitempty"`     // CustSyncOplog最初开始同步的位置，--replayoplog从该位置开始重放
+	ResumeToken      bson.Raw            `bson:"resumeToken,omitempty"` // change stream最后处理的位置，ts为该位置的时间点
+	UpdateTime       time.Time           `bson:"updateTime"`
+}
+
+// checkpointMigrations[v]将版本v的同步进度文档迁移为版本v+1
+var checkpointMigrations = map[int]func(doc bson.M){
+	1: func(doc bson.M) {
+		// 版本1只用于CustSyncOplog，oplog固定来自local.oplog.rs
+		doc["oplogNs"] = "local.oplog.rs"
+		doc["minReaderVersion"] = 1
+	},
+	2: func(doc bson.M) {
+		// 版本2没有记录最初开始同步的位置，startTs为空
+	},
+	3: func(doc bson.M) {
+		// 版本3只用于oplog，没有resumeToken
+	},
+}
+
+// 读取同步进度，旧版本的文档会自动迁移为当前版本并写回。不存在时返回nil
+func loadCheckpoint(ctx context.Context, coll *mongo.Collection, id string) (*Checkpoint, error) {
+	var doc bson.M
+	findCtx, cancel := withTimeout(ctx, findTimeout)
+	err := coll.FindOne(findCtx, bson.M{"_id": id}).Decode(&doc)
+	cancel()
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	version := 1
+	if value, exists := doc["version"]; exists {
+		switch v := value.(type) {
+		case int32:
+			version = int(v)
+		case int64:
+			version = int(v)
+		default:
+			return nil, fmt.Errorf("同步进度%s的version字段类型错误：%T", id, value)
+		}
+	}
+	if version > checkpointVersion {
+		// 更新版本的mongosync写入的文档，只要声明兼容当前版本即可读取，多出来的字段忽略
+		minReaderVersion, _ := doc["minReaderVersion"].(int32)
+		if int(minReaderVersion) > checkpointVersion {
+			return nil, fmt.Errorf("同步进度%s由更新版本的mongosync写入（格式版本%d，至少需要%d），请升级mongosync", id, version, minReaderVersion)
+		}
+	}
+	migrated := version < checkpointVersion
+	for ; version < checkpointVersion; version++ {
+		checkpointMigrations[version](doc)
+	}
+	if migrated {
+		doc["version"] = checkpointVersion
+		writeCtx, cancel := withTimeout(ctx, writeTimeout)
+		_, err := coll.ReplaceOne(writeCtx, bson.M{"_id": id}, doc)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("同步进度%s迁移为格式版本%d失败：%v", id, checkpointVersion, err)
+		}
+		loggerFrom(ctx).Info("同步进度已迁移为当前格式版本", zap.String("id", id), zap.Int("version", checkpointVersion))
+	}
+
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var checkpoint Checkpoint
+	if err := bson.Unmarshal(raw, &checkpoint); err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+// 保存同步进度，写入当前的格式版本
+func saveCheckpoint(ctx context.Context, coll *mongo.Collection, checkpoint *Checkpoint) error {
+	checkpoint.Version = checkpointVersion
+	checkpoint.MinReaderVersion = checkpointMinReaderVersion
+	checkpoint.UpdateTime = time.Now()
+	return doWithRetry(ctx, writeTimeout, "saveCheckpoint", func(ctx context.Context) error {
+		_, err := coll.ReplaceOne(ctx, bson.M{"_id": checkpoint.ID}, checkpoint, options.Replace().SetUpsert(true))
+		return err
+	})
+}
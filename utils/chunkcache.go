@@ -0,0 +1,282 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// chunk缓存保存在目标实例的mongosync.chunk_cache集合中
+const (
+	mongosyncDbName    = "mongosync"
+	chunkCacheCollName = "chunk_cache"
+)
+
+var (
+	chunkCacheEnabled = false // 是否启用chunk缓存
+	chunkSize         = 1000  // chunk的平均文档数
+)
+
+// 设置是否启用chunk缓存以及chunk的平均文档数。
+// 启用后按_id顺序读取源集合，并以_id的哈希值切分chunk（内容定义切分，插入或删除文档只影响所在的chunk），
+// 对每个chunk的内容计算sha256，与上一次同步时记录的哈希值相同的chunk直接跳过，不再写入目标端
+func SetChunkCache(enabled bool, size int) {
+	chunkCacheEnabled = enabled
+	if size > 0 {
+		chunkSize = size
+	}
+}
+
+// mongosync.chunk_cache中的文档
+type chunkCacheEntry struct {
+	ID    primitive.ObjectID `bson:"_id,omitempty"`
+	NS    string             `bson:"ns"`
+	Min   bson.RawValue      `bson:"min"`
+	Max   bson.RawValue      `bson:"max"`
+	Hash  string             `bson:"hash"`
+	Count int                `bson:"count"`
+}
+
+// chunk在缓存中的key，由_id的上下界唯一确定
+func chunkKey(min, max bson.RawValue) string {
+	return fmt.Sprintf("%x:%x:%x:%x", byte(min.Type), min.Value, byte(max.Type), max.Value)
+}
+
+// 判断_id是否为chunk的边界：_id哈希值对chunkSize取模为0
+func isChunkBoundary(id bson.RawValue) bool {
+	h := fnv.New32a()
+	h.Write([]byte{byte(id.Type)})
+	h.Write(id.Value)
+	return h.Sum32()%uint32(chunkSize) == 0
+}
+
+// 基于chunk缓存同步集合，返回写入的文档数和因chunk未变化而跳过的文档数。
+// 内容发生变化或目标端文档数不一致的chunk使用覆盖的方式写入，并删除目标端该chunk的_id范围内源端已经不存在的文档。
+// srcCtx、dstCtx分别为源端和目标端操作的上下文
+func custSyncCollectionByChunk(srcCtx, dstCtx context.Context, srcColl, dstColl *mongo.Collection) (int64, int64) {
+	ns := dstColl.Database().Name() + "." + dstColl.Name()
+	cacheColl := dstColl.Database().Client().Database(mongosyncDbName).Collection(chunkCacheCollName)
+	indexmodel := mongo.IndexModel{Keys: bson.D{{"ns", 1}}, Options: options.Index().SetName("ns_1")}
+	opCtx, cancel := withTimeout(dstCtx, commandTimeout)
+	_, err := cacheColl.Indexes().CreateOne(opCtx, indexmodel)
+	cancel()
+	if err != nil {
+		loggerFrom(srcCtx).Fatal("创建chunk缓存索引失败", zap.Error(err))
+	}
+
+	// 加载该ns上一次同步的chunk缓存
+	cached := make(map[string]chunkCacheEntry)
+	opCtx, cancel = withTimeout(dstCtx, findTimeout)
+	cacheCur, err := cacheColl.Find(opCtx, bson.M{"ns": ns})
+	cancel()
+	if err != nil {
+		loggerFrom(srcCtx).Fatal("加载chunk缓存失败", zap.String("NS", ns), zap.Error(err))
+	}
+	for cursorNext(dstCtx, cacheCur, false) {
+		var entry chunkCacheEntry
+		if err := cacheCur.Decode(&entry); err != nil {
+			loggerFrom(srcCtx).Fatal("解析chunk缓存失败", zap.String("NS", ns), zap.Error(err))
+		}
+		cached[chunkKey(entry.Min, entry.Max)] = entry
+	}
+	if err := cacheCur.Err(); err != nil {
+		loggerFrom(srcCtx).Fatal("加载chunk缓存失败", zap.String("NS", ns), zap.Error(err))
+	}
+	cacheCur.Close(context.Background())
+
+	// 按_id顺序读取源集合，保证每次同步的chunk切分结果一致
+	findOpts := limitCursorBatch(options.Find())
+	findOpts.SetSort(bson.D{{"_id", 1}})
+	findOpts.SetNoCursorTimeout(true)
+	opCtx, cancel = withTimeout(srcCtx, findTimeout)
+	srcNs := srcColl.Database().Name() + "." + srcColl.Name()
+	if p := projectionFor(srcNs); p != nil {
+		findOpts.SetProjection(p.spec)
+	}
+	cur, err := srcColl.Find(opCtx, withNsFilter(srcNs, bson.M{}), findOpts)
+	cancel()
+	if err != nil {
+		loggerFrom(srcCtx).Fatal("读取源集合失败", zap.String("NS", ns), zap.Error(err))
+	}
+	defer cur.Close(context.Background())
+
+	var (
+		copiedNum, skippedNum int64
+		docs, ids             []interface{}
+		chunkBytes            int64
+		minId, maxId          bson.RawValue
+		seen                  = make(map[string]bool)
+		hash                  = sha256.New()
+		sizes                 = newDocSizeHistogram(srcColl.Database().Name() + "." + srcColl.Name())
+	)
+	// 上一个chunk的_id上界。每个chunk负责目标端(prevMax, maxId]范围内的文档，第一个chunk不限制下界，
+	// 最后一个chunk之后的文档在读取完源集合后删除，因此chunk之间的空隙、已经整体删除的chunk中的文档都会被清理
+	var prevMax bson.RawValue
+	flush := func() {
+		if len(docs) == 0 {
+			return
+		}
+		key := chunkKey(minId, maxId)
+		sum := hex.EncodeToString(hash.Sum(nil))
+		seen[key] = true
+		unchanged := false
+		if entry, exists := cached[key]; exists && entry.Hash == sum && entry.Count == len(docs) {
+			// 缓存只说明源端没有变化，目标端的文档可能在上一次同步之后被删除或写入，范围内的文档数一致时才跳过
+			var dstCount int64
+			err := doWithRetry(dstCtx, findTimeout, "count "+ns, func(ctx context.Context) error {
+				var err error
+				dstCount, err = dstColl.CountDocuments(ctx, withNsFilter(srcNs, bson.M{"_id": idRangeCond(prevMax, maxId)}))
+				return err
+			})
+			if err != nil {
+				loggerFrom(srcCtx).Fatal("统计目标端chunk的文档数失败", zap.String("NS", ns), zap.Error(err))
+			}
+			unchanged = dstCount == int64(len(docs))
+			if !unchanged {
+				loggerFrom(srcCtx).Info("目标端chunk的文档数与源端不一致，重新写入", zap.String("NS", ns), zap.Int("count", len(docs)), zap.Int64("dstCount", dstCount))
+			}
+		}
+		if unchanged {
+			skippedNum += int64(len(docs))
+		} else {
+			dstWriteLimiterFor(srcNs).wait(dstCtx, int64(len(docs)), chunkBytes)
+			sucessNum, failNum := CustInsertMany(dstCtx, dstColl, docs, ConflictOverwrite)
+			if failNum != 0 {
+				loggerFrom(srcCtx).Fatal("insert data err！")
+			}
+			copiedNum += sucessNum
+			// 源端已经删除的文档。指定了过滤条件时只删除目标端满足条件的文档
+			cond := idRangeCond(prevMax, maxId)
+			cond["$nin"] = ids
+			opCtx, cancel := withTimeout(dstCtx, writeTimeout)
+			_, err := dstColl.DeleteMany(opCtx, withNsFilter(srcNs, bson.M{"_id": cond}))
+			cancel()
+			if err != nil {
+				loggerFrom(srcCtx).Fatal("删除目标端多余的文档失败", zap.String("NS", ns), zap.Error(err))
+			}
+			update := bson.M{"$set": bson.M{"hash": sum, "count": len(docs), "updateTime": time.Now()}}
+			filter := bson.M{"ns": ns, "min": minId, "max": maxId}
+			opCtx, cancel = withTimeout(dstCtx, writeTimeout)
+			_, err = cacheColl.UpdateOne(opCtx, filter, update, options.Update().SetUpsert(true))
+			cancel()
+			if err != nil {
+				loggerFrom(srcCtx).Error("更新chunk缓存失败", zap.String("NS", ns), zap.Error(err))
+			}
+		}
+		prevMax = maxId
+		docs, ids, chunkBytes = nil, nil, 0
+		hash.Reset()
+	}
+
+	for cursorNext(srcCtx, cur, false) {
+		id, err := cur.Current.LookupErr("_id")
+		if err != nil {
+			loggerFrom(srcCtx).Fatal("文档缺少_id字段", zap.String("NS", ns), zap.String("doc", truncateDoc(cur.Current.String())))
+		}
+		id.Value = append([]byte(nil), id.Value...) // cur.Current在读取下一条文档后失效
+		doc := make(bson.Raw, len(cur.Current))
+		copy(doc, cur.Current)
+		if len(docs) == 0 {
+			minId = id
+		}
+		maxId = id
+		hash.Write(cur.Current)
+		sizes.add(int64(len(cur.Current)))
+		addCopiedBytes(int64(len(cur.Current)))
+		srcReadLimiterFor(srcNs).wait(srcCtx, 1, int64(len(cur.Current)))
+		chunkBytes += int64(len(cur.Current))
+		docs = append(docs, doc)
+		ids = append(ids, id)
+		// 以_id的哈希值作为边界，同时限制chunk的最大文档数
+		if isChunkBoundary(id) || len(docs) >= 4*chunkSize {
+			flush()
+		}
+	}
+	if err := cur.Err(); err != nil {
+		loggerFrom(srcCtx).Fatal("读取源集合失败", zap.String("NS", ns), zap.Error(err))
+	}
+	flush()
+	mergeDocSizeHistogram(srcCtx, sizes)
+
+	// 最后一个chunk之后的文档在源端已经删除，源集合为空时删除目标端的全部文档
+	opCtx, cancel = withTimeout(dstCtx, writeTimeout)
+	_, err = dstColl.DeleteMany(opCtx, withNsFilter(srcNs, bson.M{"_id": idRangeCond(prevMax, bson.RawValue{})}))
+	cancel()
+	if err != nil {
+		loggerFrom(srcCtx).Fatal("删除目标端多余的文档失败", zap.String("NS", ns), zap.Error(err))
+	}
+
+	// 清理本次同步中已经不存在的chunk：先删除目标端该chunk范围内源端已经不存在的文档，再删除缓存
+	var stale []primitive.ObjectID
+	for key, entry := range cached {
+		if seen[key] {
+			continue
+		}
+		deleteStaleChunk(srcCtx, dstCtx, srcColl, dstColl, entry)
+		stale = append(stale, entry.ID)
+	}
+	if len(stale) > 0 {
+		opCtx, cancel := withTimeout(dstCtx, writeTimeout)
+		_, err := cacheColl.DeleteMany(opCtx, bson.M{"_id": bson.M{"$in": stale}})
+		cancel()
+		if err != nil {
+			loggerFrom(srcCtx).Error("清理chunk缓存失败", zap.String("NS", ns), zap.Error(err))
+		}
+	}
+	loggerFrom(srcCtx).Info("基于chunk缓存同步集合完成", zap.String("NS", ns), zap.Int64("copiedNum", copiedNum), zap.Int64("skippedNum", skippedNum))
+	return copiedNum, skippedNum
+}
+
+// _id在(lower, upper]范围内的查询条件，lower为空时不限制下界，upper为空时不限制上界
+func idRangeCond(lower, upper bson.RawValue) bson.M {
+	cond := bson.M{}
+	if lower.Type != 0 {
+		cond["$gt"] = lower
+	}
+	if upper.Type != 0 {
+		cond["$lte"] = upper
+	}
+	if len(cond) == 0 {
+		cond["$exists"] = true
+	}
+	return cond
+}
+
+// 删除目标端已经不存在的chunk的[min, max]范围内、源端当前没有的文档。
+// 该范围可能与本次同步的chunk重叠，只删除源端不存在的_id，不影响本次已经写入的文档
+func deleteStaleChunk(srcCtx, dstCtx context.Context, srcColl, dstColl *mongo.Collection, entry chunkCacheEntry) {
+	srcNs := srcColl.Database().Name() + "." + srcColl.Name()
+	rangeCond := bson.M{"$gte": entry.Min, "$lte": entry.Max}
+	findOpts := limitCursorBatch(options.Find()).SetProjection(bson.M{"_id": 1})
+	opCtx, cancel := withTimeout(srcCtx, findTimeout)
+	cur, err := srcColl.Find(opCtx, withNsFilter(srcNs, bson.M{"_id": rangeCond}), findOpts)
+	cancel()
+	if err != nil {
+		loggerFrom(srcCtx).Fatal("读取源集合失败", zap.String("NS", srcNs), zap.Error(err))
+	}
+	defer cur.Close(context.Background())
+	ids := []interface{}{} // $nin不能为null
+	for cursorNext(srcCtx, cur, false) {
+		id := cur.Current.Lookup("_id")
+		id.Value = append([]byte(nil), id.Value...)
+		ids = append(ids, id)
+	}
+	if err := cur.Err(); err != nil {
+		loggerFrom(srcCtx).Fatal("读取源集合失败", zap.String("NS", srcNs), zap.Error(err))
+	}
+	opCtx, cancel = withTimeout(dstCtx, writeTimeout)
+	_, err = dstColl.DeleteMany(opCtx, withNsFilter(srcNs, bson.M{"_id": bson.M{"$gte": entry.Min, "$lte": entry.Max, "$nin": ids}}))
+	cancel()
+	if err != nil {
+		loggerFrom(srcCtx).Fatal("删除目标端多余的文档失败", zap.String("NS", entry.NS), zap.Error(err))
+	}
+}
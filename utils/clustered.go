@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+// 聚簇集合（clustered collection，5.3+）：文档按聚簇键（目前只能为{_id: 1}）顺序存储，没有单独的_id索引。
+// 目标端的集合在插入数据时会被隐式创建为普通集合，因此需要先使用create命令按源端的clusteredIndex选项显式创建（见collopts.go）。
+// 聚簇键就是_id，写入目标端时按_id进行upsert的逻辑不需要改变
+
+// 源端集合的聚簇选项
+type clusteredOptions struct {
+	ClusteredIndex     bson.D        `bson:"clusteredIndex"`
+	ExpireAfterSeconds bson.RawValue `bson:"expireAfterSeconds"` // 聚簇集合的TTL，基于聚簇键中的时间
+}
+
+// 获取源端集合的聚簇选项，不是聚簇集合时返回nil
+func getClusteredOptions(srcMongo *MongoArgs, dbName, collName string) (*clusteredOptions, error) {
+	spec, err := srcMongo.collectionSpec(dbName, collName)
+	if err != nil || spec == nil || len(spec.Options) == 0 {
+		return nil, err
+	}
+	var options clusteredOptions
+	if err := bson.Unmarshal(spec.Options, &options); err != nil {
+		return nil, err
+	}
+	if len(options.ClusteredIndex) == 0 {
+		return nil, nil
+	}
+	return &options, nil
+}
+
+// 聚簇集合在create命令中的选项。目标端版本不支持聚簇集合时返回nil，创建为普通集合
+func clusteredCreateOptions(dstMongo *MongoArgs, ns string, clustered *clusteredOptions) bson.D {
+	if dstInfo, err := dstMongo.ServerInfo(); err == nil && !dstInfo.FeatureAtLeast(5, 3) {
+		dstMongo.logger().Warn("目标端版本不支持聚簇集合，创建为普通集合", zap.String("NS", ns), zap.String("dstVersion", dstInfo.String()))
+		return nil
+	}
+	// clusteredIndex中的v由服务端生成，创建时不能指定
+	var index bson.D
+	for _, e := range clustered.ClusteredIndex {
+		if e.Key != "v" {
+			index = append(index, e)
+		}
+	}
+	opts := bson.D{{"clusteredIndex", index}}
+	if clustered.ExpireAfterSeconds.Type != 0 {
+		opts = append(opts, bson.E{"expireAfterSeconds", clustered.ExpireAfterSeconds})
+	}
+	return opts
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// collMod在oplog中为c类型的命令，o为源端执行的collMod，o2（4.4+）中为修改前的值，例如：
+//
+//	{"op" : "c", "ns" : "GlobalDB.$cmd", "o" : { "collMod" : "GlobalService", "index" : { "name" : "createTime_1", "expireAfterSeconds" : 3600 } }, "o2" : { "expireAfterSeconds_old" : 7200 }}
+//	{"op" : "c", "ns" : "GlobalDB.$cmd", "o" : { "collMod" : "GlobalService", "validator" : {...}, "validationLevel" : "strict", "validationAction" : "error" }}
+//	{"op" : "c", "ns" : "GlobalDB.$cmd", "o" : { "collMod" : "GlobalView", "viewOn" : "GlobalService", "pipeline" : [...] }}
+//
+// 重放时在映射后的目标集合执行（视图引用的集合同样映射，见mapDDLOplog），只保留collModOptions中的字段，
+// 早期版本的usePowerOf2Sizes等已经废弃的选项不重放。6.0+的change stream中为modify事件，operationDescription中为修改的内容
+var collModOptions = map[string]bool{
+	"index":                        true, // TTL索引的expireAfterSeconds、hidden等
+	"expireAfterSeconds":           true, // 聚簇集合、时间序列集合的TTL
+	"validator":                    true,
+	"validationLevel":              true,
+	"validationAction":             true,
+	"viewOn":                       true,
+	"pipeline":                     true,
+	"cappedSize":                   true,
+	"cappedMax":                    true,
+	"timeseries":                   true,
+	"recordPreImages":              true,
+	"changeStreamPreAndPostImages": true,
+}
+
+// 在目标端执行collMod，cmd中的集合名已经映射为目标集合
+func applyCollMod(ctx context.Context, dstDb *mongo.Database, cmd bson.D) error {
+	mod := bson.D{cmd[0]}
+	for _, e := range cmd[1:] {
+		if collModOptions[e.Key] {
+			mod = append(mod, e)
+		} else {
+			loggerFrom(ctx).Warn("collMod中的选项不重放", zap.String("NS", fmt.Sprintf("%s.%v", dstDb.Name(), cmd[0].Value)), zap.String("option", e.Key))
+		}
+	}
+	if len(mod) == 1 {
+		return nil
+	}
+	err := doWithRetry(ctx, commandTimeout, "collMod", func(ctx context.Context) error {
+		return dstDb.RunCommand(ctx, mod).Err()
+	})
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == 27 { // IndexNotFound：目标集合中没有要修改的索引
+		return fmt.Errorf("目标集合%s.%v中没有collMod修改的索引%v，请检查索引是否已经同步：%v", dstDb.Name(), cmd[0].Value, mod.Map()["index"], err)
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// 目标端的集合在插入数据时会被隐式创建为默认选项的集合，源端集合的固定集合（capped）、默认排序规则（collation）、
+// 文档校验规则（validator）等属性会丢失。因此在复制数据之前，按源端listCollections返回的选项使用create命令显式创建目标集合
+
+// 全量复制时是否跳过目标集合的文档校验规则。源端validationLevel为moderate时可能存在不满足规则的历史文档，
+// 按validator创建目标集合后这些文档会写入失败
+var bypassValidation bool
+
+// 设置全量复制时是否跳过目标集合的文档校验规则
+func SetBypassDocumentValidation(bypass bool) {
+	bypassValidation = bypass
+}
+
+// 按原样复制到create命令中的集合选项
+var copiedCollOptions = []string{"capped", "size", "max", "collation", "validator", "validationLevel", "validationAction"}
+
+// 在目标端按源端集合的选项创建集合，目标集合已经存在时沿用已有的集合。返回源端是否为聚簇集合、固定集合
+func syncCollectionOptions(srcMongo *MongoArgs, srcDbName, srcCollName string, dstMongo *MongoArgs, dstDbName, dstCollName string) (clustered, capped bool) {
+	ns := dstDbName + "." + dstCollName
+	spec, err := srcMongo.collectionSpec(srcDbName, srcCollName)
+	if err != nil {
+		srcMongo.logger().Warn("获取源端集合选项失败，按默认选项创建", zap.String("NS", srcDbName+"."+srcCollName), zap.Error(err))
+		return false, false
+	}
+	if spec == nil || len(spec.Options) == 0 {
+		return false, false
+	}
+	capped, _ = spec.Options.Lookup("capped").BooleanOK()
+
+	var opts bson.D
+	for _, name := range copiedCollOptions {
+		if value, err := spec.Options.LookupErr(name); err == nil {
+			opts = append(opts, bson.E{name, value})
+		}
+	}
+	clusteredOpts, err := getClusteredOptions(srcMongo, srcDbName, srcCollName)
+	if err != nil {
+		srcMongo.logger().Warn("获取源端集合的聚簇选项失败，按普通集合处理", zap.String("NS", srcDbName+"."+srcCollName), zap.Error(err))
+	}
+	if clustered = clusteredOpts != nil; clustered {
+		opts = append(opts, clusteredCreateOptions(dstMongo, ns, clusteredOpts)...)
+	}
+	if len(opts) == 0 {
+		return clustered, capped
+	}
+
+	cmd := append(bson.D{{"create", dstCollName}}, opts...)
+	err = doWithRetry(dstMongo.Context(), commandTimeout, "create", func(ctx context.Context) error {
+		return dstMongo.Client().Database(dstDbName).RunCommand(ctx, cmd).Err()
+	})
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == 48 { // NamespaceExists：目标集合已经存在时沿用已有的集合
+		dstMongo.logger().Warn("目标集合已经存在，未按源端集合的选项重新创建", zap.String("NS", ns), zap.String("options", fmt.Sprintf("%v", opts)))
+	} else if err != nil {
+		dstMongo.logger().Fatal("按源端集合的选项创建集合失败", zap.String("NS", ns), zap.String("options", fmt.Sprintf("%v", opts)), zap.Error(err))
+	} else {
+		dstMongo.logger().Info("已按源端集合的选项创建集合", zap.String("NS", ns), zap.String("options", fmt.Sprintf("%v", opts)))
+	}
+	return clustered, capped
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 写入的文档_id在目标端已经存在时的处理方式，全量复制和重放insert类型的oplog使用相同的处理：
+//
+//	skip       保留目标端的文档
+//	overwrite  用写入的文档替换目标端的文档
+//	fail       按写入失败处理
+//	merge      将写入的文档中_id以外的字段$set到目标端的文档，目标端文档中的其他字段保留
+type ConflictPolicy string
+
+const (
+	ConflictSkip      ConflictPolicy = "skip"
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictFail      ConflictPolicy = "fail"
+	ConflictMerge     ConflictPolicy = "merge"
+)
+
+// 通过--conflict_policy指定的处理方式，为空时全量复制按--overwrite处理，重放oplog时替换（与之前的行为一致）
+var conflictPolicy ConflictPolicy
+
+// 检查处理方式
+func CustParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(s); policy {
+	case ConflictSkip, ConflictOverwrite, ConflictFail, ConflictMerge:
+		return policy, nil
+	}
+	return "", fmt.Errorf("不支持的处理方式%s，可选值为%s、%s、%s、%s", s, ConflictSkip, ConflictOverwrite, ConflictFail, ConflictMerge)
+}
+
+// 设置全局的处理方式，同时用于重放oplog
+func SetConflictPolicy(policy ConflictPolicy) {
+	conflictPolicy = policy
+}
+
+// 源ns全量复制时的处理方式：--ns_overrides_file中指定的优先，否则为def
+func conflictPolicyFor(srcNs string, def ConflictPolicy) ConflictPolicy {
+	if override := nsOverrides[srcNs]; override != nil && override.ConflictPolicy != "" {
+		return override.ConflictPolicy
+	}
+	return def
+}
+
+// 源ns重放insert类型的oplog时的处理方式：--ns_overrides_file中指定的优先，其次为--conflict_policy，默认替换
+func oplogConflictPolicy(srcNs string) ConflictPolicy {
+	if conflictPolicy == "" {
+		return conflictPolicyFor(srcNs, ConflictOverwrite)
+	}
+	return conflictPolicyFor(srcNs, conflictPolicy)
+}
+
+// 文档中_id以外的字段，doc为bson.Raw或bson.D
+func docWithoutId(doc interface{}) bson.D {
+	var fields bson.D
+	switch d := doc.(type) {
+	case bson.Raw:
+		elems, _ := d.Elements()
+		for _, elem := range elems {
+			if elem.Key() != "_id" {
+				fields = append(fields, bson.E{elem.Key(), elem.Value()})
+			}
+		}
+	case bson.D:
+		for _, e := range d {
+			if e.Key != "_id" {
+				fields = append(fields, e)
+			}
+		}
+	}
+	return fields
+}
+
+// 按处理方式写入文档的WriteModel。skip和merge使用upsert，文档已经存在时不会产生重复_id错误，重复执行的结果相同
+func conflictWriteModel(policy ConflictPolicy, doc interface{}) mongo.WriteModel {
+	id := docId(doc)
+	filter := bson.D{{"_id", id}}
+	switch policy {
+	case ConflictOverwrite:
+		return mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(doc).SetUpsert(true)
+	case ConflictSkip, ConflictMerge:
+		// 插入时文档的_id来自filter，$setOnInsert、$set中只包含其他字段（不能为空）
+		fields := docWithoutId(doc)
+		update := bson.D{{"$setOnInsert", bson.D{{"_id", id}}}}
+		if len(fields) > 0 && policy == ConflictSkip {
+			update = bson.D{{"$setOnInsert", fields}}
+		} else if len(fields) > 0 {
+			update = bson.D{{"$set", fields}}
+		}
+		return mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true)
+	}
+	return mongo.NewInsertOneModel().SetDocument(doc)
+}
+
+// 按处理方式执行一条insert类型的oplog
+func applyConflictInsert(ctx context.Context, coll *mongo.Collection, policy ConflictPolicy, doc interface{}) error {
+	model := conflictWriteModel(policy, doc)
+	setModelHint(ctx, coll, model)
+	return doWithRetry(ctx, writeTimeout, "insert "+string(policy), func(ctx context.Context) error {
+		var err error
+		switch m := model.(type) {
+		case *mongo.InsertOneModel:
+			_, err = coll.InsertOne(ctx, m.Document)
+		case *mongo.UpdateOneModel:
+			_, err = coll.UpdateOne(ctx, m.Filter, m.Update, options.Update().SetUpsert(true).SetHint(m.Hint))
+		case *mongo.ReplaceOneModel:
+			_, err = coll.ReplaceOne(ctx, m.Filter, m.Replacement, options.Replace().SetUpsert(true).SetHint(m.Hint))
+		}
+		return err
+	})
+}
@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// 全量同步中每个集合的复制进度保存在目标实例的mongosync.copy_progress集合中，每个目标集合一个文档。
+// 任务中断后继续该任务（见CustCheckManifest）时，已经完成的集合直接跳过，未完成的集合从每个_id范围最后写入的_id之后继续复制；
+// 开始新的任务时清空同一源端的复制进度
+const copyProgressCollName = "copy_progress"
+
+// 单个_id范围的复制进度
+type rangeProgress struct {
+	Min       *bson.RawValue `bson:"min,omitempty"`
+	Max       *bson.RawValue `bson:"max,omitempty"`
+	LastId    *bson.RawValue `bson:"lastId,omitempty"` // 最后写入目标端的文档的_id
+	CopiedNum int64          `bson:"copiedNum"`
+	Done      bool           `bson:"done"`
+}
+
+// mongosync.copy_progress中的文档
+type copyProgress struct {
+	ID         string          `bson:"_id"` // 目标ns
+	Source     string          `bson:"source"`
+	SrcNs      string          `bson:"srcNs"`
+	Done       bool            `bson:"done"`
+	Ranges     []rangeProgress `bson:"ranges"`
+	UpdateTime time.Time       `bson:"updateTime"`
+}
+
+// 单个集合复制过程中的进度记录：每批写入目标端后更新内存中的进度、通知ProgressListener并保存到目标端
+type copyTracker struct {
+	dstMongo *MongoArgs
+	coll     *mongo.Collection
+	nsmap    NsMap
+	lock     sync.Mutex
+	progress copyProgress
+	resumed  bool  // 是否存在之前运行保存的进度
+	total    int64 // 包括之前运行在内已经写入的文档数
+}
+
+func rawValuePtr(v bson.RawValue) *bson.RawValue {
+	if v.Type == 0 {
+		return nil
+	}
+	return &v
+}
+
+func rawValueOf(v *bson.RawValue) bson.RawValue {
+	if v == nil {
+		return bson.RawValue{}
+	}
+	return *v
+}
+
+// 读取集合之前保存的复制进度，读取失败时作为新的集合复制
+func loadCopyTracker(srcMongo, dstMongo *MongoArgs, nsmap NsMap) *copyTracker {
+	t := &copyTracker{
+		dstMongo: dstMongo,
+		coll:     dstMongo.Client().Database(mongosyncDbName).Collection(copyProgressCollName),
+		nsmap:    nsmap,
+		progress: copyProgress{
+			ID:     nsmap.DstDb + "." + nsmap.DstColl,
+			Source: srcMongo.uri(),
+			SrcNs:  nsmap.SrcDb + "." + nsmap.SrcColl,
+		},
+	}
+	var previous copyProgress
+	err := doWithRetry(dstMongo.Context(), findTimeout, "find "+mongosyncDbName+"."+copyProgressCollName, func(ctx context.Context) error {
+		return t.coll.FindOne(ctx, bson.M{"_id": t.progress.ID, "source": t.progress.Source}).Decode(&previous)
+	})
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			dstMongo.logger().Warn("读取集合的复制进度失败，重新复制该集合", zap.String("NS", t.progress.ID), zap.Error(err))
+		}
+		return t
+	}
+	if previous.SrcNs != t.progress.SrcNs {
+		return t
+	}
+	t.progress = previous
+	t.resumed = true
+	for _, r := range previous.Ranges {
+		t.total += r.CopiedNum
+	}
+	return t
+}
+
+// 集合是否已经在之前的运行中复制完成
+func (t *copyTracker) done() bool {
+	return t.resumed && t.progress.Done
+}
+
+// 返回之前运行中未完成的_id范围，resumed为false表示没有保存的范围，需要重新切分
+func (t *copyTracker) pending() (ranges []idRange, resumed bool) {
+	if !t.resumed || len(t.progress.Ranges) == 0 {
+		return nil, false
+	}
+	for i, r := range t.progress.Ranges {
+		if !r.Done {
+			ranges = append(ranges, idRange{min: rawValueOf(r.Min), max: rawValueOf(r.Max), lastId: rawValueOf(r.LastId), index: i})
+		}
+	}
+	t.dstMongo.logger().Info("继续未完成的集合复制", zap.String("NS", t.progress.ID), zap.Int64("copiedNum", t.total),
+		zap.Int("ranges", len(t.progress.Ranges)), zap.Int("pendingRanges", len(ranges)))
+	return ranges, true
+}
+
+// 开始复制集合，保存切分的_id范围
+func (t *copyTracker) start(ranges []idRange) {
+	t.lock.Lock()
+	t.progress.Done = false
+	t.progress.Ranges = make([]rangeProgress, len(ranges))
+	for i := range ranges {
+		ranges[i].index = i
+		t.progress.Ranges[i] = rangeProgress{Min: rawValuePtr(ranges[i].min), Max: rawValuePtr(ranges[i].max)}
+	}
+	t.progress.UpdateTime = time.Now()
+	progress := t.progress
+	t.lock.Unlock()
+	t.save("save copy progress", func(ctx context.Context) error {
+		_, err := t.coll.ReplaceOne(ctx, bson.M{"_id": progress.ID}, progress, options.Replace().SetUpsert(true))
+		return err
+	})
+}
+
+// 范围r的一批文档写入目标端后调用，lastId为该批最后一个文档的_id
+func (t *copyTracker) batchDone(r idRange, lastId bson.RawValue, n int64) {
+	t.lock.Lock()
+	t.total += n
+	total := t.total
+	t.progress.Ranges[r.index].LastId = rawValuePtr(lastId)
+	t.progress.Ranges[r.index].CopiedNum += n
+	copiedNum := t.progress.Ranges[r.index].CopiedNum
+	t.lock.Unlock()
+	notifyProgress(func(listener ProgressListener) { listener.OnCollectionProgress(t.nsmap, total) })
+	t.updateRange(r.index, bson.M{"lastId": lastId, "copiedNum": copiedNum})
+}
+
+// 范围r复制完成
+func (t *copyTracker) rangeDone(r idRange) {
+	t.lock.Lock()
+	t.progress.Ranges[r.index].Done = true
+	t.lock.Unlock()
+	t.updateRange(r.index, bson.M{"done": true})
+}
+
+// 集合复制完成
+func (t *copyTracker) finish() {
+	t.progress.Done = true
+	t.save("update copy progress", func(ctx context.Context) error {
+		_, err := t.coll.UpdateOne(ctx, bson.M{"_id": t.progress.ID}, bson.M{"$set": bson.M{"done": true, "updateTime": time.Now()}}, options.Update().SetUpsert(true))
+		return err
+	})
+}
+
+func (t *copyTracker) updateRange(index int, fields bson.M) {
+	set := bson.M{"updateTime": time.Now()}
+	prefix := "ranges." + strconv.Itoa(index) + "."
+	for k, v := range fields {
+		set[prefix+k] = v
+	}
+	t.save("update copy progress", func(ctx context.Context) error {
+		_, err := t.coll.UpdateOne(ctx, bson.M{"_id": t.progress.ID}, bson.M{"$set": set})
+		return err
+	})
+}
+
+// 保存失败只影响中断后继续复制的位置，记录警告后继续同步
+func (t *copyTracker) save(desc string, op func(ctx context.Context) error) {
+	if err := doWithRetry(t.dstMongo.Context(), writeTimeout, desc, op); err != nil {
+		t.dstMongo.logger().Warn("保存集合的复制进度失败", zap.String("NS", t.progress.ID), zap.Error(err))
+	}
+}
+
+// 开始新的任务时清空同一源端之前保存的复制进度
+func resetCopyProgress(srcMongo, dstMongo *MongoArgs) error {
+	coll := dstMongo.Client().Database(mongosyncDbName).Collection(copyProgressCollName)
+	return doWithRetry(dstMongo.Context(), writeTimeout, "delete copy progress", func(ctx context.Context) error {
+		_, err := coll.DeleteMany(ctx, bson.M{"source": srcMongo.uri()})
+		return err
+	})
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// 文档数核对：每个集合复制前记录源端的文档数，复制完成后比较源端和目标端的文档数，不一致时输出警告，
+// fail模式下全量同步结束后报错退出。没有--filter时使用集合元数据中的文档数（不扫描集合），否则按过滤条件计数。
+// 复制期间源端文档数发生变化（源端仍在写入）时，不一致只作为警告，由增量同步补齐
+const (
+	CountCheckOff  = "off"
+	CountCheckWarn = "warn"
+	CountCheckFail = "fail"
+)
+
+var countCheckMode = CountCheckWarn
+
+// 设置文档数核对的模式
+func SetCountCheck(mode string) error {
+	switch mode {
+	case CountCheckOff, CountCheckWarn, CountCheckFail:
+		countCheckMode = mode
+		return nil
+	}
+	return fmt.Errorf("不支持的模式%s，可选值为%s、%s、%s", mode, CountCheckOff, CountCheckWarn, CountCheckFail)
+}
+
+// 集合的文档数，失败时返回-1
+func countDocs(ctx context.Context, coll *mongo.Collection, filter interface{}) int64 {
+	var count int64
+	err := doWithRetry(ctx, findTimeout, "count "+coll.Database().Name()+"."+coll.Name(), func(ctx context.Context) error {
+		var err error
+		if m, ok := filter.(bson.M); ok && len(m) == 0 {
+			count, err = coll.EstimatedDocumentCount(ctx)
+		} else {
+			count, err = coll.CountDocuments(ctx, filter)
+		}
+		return err
+	})
+	if err != nil {
+		loggerFrom(ctx).Warn("获取集合的文档数失败，不核对文档数", zap.String("NS", coll.Database().Name()+"."+coll.Name()), zap.Error(err))
+		return -1
+	}
+	return count
+}
+
+// 复制前源端集合的文档数，不核对时返回-1
+func countSrcBefore(srcMongo *MongoArgs, srcColl *mongo.Collection) int64 {
+	if countCheckMode == CountCheckOff {
+		return -1
+	}
+	return countDocs(srcMongo.Context(), srcColl, withNsFilter(srcColl.Database().Name()+"."+srcColl.Name(), bson.M{}))
+}
+
+// 复制完成后核对源端和目标端的文档数，srcBefore为复制前源端的文档数
+func reconcileCounts(srcMongo, dstMongo *MongoArgs, nsmap NsMap, srcColl, dstColl *mongo.Collection, srcBefore int64) {
+	if countCheckMode == CountCheckOff || srcBefore < 0 {
+		return
+	}
+	srcNs := nsmap.SrcDb + "." + nsmap.SrcColl
+	srcAfter := countDocs(srcMongo.Context(), srcColl, withNsFilter(srcNs, bson.M{}))
+	dstCount := countDocs(dstMongo.Context(), dstColl, bson.M{})
+	if srcAfter < 0 || dstCount < 0 {
+		return
+	}
+	// 复制期间源端没有变化时文档数仍然不一致才判定为不一致
+	mismatch := srcAfter != dstCount && srcBefore == srcAfter
+	notifyProgress(func(listener ProgressListener) { listener.OnCollectionCounts(nsmap, srcAfter, dstCount, mismatch) })
+	fields := []zap.Field{zap.String("NS", srcNs), zap.String("dstNs", nsmap.DstDb+"."+nsmap.DstColl),
+		zap.Int64("srcBefore", srcBefore), zap.Int64("srcCount", srcAfter), zap.Int64("dstCount", dstCount)}
+	switch {
+	case srcAfter == dstCount:
+		srcMongo.logger().Debug("文档数核对一致", fields...)
+	case !mismatch:
+		srcMongo.logger().Warn("文档数不一致，复制期间源端集合发生了变化", fields...)
+	default:
+		srcMongo.logger().Warn("文档数不一致", fields...)
+		fmt.Printf("%s文档数不一致，源端：%v，目标端：%v\n", srcNs, srcAfter, dstCount)
+	}
+}
+
+// fail模式下，存在文档数不一致（复制期间源端没有变化）的集合时返回错误
+func CustCheckCountMismatches(statuses []CollectionStatus) error {
+	if countCheckMode != CountCheckFail {
+		return nil
+	}
+	var mismatched []string
+	for _, status := range statuses {
+		if status.CountMismatch {
+			mismatched = append(mismatched, fmt.Sprintf("%s.%s(源:%d 目标:%d)", status.Ns.SrcDb, status.Ns.SrcColl, status.SrcCount, status.DstCount))
+		}
+	}
+	if len(mismatched) > 0 {
+		return fmt.Errorf("%d个集合的文档数不一致：%s", len(mismatched), strings.Join(mismatched, ", "))
+	}
+	return nil
+}
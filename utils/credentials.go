@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/term"
+)
+
+// 用户名、密码的来源，优先级：命令行参数 > 环境变量 > 凭据文件。密码为"-"时从标准输入读取
+const (
+	EnvSrcUser     = "MONGOSYNC_SRC_USER"
+	EnvSrcPassword = "MONGOSYNC_SRC_PASSWORD"
+	EnvDstUser     = "MONGOSYNC_DST_USER"
+	EnvDstPassword = "MONGOSYNC_DST_PASSWORD"
+
+	// --verify使用的只读账号，与同步任务的账号分开配置
+	EnvVerifySrcUser     = "MONGOSYNC_VERIFY_SRC_USER"
+	EnvVerifySrcPassword = "MONGOSYNC_VERIFY_SRC_PASSWORD"
+	EnvVerifyDstUser     = "MONGOSYNC_VERIFY_DST_USER"
+	EnvVerifyDstPassword = "MONGOSYNC_VERIFY_DST_PASSWORD"
+
+	PasswordPrompt = "-" // 密码参数为该值时交互输入
+)
+
+// 凭据文件中支持的key
+var credentialsFileKeys = map[string]bool{"src_user": true, "src_password": true, "dst_user": true, "dst_password": true}
+
+// 凭据文件中--verify使用的账号所在的节，节中的key返回时加上"verify_"前缀
+const verifyCredentialsSection = "verify"
+
+// 加载凭据文件。文件每行一个key=value，支持的key为src_user、src_password、dst_user、dst_password，
+// 以#开头的行为注释。[verify]之后的key为--verify使用的只读账号，返回的key为verify_src_user等。
+// 文件可以被其他用户读取时给出警告
+func CustLoadCredentialsFile(ctx context.Context, path string) (map[string]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		loggerFrom(ctx).Warn("凭据文件可以被其他用户读取，建议执行chmod 600", zap.String("path", path), zap.String("mode", info.Mode().Perm().String()))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	prefix := ""
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "["+verifyCredentialsSection+"]" {
+			prefix = verifyCredentialsSection + "_"
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || !credentialsFileKeys[key] {
+			return nil, fmt.Errorf("凭据文件第%d行格式错误，应为src_user|src_password|dst_user|dst_password=value或[verify]", lineNum)
+		}
+		values[prefix+key] = strings.TrimSpace(kv[1])
+	}
+	return values, scanner.Err()
+}
+
+// 按命令行参数、环境变量、凭据文件的优先级返回第一个非空的值
+func CustResolveCredential(flagValue, envName string, fileValues map[string]string, fileKey string) string {
+	return firstNonEmpty(flagValue, os.Getenv(envName), fileValues[fileKey])
+}
+
+// 从标准输入读取密码，标准输入为终端时不回显
+func CustPromptPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+	// 逐字节读取一行，避免缓冲读取多余的内容，影响之后的确认输入
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n == 1 && buf[0] != '\n' {
+			line = append(line, buf[0])
+			continue
+		}
+		if err != nil && len(line) == 0 {
+			return "", err
+		}
+		if n == 1 || err != nil {
+			break
+		}
+	}
+	return strings.TrimRight(string(line), "\r"), nil
+}
@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// convertToCapped在oplog中为创建临时集合<db>.tmp<随机串>.convertToCapped.<集合>、写入数据、
+// 再以dropTarget改名为原集合，临时集合按原集合进行过滤和名称空间映射
+var convertToCappedTmpReg = regexp.MustCompile(`^([^.]+)\.(tmp[^.]*\.convertToCapped\.)(.+)$`)
+
+// 判断ns是否为convertToCapped的临时集合，是则返回原集合的ns和临时集合名的前缀
+func convertToCappedOrigin(ns string) (origNs string, tmpPrefix string, ok bool) {
+	m := convertToCappedTmpReg.FindStringSubmatch(ns)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1] + "." + m[3], m[2], true
+}
+
+// 集合的DDL命令，o中第一个字段的值为命令所在库中的集合名，例如：
+//
+//	{"op" : "c", "ns" : "GlobalDB.$cmd", "o" : { "create" : "GlobalService", "idIndex" : {...} }}
+//	{"op" : "c", "ns" : "GlobalDB.$cmd", "o" : { "drop" : "GlobalService" }}
+//
+// renameCollection的值为完整的ns，dropTarget为被替换的目标集合的UUID（4.2+）或bool：
+//
+//	{"op" : "c", "ns" : "GlobalDB.$cmd", "o" : { "renameCollection" : "GlobalDB.a", "to" : "GlobalDB.b", "stayTemp" : false, "dropTarget" : false }}
+//
+// 这些命令与增删改一样按命令涉及的集合进行过滤和名称空间映射，命令中的集合名替换为映射后的目标集合
+var collDDLCommands = map[string]bool{
+	"create":           true,
+	"drop":             true,
+	"convertToCapped":  true,
+	"renameCollection": true,
+	"collMod":          true,
+}
+
+// 判断c类型oplog的o是否为集合DDL命令，是则返回命令涉及的集合名（renameCollection为改名前的集合）
+func ddlColl(o bson.D) (string, bool) {
+	if len(o) == 0 || !collDDLCommands[o[0].Key] {
+		return "", false
+	}
+	coll, ok := o[0].Value.(string)
+	if ok && o[0].Key == "renameCollection" {
+		parts := strings.SplitN(coll, ".", 2)
+		if len(parts) != 2 {
+			return "", false
+		}
+		coll = parts[1]
+	}
+	return coll, ok
+}
+
+// 索引创建、删除或集合DDL命令涉及的集合
+func commandColl(o bson.D) (string, bool) {
+	if coll, ok := indexBuildColl(o); ok {
+		return coll, true
+	}
+	if coll, ok := indexDropColl(o); ok {
+		return coll, true
+	}
+	return ddlColl(o)
+}
+
+// 将集合DDL命令中的集合名替换为映射后的目标集合，nsStruct为命令涉及的集合映射后的结果。其他oplog原样返回
+func mapDDLOplog(nsStruct *NsMap, oplog OPLOG, nsnsMap map[string]string) OPLOG {
+	cmd, ok := oplog.O.(bson.D)
+	if oplog.OP != "c" || !ok {
+		return oplog
+	}
+	if _, ok := ddlColl(cmd); !ok {
+		return oplog
+	}
+	var mapped bson.D
+	switch cmd[0].Key {
+	case "renameCollection":
+		// 只保留目标端需要的字段，dropTarget为UUID时表示替换了已经存在的目标集合
+		mapped = bson.D{{"renameCollection", nsStruct.DstDb + "." + nsStruct.DstColl}}
+		for _, e := range cmd[1:] {
+			switch e.Key {
+			case "to":
+				if to, ok := e.Value.(string); ok && strings.Contains(to, ".") {
+					toStruct := CustFilter(to, nsnsMap)
+					mapped = append(mapped, bson.E{"to", toStruct.DstDb + "." + toStruct.DstColl})
+				}
+			case "dropTarget":
+				dropTarget, isBool := e.Value.(bool)
+				mapped = append(mapped, bson.E{"dropTarget", dropTarget || !isBool})
+			case "stayTemp":
+				mapped = append(mapped, e)
+			}
+		}
+	default:
+		// 视图只能引用同一个库中的集合，映射到其他库的集合保持原名
+		mapColl := func(coll string) (string, error) {
+			if collStruct := CustFilter(nsStruct.SrcDb+"."+coll, nsnsMap); collStruct.DstDb == nsStruct.DstDb {
+				return collStruct.DstColl, nil
+			}
+			return coll, nil
+		}
+		mapped = append(bson.D{{cmd[0].Key, nsStruct.DstColl}}, cmd[1:]...)
+		for i, e := range mapped {
+			switch e.Key {
+			case "viewOn":
+				if viewOn, ok := e.Value.(string); ok {
+					mapped[i].Value, _ = mapColl(viewOn)
+				}
+			case "pipeline":
+				// create、collMod视图时pipeline中$lookup等阶段引用的集合
+				if pipeline, ok := e.Value.(bson.A); ok {
+					mapped[i].Value, _ = mapViewPipeline(pipeline, mapColl)
+				}
+			case "idIndex":
+				// 早期版本的_id索引定义中带有源端的ns
+				if idIndex, ok := e.Value.(bson.D); ok {
+					var cleaned bson.D
+					for _, f := range idIndex {
+						if f.Key != "ns" {
+							cleaned = append(cleaned, f)
+						}
+					}
+					mapped[i].Value = cleaned
+				}
+			}
+		}
+	}
+	oplog.O = mapped
+	return oplog
+}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// 索引的创建时机：先创建索引再写入文档时，每次写入都要维护所有索引，批量写入大集合很慢。
+//
+//	before  复制每个集合的文档之前创建索引（之前的行为）。固定集合写满后按插入顺序删除文档、TTL索引在写入过程中就开始删除过期文档，
+//	        需要与源端保持一致的写入过程时使用
+//	after   复制文档之前只记录源端的索引，所有集合复制完成后再在目标端创建，--index_build_threads个集合并发创建，
+//	        同一个集合的索引通过一次createIndexes一起创建，只扫描一次集合
+//
+// GridFS bucket复制时需要按files_id查询chunk，始终在复制之前创建索引
+const (
+	IndexBuildBefore = "before"
+	IndexBuildAfter  = "after"
+)
+
+var (
+	indexBuildMode    = IndexBuildBefore
+	indexBuildThreads = 4
+)
+
+// 延后创建的索引，按复制开始的顺序创建
+var deferredIndexes struct {
+	sync.Mutex
+	colls []deferredIndexColl
+}
+
+type deferredIndexColl struct {
+	ns     NsMap
+	models []mongo.IndexModel
+}
+
+// 设置索引的创建时机和延后创建时并发创建索引的集合数
+func SetIndexBuild(mode string, threads int) error {
+	if mode != IndexBuildBefore && mode != IndexBuildAfter {
+		return fmt.Errorf("不支持的模式%s，可选值为%s、%s", mode, IndexBuildBefore, IndexBuildAfter)
+	}
+	indexBuildMode = mode
+	if threads > 0 {
+		indexBuildThreads = threads
+	}
+	return nil
+}
+
+// 创建集合的索引：before时立即创建，after时读取源端的索引并记录，由buildDeferredIndexes在全部集合复制完成后创建
+func syncOrDeferIndex(srcMongo, dstMongo *MongoArgs, nsmap NsMap) {
+	if indexBuildMode != IndexBuildAfter {
+		CustSyncIndex(srcMongo, nsmap.SrcDb, nsmap.SrcColl, dstMongo, nsmap.DstDb, nsmap.DstColl)
+		return
+	}
+	models := srcIndexModels(srcMongo, nsmap.SrcDb, nsmap.SrcColl, dstMongo, nsmap.DstDb, nsmap.DstColl)
+	if len(models) == 0 {
+		return
+	}
+	deferredIndexes.Lock()
+	deferredIndexes.colls = append(deferredIndexes.colls, deferredIndexColl{ns: nsmap, models: models})
+	deferredIndexes.Unlock()
+}
+
+// 创建延后的索引。已经存在的相同索引（之前中断的运行中已经创建）不会报错
+func buildDeferredIndexes(dstMongo *MongoArgs) {
+	deferredIndexes.Lock()
+	colls := deferredIndexes.colls
+	deferredIndexes.colls = nil
+	deferredIndexes.Unlock()
+	if len(colls) == 0 {
+		return
+	}
+	start := time.Now()
+	dstMongo.logger().Info("开始创建延后的索引", zap.Int("collNum", len(colls)), zap.Int("threads", indexBuildThreads))
+	queue := make(chan deferredIndexColl, len(colls))
+	for _, coll := range colls {
+		queue <- coll
+	}
+	close(queue)
+	var wg sync.WaitGroup
+	for i := 0; i < indexBuildThreads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for coll := range queue {
+				collStart := time.Now()
+				dstColl := dstMongo.Client().Database(coll.ns.DstDb).Collection(coll.ns.DstColl)
+				// 大集合创建索引的耗时远超单条命令的超时时间，不设置超时
+				err := doWithRetry(dstMongo.Context(), 0, "createIndexes", func(ctx context.Context) error {
+					_, err := dstColl.Indexes().CreateMany(ctx, coll.models)
+					return err
+				})
+				if err != nil {
+					dstMongo.logger().Fatal("创建延后的索引失败", zap.String("NS", coll.ns.DstDb+"."+coll.ns.DstColl), zap.Error(err))
+				}
+				fmt.Printf("%s索引创建完成，索引数：%v，耗时：%.2f秒\n", coll.ns.DstDb+"."+coll.ns.DstColl, len(coll.models), time.Since(collStart).Seconds())
+			}
+		}()
+	}
+	wg.Wait()
+	dstMongo.logger().Info("延后的索引创建完成", zap.Int("collNum", len(colls)), zap.Duration("duration", time.Since(start)))
+}
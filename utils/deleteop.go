@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// d类型oplog的o通常为{_id: ...}（分片集合中可能还包含片键字段），每条oplog只删除一个文档。
+// 一些工具或旧版本产生的删除操作o中没有_id（_id在o2中），或者以{_id: {$in: [...]}}表示批量删除，
+// 也可能是不包含_id的任意条件。按条件删除可能误删目标端的大量文档，默认拒绝执行，使用--allow_broad_deletes时按条件删除全部匹配的文档
+var allowBroadDeletes bool
+
+// 设置是否允许执行不按_id的删除操作
+func SetAllowBroadDeletes(allow bool) {
+	allowBroadDeletes = allow
+}
+
+var errBroadDelete = errors.New("delete操作的条件中没有_id，拒绝执行；确认需要按条件删除时使用--allow_broad_deletes")
+
+// 删除操作的统计，用于检查实际删除的文档数是否与预期一致
+var deleteStats struct {
+	applied  int64 // 执行的delete操作数
+	expected int64 // 按_id删除时预期删除的文档数
+	deleted  int64 // 实际删除的文档数
+	notFound int64 // 按_id删除时目标端不存在的文档数
+	broad    int64 // 按条件删除的操作数
+	refused  int64 // 拒绝执行的操作数
+}
+
+// 解析d类型oplog的删除条件。expected为按_id删除时预期删除的文档数，按条件删除时为-1
+func deleteFilter(oplog OPLOG) (filter bson.D, expected int64, err error) {
+	o, ok := oplog.O.(bson.D)
+	if !ok {
+		return nil, 0, fmt.Errorf("delete操作的o不是文档：%v", oplog.O)
+	}
+	if _, exists := o.Map()["_id"]; !exists {
+		// _id在o2中
+		if o2, ok := oplog.O2.(bson.D); ok {
+			if id, exists := o2.Map()["_id"]; exists {
+				o = append(bson.D{{"_id", id}}, o...)
+			}
+		}
+	}
+	if len(o) == 0 {
+		return nil, 0, errors.New("delete操作的条件为空")
+	}
+	for _, e := range o {
+		if strings.HasPrefix(e.Key, "$") && e.Key != "$and" {
+			// $or、$where等顶层操作符无法确定删除的范围
+			return o, -1, nil
+		}
+	}
+	id, exists := o.Map()["_id"]
+	if !exists {
+		return o, -1, nil
+	}
+	cond, ok := id.(bson.D)
+	if !ok || len(cond) == 0 || !strings.HasPrefix(cond[0].Key, "$") {
+		return o, 1, nil
+	}
+	// {_id: {$in: [...]}}展开为按_id批量删除，预期删除的文档数为_id的个数
+	if len(cond) == 1 && cond[0].Key == "$in" {
+		if ids, ok := cond[0].Value.(bson.A); ok {
+			return o, int64(len(ids)), nil
+		}
+	}
+	return o, -1, nil
+}
+
+// 执行d类型的oplog
+func applyDelete(ctx context.Context, dstColl *mongo.Collection, oplog OPLOG) error {
+	filter, expected, err := deleteFilter(oplog)
+	if err != nil {
+		return err
+	}
+	if expected < 0 && !allowBroadDeletes {
+		atomic.AddInt64(&deleteStats.refused, 1)
+		return errBroadDelete
+	}
+	var deleted int64
+	err = doWithRetry(ctx, writeTimeout, "Delete", func(ctx context.Context) error {
+		var result *mongo.DeleteResult
+		var err error
+		if expected == 1 {
+			result, err = dstColl.DeleteOne(ctx, filter)
+		} else {
+			result, err = dstColl.DeleteMany(ctx, filter)
+		}
+		if err == nil {
+			deleted = result.DeletedCount
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	recordDeletes(1, expected, deleted)
+	if expected > 0 && deleted < expected {
+		loggerFrom(ctx).Debug("delete操作删除的文档数少于预期，目标端不存在对应的文档", zap.String("ns", dstColl.Database().Name()+"."+dstColl.Name()),
+			zap.Int64("expected", expected), zap.Int64("deleted", deleted))
+	} else if expected < 0 {
+		loggerFrom(ctx).Warn("按条件执行delete操作", zap.String("ns", dstColl.Database().Name()+"."+dstColl.Name()),
+			zap.String("filter", truncateDoc(fmt.Sprint(filter))), zap.Int64("deleted", deleted))
+	}
+	return nil
+}
+
+// 将d类型的oplog转换为BulkWrite的WriteModel，只合并按单个_id删除的操作
+func deleteWriteModel(oplog OPLOG) mongo.WriteModel {
+	filter, expected, err := deleteFilter(oplog)
+	if err != nil || expected != 1 {
+		return nil
+	}
+	return mongo.NewDeleteOneModel().SetFilter(filter)
+}
+
+// 记录opNum个删除操作的结果，expected<0表示按条件删除
+func recordDeletes(opNum, expected, deleted int64) {
+	atomic.AddInt64(&deleteStats.applied, opNum)
+	atomic.AddInt64(&deleteStats.deleted, deleted)
+	if expected < 0 {
+		atomic.AddInt64(&deleteStats.broad, 1)
+		return
+	}
+	atomic.AddInt64(&deleteStats.expected, expected)
+	if deleted < expected {
+		atomic.AddInt64(&deleteStats.notFound, expected-deleted)
+	}
+}
+
+// 输出删除操作的统计，与重放进度一起定期输出
+func logDeleteStats(logger *zap.Logger) {
+	if atomic.LoadInt64(&deleteStats.applied)+atomic.LoadInt64(&deleteStats.refused) == 0 {
+		return
+	}
+	logger.Info("delete操作统计", zap.Int64("appliedNum", atomic.LoadInt64(&deleteStats.applied)),
+		zap.Int64("expectedNum", atomic.LoadInt64(&deleteStats.expected)), zap.Int64("deletedNum", atomic.LoadInt64(&deleteStats.deleted)),
+		zap.Int64("notFoundNum", atomic.LoadInt64(&deleteStats.notFound)), zap.Int64("broadNum", atomic.LoadInt64(&deleteStats.broad)),
+		zap.Int64("refusedNum", atomic.LoadInt64(&deleteStats.refused)))
+}
+
+// BulkWrite中按_id删除的操作数，用于按BulkWriteResult.DeletedCount统计
+func countDeleteModels(models []mongo.WriteModel) int64 {
+	var n int64
+	for _, model := range models {
+		if _, ok := model.(*mongo.DeleteOneModel); ok {
+			n++
+		}
+	}
+	return n
+}
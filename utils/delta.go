@@ -0,0 +1,222 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// 增量补齐：按_id顺序读取源集合的_id以及用于比较的值，每批与目标端相同_id的文档比较，
+// 只复制目标端缺少或内容不同的文档，部分集合同步失败后重新执行时不需要重新写入全部文档。比较方式：
+//
+//	id            只比较_id是否存在
+//	hash          比较服务端计算的文档哈希（与--verify使用相同的表达式），只传输哈希值
+//	field:<字段>  比较指定字段（如updatedAt）的值
+//
+// 目标端多出的文档不删除
+const (
+	DeltaId          = "id"
+	DeltaHash        = "hash"
+	DeltaFieldPrefix = "field:"
+)
+
+var (
+	deltaMode  string // 为空时不启用
+	deltaField string // DeltaFieldPrefix模式比较的字段
+)
+
+// 每批比较的文档数
+const deltaBatchSize = 1000
+
+// 设置增量补齐的比较方式，为空时不启用
+func SetDelta(mode string) error {
+	deltaMode, deltaField = "", ""
+	switch {
+	case mode == "", mode == DeltaId, mode == DeltaHash:
+		deltaMode = mode
+	case strings.HasPrefix(mode, DeltaFieldPrefix) && len(mode) > len(DeltaFieldPrefix):
+		deltaMode, deltaField = DeltaFieldPrefix, mode[len(DeltaFieldPrefix):]
+	default:
+		return fmt.Errorf("不支持的比较方式%s，可选值为%s、%s、%s<字段>", mode, DeltaId, DeltaHash, DeltaFieldPrefix)
+	}
+	return nil
+}
+
+// 比较值的聚合表达式，为nil时只比较_id
+func deltaCompareExpr(srcCtx, dstCtx context.Context, srcColl, dstColl *mongo.Collection) (interface{}, error) {
+	switch deltaMode {
+	case DeltaFieldPrefix:
+		return "$" + deltaField, nil
+	case DeltaHash:
+		// 选择两端都支持的哈希表达式
+		for _, candidate := range docHashExprs {
+			pipeline := mongo.Pipeline{{{"$limit", 1}}, {{"$project", bson.D{{"k", candidate.expr}}}}}
+			_, srcErr := aggregateDigests(srcCtx, srcColl, pipeline)
+			var dstErr error
+			if srcErr == nil {
+				_, dstErr = aggregateDigests(dstCtx, dstColl, pipeline)
+			}
+			if srcErr == nil && dstErr == nil {
+				return candidate.expr, nil
+			}
+			if !isUnsupportedExprError(srcErr) && !isUnsupportedExprError(dstErr) {
+				if srcErr != nil {
+					return nil, srcErr
+				}
+				return nil, dstErr
+			}
+		}
+		return nil, fmt.Errorf("源端或目标端不支持$toHashedIndexKey和$function，无法在服务端计算哈希")
+	}
+	return nil, nil
+}
+
+// 只包含_id和比较值k的$project
+func deltaProject(expr interface{}) bson.D {
+	if expr == nil {
+		return bson.D{{"$project", bson.D{{"_id", 1}}}}
+	}
+	return bson.D{{"$project", bson.D{{"_id", 1}, {"k", expr}}}}
+}
+
+// 基于增量补齐同步集合，返回复制的文档数和与目标端一致而跳过的文档数。
+// srcCtx、dstCtx分别为源端和目标端操作的上下文
+func custSyncCollectionDelta(srcCtx, dstCtx context.Context, srcColl, dstColl *mongo.Collection) (copiedNum, skippedNum int64, err error) {
+	srcNs := srcColl.Database().Name() + "." + srcColl.Name()
+	ns := dstColl.Database().Name() + "." + dstColl.Name()
+	expr, err := deltaCompareExpr(srcCtx, dstCtx, srcColl, dstColl)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// 源端先按--filter过滤、按--projection裁剪，与全量复制写入目标端的文档一致后再计算比较值
+	pipeline := mongo.Pipeline{{{"$match", withNsFilter(srcNs, bson.M{})}}, {{"$sort", bson.D{{"_id", 1}}}}}
+	if p := projectionFor(srcNs); p != nil {
+		pipeline = append(pipeline, bson.D{{"$project", p.spec}})
+	}
+	pipeline = append(pipeline, deltaProject(expr))
+	opCtx, cancel := withTimeout(srcCtx, findTimeout)
+	cur, err := srcColl.Aggregate(opCtx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	cancel()
+	if err != nil {
+		return 0, 0, fmt.Errorf("读取源集合%s失败：%v", srcNs, err)
+	}
+	defer cur.Close(context.Background())
+
+	var ids []interface{}
+	srcKeys := make(map[string][]byte, deltaBatchSize)
+	flush := func() error {
+		if len(ids) == 0 {
+			return nil
+		}
+		defer func() {
+			ids = nil
+			srcKeys = make(map[string][]byte, deltaBatchSize)
+		}()
+		// 目标端同一批_id的比较值
+		var dstDocs []bson.Raw
+		dstPipeline := mongo.Pipeline{{{"$match", bson.D{{"_id", bson.D{{"$in", ids}}}}}}, deltaProject(expr)}
+		err := doWithRetry(dstCtx, findTimeout, "aggregate "+ns, func(ctx context.Context) error {
+			cur, err := dstColl.Aggregate(ctx, dstPipeline)
+			if err != nil {
+				return err
+			}
+			dstDocs = nil
+			return cur.All(ctx, &dstDocs)
+		})
+		if err != nil {
+			return fmt.Errorf("读取目标集合%s失败：%v", ns, err)
+		}
+		var changed []interface{}
+		same := make(map[string]bool, len(dstDocs))
+		for _, doc := range dstDocs {
+			key := rawValueKey(doc.Lookup("_id"))
+			if srcKey, exists := srcKeys[key]; exists && bytes.Equal(srcKey, deltaKeyValue(doc)) {
+				same[key] = true
+			}
+		}
+		for _, id := range ids {
+			if !same[rawValueKey(id.(bson.RawValue))] {
+				changed = append(changed, id)
+			}
+		}
+		skippedNum += int64(len(ids) - len(changed))
+		if len(changed) == 0 {
+			return nil
+		}
+
+		// 从源端读取需要复制的完整文档，按_id覆盖写入
+		findOpts := options.Find()
+		if p := projectionFor(srcNs); p != nil {
+			findOpts.SetProjection(p.spec)
+		}
+		var docs []interface{}
+		var docsBytes int64
+		err = doWithRetry(srcCtx, findTimeout, "find "+srcNs, func(ctx context.Context) error {
+			cur, err := srcColl.Find(ctx, withNsFilter(srcNs, bson.M{"_id": bson.M{"$in": changed}}), findOpts)
+			if err != nil {
+				return err
+			}
+			defer cur.Close(context.Background())
+			docs, docsBytes = docs[:0], 0
+			for cur.Next(ctx) {
+				doc := make(bson.Raw, len(cur.Current))
+				copy(doc, cur.Current)
+				docs = append(docs, doc)
+				docsBytes += int64(len(doc))
+			}
+			return cur.Err()
+		})
+		if err != nil {
+			return fmt.Errorf("读取源集合%s失败：%v", srcNs, err)
+		}
+		if len(docs) == 0 {
+			// 比较之后源端的文档已经被删除
+			return nil
+		}
+		addCopiedBytes(docsBytes)
+		srcReadLimiterFor(srcNs).wait(srcCtx, int64(len(docs)), docsBytes)
+		dstWriteLimiterFor(srcNs).wait(dstCtx, int64(len(docs)), docsBytes)
+		sucessNum, failNum := CustInsertMany(dstCtx, dstColl, docs, ConflictOverwrite)
+		copiedNum += sucessNum
+		if failNum != 0 {
+			return fmt.Errorf("写入目标集合%s失败的文档数：%d", ns, failNum)
+		}
+		loggerFrom(srcCtx).Debug("增量补齐", zap.String("NS", ns), zap.Int("comparedNum", len(ids)), zap.Int("copiedNum", len(docs)))
+		return nil
+	}
+
+	for cursorNext(srcCtx, cur, false) {
+		id, err := cur.Current.LookupErr("_id")
+		if err != nil {
+			return copiedNum, skippedNum, fmt.Errorf("源集合%s的文档缺少_id字段：%s", srcNs, truncateDoc(cur.Current.String()))
+		}
+		id.Value = append([]byte(nil), id.Value...) // cur.Current在读取下一条文档后失效
+		ids = append(ids, id)
+		srcKeys[rawValueKey(id)] = deltaKeyValue(cur.Current)
+		if len(ids) >= deltaBatchSize {
+			if err := flush(); err != nil {
+				return copiedNum, skippedNum, err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return copiedNum, skippedNum, fmt.Errorf("读取源集合%s失败：%v", srcNs, err)
+	}
+	return copiedNum, skippedNum, flush()
+}
+
+// 文档中比较值k的类型和原始字节，不存在该字段时为空
+func deltaKeyValue(doc bson.Raw) []byte {
+	value, err := doc.LookupErr("k")
+	if err != nil {
+		return []byte{}
+	}
+	return append([]byte{byte(value.Type)}, value.Value...)
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// 5.0+的update类型的oplog使用$v:2格式：{$v: 2, diff: <差异>}，不能直接作为更新操作符执行，需要转换为$set、$unset。
+// 文档的差异中u、i为修改和新增的字段，d为删除的字段，s<字段名>为嵌套文档或数组的差异；
+// 数组的差异中a为true，l为截短后的长度，u<下标>为修改的元素，s<下标>为元素的差异。
+// 数组截短转换为$push: {<字段>: {$each: [], $slice: <长度>}}，与同一数组中元素的修改路径冲突时需要先单独执行
+
+// 返回$v:2格式的update中的差异
+func oplogUpdateDiff(o bson.D) (bson.D, bool) {
+	if len(o) == 0 || o[0].Key != "$v" {
+		return nil, false
+	}
+	for _, e := range o {
+		if e.Key == "diff" {
+			diff, ok := e.Value.(bson.D)
+			return diff, ok
+		}
+	}
+	return nil, false
+}
+
+// 将差异转换为更新操作。truncate不为空时，需要先执行truncate（截短数组）再执行update
+func diffToUpdate(diff bson.D) (update bson.D, truncate bson.D) {
+	var u diffUpdate
+	u.object(diff, "")
+	if len(u.set) > 0 {
+		update = append(update, bson.E{"$set", u.set})
+	}
+	if len(u.unset) > 0 {
+		update = append(update, bson.E{"$unset", u.unset})
+	}
+	if len(u.push) == 0 {
+		return update, nil
+	}
+	for _, push := range u.push {
+		for _, paths := range []bson.D{u.set, u.unset} {
+			for _, e := range paths {
+				if pathsConflict(push.Key, e.Key) {
+					return update, bson.D{{"$push", u.push}}
+				}
+			}
+		}
+	}
+	return append(update, bson.E{"$push", u.push}), nil
+}
+
+type diffUpdate struct {
+	set, unset, push bson.D
+}
+
+// 文档的差异，prefix为嵌套文档的路径前缀（以.结尾）
+func (u *diffUpdate) object(diff bson.D, prefix string) {
+	for _, e := range diff {
+		switch {
+		case e.Key == "u" || e.Key == "i":
+			fields, _ := e.Value.(bson.D)
+			for _, f := range fields {
+				u.set = append(u.set, bson.E{prefix + f.Key, f.Value})
+			}
+		case e.Key == "d":
+			fields, _ := e.Value.(bson.D)
+			for _, f := range fields {
+				u.unset = append(u.unset, bson.E{prefix + f.Key, ""})
+			}
+		case strings.HasPrefix(e.Key, "s"):
+			u.sub(e.Value, prefix+e.Key[1:])
+		}
+	}
+}
+
+// 数组的差异，path为数组字段的路径
+func (u *diffUpdate) array(diff bson.D, path string) {
+	for _, e := range diff {
+		switch {
+		case e.Key == "a":
+		case e.Key == "l":
+			u.push = append(u.push, bson.E{path, bson.D{{"$each", bson.A{}}, {"$slice", e.Value}}})
+		case strings.HasPrefix(e.Key, "u"):
+			u.set = append(u.set, bson.E{path + "." + e.Key[1:], e.Value})
+		case strings.HasPrefix(e.Key, "s"):
+			u.sub(e.Value, path+"."+e.Key[1:])
+		}
+	}
+}
+
+// 嵌套文档或数组元素的差异
+func (u *diffUpdate) sub(value interface{}, path string) {
+	diff, ok := value.(bson.D)
+	if !ok {
+		return
+	}
+	if isArrayDiff(diff) {
+		u.array(diff, path)
+	} else {
+		u.object(diff, path+".")
+	}
+}
+
+func isArrayDiff(diff bson.D) bool {
+	for _, e := range diff {
+		if e.Key == "a" {
+			isArray, _ := e.Value.(bool)
+			return isArray
+		}
+	}
+	return false
+}
+
+// 两个字段路径是否相同或者一个是另一个的前缀
+func pathsConflict(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
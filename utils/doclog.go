@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+var (
+	docLogLimit       = 4096                    // 日志中doc内容的最大字节数，超过时截断。<=0表示不截断
+	errorArtifactsDir = "./mongosync_artifacts" // 被截断的失败doc的完整内容保存目录，为空表示不保存
+	artifactSeq       uint64
+)
+
+// 设置日志中doc内容的最大字节数
+func SetDocLogLimit(limit int) {
+	docLogLimit = limit
+}
+
+// 设置失败doc完整内容的保存目录
+func SetErrorArtifactsDir(dir string) {
+	errorArtifactsDir = dir
+}
+
+// 截断过长的doc内容，保证不会截断在多字节字符的中间
+func truncateDoc(s string) string {
+	if docLogLimit <= 0 || len(s) <= docLogLimit {
+		return s
+	}
+	cut := docLogLimit
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s...(共%d字节，已截断)", s[:cut], len(s))
+}
+
+// 处理写入失败的doc：日志中只保留截断后的内容，被截断时将完整内容gzip压缩后写入errorArtifactsDir。
+// 返回截断后的内容、完整内容的保存路径（未保存时为空）和保存失败的错误
+func failedDoc(ns string, doc interface{}) (string, string, error) {
+	s := fmt.Sprintf("%v", doc)
+	truncated := truncateDoc(s)
+	if truncated == s || errorArtifactsDir == "" {
+		return truncated, "", nil
+	}
+	path, err := writeErrorArtifact(ns, doc, s)
+	if err != nil {
+		return truncated, "", err
+	}
+	return truncated, path, nil
+}
+
+// 写入失败doc对应的zap日志字段
+func failedDocFields(ns string, doc interface{}) []zap.Field {
+	truncated, path, err := failedDoc(ns, doc)
+	fields := []zap.Field{zap.String("NS", ns), zap.String("doc", truncated)}
+	if path != "" {
+		fields = append(fields, zap.String("artifact", path))
+	} else if err != nil {
+		fields = append(fields, zap.NamedError("artifactError", err))
+	}
+	return fields
+}
+
+// 写入失败doc对应的普通日志内容
+func failedDocString(ns string, doc interface{}) string {
+	truncated, path, err := failedDoc(ns, doc)
+	if path != "" {
+		return fmt.Sprintf("%s\t完整内容：%s", truncated, path)
+	} else if err != nil {
+		return fmt.Sprintf("%s\t完整内容保存失败：%v", truncated, err)
+	}
+	return truncated
+}
+
+// 将doc的完整内容（优先使用扩展JSON格式）gzip压缩后保存到errorArtifactsDir中
+func writeErrorArtifact(ns string, doc interface{}, fallback string) (string, error) {
+	if err := os.MkdirAll(errorArtifactsDir, 0755); err != nil {
+		return "", err
+	}
+	content, err := bson.MarshalExtJSON(doc, true, false)
+	if err != nil {
+		content = []byte(fallback)
+	}
+	name := fmt.Sprintf("%s_%s_%d.json.gz", strings.NewReplacer("/", "_", "$", "_").Replace(ns), time.Now().Format("20060102150405"), atomic.AddUint64(&artifactSeq, 1))
+	path := filepath.Join(errorArtifactsDir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	if _, err := zw.Write(content); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// 文档大小分布的分桶上限（字节），最后一个桶为16MB以上（超过BSON文档的大小限制，一般只会出现在oplog中）
+var docSizeBuckets = []int64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+// 单个ns导入的文档大小分布
+type DocSizeHistogram struct {
+	Ns         string
+	Count      int64
+	TotalBytes int64
+	MaxBytes   int64
+	Buckets    []int64 // Buckets[i]为大小不超过docSizeBuckets[i]的文档数，最后一个元素为超过所有上限的文档数
+}
+
+var (
+	docSizeStats = make(map[string]*DocSizeHistogram) // key为源ns
+	docSizeLock  sync.Mutex
+)
+
+// 记录导入的一个文档的大小
+func (h *DocSizeHistogram) add(size int64) {
+	h.Count++
+	h.TotalBytes += size
+	if size > h.MaxBytes {
+		h.MaxBytes = size
+	}
+	i := sort.Search(len(docSizeBuckets), func(i int) bool { return size <= docSizeBuckets[i] })
+	h.Buckets[i]++
+}
+
+// 平均文档大小
+func (h *DocSizeHistogram) AvgBytes() int64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.TotalBytes / h.Count
+}
+
+// 估算百分位数：返回第p百分位文档所在桶的上限，落在最后一个桶时返回MaxBytes
+func (h *DocSizeHistogram) Percentile(p float64) int64 {
+	target := int64(float64(h.Count) * p / 100)
+	var seen int64
+	for i, n := range h.Buckets {
+		seen += n
+		if seen > target && i < len(docSizeBuckets) {
+			return docSizeBuckets[i]
+		}
+	}
+	return h.MaxBytes
+}
+
+// 为源ns创建文档大小统计，导入过程中的局部统计通过mergeDocSizeHistogram合并，避免每个文档都加锁
+func newDocSizeHistogram(ns string) *DocSizeHistogram {
+	return &DocSizeHistogram{Ns: ns, Buckets: make([]int64, len(docSizeBuckets)+1)}
+}
+
+// 将other的统计合并到h中
+func (h *DocSizeHistogram) merge(other *DocSizeHistogram) {
+	h.Count += other.Count
+	h.TotalBytes += other.TotalBytes
+	if other.MaxBytes > h.MaxBytes {
+		h.MaxBytes = other.MaxBytes
+	}
+	for i, n := range other.Buckets {
+		h.Buckets[i] += n
+	}
+}
+
+// 将单个集合导入过程中的统计合并到全局统计中，并输出到日志
+func mergeDocSizeHistogram(ctx context.Context, h *DocSizeHistogram) {
+	docSizeLock.Lock()
+	defer docSizeLock.Unlock()
+	total, exists := docSizeStats[h.Ns]
+	if !exists {
+		total = newDocSizeHistogram(h.Ns)
+		docSizeStats[h.Ns] = total
+	}
+	total.merge(h)
+	loggerFrom(ctx).Info("文档大小分布", zap.String("NS", h.Ns), zap.Int64("count", h.Count), zap.Int64("avgBytes", h.AvgBytes()), zap.Int64("p50Bytes", h.Percentile(50)), zap.Int64("p99Bytes", h.Percentile(99)), zap.Int64("maxBytes", h.MaxBytes), zap.Int64s("buckets", h.Buckets))
+}
+
+// 获取所有ns的文档大小分布，按ns排序
+func CustDocSizeStats() []DocSizeHistogram {
+	docSizeLock.Lock()
+	defer docSizeLock.Unlock()
+	var list []DocSizeHistogram
+	for _, h := range docSizeStats {
+		list = append(list, *h)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Ns < list[j].Ns })
+	return list
+}
+
+// 输出文档大小分布报告。大文档较多的集合可以考虑使用投影或者单独处理，批量写入的条数也可以参考平均大小调整
+func CustPrintDocSizeReport() {
+	list := CustDocSizeStats()
+	if len(list) == 0 {
+		return
+	}
+	var header []string
+	for _, limit := range docSizeBuckets {
+		header = append(header, "<="+formatBytes(limit))
+	}
+	header = append(header, ">"+formatBytes(docSizeBuckets[len(docSizeBuckets)-1]))
+	fmt.Println("文档大小分布：")
+	fmt.Printf("%-60s%10s%10s%10s%10s%10s  %s\n", "NS", "文档数", "平均", "P50", "P99", "最大", strings.Join(header, " "))
+	for _, h := range list {
+		var buckets []string
+		for i, n := range h.Buckets {
+			buckets = append(buckets, fmt.Sprintf("%*d", len(header[i]), n))
+		}
+		fmt.Printf("%-60s%10d%10s%10s%10s%10s  %s\n", h.Ns, h.Count, formatBytes(h.AvgBytes()), formatBytes(h.Percentile(50)), formatBytes(h.Percentile(99)), formatBytes(h.MaxBytes), strings.Join(buckets, " "))
+	}
+}
+
+// 以B、KB、MB、GB为单位格式化字节数
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dMB", n>>20)
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dKB", n>>10)
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
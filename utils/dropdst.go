@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// 全量同步默认向目标集合中upsert，目标端已有的旧数据会保留并与本次同步的数据混在一起。
+// 反复进行测试迁移时，可以在复制每个集合（或创建视图）之前删除目标集合，或将其重命名到一旁保留，从空集合开始同步。
+// 继续之前中断的任务时，已经开始复制的集合不会被删除
+const (
+	DropDstDrop   = "drop"   // 删除目标集合
+	DropDstRename = "rename" // 重命名为<集合名>_bak_<时间>
+)
+
+var dropDstMode string
+
+// 设置全量同步前如何处理目标端已存在的集合，为空时保留
+func SetDropDst(mode string) error {
+	if mode != "" && mode != DropDstDrop && mode != DropDstRename {
+		return fmt.Errorf("不支持的模式%s，可选值为%s、%s", mode, DropDstDrop, DropDstRename)
+	}
+	dropDstMode = mode
+	return nil
+}
+
+// 按--drop_dst删除或重命名目标集合，并清理该集合的chunk缓存，目标集合不存在时不做处理
+func clearDstColl(dstMongo *MongoArgs, dstDbName, dstCollName string) error {
+	return clearDstCollMode(dstMongo, dstDbName, dstCollName, dropDstMode)
+}
+
+// 删除所有目标集合并清理其chunk缓存，不受--drop_dst影响。oplog被覆盖后重新全量同步之前调用，
+// 否则丢失的oplog中源端删除的文档会一直残留在目标端。多个源ns映射到同一个目标ns时只删除一次
+func CustDropDstColls(dstMongo *MongoArgs, nsStructSlice []*NsMap) error {
+	dropped := make(map[string]bool)
+	for _, nsStruct := range nsStructSlice {
+		ns := nsStruct.DstDb + "." + nsStruct.DstColl
+		if dropped[ns] {
+			continue
+		}
+		if err := clearDstCollMode(dstMongo, nsStruct.DstDb, nsStruct.DstColl, DropDstDrop); err != nil {
+			return err
+		}
+		dropped[ns] = true
+	}
+	return nil
+}
+
+// 按mode删除或重命名目标集合，mode为空时不做处理
+func clearDstCollMode(dstMongo *MongoArgs, dstDbName, dstCollName, mode string) error {
+	if mode == "" {
+		return nil
+	}
+	ns := dstDbName + "." + dstCollName
+	// 目标集合将被清空，先清理其chunk缓存（目标集合不存在时也可能残留），否则--chunk_cache会跳过未变化的chunk，目标端缺少这些文档
+	cacheColl := dstMongo.Client().Database(mongosyncDbName).Collection(chunkCacheCollName)
+	err := doWithRetry(dstMongo.Context(), writeTimeout, "delete "+chunkCacheCollName, func(ctx context.Context) error {
+		_, err := cacheColl.DeleteMany(ctx, bson.M{"ns": ns})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("清理目标集合%s的chunk缓存失败：%v", ns, err)
+	}
+	var db string
+	var cmd bson.D
+	if mode == DropDstDrop {
+		db, cmd = dstDbName, bson.D{{"drop", dstCollName}}
+	} else {
+		bak := dstCollName + "_bak_" + time.Now().Format("20060102150405")
+		db, cmd = "admin", bson.D{{"renameCollection", ns}, {"to", dstDbName + "." + bak}}
+	}
+	err = doWithRetry(dstMongo.Context(), commandTimeout, cmd[0].Key, func(ctx context.Context) error {
+		return dstMongo.Client().Database(db).RunCommand(ctx, cmd).Err()
+	})
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == 26 { // NamespaceNotFound：目标集合不存在
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s目标集合%s失败：%v", cmd[0].Key, ns, err)
+	}
+	indexCacheFor(dstMongo.Client()).invalidate(dstDbName, cmd)
+	if mode == DropDstDrop {
+		dstMongo.logger().Info("已删除目标集合", zap.String("NS", ns))
+	} else {
+		dstMongo.logger().Info("已将目标集合重命名", zap.String("NS", ns), zap.String("to", cmd[1].Value.(string)))
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// 目标端为分片集群时，全量复制前按源端集合的分片键（源端config.collections）对目标集合分片，避免所有文档都写入
+// 主分片，再由均衡器慢慢迁移。模式：
+//
+//	key       只按源端的分片键分片
+//	presplit  分片后按源端chunk的边界预先切分，并将chunk轮流迁移到目标端的各个分片，之后的批量写入分散到所有分片；
+//	          哈希分片键由shardCollection的numInitialChunks预先切分并均匀分布
+//
+// 源端集合没有分片、目标集合已经分片或已有文档时不做处理
+const (
+	ShardDstKey      = "key"
+	ShardDstPresplit = "presplit"
+)
+
+var shardDstMode string
+
+// 预先切分的最大chunk数，源端的chunk更多时均匀抽取切分点
+const maxPresplitChunks = 1000
+
+// 设置目标集合的分片方式，为空时不分片
+func SetShardDst(mode string) error {
+	if mode != "" && mode != ShardDstKey && mode != ShardDstPresplit {
+		return fmt.Errorf("不支持的模式%s，可选值为%s、%s", mode, ShardDstKey, ShardDstPresplit)
+	}
+	shardDstMode = mode
+	return nil
+}
+
+// 源端或目标端config.collections中集合的分片信息
+type shardedCollInfo struct {
+	Key     bson.D      `bson:"key"`
+	Unique  bool        `bson:"unique"`
+	Dropped bool        `bson:"dropped"`
+	UUID    interface{} `bson:"uuid"`
+}
+
+// config.chunks中的一个chunk
+type chunkRange struct {
+	Min bson.Raw `bson:"min"`
+	Max bson.Raw `bson:"max"`
+}
+
+// 读取集合的分片信息，集合没有分片时返回nil
+func shardedCollection(mongoArgs *MongoArgs, ns string) (*shardedCollInfo, error) {
+	var info shardedCollInfo
+	err := doWithRetry(mongoArgs.Context(), findTimeout, "find config.collections", func(ctx context.Context) error {
+		return mongoArgs.Client().Database("config").Collection("collections").FindOne(ctx, bson.D{{"_id", ns}}).Decode(&info)
+	})
+	if err == mongo.ErrNoDocuments || (err == nil && (info.Dropped || len(info.Key) == 0)) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// 读取集合按min排序的chunk，5.0+的config.chunks按uuid关联集合
+func collectionChunks(mongoArgs *MongoArgs, ns string, info *shardedCollInfo) ([]chunkRange, error) {
+	filters := []bson.D{{{"ns", ns}}}
+	if info.UUID != nil {
+		filters = append([]bson.D{{{"uuid", info.UUID}}}, filters...)
+	}
+	var chunks []chunkRange
+	for _, filter := range filters {
+		err := doWithRetry(mongoArgs.Context(), findTimeout, "find config.chunks", func(ctx context.Context) error {
+			cur, err := mongoArgs.Client().Database("config").Collection("chunks").Find(ctx, filter,
+				options.Find().SetSort(bson.D{{"min", 1}}).SetProjection(bson.D{{"min", 1}, {"max", 1}}))
+			if err != nil {
+				return err
+			}
+			chunks = nil
+			return cur.All(ctx, &chunks)
+		})
+		if err != nil || len(chunks) > 0 {
+			return chunks, err
+		}
+	}
+	return nil, nil
+}
+
+// 分片键是否为哈希分片键
+func isHashedKey(key bson.D) bool {
+	for _, e := range key {
+		if e.Value == "hashed" {
+			return true
+		}
+	}
+	return false
+}
+
+// 目标端不是分片集群时只警告一次
+var dstNotSharded sync.Once
+
+// 目标端的分片，只读取一次
+var dstShardIds struct {
+	sync.Once
+	ids []string
+	err error
+}
+
+// 目标端分片的id
+func custDstShardIds(dstMongo *MongoArgs) ([]string, error) {
+	dstShardIds.Do(func() {
+		var shards []*Shard
+		shards, dstShardIds.err = CustGetShards(dstMongo)
+		for _, shard := range shards {
+			dstShardIds.ids = append(dstShardIds.ids, shard.ID)
+		}
+	})
+	return dstShardIds.ids, dstShardIds.err
+}
+
+// 在目标端执行admin命令
+func runDstAdminCommand(dstMongo *MongoArgs, desc string, cmd bson.D) error {
+	return doWithRetry(dstMongo.Context(), commandTimeout, desc, func(ctx context.Context) error {
+		return dstMongo.Client().Database("admin").RunCommand(ctx, cmd).Err()
+	})
+}
+
+// 按源端集合的分片键对目标集合分片，并按--shard_dst presplit预先切分、迁移chunk
+func shardDstCollection(srcMongo *MongoArgs, srcDbName, srcCollName string, dstMongo *MongoArgs, dstDbName, dstCollName string) error {
+	if shardDstMode == "" || !srcMongo.IsMongos() {
+		return nil
+	}
+	srcNs, ns := srcDbName+"."+srcCollName, dstDbName+"."+dstCollName
+	if !dstMongo.IsMongos() {
+		dstNotSharded.Do(func() { dstMongo.logger().Warn("目标端不是分片集群，忽略--shard_dst") })
+		return nil
+	}
+	srcInfo, err := shardedCollection(srcMongo, srcNs)
+	if err != nil {
+		return fmt.Errorf("读取源端%s的分片信息失败：%v", srcNs, err)
+	}
+	if srcInfo == nil {
+		return nil
+	}
+	if dstInfo, err := shardedCollection(dstMongo, ns); err != nil {
+		return fmt.Errorf("读取目标端%s的分片信息失败：%v", ns, err)
+	} else if dstInfo != nil {
+		dstMongo.logger().Info("目标集合已经分片，不再分片", zap.String("NS", ns), zap.String("key", fmt.Sprint(dstInfo.Key)))
+		return nil
+	}
+	dstColl := dstMongo.Client().Database(dstDbName).Collection(dstCollName)
+	var existing bson.Raw
+	err = doWithRetry(dstMongo.Context(), findTimeout, "find "+ns, func(ctx context.Context) error {
+		var err error
+		existing, err = dstColl.FindOne(ctx, bson.D{}, options.FindOne().SetProjection(bson.D{{"_id", 1}})).DecodeBytes()
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("读取目标集合%s失败：%v", ns, err)
+	}
+	if existing != nil {
+		dstMongo.logger().Warn("目标集合已有文档，不按源端的分片键分片", zap.String("NS", ns))
+		return nil
+	}
+
+	// 4.4之前需要先对库启用分片，之后的版本为空操作
+	if err := runDstAdminCommand(dstMongo, "enableSharding", bson.D{{"enableSharding", dstDbName}}); err != nil {
+		return fmt.Errorf("对目标库%s启用分片失败：%v", dstDbName, err)
+	}
+	shardIds, err := custDstShardIds(dstMongo)
+	if err != nil {
+		return fmt.Errorf("读取目标端的分片失败：%v", err)
+	}
+	hashed := isHashedKey(srcInfo.Key)
+	cmd := bson.D{{"shardCollection", ns}, {"key", srcInfo.Key}}
+	if srcInfo.Unique {
+		cmd = append(cmd, bson.E{"unique", true})
+	}
+	if spec, err := srcMongo.collectionSpec(srcDbName, srcCollName); err == nil && spec != nil {
+		if _, err := spec.Options.LookupErr("collation"); err == nil {
+			// 集合有默认排序规则时，分片键索引需要使用simple排序规则
+			cmd = append(cmd, bson.E{"collation", bson.D{{"locale", "simple"}}})
+		}
+	}
+	if hashed && shardDstMode == ShardDstPresplit {
+		cmd = append(cmd, bson.E{"numInitialChunks", int32(2 * len(shardIds))})
+	}
+	if err := runDstAdminCommand(dstMongo, "shardCollection", cmd); err != nil {
+		return fmt.Errorf("按分片键%v对目标集合%s分片失败：%v", srcInfo.Key, ns, err)
+	}
+	dstMongo.logger().Info("已按源端的分片键对目标集合分片", zap.String("NS", ns), zap.String("key", fmt.Sprint(srcInfo.Key)))
+	if shardDstMode != ShardDstPresplit || hashed || len(shardIds) < 2 {
+		return nil
+	}
+	// 预先切分只影响写入的分布，失败时由均衡器迁移，不中断同步
+	if err := presplitDstCollection(srcMongo, srcNs, srcInfo, dstMongo, ns, shardIds); err != nil {
+		dstMongo.logger().Warn("预先切分目标集合失败，由均衡器迁移chunk", zap.String("NS", ns), zap.Error(err))
+	}
+	return nil
+}
+
+// 按源端chunk的边界切分目标集合，并将chunk轮流迁移到各个分片
+func presplitDstCollection(srcMongo *MongoArgs, srcNs string, srcInfo *shardedCollInfo, dstMongo *MongoArgs, ns string, shardIds []string) error {
+	chunks, err := collectionChunks(srcMongo, srcNs, srcInfo)
+	if err != nil {
+		return fmt.Errorf("读取源端%s的chunk失败：%v", srcNs, err)
+	}
+	if len(chunks) < 2 {
+		return nil
+	}
+	// 切分点为各个chunk的min（第一个chunk的min为MinKey，不切分），超过maxPresplitChunks时均匀抽取
+	var points []bson.Raw
+	step := float64(len(chunks)) / float64(maxPresplitChunks)
+	if step < 1 {
+		step = 1
+	}
+	for i := step; int(i) < len(chunks); i += step {
+		points = append(points, chunks[int(i)].Min)
+	}
+	for _, point := range points {
+		if err := runDstAdminCommand(dstMongo, "split", bson.D{{"split", ns}, {"middle", point}}); err != nil {
+			return fmt.Errorf("在%s切分失败：%v", point.String(), err)
+		}
+	}
+	// 各个chunk的范围：[MinKey, points[0])、[points[0], points[1])、...、[points[n-1], MaxKey)
+	bounds := append([]bson.Raw{chunks[0].Min}, points...)
+	bounds = append(bounds, chunks[len(chunks)-1].Max)
+	var moved int
+	for i := 0; i+1 < len(bounds); i++ {
+		to := shardIds[i%len(shardIds)]
+		err := runDstAdminCommand(dstMongo, "moveChunk", bson.D{{"moveChunk", ns}, {"bounds", bson.A{bounds[i], bounds[i+1]}}, {"to", to}})
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.Code == 20 { // IllegalOperation：chunk已经在目标分片上
+			continue
+		} else if err != nil {
+			return fmt.Errorf("迁移chunk%s到%s失败：%v", bounds[i].String(), to, err)
+		}
+		moved++
+	}
+	dstMongo.logger().Info("已预先切分目标集合", zap.String("NS", ns), zap.Int("chunkNum", len(bounds)-1), zap.Int("movedNum", moved), zap.Strings("shards", shardIds))
+	return nil
+}
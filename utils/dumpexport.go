@@ -0,0 +1,495 @@
+package utils
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// 导出为mongodump格式的备份：没有可用的目标端时，将选择的集合写入mongodump兼容的输出目录（<db>/<coll>.bson和
+// <coll>.metadata.json）或单个归档文件，可以用mongorestore或--dump导入。名称空间映射和投影与全量同步相同。
+// 导出时记录源端的oplog位置，导出完成后将这段时间内选择的集合的oplog写入oplog.bson（与mongodump --oplog相同），
+// 导入数据后重放这部分oplog即得到导出结束时刻一致的数据
+
+// 导出的选项
+type ExportOptions struct {
+	Archive bool // 写入单个归档文件，否则写入输出目录
+	Gzip    bool
+	Oplog   bool                // 导出期间的oplog写入oplog.bson
+	StartTS primitive.Timestamp // Oplog为true时，导出开始前源端的oplog位置
+	Workers int
+}
+
+// 归档文件中每个数据块的最大字节数，多个集合的数据块交错写入
+const exportBlockBytes = 1 << 20
+
+// 一个导出的集合（或oplog）
+type exportColl interface {
+	write(doc bson.Raw) error
+	close() error
+}
+
+// 备份的写入端：输出目录或归档文件
+type exportWriter struct {
+	path string
+	opts ExportOptions
+
+	lock    sync.Mutex // 归档文件的写入
+	file    *os.File
+	gz      *gzip.Writer
+	archive *bufio.Writer
+}
+
+// 创建文件，需要时压缩
+func createExportFile(path string, gz bool) (io.Writer, func() error, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !gz {
+		w := bufio.NewWriterSize(f, 1<<20)
+		return w, func() error {
+			if err := w.Flush(); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		}, nil
+	}
+	gzw := gzip.NewWriter(f)
+	w := bufio.NewWriterSize(gzw, 1<<20)
+	return w, func() error {
+		err := w.Flush()
+		if err == nil {
+			err = gzw.Close()
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}, nil
+}
+
+func writeTerminator(w io.Writer) error {
+	var term [4]byte
+	binary.LittleEndian.PutUint32(term[:], dumpTerminator)
+	_, err := w.Write(term[:])
+	return err
+}
+
+// 目录格式中文件名的后缀
+func (e *exportWriter) suffix() string {
+	if e.opts.Gzip {
+		return ".gz"
+	}
+	return ""
+}
+
+// 写入目录格式中一个集合的元数据
+func (e *exportWriter) writeMetadata(db, coll, metadata string) error {
+	if err := os.MkdirAll(filepath.Join(e.path, db), 0755); err != nil {
+		return err
+	}
+	w, closeFile, err := createExportFile(filepath.Join(e.path, db, coll+".metadata.json"+e.suffix()), e.opts.Gzip)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, metadata); err != nil {
+		closeFile()
+		return err
+	}
+	return closeFile()
+}
+
+// 写入归档文件的magic和头部，头部包含所有集合的元数据
+func (e *exportWriter) writeArchiveHeader(serverVersion string, metas []exportMeta) error {
+	var magic [4]byte
+	binary.LittleEndian.PutUint32(magic[:], dumpArchiveMagic)
+	if _, err := e.archive.Write(magic[:]); err != nil {
+		return err
+	}
+	prelude, _ := bson.Marshal(bson.D{{"version", "0.1"}, {"server_version", serverVersion}, {"tool_version", "mongosync"}, {"concurrent_collections", int32(e.opts.Workers)}})
+	if _, err := e.archive.Write(prelude); err != nil {
+		return err
+	}
+	for _, meta := range metas {
+		doc, _ := bson.Marshal(bson.D{{"db", meta.db}, {"collection", meta.coll}, {"metadata", meta.metadata}, {"size", int32(0)}, {"type", meta.typ}})
+		if _, err := e.archive.Write(doc); err != nil {
+			return err
+		}
+	}
+	return writeTerminator(e.archive)
+}
+
+// 开始写入一个集合的文档，db为空、coll为oplog时写入oplog
+func (e *exportWriter) begin(db, coll string) (exportColl, error) {
+	if e.opts.Archive {
+		return &archiveExportColl{writer: e, db: db, coll: coll, crc: crc64.New(crc64.MakeTable(crc64.ECMA))}, nil
+	}
+	path := filepath.Join(e.path, db, coll+".bson"+e.suffix())
+	if db == "" {
+		path = filepath.Join(e.path, "oplog.bson"+e.suffix())
+	}
+	w, closeFile, err := createExportFile(path, e.opts.Gzip)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExportColl{w: w, closeFile: closeFile}, nil
+}
+
+// 关闭写入端
+func (e *exportWriter) close() error {
+	if !e.opts.Archive {
+		return nil
+	}
+	err := e.archive.Flush()
+	if err == nil && e.gz != nil {
+		err = e.gz.Close()
+	}
+	if err != nil {
+		e.file.Close()
+		return err
+	}
+	return e.file.Close()
+}
+
+// 目录格式中一个集合的.bson文件
+type fileExportColl struct {
+	w         io.Writer
+	closeFile func() error
+}
+
+func (c *fileExportColl) write(doc bson.Raw) error {
+	_, err := c.w.Write(doc)
+	return err
+}
+
+func (c *fileExportColl) close() error {
+	return c.closeFile()
+}
+
+// 归档文件中一个集合的数据块，文档累积到exportBlockBytes后作为一个数据块写入
+type archiveExportColl struct {
+	writer   *exportWriter
+	db, coll string
+	buf      []byte
+	crc      hash.Hash64
+}
+
+func (c *archiveExportColl) write(doc bson.Raw) error {
+	c.buf = append(c.buf, doc...)
+	c.crc.Write(doc)
+	if len(c.buf) >= exportBlockBytes {
+		return c.flush(false)
+	}
+	return nil
+}
+
+func (c *archiveExportColl) flush(eof bool) error {
+	if len(c.buf) == 0 && !eof {
+		return nil
+	}
+	e := c.writer
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if len(c.buf) > 0 {
+		header, _ := bson.Marshal(bson.D{{"db", c.db}, {"collection", c.coll}, {"EOF", false}, {"CRC", int64(0)}})
+		if _, err := e.archive.Write(header); err != nil {
+			return err
+		}
+		if _, err := e.archive.Write(c.buf); err != nil {
+			return err
+		}
+		if err := writeTerminator(e.archive); err != nil {
+			return err
+		}
+		c.buf = c.buf[:0]
+	}
+	if eof {
+		header, _ := bson.Marshal(bson.D{{"db", c.db}, {"collection", c.coll}, {"EOF", true}, {"CRC", int64(c.crc.Sum64())}})
+		if _, err := e.archive.Write(header); err != nil {
+			return err
+		}
+		return writeTerminator(e.archive)
+	}
+	return nil
+}
+
+func (c *archiveExportColl) close() error {
+	return c.flush(true)
+}
+
+// 导出的集合的元数据
+type exportMeta struct {
+	nsmap    *NsMap
+	db, coll string // 备份中的名称，即映射后的目标ns
+	typ      string
+	metadata string // metadata.json的内容
+}
+
+// 读取源集合的选项和索引，生成metadata.json
+func exportMetadata(srcMongo *MongoArgs, nsmap *NsMap) (exportMeta, error) {
+	ns := nsmap.SrcDb + "." + nsmap.SrcColl
+	meta := exportMeta{nsmap: nsmap, db: nsmap.DstDb, coll: nsmap.DstColl, typ: "collection"}
+	spec, err := srcMongo.collectionSpec(nsmap.SrcDb, nsmap.SrcColl)
+	if err != nil {
+		return meta, fmt.Errorf("获取%s的集合选项失败：%v", ns, err)
+	}
+	options := bson.Raw(emptyDocument)
+	if spec != nil {
+		if len(spec.Options) > 0 {
+			options = spec.Options
+		}
+		switch spec.Type {
+		case "view":
+			meta.typ = "view"
+		case "timeseries":
+			// 时序集合按普通集合导出其中的文档
+			srcMongo.logger().Warn("时序集合按普通集合导出", zap.String("NS", ns))
+			options = bson.Raw(emptyDocument)
+		}
+	}
+	metadata := bson.D{{"options", options}, {"indexes", bson.A{}}, {"collectionName", nsmap.DstColl}, {"type", meta.typ}}
+	if meta.typ != "view" {
+		var indexes []bson.Raw
+		coll := srcMongo.Client().Database(nsmap.SrcDb).Collection(nsmap.SrcColl)
+		err := doWithRetry(srcMongo.Context(), commandTimeout, "listIndexes "+ns, func(ctx context.Context) error {
+			cur, err := coll.Indexes().List(ctx)
+			if err != nil {
+				return err
+			}
+			indexes = nil
+			return cur.All(ctx, &indexes)
+		})
+		if err != nil {
+			return meta, fmt.Errorf("获取%s的索引失败：%v", ns, err)
+		}
+		list := bson.A{}
+		for _, index := range indexes {
+			var spec bson.D
+			for _, e := range mustElements(index) {
+				if e.Key() != "ns" {
+					spec = append(spec, bson.E{e.Key(), e.Value()})
+				}
+			}
+			list = append(list, spec)
+		}
+		metadata[1].Value = list
+	}
+	data, err := bson.MarshalExtJSON(metadata, true, false)
+	if err != nil {
+		return meta, fmt.Errorf("生成%s的元数据失败：%v", ns, err)
+	}
+	meta.metadata = string(data)
+	return meta, nil
+}
+
+// 空的BSON文档
+var emptyDocument = []byte{5, 0, 0, 0, 0}
+
+// 导出一个集合的文档
+func exportCollection(srcMongo *MongoArgs, writer *exportWriter, meta exportMeta) error {
+	start := time.Now()
+	nsmap := meta.nsmap
+	srcNs := nsmap.SrcDb + "." + nsmap.SrcColl
+	notifyProgress(func(listener ProgressListener) { listener.OnCollectionStart(*nsmap) })
+	waitFullSyncMemberLag(srcMongo.Context())
+	out, err := writer.begin(meta.db, meta.coll)
+	if err != nil {
+		return err
+	}
+	findOpts := options.Find().SetBatchSize(int32(copyBatchDocs))
+	if p := projectionFor(srcNs); p != nil {
+		findOpts.SetProjection(p.spec)
+	}
+	coll := srcMongo.Client().Database(nsmap.SrcDb).Collection(nsmap.SrcColl)
+	opCtx, cancel := withTimeout(srcMongo.Context(), findTimeout)
+	cur, err := coll.Find(opCtx, withNsFilter(srcNs, bson.M{}), findOpts)
+	cancel()
+	if err != nil {
+		out.close()
+		return fmt.Errorf("读取源集合%s失败：%v", srcNs, err)
+	}
+	defer cur.Close(context.Background())
+	var exportedNum int64
+	for cursorNext(srcMongo.Context(), cur, false) {
+		srcReadLimiter.wait(srcMongo.Context(), 1, int64(len(cur.Current)))
+		if err := out.write(cur.Current); err != nil {
+			out.close()
+			return fmt.Errorf("写入%s失败：%v", meta.db+"."+meta.coll, err)
+		}
+		addCopiedBytes(int64(len(cur.Current)))
+		exportedNum++
+	}
+	if err := cur.Err(); err != nil {
+		out.close()
+		return fmt.Errorf("读取源集合%s失败：%v", srcNs, err)
+	}
+	if err := out.close(); err != nil {
+		return fmt.Errorf("写入%s失败：%v", meta.db+"."+meta.coll, err)
+	}
+	fmt.Printf("%s导出完成，导出数量：%v，耗时：%.2f秒\n", srcNs, exportedNum, time.Since(start).Seconds())
+	notifyProgress(func(listener ProgressListener) { listener.OnCollectionDone(*nsmap, exportedNum, 0, time.Since(start)) })
+	return nil
+}
+
+// 将startTS到endTS之间选择的集合的oplog写入备份
+func exportOplog(srcMongo *MongoArgs, writer *exportWriter, startTS, endTS primitive.Timestamp, nsSlice []string) (int64, error) {
+	out, err := writer.begin("", "oplog")
+	if err != nil {
+		return 0, err
+	}
+	coll := srcMongo.Client().Database("local").Collection("oplog.rs")
+	filter := bson.D{{"ts", bson.D{{"$gte", startTS}, {"$lte", endTS}}}}
+	opCtx, cancel := withTimeout(srcMongo.Context(), findTimeout)
+	cur, err := coll.Find(opCtx, filter, options.Find().SetSort(bson.D{{"$natural", 1}}))
+	cancel()
+	if err != nil {
+		out.close()
+		return 0, fmt.Errorf("读取源端oplog失败：%v", err)
+	}
+	defer cur.Close(context.Background())
+	var exportedNum int64
+	for cursorNext(srcMongo.Context(), cur, false) {
+		var oplog OPLOG
+		if err := bson.Unmarshal(cur.Current, &oplog); err != nil {
+			out.close()
+			return exportedNum, fmt.Errorf("解析oplog失败：%v", err)
+		}
+		if oplog.OP == "n" || oplog.FromMigrate {
+			continue
+		}
+		if dbName, collName := CustGetOplogNs(oplog); !containsOplogNs(dbName+"."+collName, nsSlice) {
+			continue
+		}
+		if err := out.write(cur.Current); err != nil {
+			out.close()
+			return exportedNum, err
+		}
+		exportedNum++
+	}
+	if err := cur.Err(); err != nil {
+		out.close()
+		return exportedNum, fmt.Errorf("读取源端oplog失败：%v", err)
+	}
+	return exportedNum, out.close()
+}
+
+// 将nsStructSlice中的集合导出为mongodump格式的备份。srcMongo读取集合（可以是--src_full_sync_member选择的从节点），
+// oplogSrc读取oplog。opts.Oplog为true时返回备份中的数据对应的oplog位置，导入后从该位置继续重放
+func CustExport(srcMongo, oplogSrc *MongoArgs, path string, nsStructSlice []*NsMap, nsSlice []string, opts ExportOptions) (primitive.Timestamp, error) {
+	writer := &exportWriter{path: path, opts: opts}
+	if opts.Workers <= 0 {
+		writer.opts.Workers = 1
+	}
+
+	// 先读取所有集合的元数据，归档文件的头部需要包含全部集合
+	var metas []exportMeta
+	for _, nsmap := range nsStructSlice {
+		meta, err := exportMetadata(srcMongo, nsmap)
+		if err != nil {
+			return primitive.Timestamp{}, err
+		}
+		metas = append(metas, meta)
+	}
+	if opts.Archive {
+		f, err := os.Create(path)
+		if err != nil {
+			return primitive.Timestamp{}, err
+		}
+		writer.file = f
+		var w io.Writer = f
+		if opts.Gzip {
+			writer.gz = gzip.NewWriter(f)
+			w = writer.gz
+		}
+		writer.archive = bufio.NewWriterSize(w, 4<<20)
+		var serverVersion string
+		if info, err := srcMongo.ServerInfo(); err == nil {
+			serverVersion = info.Version
+		}
+		if opts.Oplog {
+			metas = append(metas, exportMeta{db: "", coll: "oplog", typ: "collection"})
+		}
+		if err := writer.writeArchiveHeader(serverVersion, metas); err != nil {
+			writer.close()
+			return primitive.Timestamp{}, err
+		}
+		if opts.Oplog {
+			metas = metas[:len(metas)-1]
+		}
+	} else {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return primitive.Timestamp{}, err
+		}
+		for _, meta := range metas {
+			if err := writer.writeMetadata(meta.db, meta.coll, meta.metadata); err != nil {
+				return primitive.Timestamp{}, err
+			}
+		}
+	}
+
+	// writer.opts.Workers个集合并发导出
+	queue := make(chan exportMeta, len(metas))
+	for _, meta := range metas {
+		if meta.typ != "view" {
+			queue <- meta
+		}
+	}
+	close(queue)
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	var firstErr error
+	for i := 0; i < writer.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for meta := range queue {
+				if err := exportCollection(srcMongo, writer, meta); err != nil {
+					errLock.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errLock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		writer.close()
+		return primitive.Timestamp{}, firstErr
+	}
+
+	var endTS primitive.Timestamp
+	if opts.Oplog {
+		var err error
+		if endTS, err = CustGetLatestOplogTimestamp(oplogSrc); err != nil {
+			writer.close()
+			return primitive.Timestamp{}, fmt.Errorf("获取源端最新的oplog位置失败：%v", err)
+		}
+		exportedNum, err := exportOplog(oplogSrc, writer, opts.StartTS, endTS, nsSlice)
+		if err != nil {
+			writer.close()
+			return primitive.Timestamp{}, err
+		}
+		oplogSrc.logger().Info("导出期间的oplog已写入备份", zap.Int64("num", exportedNum),
+			zap.Uint32("startT", opts.StartTS.T), zap.Uint32("startI", opts.StartTS.I), zap.Uint32("endT", endTS.T), zap.Uint32("endI", endTS.I))
+	}
+	return endTS, writer.close()
+}
@@ -0,0 +1,587 @@
+package utils
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// mongodump备份作为源端：读取mongodump的归档文件（--archive，可以是--gzip压缩的）或输出目录（<db>/<coll>.bson和
+// <coll>.metadata.json，可以是.gz），按--db、--nsInclude、--nsExclude选择集合，按名称空间映射写入目标端，
+// 与全量同步使用相同的批量写入、投影和钩子。备份中包含oplog（mongodump --oplog）时，导入数据后按顺序重放，
+// 之后可以从备份中最后一条oplog的位置开始，使用--replayoplog从源端重放后续的oplog
+
+// 归档文件的格式：magic、头部（prelude以及每个集合的元数据，以终止符结束）、数据块（块头、若干文档、终止符）
+const (
+	dumpArchiveMagic = uint32(0x8199e26d)
+	dumpTerminator   = uint32(0xffffffff)
+)
+
+var errDumpTerminator = errors.New("终止符")
+
+// 备份中的集合
+type dumpColl struct {
+	Db, Coll string
+	Options  bson.Raw   // metadata.json中的options
+	Indexes  []bson.Raw // metadata.json中的indexes
+	View     bool
+	file     string // 目录格式下的.bson文件，集合没有数据文件（如视图）时为空
+}
+
+func (c *dumpColl) ns() string {
+	return c.Db + "." + c.Coll
+}
+
+// metadata.json的内容
+type dumpMetadata struct {
+	Options bson.Raw   `bson:"options"`
+	Indexes []bson.Raw `bson:"indexes"`
+	Type    string     `bson:"type"`
+}
+
+// 归档文件头部中每个集合的元数据
+type dumpArchiveColl struct {
+	Db       string `bson:"db"`
+	Coll     string `bson:"collection"`
+	Metadata string `bson:"metadata"`
+}
+
+// 归档文件数据块的块头
+type dumpArchiveBlock struct {
+	Db   string `bson:"db"`
+	Coll string `bson:"collection"`
+	EOF  bool   `bson:"EOF"`
+}
+
+// 读取的备份：归档文件或输出目录
+type dumpSource struct {
+	path      string
+	archive   bool
+	colls     []*dumpColl
+	oplogFile string // 目录格式下的oplog.bson
+}
+
+// 打开文件，gzip压缩的文件自动解压
+func openDumpFile(path string) (io.Reader, func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReaderSize(f, 1<<20)
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return bufio.NewReaderSize(gz, 1<<20), func() { gz.Close(); f.Close() }, nil
+	}
+	return r, func() { f.Close() }, nil
+}
+
+// 读取一个BSON文档，读到归档文件的终止符时返回errDumpTerminator，文件结束时返回io.EOF
+func readDumpDoc(r io.Reader) (bson.Raw, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("备份文件不完整：%v", err)
+		}
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[:])
+	if size == dumpTerminator {
+		return nil, errDumpTerminator
+	}
+	if size < 5 || size > 64<<20 {
+		return nil, fmt.Errorf("BSON文档的长度%d错误", size)
+	}
+	doc := make(bson.Raw, size)
+	copy(doc, header[:])
+	if _, err := io.ReadFull(r, doc[4:]); err != nil {
+		return nil, fmt.Errorf("备份文件不完整：%v", err)
+	}
+	return doc, nil
+}
+
+// 解析metadata.json（扩展JSON）
+func parseDumpMetadata(data []byte, coll *dumpColl) error {
+	if len(data) == 0 {
+		return nil
+	}
+	var metadata dumpMetadata
+	if err := bson.UnmarshalExtJSON(data, false, &metadata); err != nil {
+		return err
+	}
+	coll.Options, coll.Indexes, coll.View = metadata.Options, metadata.Indexes, metadata.Type == "view"
+	return nil
+}
+
+// 打开备份，读取其中的集合列表和元数据
+func openDump(path string) (*dumpSource, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	source := &dumpSource{path: path, archive: !info.IsDir()}
+	if source.archive {
+		r, closeFile, err := openDumpFile(path)
+		if err != nil {
+			return nil, err
+		}
+		defer closeFile()
+		colls, err := readDumpArchiveHeader(r)
+		if err != nil {
+			return nil, fmt.Errorf("读取归档文件%s的头部失败：%v", path, err)
+		}
+		source.colls = colls
+		return source, nil
+	}
+
+	colls := make(map[string]*dumpColl)
+	collFor := func(db, name string) *dumpColl {
+		if colls[db+"."+name] == nil {
+			colls[db+"."+name] = &dumpColl{Db: db, Coll: name}
+		}
+		return colls[db+"."+name]
+	}
+	if _, err := os.Stat(filepath.Join(path, "oplog.bson")); err == nil {
+		source.oplogFile = filepath.Join(path, "oplog.bson")
+	}
+	dbDirs, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, dbDir := range dbDirs {
+		if !dbDir.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(path, dbDir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			name := strings.TrimSuffix(file.Name(), ".gz")
+			full := filepath.Join(path, dbDir.Name(), file.Name())
+			switch {
+			case strings.HasSuffix(name, ".metadata.json"):
+				coll := collFor(dbDir.Name(), strings.TrimSuffix(name, ".metadata.json"))
+				r, closeFile, err := openDumpFile(full)
+				if err != nil {
+					return nil, err
+				}
+				data, err := io.ReadAll(r)
+				closeFile()
+				if err == nil {
+					err = parseDumpMetadata(data, coll)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("解析%s失败：%v", full, err)
+				}
+			case strings.HasSuffix(name, ".bson"):
+				collFor(dbDir.Name(), strings.TrimSuffix(name, ".bson")).file = full
+			}
+		}
+	}
+	for _, coll := range colls {
+		source.colls = append(source.colls, coll)
+	}
+	sort.Slice(source.colls, func(i, j int) bool { return source.colls[i].ns() < source.colls[j].ns() })
+	return source, nil
+}
+
+// 读取归档文件的magic和头部，返回各个集合的元数据
+func readDumpArchiveHeader(r io.Reader) ([]*dumpColl, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(magic[:]) != dumpArchiveMagic {
+		return nil, errors.New("不是mongodump的归档文件")
+	}
+	// prelude：归档格式的版本、服务端版本等
+	if _, err := readDumpDoc(r); err != nil {
+		return nil, err
+	}
+	var colls []*dumpColl
+	for {
+		doc, err := readDumpDoc(r)
+		if err == errDumpTerminator {
+			return colls, nil
+		} else if err != nil {
+			return nil, err
+		}
+		var entry dumpArchiveColl
+		if err := bson.Unmarshal(doc, &entry); err != nil {
+			return nil, err
+		}
+		coll := &dumpColl{Db: entry.Db, Coll: entry.Coll}
+		if err := parseDumpMetadata([]byte(entry.Metadata), coll); err != nil {
+			return nil, fmt.Errorf("解析%s的元数据失败：%v", coll.ns(), err)
+		}
+		colls = append(colls, coll)
+	}
+}
+
+// 备份中的集合列表（db.coll），不包括默认排除的系统集合和oplog
+func CustDumpNamespaces(path string) ([]string, error) {
+	source, err := openDump(path)
+	if err != nil {
+		return nil, err
+	}
+	var namespaces []string
+	for _, coll := range source.colls {
+		if coll.Db != "" && !IsSystemNs(coll.ns()) {
+			namespaces = append(namespaces, coll.ns())
+		}
+	}
+	return namespaces, nil
+}
+
+// 按备份中的元数据在目标端创建集合（或视图）和索引
+func createDumpColl(dstMongo *MongoArgs, coll *dumpColl, nsmap *NsMap, noIndex bool) error {
+	dstDb := dstMongo.Client().Database(nsmap.DstDb)
+	ns := nsmap.DstDb + "." + nsmap.DstColl
+	names := copiedCollOptions
+	if coll.View {
+		names = []string{"viewOn", "pipeline", "collation"}
+	}
+	cmd := bson.D{{"create", nsmap.DstColl}}
+	for _, name := range names {
+		if value, err := coll.Options.LookupErr(name); err == nil {
+			cmd = append(cmd, bson.E{name, value})
+		}
+	}
+	if len(cmd) > 1 {
+		err := doWithRetry(dstMongo.Context(), commandTimeout, "create", func(ctx context.Context) error {
+			return dstDb.RunCommand(ctx, cmd).Err()
+		})
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.Code == 48 { // NamespaceExists：目标集合已经存在时沿用已有的集合
+			dstMongo.logger().Warn("目标集合已经存在，未按备份中的选项重新创建", zap.String("NS", ns))
+		} else if err != nil {
+			return fmt.Errorf("创建%s失败：%v", ns, err)
+		}
+	}
+	if noIndex || coll.View {
+		return nil
+	}
+	var indexes bson.A
+	for _, index := range coll.Indexes {
+		if name, _ := index.Lookup("name").StringValueOK(); name == "_id_" {
+			continue
+		}
+		var spec bson.D
+		for _, e := range mustElements(index) {
+			if key := e.Key(); key != "v" && key != "ns" {
+				spec = append(spec, bson.E{key, e.Value()})
+			}
+		}
+		indexes = append(indexes, spec)
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+	err := doWithRetry(dstMongo.Context(), commandTimeout, "createIndexes", func(ctx context.Context) error {
+		return dstDb.RunCommand(ctx, bson.D{{"createIndexes", nsmap.DstColl}, {"indexes", indexes}}).Err()
+	})
+	if err != nil {
+		return fmt.Errorf("在%s上创建索引失败：%v", ns, err)
+	}
+	indexCacheFor(dstMongo.Client()).invalidate(nsmap.DstDb, bson.D{{"createIndexes", nsmap.DstColl}})
+	return nil
+}
+
+// 文档的所有元素，文档已经通过长度校验，解析失败时返回空
+func mustElements(doc bson.Raw) []bson.RawElement {
+	elems, _ := doc.Elements()
+	return elems
+}
+
+// 将一个集合的文档分批写入目标端
+type dumpWriter struct {
+	dstMongo    *MongoArgs
+	coll        *mongo.Collection
+	srcNs       string
+	policy      ConflictPolicy
+	docs        []interface{}
+	bytes       int64
+	insertedNum int64
+}
+
+func (w *dumpWriter) add(doc bson.Raw) error {
+	var value interface{} = doc
+	if p := projectionFor(w.srcNs); p != nil {
+		var d bson.D
+		if err := bson.Unmarshal(doc, &d); err != nil {
+			return err
+		}
+		value = p.apply(d, "")
+	}
+	addCopiedBytes(int64(len(doc)))
+	w.docs = append(w.docs, value)
+	w.bytes += int64(len(doc))
+	if len(w.docs) >= copyBatchDocs || (copyBatchBytes > 0 && w.bytes >= copyBatchBytes) {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *dumpWriter) flush() error {
+	if len(w.docs) == 0 {
+		return nil
+	}
+	dstWriteLimiter.wait(w.dstMongo.Context(), int64(len(w.docs)), w.bytes)
+	sucessNum, failNum := CustInsertMany(w.dstMongo.Context(), w.coll, w.docs, w.policy)
+	w.insertedNum += sucessNum
+	w.docs, w.bytes = nil, 0
+	if failNum != 0 {
+		return fmt.Errorf("写入%s失败的文档数：%d", w.coll.Database().Name()+"."+w.coll.Name(), failNum)
+	}
+	return nil
+}
+
+// 从备份导入nsStructSlice中的集合并重放备份中的oplog，workers为目录格式下并发导入的集合数。
+// 返回备份中最后一条oplog的ts，备份中没有oplog时为空
+func CustLoadDump(path string, dstMongo *MongoArgs, nsStructSlice []*NsMap, nsSlice []string, nsnsMap map[string]string, workers int, policy ConflictPolicy, noIndex bool) (primitive.Timestamp, error) {
+	source, err := openDump(path)
+	if err != nil {
+		return primitive.Timestamp{}, err
+	}
+	if len(nsFilters) > 0 {
+		dstMongo.logger().Warn("从备份导入时不支持--filters_file，导入全部文档")
+	}
+	selected := make(map[string]*NsMap, len(nsStructSlice))
+	for _, nsmap := range nsStructSlice {
+		selected[nsmap.SrcDb+"."+nsmap.SrcColl] = nsmap
+	}
+	byNs := make(map[string]*dumpColl)
+	for _, coll := range source.colls {
+		if nsmap := selected[coll.ns()]; nsmap != nil {
+			byNs[coll.ns()] = coll
+			if err := createDumpColl(dstMongo, coll, nsmap, noIndex); err != nil {
+				return primitive.Timestamp{}, err
+			}
+		}
+	}
+	writerFor := func(nsmap *NsMap) *dumpWriter {
+		coll := dstMongo.Client().Database(nsmap.DstDb).Collection(nsmap.DstColl)
+		return &dumpWriter{dstMongo: dstMongo, coll: coll, srcNs: nsmap.SrcDb + "." + nsmap.SrcColl, policy: conflictPolicyFor(nsmap.SrcDb+"."+nsmap.SrcColl, policy)}
+	}
+	done := func(nsmap *NsMap, w *dumpWriter, start time.Time) {
+		fmt.Printf("%s从备份导入完成，导入数量：%v，耗时：%.2f秒\n", nsmap.SrcDb+"."+nsmap.SrcColl, w.insertedNum, time.Since(start).Seconds())
+		notifyProgress(func(listener ProgressListener) {
+			listener.OnCollectionDone(*nsmap, w.insertedNum, 0, time.Since(start))
+		})
+		CustRunHooks(HookPhaseAfterCopy, dstMongo, nsmap.DstDb, nsmap.DstColl)
+	}
+
+	if source.archive {
+		return loadDumpArchive(source, dstMongo, selected, writerFor, done, nsSlice, nsnsMap)
+	}
+
+	// 目录格式：每个集合一个文件，并发导入
+	if workers <= 0 {
+		workers = 1
+	}
+	queue := make(chan *dumpColl, len(byNs))
+	for _, coll := range source.colls {
+		if byNs[coll.ns()] != nil && coll.file != "" {
+			queue <- coll
+		}
+	}
+	close(queue)
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	var firstErr error
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for coll := range queue {
+				if err := loadDumpFile(coll, selected[coll.ns()], writerFor, done); err != nil {
+					errLock.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errLock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return primitive.Timestamp{}, firstErr
+	}
+	if source.oplogFile == "" {
+		return primitive.Timestamp{}, nil
+	}
+	r, closeFile, err := openDumpFile(source.oplogFile)
+	if err != nil {
+		return primitive.Timestamp{}, err
+	}
+	defer closeFile()
+	replayer := &dumpOplogReplayer{dstMongo: dstMongo, nsSlice: nsSlice, nsnsMap: nsnsMap}
+	for {
+		doc, err := readDumpDoc(r)
+		if err == io.EOF {
+			return replayer.lastTS, replayer.finish()
+		} else if err != nil {
+			return replayer.lastTS, err
+		}
+		if err := replayer.apply(doc); err != nil {
+			return replayer.lastTS, err
+		}
+	}
+}
+
+// 导入目录格式中一个集合的.bson文件
+func loadDumpFile(coll *dumpColl, nsmap *NsMap, writerFor func(*NsMap) *dumpWriter, done func(*NsMap, *dumpWriter, time.Time)) error {
+	start := time.Now()
+	notifyProgress(func(listener ProgressListener) { listener.OnCollectionStart(*nsmap) })
+	r, closeFile, err := openDumpFile(coll.file)
+	if err != nil {
+		return err
+	}
+	defer closeFile()
+	w := writerFor(nsmap)
+	for {
+		doc, err := readDumpDoc(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("读取%s失败：%v", coll.file, err)
+		}
+		if err := w.add(doc); err != nil {
+			return err
+		}
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	done(nsmap, w, start)
+	return nil
+}
+
+// 导入归档文件。归档文件中多个集合的数据块交错排列，按集合分别累积批次；oplog在所有集合之后
+func loadDumpArchive(source *dumpSource, dstMongo *MongoArgs, selected map[string]*NsMap, writerFor func(*NsMap) *dumpWriter,
+	done func(*NsMap, *dumpWriter, time.Time), nsSlice []string, nsnsMap map[string]string) (primitive.Timestamp, error) {
+	r, closeFile, err := openDumpFile(source.path)
+	if err != nil {
+		return primitive.Timestamp{}, err
+	}
+	defer closeFile()
+	if _, err := readDumpArchiveHeader(r); err != nil {
+		return primitive.Timestamp{}, err
+	}
+	writers := make(map[string]*dumpWriter)
+	starts := make(map[string]time.Time)
+	replayer := &dumpOplogReplayer{dstMongo: dstMongo, nsSlice: nsSlice, nsnsMap: nsnsMap}
+	for {
+		header, err := readDumpDoc(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return replayer.lastTS, fmt.Errorf("读取归档文件失败：%v", err)
+		}
+		var block dumpArchiveBlock
+		if err := bson.Unmarshal(header, &block); err != nil {
+			return replayer.lastTS, fmt.Errorf("解析归档文件的块头失败：%v", err)
+		}
+		ns := block.Db + "." + block.Coll
+		oplog := block.Db == "" && block.Coll == "oplog"
+		nsmap := selected[ns]
+		w := writers[ns]
+		if nsmap != nil && w == nil && !block.EOF {
+			w, starts[ns] = writerFor(nsmap), time.Now()
+			writers[ns] = w
+			notifyProgress(func(listener ProgressListener) { listener.OnCollectionStart(*nsmap) })
+		}
+		for {
+			doc, err := readDumpDoc(r)
+			if err == errDumpTerminator {
+				break
+			} else if err != nil {
+				return replayer.lastTS, fmt.Errorf("读取归档文件失败：%v", err)
+			}
+			switch {
+			case oplog:
+				if err := replayer.apply(doc); err != nil {
+					return replayer.lastTS, err
+				}
+			case w != nil:
+				if err := w.add(doc); err != nil {
+					return replayer.lastTS, err
+				}
+			}
+		}
+		if block.EOF && w != nil {
+			if err := w.flush(); err != nil {
+				return replayer.lastTS, err
+			}
+			done(nsmap, w, starts[ns])
+			delete(writers, ns)
+		}
+	}
+	for ns, w := range writers {
+		if err := w.flush(); err != nil {
+			return replayer.lastTS, err
+		}
+		done(selected[ns], w, starts[ns])
+	}
+	return replayer.lastTS, replayer.finish()
+}
+
+// 按顺序重放备份中的oplog
+type dumpOplogReplayer struct {
+	dstMongo   *MongoArgs
+	nsSlice    []string
+	nsnsMap    map[string]string
+	lastTS     primitive.Timestamp
+	appliedNum int64
+}
+
+func (p *dumpOplogReplayer) apply(doc bson.Raw) error {
+	var oplog OPLOG
+	if err := bson.Unmarshal(doc, &oplog); err != nil {
+		return fmt.Errorf("解析备份中的oplog失败：%v", err)
+	}
+	p.lastTS = oplog.TS
+	if oplog.FromMigrate || oplog.OP == "n" {
+		return nil
+	}
+	dstDbName, dstCollName := CustGetOplogNs(oplog)
+	if !containsOplogNs(dstDbName+"."+dstCollName, p.nsSlice) {
+		return nil
+	}
+	nsStruct := CustFilter(dstDbName+"."+dstCollName, p.nsnsMap)
+	oplog = mapDDLOplog(nsStruct, oplog, p.nsnsMap)
+	if err := applyOplog(p.dstMongo.Context(), p.dstMongo.Client(), nsStruct, oplog); err != nil {
+		p.dstMongo.logger().Error(fmt.Sprintf("oplog执行'%s'操作失败：%v", oplog.OP, err), failedDocFields(oplog.NS, doc.String())...)
+		notifyProgress(func(listener ProgressListener) { listener.OnError(oplog.NS, err) })
+		return nil
+	}
+	p.appliedNum++
+	return nil
+}
+
+func (p *dumpOplogReplayer) finish() error {
+	if p.lastTS.T != 0 || p.lastTS.I != 0 {
+		p.dstMongo.logger().Info("备份中的oplog重放完成", zap.Int64("appliedNum", p.appliedNum), zap.Uint32("T", p.lastTS.T), zap.Uint32("I", p.lastTS.I))
+	}
+	return nil
+}
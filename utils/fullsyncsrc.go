@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.uber.org/zap"
+)
+
+// 全量同步从副本集的从节点（包括隐藏节点）读取，避免大量读取影响繁忙的主节点，oplog仍然从原来的连接读取。
+// 复制每个集合之前检查该节点的复制延迟，超过阈值时等待延迟降低后再复制。
+// 增量同步从该节点开始读取时已经应用的位置（不晚于主节点的最新位置）开始重放，从节点落后的部分由oplog补齐
+const FullSyncMemberSecondary = "secondary" // 自动选择延迟最小的从节点
+
+// 检查复制延迟的间隔
+const memberLagPollInterval = 10 * time.Second
+
+// replSetGetStatus中的成员状态
+type replMember struct {
+	Name       string    `bson:"name"`
+	State      int       `bson:"state"`
+	Health     float64   `bson:"health"`
+	OptimeDate time.Time `bson:"optimeDate"`
+	Optime     struct {
+		TS primitive.Timestamp `bson:"ts"`
+	} `bson:"optime"`
+	Self bool `bson:"self"`
+}
+
+func replSetMembers(ctx context.Context, mc *MongoArgs) ([]replMember, error) {
+	var res struct {
+		Members []replMember `bson:"members"`
+	}
+	err := doWithRetry(ctx, commandTimeout, "replSetGetStatus", func(ctx context.Context) error {
+		return mc.Client().Database("admin").RunCommand(ctx, bson.D{{"replSetGetStatus", 1}}).Decode(&res)
+	})
+	return res.Members, err
+}
+
+// 全量同步读取的节点及其复制延迟的上限
+type fullSyncMember struct {
+	mc     *MongoArgs // 直接连接该节点
+	name   string
+	maxLag time.Duration
+}
+
+var fullSyncSource *fullSyncMember
+
+// 返回全量同步使用的源端连接。member为空时返回src；为secondary时选择延迟最小的从节点；为host:port时直接连接该节点（可以是隐藏节点）。
+// 源端为mongos时只支持secondary，由mongos将读取路由到各个分片中延迟不超过maxLag（最少90秒）的从节点
+func CustFullSyncSource(src *MongoArgs, member string, maxLag time.Duration) (*MongoArgs, error) {
+	if member == "" {
+		return src, nil
+	}
+	if src.IsMongos() {
+		if member != FullSyncMemberSecondary {
+			return nil, errors.New("源端为mongos时只能指定secondary")
+		}
+		staleness := maxLag
+		if staleness < 90*time.Second {
+			src.logger().Warn("mongos的maxStalenessSeconds最少为90秒", zap.Duration("maxLag", maxLag))
+			staleness = 90 * time.Second
+		}
+		return src.Clone().SetReadPreference(readpref.Secondary(readpref.WithMaxStaleness(staleness))), nil
+	}
+	members, err := replSetMembers(src.Context(), src)
+	if err != nil {
+		return nil, fmt.Errorf("获取副本集成员失败：%v", err)
+	}
+	if member == FullSyncMemberSecondary {
+		var secondaries []replMember
+		for _, m := range members {
+			if m.State == 2 && m.Health == 1 {
+				secondaries = append(secondaries, m)
+			}
+		}
+		if len(secondaries) == 0 {
+			return nil, errors.New("副本集中没有可用的从节点")
+		}
+		sort.Slice(secondaries, func(i, j int) bool { return secondaries[i].OptimeDate.After(secondaries[j].OptimeDate) })
+		member = secondaries[0].Name
+	} else {
+		found := false
+		for _, m := range members {
+			if m.Name == member {
+				if m.State != 2 {
+					return nil, fmt.Errorf("%s不是从节点", member)
+				}
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s不是副本集的成员", member)
+		}
+	}
+	mc := src.Clone().SetHosts([]string{member}).SetReplicaSet("").SetDirect(true).SetReadPreference(readpref.SecondaryPreferred())
+	fullSyncSource = &fullSyncMember{mc: mc, name: member, maxLag: maxLag}
+	src.logger().Info("全量同步从从节点读取", zap.String("member", member), zap.Duration("maxLag", maxLag))
+	return mc, nil
+}
+
+func primaryMember(members []replMember) *replMember {
+	for i := range members {
+		if members[i].State == 1 {
+			return &members[i]
+		}
+	}
+	return nil
+}
+
+// 全量同步读取的从节点已经应用的oplog位置，没有指定从节点时返回false
+func CustFullSyncMemberOptime() (primitive.Timestamp, bool, error) {
+	if fullSyncSource == nil {
+		return primitive.Timestamp{}, false, nil
+	}
+	members, err := replSetMembers(fullSyncSource.mc.Context(), fullSyncSource.mc)
+	if err != nil {
+		return primitive.Timestamp{}, true, err
+	}
+	for _, m := range members {
+		if m.Self {
+			return m.Optime.TS, true, nil
+		}
+	}
+	return primitive.Timestamp{}, true, fmt.Errorf("replSetGetStatus中没有%s的状态", fullSyncSource.name)
+}
+
+// 等待全量同步读取的从节点的复制延迟降低到阈值以内。获取延迟失败时不等待
+func waitFullSyncMemberLag(ctx context.Context) {
+	member := fullSyncSource
+	if member == nil || member.maxLag <= 0 {
+		return
+	}
+	for {
+		members, err := replSetMembers(ctx, member.mc)
+		if err != nil {
+			loggerFrom(ctx).Warn("获取从节点的复制延迟失败", zap.String("member", member.name), zap.Error(err))
+			return
+		}
+		var self *replMember
+		for i := range members {
+			if members[i].Self {
+				self = &members[i]
+			}
+		}
+		primary := primaryMember(members)
+		if self == nil || primary == nil {
+			return
+		}
+		lag := primary.OptimeDate.Sub(self.OptimeDate)
+		if lag <= member.maxLag {
+			return
+		}
+		loggerFrom(ctx).Warn("从节点的复制延迟超过阈值，等待后再读取", zap.String("member", member.name), zap.Duration("lag", lag), zap.Duration("maxLag", member.maxLag))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(memberLagPollInterval):
+		}
+	}
+}
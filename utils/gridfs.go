@@ -0,0 +1,346 @@
+package utils
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// GridFS：同一个bucket的<bucket>.files和<bucket>.chunks作为一个整体同步。按文件逐个复制，先写入该文件的所有
+// chunk，校验chunk的数量、总长度和md5（文件记录了md5时）与文件文档一致后，最后写入文件文档；目标端存在文件文档
+// 即表示该文件完整。同步中断时目标端可能留下没有文件文档的chunk，下次同步该bucket前先删除这些chunk。
+// 启用--delta或--chunk_cache时按普通集合同步
+
+var gridfsEnabled = true
+
+// 设置是否按GridFS bucket同步.files和.chunks集合
+func SetGridFS(enabled bool) {
+	gridfsEnabled = enabled
+}
+
+// GridFS bucket的文件集合和chunk集合
+type gridfsBucket struct {
+	files, chunks NsMap
+}
+
+// 从要同步的集合中找出GridFS bucket：同一个库中同时选择了<bucket>.files和<bucket>.chunks，
+// 且目标端也映射为同一个bucket的两个集合。返回chunk集合 -> bucket
+func gridfsBuckets(nsStructSlice []*NsMap) map[NsMap]*gridfsBucket {
+	if !gridfsEnabled || deltaMode != "" || chunkCacheEnabled {
+		return nil
+	}
+	byNs := make(map[string]*NsMap, len(nsStructSlice))
+	for _, nsmap := range nsStructSlice {
+		byNs[nsmap.SrcDb+"."+nsmap.SrcColl] = nsmap
+	}
+	buckets := make(map[NsMap]*gridfsBucket)
+	for _, files := range nsStructSlice {
+		if !strings.HasSuffix(files.SrcColl, ".files") {
+			continue
+		}
+		prefix := strings.TrimSuffix(files.SrcColl, ".files")
+		chunks := byNs[files.SrcDb+"."+prefix+".chunks"]
+		if chunks == nil || !strings.HasSuffix(files.DstColl, ".files") || chunks.DstDb != files.DstDb ||
+			chunks.DstColl != strings.TrimSuffix(files.DstColl, ".files")+".chunks" {
+			continue
+		}
+		buckets[*chunks] = &gridfsBucket{files: *files, chunks: *chunks}
+	}
+	return buckets
+}
+
+// 数值字段转换为int64，GridFS的length、chunkSize在不同驱动中可能为int32、int64或double
+func rawInt64(value bson.RawValue) (int64, bool) {
+	if v, ok := value.Int32OK(); ok {
+		return int64(v), true
+	}
+	if v, ok := value.Int64OK(); ok {
+		return v, true
+	}
+	if v, ok := value.DoubleOK(); ok {
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// 删除目标端没有文件文档的chunk，即之前的同步中断时留下的不完整的文件
+func removeDanglingChunks(ctx context.Context, dstFiles, dstChunks *mongo.Collection) (int64, error) {
+	cur, err := dstChunks.Aggregate(ctx, mongo.Pipeline{{{"$group", bson.D{{"_id", "$files_id"}}}}}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(context.Background())
+	var removed int64
+	var ids []interface{}
+	flush := func() error {
+		if len(ids) == 0 {
+			return nil
+		}
+		var existing []bson.Raw
+		err := doWithRetry(ctx, findTimeout, "find "+dstFiles.Name(), func(ctx context.Context) error {
+			cur, err := dstFiles.Find(ctx, bson.D{{"_id", bson.D{{"$in", ids}}}}, options.Find().SetProjection(bson.D{{"_id", 1}}))
+			if err != nil {
+				return err
+			}
+			existing = nil
+			return cur.All(ctx, &existing)
+		})
+		if err != nil {
+			return err
+		}
+		found := make(map[string]bool, len(existing))
+		for _, doc := range existing {
+			found[rawValueKey(doc.Lookup("_id"))] = true
+		}
+		var dangling []interface{}
+		for _, id := range ids {
+			if !found[rawValueKey(id.(bson.RawValue))] {
+				dangling = append(dangling, id)
+			}
+		}
+		ids = nil
+		if len(dangling) == 0 {
+			return nil
+		}
+		return doWithRetry(ctx, writeTimeout, "delete "+dstChunks.Name(), func(ctx context.Context) error {
+			result, err := dstChunks.DeleteMany(ctx, bson.D{{"files_id", bson.D{{"$in", dangling}}}})
+			if err == nil {
+				removed += result.DeletedCount
+			}
+			return err
+		})
+	}
+	for cursorNext(ctx, cur, false) {
+		id := cur.Current.Lookup("_id")
+		id.Value = append([]byte(nil), id.Value...)
+		ids = append(ids, id)
+		if len(ids) >= deltaBatchSize {
+			if err := flush(); err != nil {
+				return removed, err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return removed, err
+	}
+	return removed, flush()
+}
+
+// 复制一个GridFS文件的chunk，返回chunk数和校验失败的原因（为空表示校验通过）
+func copyGridFSChunks(ctx, dstCtx context.Context, srcChunks, dstChunks *mongo.Collection, fileId bson.RawValue, file bson.Raw) (int64, string, error) {
+	length, hasLength := rawInt64(file.Lookup("length"))
+	chunkSize, hasChunkSize := rawInt64(file.Lookup("chunkSize"))
+	expectedMd5, hasMd5 := file.Lookup("md5").StringValueOK()
+	var digest hash.Hash
+	if hasMd5 {
+		digest = md5.New()
+	}
+
+	opCtx, cancel := withTimeout(ctx, findTimeout)
+	cur, err := srcChunks.Find(opCtx, bson.D{{"files_id", fileId}}, options.Find().SetSort(bson.D{{"n", 1}}))
+	cancel()
+	if err != nil {
+		return 0, "", err
+	}
+	defer cur.Close(context.Background())
+	var (
+		chunkNum, copiedLength int64
+		docs                   []interface{}
+		docsBytes              int64
+		reason                 string
+	)
+	flush := func() error {
+		if len(docs) == 0 {
+			return nil
+		}
+		srcReadLimiter.wait(ctx, int64(len(docs)), docsBytes)
+		dstWriteLimiter.wait(dstCtx, int64(len(docs)), docsBytes)
+		addCopiedBytes(docsBytes)
+		_, failNum := CustInsertMany(dstCtx, dstChunks, docs, ConflictOverwrite)
+		docs, docsBytes = nil, 0
+		if failNum != 0 {
+			return fmt.Errorf("写入chunk失败的数量：%d", failNum)
+		}
+		return nil
+	}
+	for cursorNext(ctx, cur, false) {
+		n, _ := rawInt64(cur.Current.Lookup("n"))
+		if n != chunkNum && reason == "" {
+			reason = fmt.Sprintf("缺少第%d个chunk", chunkNum)
+		}
+		_, data, ok := cur.Current.Lookup("data").BinaryOK()
+		if !ok && reason == "" {
+			reason = fmt.Sprintf("第%d个chunk缺少data字段", n)
+		}
+		copiedLength += int64(len(data))
+		if digest != nil {
+			digest.Write(data)
+		}
+		chunkNum++
+		doc := make(bson.Raw, len(cur.Current))
+		copy(doc, cur.Current)
+		docs = append(docs, doc)
+		docsBytes += int64(len(doc))
+		if len(docs) >= copyBatchDocs || (copyBatchBytes > 0 && docsBytes >= copyBatchBytes) {
+			if err := flush(); err != nil {
+				return chunkNum, "", err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return chunkNum, "", err
+	}
+	if err := flush(); err != nil {
+		return chunkNum, "", err
+	}
+	if reason == "" && hasLength && copiedLength != length {
+		reason = fmt.Sprintf("chunk的总长度%d与文件长度%d不一致", copiedLength, length)
+	}
+	if reason == "" && hasLength && hasChunkSize && chunkSize > 0 && chunkNum != (length+chunkSize-1)/chunkSize {
+		reason = fmt.Sprintf("chunk数%d与文件长度%d、chunkSize %d不一致", chunkNum, length, chunkSize)
+	}
+	if reason == "" && digest != nil && !strings.EqualFold(hex.EncodeToString(digest.Sum(nil)), expectedMd5) {
+		reason = fmt.Sprintf("md5 %s与文件记录的%s不一致", hex.EncodeToString(digest.Sum(nil)), expectedMd5)
+	}
+	return chunkNum, reason, nil
+}
+
+// 同步一个GridFS bucket
+func custSyncGridFSBucket(srcMongo *MongoArgs, dstMongo *MongoArgs, bucket *gridfsBucket, policy ConflictPolicy, noIndex bool) {
+	start := time.Now()
+	files, chunks := bucket.files, bucket.chunks
+	filesNs := files.SrcDb + "." + files.SrcColl
+	// 文件作为整体写入，merge与overwrite相同，删除后重新写入整个文件
+	policy = conflictPolicyFor(filesNs, policy)
+	for _, nsmap := range []NsMap{files, chunks} {
+		if err := clearDstColl(dstMongo, nsmap.DstDb, nsmap.DstColl); err != nil {
+			dstMongo.logger().Fatal("全量同步前清理目标集合失败", zap.Error(err))
+		}
+		syncCollectionOptions(srcMongo, nsmap.SrcDb, nsmap.SrcColl, dstMongo, nsmap.DstDb, nsmap.DstColl)
+		if !noIndex {
+			CustSyncIndex(srcMongo, nsmap.SrcDb, nsmap.SrcColl, dstMongo, nsmap.DstDb, nsmap.DstColl)
+		}
+		CustRunHooks(HookPhaseAfterSchema, dstMongo, nsmap.DstDb, nsmap.DstColl)
+		nsmap := nsmap
+		notifyProgress(func(listener ProgressListener) { listener.OnCollectionStart(nsmap) })
+	}
+	waitFullSyncMemberLag(srcMongo.Context())
+
+	srcCtx, dstCtx := srcMongo.Context(), dstMongo.Context()
+	srcFiles := srcMongo.Client().Database(files.SrcDb).Collection(files.SrcColl)
+	srcChunks := srcMongo.Client().Database(chunks.SrcDb).Collection(chunks.SrcColl)
+	dstFiles := dstMongo.Client().Database(files.DstDb).Collection(files.DstColl)
+	dstChunks := dstMongo.Client().Database(chunks.DstDb).Collection(chunks.DstColl)
+	srcBefore := countSrcBefore(srcMongo, srcFiles)
+
+	if removed, err := removeDanglingChunks(dstCtx, dstFiles, dstChunks); err != nil {
+		dstMongo.logger().Fatal("删除目标端不完整的GridFS文件失败", zap.String("NS", chunks.DstDb+"."+chunks.DstColl), zap.Error(err))
+	} else if removed > 0 {
+		dstMongo.logger().Warn("已删除之前中断的同步留下的不完整的GridFS文件", zap.String("NS", chunks.DstDb+"."+chunks.DstColl), zap.Int64("chunkNum", removed))
+	}
+
+	opCtx, cancel := withTimeout(srcCtx, findTimeout)
+	cur, err := srcFiles.Find(opCtx, withNsFilter(filesNs, bson.M{}), options.Find().SetSort(bson.D{{"_id", 1}}))
+	cancel()
+	if err != nil {
+		srcMongo.logger().Fatal("读取源集合失败", zap.String("NS", filesNs), zap.Error(err))
+	}
+	defer cur.Close(context.Background())
+	var fileNum, skippedNum, chunkNum, failedNum int64
+	for cursorNext(srcCtx, cur, false) {
+		file := make(bson.Raw, len(cur.Current))
+		copy(file, cur.Current)
+		fileId := file.Lookup("_id")
+		filter := bson.D{{"_id", fileId}}
+
+		// 目标端已经存在文件文档时该文件是完整的，skip时跳过，fail时按失败处理；覆盖时先删除文件文档，写入所有chunk后再重新写入
+		if policy == ConflictSkip || policy == ConflictFail {
+			var exists bson.Raw
+			err := doWithRetry(dstCtx, findTimeout, "find "+files.DstColl, func(ctx context.Context) error {
+				var err error
+				exists, err = dstFiles.FindOne(ctx, filter, options.FindOne().SetProjection(bson.D{{"_id", 1}})).DecodeBytes()
+				if err == mongo.ErrNoDocuments {
+					return nil
+				}
+				return err
+			})
+			if err != nil {
+				dstMongo.logger().Fatal("读取目标端的GridFS文件失败", zap.String("NS", files.DstDb+"."+files.DstColl), zap.Error(err))
+			}
+			if exists != nil && policy == ConflictFail {
+				failedNum++
+				err := fmt.Errorf("GridFS文件%s在目标端已经存在", fileId.String())
+				dstMongo.logger().Error("GridFS文件在目标端已经存在", zap.String("NS", files.DstDb+"."+files.DstColl), zap.String("_id", fileId.String()))
+				notifyProgress(func(listener ProgressListener) { listener.OnError(files.DstDb+"."+files.DstColl, err) })
+				continue
+			} else if exists != nil {
+				skippedNum++
+				continue
+			}
+		} else {
+			err := doWithRetry(dstCtx, writeTimeout, "delete "+files.DstColl, func(ctx context.Context) error {
+				_, err := dstFiles.DeleteOne(ctx, filter)
+				return err
+			})
+			if err != nil {
+				dstMongo.logger().Fatal("删除目标端的GridFS文件失败", zap.String("NS", files.DstDb+"."+files.DstColl), zap.Error(err))
+			}
+		}
+
+		copied, reason, err := copyGridFSChunks(srcCtx, dstCtx, srcChunks, dstChunks, fileId, file)
+		if err == nil {
+			// 删除目标端该文件多余的chunk（之前写入的同一文件的旧版本），校验失败时删除所有chunk
+			chunkFilter := bson.D{{"files_id", fileId}}
+			if reason == "" {
+				chunkFilter = append(chunkFilter, bson.E{"n", bson.D{{"$gte", copied}}})
+			}
+			err = doWithRetry(dstCtx, writeTimeout, "delete "+chunks.DstColl, func(ctx context.Context) error {
+				_, err := dstChunks.DeleteMany(ctx, chunkFilter)
+				return err
+			})
+		}
+		if err != nil {
+			dstMongo.logger().Fatal("复制GridFS文件失败", zap.String("NS", filesNs), zap.String("_id", fileId.String()), zap.Error(err))
+		}
+		if reason != "" {
+			// 源端文件不完整（如正在写入），不写入文件文档，由oplog重放补齐
+			failedNum++
+			err := fmt.Errorf("GridFS文件%s校验失败：%s", fileId.String(), reason)
+			srcMongo.logger().Error("GridFS文件的chunk与文件文档不一致，未写入该文件", zap.String("NS", filesNs), zap.String("_id", fileId.String()), zap.String("reason", reason))
+			notifyProgress(func(listener ProgressListener) { listener.OnError(files.DstDb+"."+files.DstColl, err) })
+			continue
+		}
+		addCopiedBytes(int64(len(file)))
+		if _, failNum := CustInsertMany(dstCtx, dstFiles, []interface{}{file}, ConflictOverwrite); failNum != 0 {
+			failedNum++
+			continue
+		}
+		fileNum++
+		chunkNum += copied
+		notifyProgress(func(listener ProgressListener) { listener.OnCollectionProgress(files, fileNum) })
+		notifyProgress(func(listener ProgressListener) { listener.OnCollectionProgress(chunks, chunkNum) })
+	}
+	if err := cur.Err(); err != nil {
+		srcMongo.logger().Fatal("读取源集合失败", zap.String("NS", filesNs), zap.Error(err))
+	}
+
+	duration := fmt.Sprintf("%.2f", time.Since(start).Seconds())
+	fmt.Printf("%s GridFS导入完成，文件数：%v，chunk数：%v，已存在跳过的文件数：%v，校验失败的文件数：%v，耗时：%v秒\n",
+		files.SrcDb+"."+strings.TrimSuffix(files.SrcColl, ".files"), fileNum, chunkNum, skippedNum, failedNum, duration)
+	notifyProgress(func(listener ProgressListener) {
+		listener.OnCollectionDone(files, fileNum, skippedNum, time.Since(start))
+	})
+	notifyProgress(func(listener ProgressListener) { listener.OnCollectionDone(chunks, chunkNum, 0, time.Since(start)) })
+	reconcileCounts(srcMongo, dstMongo, files, srcFiles, dstFiles, srcBefore)
+	CustRunHooks(HookPhaseAfterCopy, dstMongo, files.DstDb, files.DstColl)
+	CustRunHooks(HookPhaseAfterCopy, dstMongo, chunks.DstDb, chunks.DstColl)
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// 全量同步与增量同步的自动衔接：--sync_oplog在全量同步开始前获取源端最新的oplog位置，并从该位置开始将oplog复制到目标端的
+// syncoplog.oplog.rs。全量同步完成后，自动从同一位置开始按相同的ns过滤和映射重放syncoplog.oplog.rs，不再需要手动使用
+// --replayoplog --op_start衔接。syncoplog.oplog.rs是无序批量写入的普通集合，只重放到syncoplog.checkpoint记录的位置，
+// 该位置之前的oplog都已写入；之后每隔syncOplogReplayInterval检查一次新的位置，继续重放
+const syncOplogReplayInterval = time.Second
+
+var syncOplogReplayed struct {
+	sync.Mutex
+	ts primitive.Timestamp // 已经重放的最后一条oplog的位置
+}
+
+// 返回自动重放syncoplog.oplog.rs已经重放到的位置，尚未开始时为空
+func CustSyncOplogReplayed() primitive.Timestamp {
+	syncOplogReplayed.Lock()
+	defer syncOplogReplayed.Unlock()
+	return syncOplogReplayed.ts
+}
+
+// 从startTS开始持续重放dstMongo中syncoplog.oplog.rs已经复制完成的oplog到replayDst，不会返回
+func CustReplaySyncOplog(dstMongo, replayDst *MongoArgs, startTS primitive.Timestamp, nsSlice []string, nsnsMap map[string]string) {
+	var dstNsSlice []string
+	for _, ns := range nsSlice {
+		nsStruct := CustFilter(ns, nsnsMap)
+		dstNsSlice = append(dstNsSlice, nsStruct.DstDb+"."+nsStruct.DstColl)
+	}
+	warmIndexCache(replayDst, dstNsSlice)
+	checkReplayHints(replayDst)
+
+	dstMongo.logger().Info("全量同步完成，开始自动重放syncoplog", zap.Uint32("T", startTS.T), zap.Uint32("I", startTS.I))
+	from, first := startTS, true
+	for {
+		_, lastTS, err := CustGetSyncOplogProgress(dstMongo)
+		if err != nil {
+			dstMongo.logger().Warn("获取syncoplog同步进度失败", zap.Error(err))
+		} else if cmp := primitive.CompareTimestamp(lastTS, from); cmp > 0 || first && cmp == 0 {
+			// 相邻两次重放的边界（from）会重放两次，oplog重复执行的结果相同
+			if err := replayOplog(dstMongo, replayDst, from, lastTS, syncOplogDbName+"."+syncOplogCollName, nsSlice, nsnsMap, true); err != nil {
+				log.Fatalln("重放syncoplog失败：", err)
+			}
+			from, first = lastTS, false
+			syncOplogReplayed.Lock()
+			syncOplogReplayed.ts = lastTS
+			syncOplogReplayed.Unlock()
+		}
+		time.Sleep(syncOplogReplayInterval)
+	}
+}
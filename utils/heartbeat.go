@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+var (
+	oplogHeartbeatInterval time.Duration                          // 在源端写入心跳noop的间隔，为0表示不写入
+	replayProgressInterval = 10 * time.Second                     // oplog重放进度的输出间隔
+	heartbeatNote          = bson.M{"msg": "mongosync heartbeat"} // 心跳noop中的内容
+)
+
+// 设置在源端写入心跳noop的间隔，为0表示不写入
+func SetOplogHeartbeat(interval time.Duration) {
+	oplogHeartbeatInterval = interval
+}
+
+// 定期在源端执行appendOplogNote命令写入一条noop oplog（需要clusterManager角色），
+// 使没有业务写入的源端也会产生oplog，从而推进oplog同步的进度，避免空闲时延迟统计虚高。
+// 返回的函数用于停止心跳
+func startOplogHeartbeat(srcMongo *MongoArgs) func() {
+	if oplogHeartbeatInterval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		srcClient := srcMongo.Client()
+		ticker := time.NewTicker(oplogHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-srcMongo.Context().Done():
+				return
+			case <-ticker.C:
+				opCtx, cancel := withTimeout(srcMongo.Context(), commandTimeout)
+				err := srcClient.Database("admin").RunCommand(opCtx, bson.D{{"appendOplogNote", 1}, {"data", heartbeatNote}}).Err()
+				cancel()
+				if err != nil {
+					srcMongo.logger().Warn("源端写入心跳noop失败，停止写入心跳", zap.Error(err))
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// 输出oplog重放进度。lastTS为已经处理过的最新oplog的ts（包括noop和被过滤掉的oplog），即重放的低水位
+func reportReplayProgress(srcMongo *MongoArgs, lastTS primitive.Timestamp, appliedNum int64) {
+	currentTS, err := CustGetLatestOplogTimestamp(srcMongo)
+	if err != nil {
+		srcMongo.logger().Warn("获取当前最新的oplog对应的timestamp失败", zap.Error(err))
+		return
+	}
+	lag := int64(currentTS.T) - int64(lastTS.T)
+	if lag < 0 {
+		lag = 0
+	}
+	srcMongo.logger().Info("oplog重放进度", zap.Uint32("T", lastTS.T), zap.Uint32("I", lastTS.I), zap.Int64("lagSeconds", lag), zap.Int64("appliedNum", appliedNum))
+	if currentTS.Equal(lastTS) {
+		log.Printf("正在实时重放当前最新生成的oplog，您可以\"ctrl+c\"手动终止程序!  当前oplog的ts为(%d,%d)\n", lastTS.T, lastTS.I)
+	}
+}
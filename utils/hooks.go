@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// 同步各阶段结束时在目标端执行的hook
+const (
+	HookPhaseAfterSchema = "after_schema" // 单个集合的索引同步完成后、导入数据之前
+	HookPhaseAfterCopy   = "after_copy"   // 单个集合的数据导入完成后
+	HookPhaseFinalize    = "finalize"     // 所有集合同步完成后
+)
+
+// Hook表示在目标端执行的一条命令或一个聚合管道，command和pipeline二选一。
+// command和pipeline中的${db}、${coll}会被替换为当前的目标库名、集合名（finalize阶段为空）
+type Hook struct {
+	Ns         string          `json:"ns"`         // 仅对该目标ns生效，为空时对所有ns生效。finalize阶段忽略该参数
+	Db         string          `json:"db"`         // 执行hook的库，为空时使用当前的目标库，finalize阶段必须指定
+	Collection string          `json:"collection"` // 执行pipeline的集合，为空时使用当前的目标集合
+	Command    json.RawMessage `json:"command"`    // 扩展JSON格式的命令，如：{"collMod": "${coll}", "validationLevel": "moderate"}
+	Pipeline   json.RawMessage `json:"pipeline"`   // 扩展JSON格式的聚合管道，如：[{"$group": ...}, {"$merge": ...}]
+}
+
+// 各阶段的hook列表
+type Hooks struct {
+	AfterSchema []Hook `json:"after_schema"`
+	AfterCopy   []Hook `json:"after_copy"`
+	Finalize    []Hook `json:"finalize"`
+}
+
+// hook的执行记录
+type HookResult struct {
+	Phase    string
+	Ns       string
+	Duration time.Duration
+	Err      error
+}
+
+var (
+	hooks       *Hooks
+	hookResults []HookResult
+	hookLock    sync.Mutex
+)
+
+// 从JSON文件中加载hook配置
+func CustLoadHooks(path string) (*Hooks, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var h Hooks
+	if err := json.Unmarshal(content, &h); err != nil {
+		return nil, err
+	}
+	for phase, list := range map[string][]Hook{HookPhaseAfterSchema: h.AfterSchema, HookPhaseAfterCopy: h.AfterCopy, HookPhaseFinalize: h.Finalize} {
+		for i, hook := range list {
+			if (len(hook.Command) == 0) == (len(hook.Pipeline) == 0) {
+				return nil, fmt.Errorf("%s阶段的第%d个hook必须且只能指定command和pipeline中的一个", phase, i+1)
+			}
+			if phase == HookPhaseFinalize && hook.Db == "" {
+				return nil, fmt.Errorf("finalize阶段的第%d个hook必须指定db", i+1)
+			}
+			if phase == HookPhaseFinalize && len(hook.Pipeline) > 0 && hook.Collection == "" {
+				return nil, fmt.Errorf("finalize阶段的第%d个hook必须指定collection", i+1)
+			}
+		}
+	}
+	return &h, nil
+}
+
+// 设置要执行的hook，为nil时不执行任何hook
+func SetHooks(h *Hooks) {
+	hooks = h
+}
+
+// 获取所有hook的执行记录
+func CustHookResults() []HookResult {
+	hookLock.Lock()
+	defer hookLock.Unlock()
+	return append([]HookResult(nil), hookResults...)
+}
+
+// 执行指定阶段中与dstDbName.dstCollName匹配的hook。hook执行失败只记录错误，不中断同步
+func CustRunHooks(phase string, dstMongo *MongoArgs, dstDbName, dstCollName string) {
+	if hooks == nil {
+		return
+	}
+	var list []Hook
+	switch phase {
+	case HookPhaseAfterSchema:
+		list = hooks.AfterSchema
+	case HookPhaseAfterCopy:
+		list = hooks.AfterCopy
+	case HookPhaseFinalize:
+		list = hooks.Finalize
+	}
+	if len(list) == 0 {
+		return
+	}
+	ns := ""
+	if dstDbName != "" {
+		ns = dstDbName + "." + dstCollName
+	}
+
+	dstClient := dstMongo.Client()
+	for _, hook := range list {
+		if phase != HookPhaseFinalize && hook.Ns != "" && hook.Ns != ns {
+			continue
+		}
+		start := time.Now()
+		opCtx, cancel := withTimeout(dstMongo.Context(), commandTimeout)
+		err := runHook(opCtx, dstClient.Database(firstNonEmpty(hook.Db, dstDbName)), hook, dstDbName, dstCollName)
+		cancel()
+		result := HookResult{Phase: phase, Ns: ns, Duration: time.Since(start), Err: err}
+		hookLock.Lock()
+		hookResults = append(hookResults, result)
+		hookLock.Unlock()
+		if err != nil {
+			dstMongo.logger().Error("hook执行失败", zap.String("phase", phase), zap.String("NS", ns), zap.Error(err))
+		} else {
+			dstMongo.logger().Info("hook执行成功", zap.String("phase", phase), zap.String("NS", ns), zap.Duration("duration", result.Duration))
+		}
+	}
+
+	// finalize为最后一个阶段，汇总输出所有hook的执行情况
+	if phase == HookPhaseFinalize {
+		var failed int
+		results := CustHookResults()
+		for _, result := range results {
+			if result.Err != nil {
+				failed++
+			}
+		}
+		fmt.Printf("hook执行完成，共执行%d个，失败%d个\n", len(results), failed)
+	}
+}
+
+// 在目标库上执行单个hook
+func runHook(ctx context.Context, db *mongo.Database, hook Hook, dstDbName, dstCollName string) error {
+	replacer := strings.NewReplacer("${db}", dstDbName, "${coll}", dstCollName)
+	if len(hook.Command) > 0 {
+		var command bson.D
+		if err := bson.UnmarshalExtJSON([]byte(replacer.Replace(string(hook.Command))), false, &command); err != nil {
+			return fmt.Errorf("解析command失败：%v", err)
+		}
+		return db.RunCommand(ctx, command).Err()
+	}
+
+	// 扩展JSON只能解析文档，将管道包装为文档后再解析
+	var wrapper struct {
+		Pipeline bson.A `bson:"pipeline"`
+	}
+	wrapped := fmt.Sprintf(`{"pipeline": %s}`, replacer.Replace(string(hook.Pipeline)))
+	if err := bson.UnmarshalExtJSON([]byte(wrapped), false, &wrapper); err != nil {
+		return fmt.Errorf("解析pipeline失败：%v", err)
+	}
+	collName := replacer.Replace(firstNonEmpty(hook.Collection, dstCollName))
+	if collName == "" {
+		return errors.New("未指定执行pipeline的集合")
+	}
+	cur, err := db.Collection(collName).Aggregate(ctx, wrapper.Pipeline)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.Background())
+	for cur.Next(ctx) {
+		// $merge/$out之类的管道不返回文档，其他管道的结果直接丢弃
+	}
+	return cur.Err()
+}
+
+// 返回第一个非空字符串
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
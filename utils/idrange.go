@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// 大集合按_id范围切分后并发读取和写入
+var (
+	rangeThreads    = 1              // 单个集合并发复制的_id范围数，<=1表示不切分
+	rangeMinDocs    = int64(1000000) // 文档数不少于该值的集合才切分
+	rangesPerThread = 4              // 每个协程平均分到的范围数，范围数多于协程数可以减少数据倾斜的影响
+	rangeSampleRate = 10             // 使用$sample切分时，每个切分点对应的样本数
+)
+
+// 设置单个集合并发复制的_id范围数，以及切分的最小文档数
+func SetRangeParallel(threads int, minDocs int64) {
+	rangeThreads = threads
+	rangeMinDocs = minDocs
+}
+
+// _id范围[min, max)，Type为0表示不限制
+type idRange struct {
+	min    bson.RawValue
+	max    bson.RawValue
+	lastId bson.RawValue // 继续之前中断的复制时，该范围已经写入目标端的最后一个_id
+	index  int           // 在集合的范围列表中的位置，用于保存复制进度
+}
+
+// 将集合切分为多个_id范围，不需要切分或切分失败时返回nil。
+// 切分点优先使用splitVector获取（按_id索引的顺序，需要splitVector权限，mongos上不可用），失败时通过$sample采样后由服务端排序。
+// 两种方式得到的切分点都符合_id索引的顺序（BSON类型顺序以及集合默认的collation），读取时通过hint _id索引并使用min()/max()限制范围
+func splitIdRanges(srcMongo *MongoArgs, srcColl *mongo.Collection) []idRange {
+	ns := srcColl.Database().Name() + "." + srcColl.Name()
+	threads := rangeThreadsFor(ns)
+	if threads <= 1 {
+		return nil
+	}
+	var count int64
+	err := doWithRetry(srcMongo.Context(), commandTimeout, "count "+ns, func(ctx context.Context) error {
+		var err error
+		count, err = srcColl.EstimatedDocumentCount(ctx)
+		return err
+	})
+	if err != nil || count < rangeMinDocs {
+		return nil
+	}
+	n := threads * rangesPerThread
+	keys, err := splitVectorKeys(srcMongo, srcColl, n)
+	if err != nil || len(keys) == 0 {
+		srcMongo.logger().Info("splitVector不可用，通过$sample切分_id范围", zap.String("NS", ns), zap.Error(err))
+		if keys, err = sampleSplitKeys(srcMongo, srcColl, n); err != nil {
+			srcMongo.logger().Warn("切分_id范围失败，不进行并发复制", zap.String("NS", ns), zap.Error(err))
+			return nil
+		}
+	}
+	var ranges []idRange
+	var last bson.RawValue
+	for _, key := range keys {
+		if last.Type != 0 && key.Equal(last) {
+			continue
+		}
+		ranges = append(ranges, idRange{min: last, max: key})
+		last = key
+	}
+	ranges = append(ranges, idRange{min: last})
+	srcMongo.logger().Info("按_id范围并发复制", zap.String("NS", ns), zap.Int64("count", count), zap.Int("ranges", len(ranges)), zap.Int("threads", threads))
+	return ranges
+}
+
+// 通过splitVector获取约n个范围的切分点
+func splitVectorKeys(srcMongo *MongoArgs, srcColl *mongo.Collection, n int) ([]bson.RawValue, error) {
+	ns := srcColl.Database().Name() + "." + srcColl.Name()
+	var stats struct {
+		Size int64 `bson:"size"`
+	}
+	err := doWithRetry(srcMongo.Context(), commandTimeout, "collStats", func(ctx context.Context) error {
+		return srcColl.Database().RunCommand(ctx, bson.D{{"collStats", srcColl.Name()}}).Decode(&stats)
+	})
+	if err != nil {
+		return nil, err
+	}
+	chunkBytes := stats.Size / int64(n)
+	if chunkBytes < 1024*1024 {
+		chunkBytes = 1024 * 1024
+	}
+	var res struct {
+		SplitKeys []bson.Raw `bson:"splitKeys"`
+	}
+	err = doWithRetry(srcMongo.Context(), commandTimeout, "splitVector", func(ctx context.Context) error {
+		return srcColl.Database().RunCommand(ctx, bson.D{{"splitVector", ns}, {"keyPattern", bson.D{{"_id", 1}}}, {"maxChunkSizeBytes", chunkBytes}}).Decode(&res)
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]bson.RawValue, 0, len(res.SplitKeys))
+	for _, key := range res.SplitKeys {
+		keys = append(keys, key.Lookup("_id"))
+	}
+	return keys, nil
+}
+
+// 通过$sample采样_id并由服务端排序，每rangeSampleRate个样本取一个切分点
+func sampleSplitKeys(srcMongo *MongoArgs, srcColl *mongo.Collection, n int) ([]bson.RawValue, error) {
+	pipeline := mongo.Pipeline{
+		{{"$sample", bson.D{{"size", n * rangeSampleRate}}}},
+		{{"$project", bson.D{{"_id", 1}}}},
+		{{"$sort", bson.D{{"_id", 1}}}},
+	}
+	var samples []bson.Raw
+	err := doWithRetry(srcMongo.Context(), findTimeout, "aggregate $sample", func(ctx context.Context) error {
+		cur, err := srcColl.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+		if err != nil {
+			return err
+		}
+		samples = nil
+		return cur.All(ctx, &samples)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var keys []bson.RawValue
+	for i := rangeSampleRate; i < len(samples); i += rangeSampleRate {
+		keys = append(keys, samples[i].Lookup("_id"))
+	}
+	return keys, nil
+}
+
+// 使用rangeThreadsFor(ns)个协程并发复制各个_id范围，返回写入的文档数
+func copyIdRanges(srcMongo, dstMongo *MongoArgs, srcColl, dstColl *mongo.Collection, ranges []idRange, strategy string, policy ConflictPolicy, sizes *DocSizeHistogram, tracker *copyTracker) int64 {
+	queue := make(chan idRange, len(ranges))
+	for _, r := range ranges {
+		queue <- r
+	}
+	close(queue)
+	var (
+		wg        sync.WaitGroup
+		lock      sync.Mutex
+		copiedNum int64
+	)
+	threads := rangeThreadsFor(srcColl.Database().Name() + "." + srcColl.Name())
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range queue {
+				rangeSizes := newDocSizeHistogram(sizes.Ns)
+				atomic.AddInt64(&copiedNum, copyIdRange(srcMongo, dstMongo, srcColl, dstColl, r, false, strategy, policy, rangeSizes, tracker))
+				lock.Lock()
+				sizes.merge(rangeSizes)
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return copiedNum
+}
@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// 4.4+的oplog中，一次索引创建对应startIndexBuild、commitIndexBuild（或abortIndexBuild）两条c类型的oplog，
+// 4.2中为createIndexes命令，o中为单个索引的定义。例如：
+//
+//	{
+//		"op" : "c",
+//		"ns" : "GlobalDB.$cmd",
+//		"o" : {
+//			"commitIndexBuild" : "GlobalService",
+//			"indexBuildUUID" : UUID("a8ef4ab3-5dc2-4fd7-8a5b-b5d2d5e6e1a1"),
+//			"indexes" : [ { "v" : 2, "key" : { "servicename" : 1 }, "name" : "servicename_1" } ]
+//		}
+//	}
+//
+// 只有commitIndexBuild表示索引创建成功，此时在目标端创建索引；startIndexBuild、abortIndexBuild忽略。
+// 3.x中索引创建为插入<db>.system.indexes的i类型的oplog，o为带ns的索引定义，同样通过createIndexes创建
+var indexBuildCommands = map[string]bool{
+	"startIndexBuild":  true,
+	"commitIndexBuild": true,
+	"abortIndexBuild":  true,
+	"createIndexes":    true,
+}
+
+// 删除索引的命令（3.x中为deleteIndexes），每个索引一条oplog，index为索引名：
+//
+//	{"op" : "c", "ns" : "GlobalDB.$cmd", "o" : { "dropIndexes" : "GlobalService", "index" : "servicename_1" }, "o2" : {<索引定义>}}
+var indexDropCommands = map[string]bool{
+	"dropIndexes":   true,
+	"deleteIndexes": true,
+}
+
+// 判断c类型oplog的o是否为删除索引的命令，是则返回索引所在的集合名
+func indexDropColl(o bson.D) (string, bool) {
+	if len(o) == 0 || !indexDropCommands[o[0].Key] {
+		return "", false
+	}
+	coll, ok := o[0].Value.(string)
+	return coll, ok
+}
+
+// 判断c类型oplog的o是否为索引创建命令，是则返回索引所在的集合名
+func indexBuildColl(o bson.D) (string, bool) {
+	if len(o) == 0 || !indexBuildCommands[o[0].Key] {
+		return "", false
+	}
+	coll, ok := o[0].Value.(string)
+	return coll, ok
+}
+
+// 在目标端执行索引创建命令。通过createIndexes创建，索引已经存在（定义相同）时直接成功，重复重放不会报错。
+// 索引缓存中已经存在的索引直接跳过
+func applyIndexBuild(ctx context.Context, dstDb *mongo.Database, dstCollName string, o bson.D) error {
+	var indexes bson.A
+	switch o[0].Key {
+	case "commitIndexBuild":
+		for _, e := range o {
+			if e.Key == "indexes" {
+				indexes, _ = e.Value.(bson.A)
+			}
+		}
+	case "createIndexes":
+		// 除命令名以外的字段即为索引定义
+		indexes = bson.A{o[1:]}
+	default:
+		return nil
+	}
+	if len(indexes) == 0 {
+		return fmt.Errorf("%s中没有索引定义", o[0].Key)
+	}
+	return createIndexes(ctx, dstDb, dstCollName, indexes)
+}
+
+// 在目标集合创建indexes中的索引，索引定义中的源端ns被去掉。
+// 目标端已经存在同名但定义不同的索引（如源端删除后以不同的选项重建）时，删除后按源端的定义重建
+func createIndexes(ctx context.Context, dstDb *mongo.Database, dstCollName string, indexes bson.A) error {
+	cache := indexCacheFor(dstDb.Client())
+	ns := dstDb.Name() + "." + dstCollName
+	specs := make(bson.A, 0, len(indexes))
+	var names []string
+	for _, index := range indexes {
+		spec, ok := index.(bson.D)
+		if !ok {
+			return fmt.Errorf("索引定义格式错误：%v", index)
+		}
+		name, _ := spec.Map()["name"].(string)
+		if cache.hasIndex(ns, name) {
+			continue
+		}
+		names = append(names, name)
+		// 去掉索引定义中的源端ns，使用映射后的集合
+		var cleaned bson.D
+		for _, e := range spec {
+			if e.Key != "ns" {
+				cleaned = append(cleaned, e)
+			}
+		}
+		specs = append(specs, cleaned)
+	}
+	if len(specs) == 0 {
+		return nil
+	}
+	create := func() error {
+		return doWithRetry(ctx, commandTimeout, "createIndexes", func(ctx context.Context) error {
+			return dstDb.RunCommand(ctx, bson.D{{"createIndexes", dstCollName}, {"indexes", specs}}).Err()
+		})
+	}
+	err := create()
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && (cmdErr.Code == 85 || cmdErr.Code == 86) { // IndexOptionsConflict、IndexKeySpecsConflict
+		loggerFrom(ctx).Warn("目标端已经存在同名但定义不同的索引，删除后重建", zap.String("NS", ns), zap.Strings("indexes", names), zap.Error(err))
+		for _, name := range names {
+			if err := dropIndex(ctx, dstDb, dstCollName, name); err != nil {
+				return err
+			}
+		}
+		err = create()
+	}
+	if err == nil {
+		cache.add(ns, names...)
+	}
+	return err
+}
+
+// 在目标端执行删除索引的命令，集合或索引不存在时视为成功
+func applyDropIndexes(ctx context.Context, dstDb *mongo.Database, dstCollName string, o bson.D) error {
+	var index interface{}
+	for _, e := range o {
+		if e.Key == "index" {
+			index = e.Value
+		}
+	}
+	if index == nil {
+		return fmt.Errorf("%s中没有索引名", o[0].Key)
+	}
+	return dropIndex(ctx, dstDb, dstCollName, index)
+}
+
+// 删除目标集合的索引，index为索引名或索引的key
+func dropIndex(ctx context.Context, dstDb *mongo.Database, dstCollName string, index interface{}) error {
+	cmd := bson.D{{"dropIndexes", dstCollName}, {"index", index}}
+	// 先使缓存失效再删除，避免与预热并发时保留删除前的结果
+	indexCacheFor(dstDb.Client()).invalidate(dstDb.Name(), cmd)
+	err := doWithRetry(ctx, commandTimeout, "dropIndexes", func(ctx context.Context) error {
+		return dstDb.RunCommand(ctx, cmd).Err()
+	})
+	if isAlreadyApplied(cmd, err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// 重放时目标端已存在的集合和索引的缓存，已经存在的集合、索引不再执行create、createIndexes，
+// 减少DDL较多的oplog重放时的往返次数。缓存在重放开始时由后台协程通过listIndexes预热，
+// 之后随着create、createIndexes的成功执行而更新，drop等可能删除集合或索引的命令会使缓存失效
+type indexCache struct {
+	sync.Mutex
+	colls map[string]map[string]bool // 目标ns -> 已存在的索引名
+	epoch uint64                     // 每次缓存失效时递增，用于丢弃与失效操作并发的预热结果
+}
+
+// 每个目标端连接一份缓存
+var indexCaches sync.Map // *mongo.Client -> *indexCache
+
+func indexCacheFor(client *mongo.Client) *indexCache {
+	cache, _ := indexCaches.LoadOrStore(client, &indexCache{colls: make(map[string]map[string]bool)})
+	return cache.(*indexCache)
+}
+
+// 集合是否已经存在
+func (c *indexCache) hasColl(ns string) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, exists := c.colls[ns]
+	return exists
+}
+
+// 索引是否已经存在
+func (c *indexCache) hasIndex(ns, name string) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.colls[ns][name]
+}
+
+// 记录集合及其索引已经存在
+func (c *indexCache) add(ns string, names ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.addLocked(ns, names...)
+}
+
+func (c *indexCache) addLocked(ns string, names ...string) {
+	if c.colls[ns] == nil {
+		c.colls[ns] = make(map[string]bool)
+	}
+	for _, name := range names {
+		c.colls[ns][name] = true
+	}
+}
+
+// 执行db库中的命令cmd之后，使可能受影响的缓存失效：
+// create和索引创建命令不删除任何对象，dropDatabase使整个库失效，renameCollection使源、目标集合失效，
+// 其他命令使第一个字段的值对应的集合失效，无法确定集合时使整个库失效
+func (c *indexCache) invalidate(db string, cmd bson.D) {
+	if len(cmd) == 0 || cmd[0].Key == "create" {
+		return
+	}
+	if _, ok := indexBuildColl(cmd); ok {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.epoch++
+	dropDb := func() {
+		for ns := range c.colls {
+			if strings.HasPrefix(ns, db+".") {
+				delete(c.colls, ns)
+			}
+		}
+	}
+	switch cmd[0].Key {
+	case "dropDatabase":
+		dropDb()
+	case "renameCollection":
+		for _, e := range cmd {
+			if name, ok := e.Value.(string); ok && (e.Key == "renameCollection" || e.Key == "to") {
+				delete(c.colls, name)
+			}
+		}
+	default:
+		if coll, ok := cmd[0].Value.(string); ok {
+			delete(c.colls, db+"."+coll)
+		} else {
+			dropDb()
+		}
+	}
+}
+
+// 后台预热缓存：读取目标端各个ns已经存在的索引。与重放并发执行，预热期间缓存发生失效时丢弃该ns的结果
+func warmIndexCache(dstMongo *MongoArgs, dstNsSlice []string) {
+	cache := indexCacheFor(dstMongo.Client())
+	go func() {
+		var warmed int
+		for _, ns := range dstNsSlice {
+			dbName, collName := splitOplogNamespace(ns)
+			cache.Lock()
+			epoch := cache.epoch
+			cache.Unlock()
+			var specs []*mongo.IndexSpecification
+			err := doWithRetry(dstMongo.Context(), commandTimeout, "listIndexes "+ns, func(ctx context.Context) error {
+				var err error
+				specs, err = dstMongo.Client().Database(dbName).Collection(collName).Indexes().ListSpecifications(ctx)
+				return err
+			})
+			if err != nil || len(specs) == 0 { // 集合不存在时没有索引
+				continue
+			}
+			names := make([]string, 0, len(specs))
+			for _, spec := range specs {
+				names = append(names, spec.Name)
+			}
+			cache.Lock()
+			if cache.epoch == epoch {
+				cache.addLocked(ns, names...)
+				warmed++
+			}
+			cache.Unlock()
+		}
+		dstMongo.logger().Info("目标端索引缓存预热完成", zap.Int("nsNum", warmed))
+	}()
+}
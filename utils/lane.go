@@ -0,0 +1,238 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// 低优先级ns的oplog不在重放主流程中逐条执行，而是交给后台通道以较低的并发、较大的批次执行，
+// 突发写入时优先保证其他ns的重放延迟
+var (
+	lowPriorityNs      []string // 低优先级的源ns，db表示整个库
+	lowPriorityWorkers = 1      // 后台通道的并发数
+	lowPriorityBatch   = 1000   // 后台通道每批执行的oplog条数上限
+)
+
+// 后台通道攒批时，等待更多oplog的最长时间
+const lowPriorityLinger = 500 * time.Millisecond
+
+// 设置低优先级的源ns（格式为db.coll或db）以及后台通道的并发数和批次大小
+func SetLowPriorityNs(nsList []string, workers, batch int) {
+	lowPriorityNs = nsList
+	if workers > 0 {
+		lowPriorityWorkers = workers
+	}
+	if batch > 0 {
+		lowPriorityBatch = batch
+	}
+}
+
+// 判断源ns是否为低优先级
+func isLowPriorityNs(ns string) bool {
+	for _, value := range lowPriorityNs {
+		if ns == value || strings.HasPrefix(ns, value+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// 后台通道中的一条oplog
+type laneOp struct {
+	nsStruct *NsMap
+	oplog    OPLOG
+	raw      bson.Raw
+}
+
+// 低优先级oplog的后台执行通道。同一个ns的oplog总是由同一个worker按顺序执行
+type lowPriorityLane struct {
+	ctx       context.Context
+	dstClient *mongo.Client
+	queues    []chan laneOp
+	pending   sync.WaitGroup
+	backlog   int64 // 尚未执行的oplog数
+	workers   sync.WaitGroup
+}
+
+// 创建并启动后台通道，没有设置低优先级ns时返回nil
+func newLowPriorityLane(ctx context.Context, dstClient *mongo.Client) *lowPriorityLane {
+	if len(lowPriorityNs) == 0 {
+		return nil
+	}
+	lane := &lowPriorityLane{ctx: ctx, dstClient: dstClient}
+	for i := 0; i < lowPriorityWorkers; i++ {
+		queue := make(chan laneOp, lowPriorityBatch)
+		lane.queues = append(lane.queues, queue)
+		lane.workers.Add(1)
+		go lane.worker(queue)
+	}
+	loggerFrom(ctx).Info("低优先级ns使用后台通道重放", zap.Strings("ns", lowPriorityNs), zap.Int("workers", lowPriorityWorkers), zap.Int("batch", lowPriorityBatch))
+	return lane
+}
+
+// 将oplog放入后台通道，队列已满时阻塞，避免积压过多占用内存
+func (lane *lowPriorityLane) submit(nsStruct *NsMap, oplog OPLOG, raw bson.Raw) {
+	h := fnv.New32a()
+	h.Write([]byte(nsStruct.DstDb + "." + nsStruct.DstColl))
+	lane.pending.Add(1)
+	atomic.AddInt64(&lane.backlog, 1)
+	lane.queues[h.Sum32()%uint32(len(lane.queues))] <- laneOp{nsStruct: nsStruct, oplog: oplog, raw: raw}
+}
+
+// 等待已经放入通道的oplog全部执行完成。执行命令类oplog之前需要先等待，保证与低优先级ns的写入顺序一致
+func (lane *lowPriorityLane) wait() {
+	lane.pending.Wait()
+}
+
+// 尚未执行的oplog数
+func (lane *lowPriorityLane) pendingNum() int64 {
+	return atomic.LoadInt64(&lane.backlog)
+}
+
+// 等待所有oplog执行完成并停止后台通道
+func (lane *lowPriorityLane) close() {
+	for _, queue := range lane.queues {
+		close(queue)
+	}
+	lane.workers.Wait()
+}
+
+func (lane *lowPriorityLane) worker(queue chan laneOp) {
+	defer lane.workers.Done()
+	for op := range queue {
+		batch := []laneOp{op}
+		// 攒批：最多等待lowPriorityLinger，或者凑满lowPriorityBatch条
+		timer := time.NewTimer(lowPriorityLinger)
+	collect:
+		for len(batch) < lowPriorityBatch {
+			select {
+			case op, ok := <-queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, op)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		lane.applyBatch(batch)
+		atomic.AddInt64(&lane.backlog, -int64(len(batch)))
+		for range batch {
+			lane.pending.Done()
+		}
+	}
+}
+
+// 执行一批oplog：同一个集合连续的增删改合并为一次有序的BulkWrite，其他oplog逐条执行
+func (lane *lowPriorityLane) applyBatch(batch []laneOp) {
+	// 预读逐条执行时需要读取的目标端文档
+	ctx := prefetchTargetDocs(lane.ctx, lane.dstClient, batch)
+	for start := 0; start < len(batch); {
+		end := start
+		var models []mongo.WriteModel
+		for ; end < len(batch) && sameNs(batch[end].nsStruct, batch[start].nsStruct); end++ {
+			oplog, ok := projectOplog(batch[end].nsStruct, batch[end].oplog)
+			if !ok {
+				break
+			}
+			model := oplogWriteModel(oplog)
+			if model == nil {
+				break
+			}
+			models = append(models, model)
+		}
+		if len(models) == 0 {
+			// 无法合并的oplog（如创建索引）单独执行
+			lane.applyOne(ctx, batch[start])
+			start++
+			continue
+		}
+		coll := lane.dstClient.Database(batch[start].nsStruct.DstDb).Collection(batch[start].nsStruct.DstColl)
+		for _, model := range models {
+			setModelHint(ctx, coll, model)
+		}
+		var deleted int64
+		err := doWithRetry(lane.ctx, writeTimeout, "BulkWrite", func(ctx context.Context) error {
+			result, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(true))
+			if err == nil {
+				deleted = result.DeletedCount
+			}
+			return err
+		})
+		if deleteNum := countDeleteModels(models); err == nil && deleteNum > 0 {
+			recordDeletes(deleteNum, deleteNum, deleted)
+		}
+		if err != nil {
+			// 批量执行失败时逐条重新执行，找出失败的oplog。oplog是幂等的，重复执行已经成功的部分不影响结果
+			loggerFrom(lane.ctx).Warn("低优先级oplog批量执行失败，转为逐条执行", zap.String("NS", batch[start].nsStruct.DstDb+"."+batch[start].nsStruct.DstColl), zap.Int("num", end-start), zap.Error(err))
+			for _, op := range batch[start:end] {
+				lane.applyOne(ctx, op)
+			}
+		}
+		start = end
+	}
+}
+
+func (lane *lowPriorityLane) applyOne(ctx context.Context, op laneOp) {
+	if err := applyOplog(ctx, lane.dstClient, op.nsStruct, op.oplog); err != nil {
+		loggerFrom(lane.ctx).Error(fmt.Sprintf("oplog执行'%s'操作失败：%v", op.oplog.OP, err), failedDocFields(op.oplog.NS, op.raw.String())...)
+		notifyProgress(func(listener ProgressListener) { listener.OnError(op.oplog.NS, err) })
+	}
+}
+
+func sameNs(a, b *NsMap) bool {
+	return a.DstDb == b.DstDb && a.DstColl == b.DstColl
+}
+
+// 将增删改类型的oplog转换为BulkWrite的WriteModel，与applyOplog的执行方式一致。其他类型的oplog返回nil
+func oplogWriteModel(oplog OPLOG) mongo.WriteModel {
+	o, ok := oplog.O.(bson.D)
+	if !ok {
+		return nil
+	}
+	switch oplog.OP {
+	case "i":
+		if _, exists := o.Map()["_id"]; exists {
+			return conflictWriteModel(oplogConflictPolicy(oplog.NS), o)
+		}
+	case "u":
+		if oplog.truncate != nil {
+			// 需要分两次执行，逐条执行
+			return nil
+		}
+		if diff, ok := oplogUpdateDiff(o); ok {
+			update, truncate := diffToUpdate(diff)
+			if truncate != nil || len(update) == 0 {
+				// 需要分两次执行，逐条执行
+				return nil
+			}
+			o = update
+		}
+		if isUpdateModifier(o) {
+			if missingDocSource != nil {
+				// 需要根据是否匹配到文档决定是否从源端读取，逐条执行
+				return nil
+			}
+			return mongo.NewUpdateOneModel().SetFilter(oplog.O2).SetUpdate(o).SetUpsert(true)
+		}
+		if useReplaceDiff(oplog) {
+			// 需要先读取目标端的文档计算差异，逐条执行
+			return nil
+		}
+		return mongo.NewReplaceOneModel().SetFilter(oplog.O2).SetReplacement(o).SetUpsert(true)
+	case "d":
+		return deleteWriteModel(oplog)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"runtime/debug"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 低内存模式：用于在内存很小的边缘设备（如ARM64小主机）上将本地MongoDB同步到中心集群。
+// 限制并发同步的集合数，不按_id范围切分，每批读取、写入的文档数和字节数都限制在较小的值，
+// 读取一批写入一批，不在内存中累积数据；同时降低GC的触发阈值，尽早回收内存
+const (
+	lowMemoryWorkers     = 2                // 并发同步的集合数上限
+	lowMemoryBatchDocs   = 500              // 全量复制每批写入的文档数上限
+	lowMemoryBatchBytes  = int64(4 << 20)   // 全量复制每批写入的字节数上限
+	lowMemoryCursorBatch = int32(256)       // 源端游标每批返回的文档数
+	lowMemoryOplogBatch  = 100              // syncoplog每批写入的oplog数、低优先级通道每批执行的oplog数
+	lowMemoryGCPercent   = 50               // GOGC
+	lowMemoryLimit       = int64(256 << 20) // Go运行时的软内存上限
+)
+
+var lowMemory bool
+
+// 启用低内存模式，需要在其他Set函数之后调用，将已经设置的并发数、批次大小限制在低内存模式的上限内
+func SetLowMemory(enabled bool) {
+	lowMemory = enabled
+	if !enabled {
+		return
+	}
+	rangeThreads = 1
+	if copyBatchDocs > lowMemoryBatchDocs {
+		copyBatchDocs = lowMemoryBatchDocs
+	}
+	if copyBatchBytes <= 0 || copyBatchBytes > lowMemoryBatchBytes {
+		copyBatchBytes = lowMemoryBatchBytes
+	}
+	lowPriorityWorkers = 1
+	if lowPriorityBatch > lowMemoryOplogBatch {
+		lowPriorityBatch = lowMemoryOplogBatch
+	}
+	if syncOplogBatchSize > lowMemoryOplogBatch {
+		syncOplogBatchSize = lowMemoryOplogBatch
+	}
+	debug.SetGCPercent(lowMemoryGCPercent)
+	debug.SetMemoryLimit(lowMemoryLimit)
+	// 未指定--max_memory_mb时以软内存上限作为全量复制的内存预算
+	copyMemory.limit = lowMemoryLimit / 2
+}
+
+// 低内存模式下将并发同步的集合数限制在上限内
+func CustLowMemoryWorkers(workers int) int {
+	if lowMemory && workers > lowMemoryWorkers {
+		return lowMemoryWorkers
+	}
+	return workers
+}
+
+// 低内存模式下限制源端游标每批返回的文档数，默认每批最多16MB
+func limitCursorBatch(opts *options.FindOptions) *options.FindOptions {
+	if lowMemory {
+		opts.SetBatchSize(lowMemoryCursorBatch)
+	}
+	return opts
+}
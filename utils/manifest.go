@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// mongosync的版本，发布时通过 -ldflags "-X mongosync/utils.ToolVersion=x.y.z" 设置
+var ToolVersion = "dev"
+
+// 同步任务的清单保存在目标实例的mongosync.manifest集合中，每个源端一个文档
+const manifestCollName = "manifest"
+
+// 清单中的任务状态
+const (
+	ManifestStateRunning = "running" // 任务进行中或异常中断，再次运行时为继续该任务
+	ManifestStateDone    = "done"    // 全量同步已经完成，再次运行时为新的任务
+)
+
+// 影响同步结果的配置：ns的过滤、映射和目标端的转换。继续未完成的任务时这些配置必须与任务开始时相同
+type ManifestConfig struct {
+	Db          string `bson:"db" json:"db"`
+	NsInclude   string `bson:"nsInclude" json:"nsInclude"`
+	NsExclude   string `bson:"nsExclude" json:"nsExclude"`
+	DbFromTo    string `bson:"dbFrom_To" json:"dbFrom_To"`
+	NsFromTo    string `bson:"nsFrom_To" json:"nsFrom_To"`
+	NsCollision string `bson:"nsCollision" json:"nsCollision"`
+	NsInvalid   string `bson:"nsInvalid,omitempty" json:"nsInvalid,omitempty"`     // 默认策略（error）时为空，与之前版本记录的配置哈希一致
+	Hooks       string `bson:"hooks" json:"hooks"`                                 // hook配置的sha256，没有hook时为空
+	Filters     string `bson:"filters,omitempty" json:"filters,omitempty"`         // 按ns过滤条件的sha256，没有过滤条件时为空
+	Projections string `bson:"projections,omitempty" json:"projections,omitempty"` // 按ns投影的sha256，没有投影时为空
+}
+
+// mongosync.manifest中的文档，记录任务的来源、版本、配置和ns映射，可以直接在目标端查看
+type Manifest struct {
+	ID          string              `bson:"_id"` // 源端地址
+	ToolVersion string              `bson:"toolVersion"`
+	ConfigHash  string              `bson:"configHash"`
+	Config      ManifestConfig      `bson:"config"`
+	NsMappings  []string            `bson:"nsMappings"` // 源ns->目标ns
+	State       string              `bson:"state"`
+	StartTS     primitive.Timestamp `bson:"startTS"` // 全量同步开始前的oplog位置，不同步oplog时为空
+	StartTime   time.Time           `bson:"startTime"`
+	UpdateTime  time.Time           `bson:"updateTime"`
+	// 各个集合在全量同步中的结果，--retry_failed只重新同步其中未成功的集合
+	Collections []ManifestCollection `bson:"collections"`
+}
+
+// 计算配置的sha256
+func (config ManifestConfig) hash() string {
+	content, _ := json.Marshal(config)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// 在任务开始时检查并写入清单。目标端存在同一源端未完成（running）的任务时，本次运行视为继续该任务，
+// 配置与该任务不同时返回错误，避免使用不兼容的配置继续同步；reset为true时丢弃旧的清单，作为新的任务开始。
+// 继续任务时全量同步从保存的复制进度继续，返回任务开始时的oplog位置（之前已经复制的文档需要从该位置开始重放）；
+// 新的任务清空之前的复制进度，返回startTS
+func CustCheckManifest(srcMongo, dstMongo *MongoArgs, config ManifestConfig, nsStructSlice []*NsMap, startTS primitive.Timestamp, reset bool) (primitive.Timestamp, error) {
+	config = config.withFileHashes()
+	manifest := Manifest{
+		ID:          srcMongo.uri(),
+		ToolVersion: ToolVersion,
+		ConfigHash:  config.hash(),
+		Config:      config,
+		State:       ManifestStateRunning,
+		StartTS:     startTS,
+		StartTime:   time.Now(),
+		UpdateTime:  time.Now(),
+	}
+	for _, nsmap := range nsStructSlice {
+		manifest.NsMappings = append(manifest.NsMappings, nsmap.SrcDb+"."+nsmap.SrcColl+"->"+nsmap.DstDb+"."+nsmap.DstColl)
+		manifest.Collections = append(manifest.Collections, ManifestCollection{
+			SrcNs: nsmap.SrcDb + "." + nsmap.SrcColl,
+			DstNs: nsmap.DstDb + "." + nsmap.DstColl,
+			State: ManifestNsPending,
+		})
+	}
+
+	coll := dstMongo.Client().Database(mongosyncDbName).Collection(manifestCollName)
+	var previous Manifest
+	err := doWithRetry(dstMongo.Context(), findTimeout, "find "+mongosyncDbName+"."+manifestCollName, func(ctx context.Context) error {
+		return coll.FindOne(ctx, bson.M{"_id": manifest.ID}).Decode(&previous)
+	})
+	if err != nil && err != mongo.ErrNoDocuments {
+		return startTS, err
+	}
+	resumed := err == nil && previous.State == ManifestStateRunning && !reset
+	if resumed {
+		if previous.ConfigHash != manifest.ConfigHash {
+			return startTS, fmt.Errorf("目标端存在%s开始的未完成任务（mongosync %s），本次的配置与该任务不同：%s\n"+
+				"请使用与该任务相同的参数继续，或使用--reset_manifest作为新的任务开始",
+				previous.StartTime.Format("2006-01-02 15:04:05"), previous.ToolVersion, diffManifestConfig(previous.Config, config))
+		}
+		manifest.StartTime = previous.StartTime
+		srcMongo.logger().Info("继续未完成的任务", zap.String("source", manifest.ID), zap.Time("startTime", previous.StartTime), zap.String("previousVersion", previous.ToolVersion))
+		if !previous.StartTS.IsZero() {
+			manifest.StartTS = previous.StartTS
+		} else if !startTS.IsZero() {
+			// 之前的运行没有记录oplog位置，已经复制的文档无法通过重放oplog追上源端，重新复制全部集合
+			srcMongo.logger().Warn("未完成的任务没有记录oplog位置，重新开始全量同步", zap.String("source", manifest.ID))
+			resumed = false
+		}
+	}
+	if resumed {
+		// 继续任务时保留之前运行中各个集合的结果
+		mergeManifestCollections(manifest.Collections, previous.Collections)
+	} else {
+		if err := resetCopyProgress(srcMongo, dstMongo); err != nil {
+			return startTS, err
+		}
+	}
+	err = doWithRetry(dstMongo.Context(), writeTimeout, "save manifest", func(ctx context.Context) error {
+		_, err := coll.ReplaceOne(ctx, bson.M{"_id": manifest.ID}, manifest, options.Replace().SetUpsert(true))
+		return err
+	})
+	if err == nil {
+		startManifestRecorder(srcMongo, dstMongo)
+	}
+	return manifest.StartTS, err
+}
+
+// 加上hook、过滤条件和投影配置的sha256
+func (config ManifestConfig) withFileHashes() ManifestConfig {
+	if hooks != nil {
+		content, _ := json.Marshal(hooks)
+		sum := sha256.Sum256(content)
+		config.Hooks = hex.EncodeToString(sum[:])
+	}
+	if nsFilters != nil {
+		content, _ := json.Marshal(nsFilters)
+		sum := sha256.Sum256(content)
+		config.Filters = hex.EncodeToString(sum[:])
+	}
+	if nsProjections != nil {
+		specs := make(map[string]bson.D, len(nsProjections))
+		for ns, p := range nsProjections {
+			specs[ns] = p.spec
+		}
+		content, _ := json.Marshal(specs)
+		sum := sha256.Sum256(content)
+		config.Projections = hex.EncodeToString(sum[:])
+	}
+	return config
+}
+
+// 全量同步完成且不需要继续增量同步时，将任务标记为已完成
+func CustFinishManifest(srcMongo, dstMongo *MongoArgs) {
+	coll := dstMongo.Client().Database(mongosyncDbName).Collection(manifestCollName)
+	err := doWithRetry(dstMongo.Context(), writeTimeout, "update manifest", func(ctx context.Context) error {
+		_, err := coll.UpdateOne(ctx, bson.M{"_id": srcMongo.uri()}, bson.M{"$set": bson.M{"state": ManifestStateDone, "updateTime": time.Now()}})
+		return err
+	})
+	if err != nil {
+		dstMongo.logger().Warn("更新任务清单的状态失败", zap.Error(err))
+	}
+}
+
+// 列出两份配置中不同的项
+func diffManifestConfig(previous, current ManifestConfig) string {
+	var diffs []string
+	add := func(name, prev, cur string) {
+		if prev != cur {
+			diffs = append(diffs, fmt.Sprintf("%s: %q -> %q", name, prev, cur))
+		}
+	}
+	add("--db", previous.Db, current.Db)
+	add("--nsInclude", previous.NsInclude, current.NsInclude)
+	add("--nsExclude", previous.NsExclude, current.NsExclude)
+	add("--dbFrom_To", previous.DbFromTo, current.DbFromTo)
+	add("--nsFrom_To", previous.NsFromTo, current.NsFromTo)
+	add("--ns_collision", previous.NsCollision, current.NsCollision)
+	add("--ns_invalid", previous.NsInvalid, current.NsInvalid)
+	add("--hooks_file", previous.Hooks, current.Hooks)
+	add("--filters_file", previous.Filters, current.Filters)
+	add("--projections_file", previous.Projections, current.Projections)
+	return strings.Join(diffs, "；")
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"context"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// oplog所在的ns。主从复制（master-slave）的主节点没有local.oplog.rs，oplog位于local.oplog.$main，
+// 其中的oplog与副本集的oplog格式基本相同，但没有t、v字段，并且存在声明数据库的"db"类型的oplog
+const (
+	replSetOplogNs     = "local.oplog.rs"
+	masterSlaveOplogNs = "local.oplog.$main"
+)
+
+// 返回实例的oplog所在的ns：主从复制的主节点为local.oplog.$main，其他情况为local.oplog.rs
+func (mc *MongoArgs) OplogNamespace() string {
+	if info, err := mc.ServerInfo(); err == nil && info.MasterSlave {
+		return masterSlaveOplogNs
+	}
+	return replSetOplogNs
+}
+
+// 判断ns是否为oplog固定集合（可以使用tailable游标）
+func isOplogNamespace(ns string) bool {
+	return ns == replSetOplogNs || ns == masterSlaveOplogNs
+}
+
+// 将ns拆分为库名和集合名
+func splitOplogNamespace(ns string) (string, string) {
+	parts := strings.SplitN(ns, ".", 2)
+	return parts[0], parts[1]
+}
+
+// 主从复制没有replSetGetStatus，直接读取local.oplog.$main中最新的一条oplog
+func latestOplogTimestampByFind(mc *MongoArgs) (primitive.Timestamp, error) {
+	oplogColl := mc.Client().Database("local").Collection("oplog.$main")
+	var last struct {
+		TS primitive.Timestamp `bson:"ts"`
+	}
+	err := doWithRetry(mc.Context(), findTimeout, "find "+masterSlaveOplogNs, func(ctx context.Context) error {
+		return oplogColl.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{"$natural", -1}})).Decode(&last)
+	})
+	return last.TS, err
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+// 全量复制的内存上限：从源端读取、等待写入目标端的文档占用内存预算，预算用完时源端游标暂停读取，
+// 先写入已经读取的文档，写入完成释放预算后再继续读取，目标端写入跟不上时不会在内存中无限累积文档。
+// 预算为--max_memory_mb的一半，其余留给驱动的游标缓冲区、oplog重放等；同时将--max_memory_mb设置为Go运行时的软内存上限
+type memoryBudget struct {
+	sync.Mutex
+	cond     *sync.Cond
+	limit    int64 // 为0时不限制
+	used     int64
+	reserved int64 // 长期占用的预算，最多为预算的一半
+}
+
+var copyMemory = newMemoryBudget()
+
+func newMemoryBudget() *memoryBudget {
+	b := &memoryBudget{}
+	b.cond = sync.NewCond(b)
+	return b
+}
+
+// 设置全量复制的内存上限，mb为0时不限制。需要在SetLowMemory之后调用，每批写入的字节数限制在预算的1/4以内
+func SetMaxMemory(mb int) {
+	if mb <= 0 {
+		return
+	}
+	limit := int64(mb) << 20
+	copyMemory.limit = limit / 2
+	if copyBatchBytes <= 0 || copyBatchBytes > copyMemory.limit/4 {
+		copyBatchBytes = copyMemory.limit / 4
+	}
+	debug.SetMemoryLimit(limit)
+}
+
+// 单个文档超过预算的一半时按一半计算，另一半可能被长期占用
+func (b *memoryBudget) clamp(n int64) int64 {
+	if n > b.limit/2 {
+		return b.limit / 2
+	}
+	return n
+}
+
+// 不等待地占用n字节的预算，返回实际占用的字节数，预算不足时返回false
+func (b *memoryBudget) tryAcquire(n int64) (int64, bool) {
+	if b.limit <= 0 {
+		return 0, true
+	}
+	n = b.clamp(n)
+	b.Lock()
+	defer b.Unlock()
+	if b.used+b.reserved+n > b.limit {
+		return 0, false
+	}
+	b.used += n
+	return n, true
+}
+
+// 占用n字节的预算，预算不足时等待其他批次写入完成释放预算，返回实际占用的字节数
+func (b *memoryBudget) acquire(n int64) int64 {
+	if b.limit <= 0 {
+		return 0
+	}
+	n = b.clamp(n)
+	b.Lock()
+	defer b.Unlock()
+	for b.used+b.reserved+n > b.limit {
+		b.cond.Wait()
+	}
+	b.used += n
+	return n
+}
+
+// 释放占用的预算
+func (b *memoryBudget) release(n int64) {
+	if n <= 0 {
+		return
+	}
+	b.Lock()
+	b.used -= n
+	b.Unlock()
+	b.cond.Broadcast()
+}
+
+// 长期占用n字节的预算（如按$natural顺序读取时记录的已读取的_id），不等待。
+// 长期占用的预算合计超过预算的一半时返回false，保证读取的文档始终可以占用另一半
+func (b *memoryBudget) reserve(n int64) bool {
+	if b.limit <= 0 {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.reserved+n > b.limit/2 {
+		return false
+	}
+	b.reserved += n
+	return true
+}
+
+// 释放长期占用的预算
+func (b *memoryBudget) unreserve(n int64) {
+	if n <= 0 || b.limit <= 0 {
+		return
+	}
+	b.Lock()
+	b.reserved -= n
+	b.Unlock()
+	b.cond.Broadcast()
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// 重放u类型的oplog（$set、$unset等更新操作）时，目标端可能还没有对应的文档（全量复制与oplog的时间窗口交错、之前的重放被中断等）。
+// 默认使用upsert执行，会在目标端生成只包含更新字段的不完整文档；设置源端后改为不使用upsert执行，
+// 没有匹配到文档时从源端按_id读取完整的文档写入目标端
+var missingDocSource *MongoArgs
+
+// 设置u操作找不到目标文档时读取完整文档的源端，nil表示使用upsert执行
+func SetFetchMissingDocs(srcMongo *MongoArgs) {
+	missingDocSource = srcMongo
+}
+
+// 不使用upsert执行更新，没有匹配到目标文档时从源端读取完整文档写入目标端
+func applyUpdateOrFetch(ctx context.Context, dstColl *mongo.Collection, nsStruct *NsMap, oplog OPLOG) error {
+	var result *mongo.UpdateResult
+	updateOpts := options.Update().SetBypassDocumentValidation(false)
+	if hint := upsertHint(ctx, dstColl, oplog.O2); hint != nil {
+		updateOpts.SetHint(hint)
+	}
+	err := doWithRetry(ctx, writeTimeout, "UpdateOne", func(ctx context.Context) error {
+		var err error
+		result, err = dstColl.UpdateOne(ctx, oplog.O2, oplog.O, updateOpts)
+		return err
+	})
+	if err != nil || result.MatchedCount > 0 {
+		return err
+	}
+	o2, _ := oplog.O2.(bson.D)
+	id, exists := o2.Map()["_id"]
+	if !exists {
+		return errors.New("u类型oplog的o2中没有_id")
+	}
+	srcColl := missingDocSource.Client().Database(nsStruct.SrcDb).Collection(nsStruct.SrcColl)
+	var doc bson.Raw
+	err = doWithRetry(ctx, findTimeout, "find "+nsStruct.SrcDb+"."+nsStruct.SrcColl, func(ctx context.Context) error {
+		findOneOpts := options.FindOne()
+		if p := projectionFor(nsStruct.SrcDb + "." + nsStruct.SrcColl); p != nil {
+			findOneOpts.SetProjection(p.spec)
+		}
+		return srcColl.FindOne(ctx, bson.M{"_id": id}, findOneOpts).Decode(&doc)
+	})
+	if err == mongo.ErrNoDocuments {
+		// 源端文档已经被删除，之后的d类型oplog会删除该文档，目标端不需要写入
+		loggerFrom(ctx).Debug("u操作对应的文档在目标端和源端均不存在，跳过", zap.String("NS", oplog.NS), zap.String("_id", fmt.Sprintf("%v", id)))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("从源端读取u操作对应的文档失败：%v", err)
+	}
+	err = doWithRetry(ctx, writeTimeout, "ReplaceOne", func(ctx context.Context) error {
+		_, err := dstColl.ReplaceOne(ctx, bson.M{"_id": id}, doc, options.Replace().SetUpsert(true))
+		return err
+	})
+	if err == nil {
+		loggerFrom(ctx).Info("目标端不存在u操作对应的文档，已从源端读取完整文档写入", zap.String("NS", oplog.NS), zap.String("_id", fmt.Sprintf("%v", id)))
+	}
+	return err
+}
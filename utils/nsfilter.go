@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// 按源ns指定的过滤条件，全量同步时只复制满足条件的文档，用于按租户、按时间范围迁移部分数据
+var nsFilters map[string]bson.D
+
+// 从JSON文件中加载过滤条件，格式为{"源ns": 扩展JSON格式的查询条件}，例如：
+//
+//	{
+//		"GlobalDB.orders": {"tenant": "acme"},
+//		"GlobalDB.logs": {"created": {"$gte": {"$date": "2023-01-01T00:00:00Z"}}}
+//	}
+func CustLoadNsFilters(path string) (map[string]bson.D, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+	filters := make(map[string]bson.D, len(raw))
+	for ns, value := range raw {
+		var filter bson.D
+		if err := bson.UnmarshalExtJSON(value, false, &filter); err != nil {
+			return nil, fmt.Errorf("%s的过滤条件格式错误：%v", ns, err)
+		}
+		filters[ns] = filter
+	}
+	return filters, nil
+}
+
+// 设置按源ns的过滤条件，为nil时复制全部文档
+func SetNsFilters(filters map[string]bson.D) {
+	nsFilters = filters
+}
+
+// 将源ns的过滤条件与cond合并
+func withNsFilter(srcNs string, cond bson.M) interface{} {
+	filter := nsFilters[srcNs]
+	if len(filter) == 0 {
+		return cond
+	}
+	if len(cond) == 0 {
+		return filter
+	}
+	return bson.M{"$and": bson.A{filter, cond}}
+}
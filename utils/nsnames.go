@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// 目标ns不符合命名限制（长度、非法字符）时的处理策略
+const (
+	NsInvalidError  = "error"  // 报错退出
+	NsInvalidRename = "rename" // 自动改为合法的名称，并记录在ns映射中
+)
+
+// 目标端的命名限制
+const (
+	maxDbNameLen       = 63  // 库名的最大字节数
+	maxNsLenBefore44   = 120 // 4.4之前ns（db.coll）的最大字节数
+	maxNsLen           = 255 // 4.4+ns的最大字节数
+	invalidDbNameChars = "/\\. \"$\x00"
+	invalidCollChars   = "$\x00"
+	renameHashLen      = 8 // 改名时追加的原名称哈希值的长度，保证不同的原名称改名后不会重复
+)
+
+// 检查目标ns是否符合目标端的命名限制。policy为rename时将不合法的库名、集合名改为合法的名称：
+// 非法字符替换为"_"，超长时截断，并追加原名称的哈希值；改名结果同步更新到nsnsMap，保证oplog重放使用相同的映射。
+// 在同步开始前检查，避免同步进行到一半时创建集合失败
+func CustCheckNsNames(dstMongo *MongoArgs, nsStructSlice []*NsMap, nsnsMap map[string]string, policy string) error {
+	if policy != NsInvalidError && policy != NsInvalidRename {
+		return fmt.Errorf("未知的ns命名不合法处理策略：%s", policy)
+	}
+	// 没有目标端（导出为备份）时按4.4之前的限制检查
+	nsLimit := maxNsLenBefore44
+	if dstMongo != nil {
+		if info, err := dstMongo.ServerInfo(); err == nil && info.FeatureAtLeast(4, 4) {
+			nsLimit = maxNsLen
+		}
+	}
+
+	var invalid []string
+	for _, nsmap := range nsStructSlice {
+		dstNs := nsmap.DstDb + "." + nsmap.DstColl
+		reason := checkDbName(nsmap.DstDb)
+		if reason == "" {
+			reason = checkCollName(nsmap.DstColl)
+		}
+		if reason == "" && len(dstNs) > nsLimit {
+			reason = fmt.Sprintf("ns长度%d超过%d字节", len(dstNs), nsLimit)
+		}
+		if reason == "" {
+			continue
+		}
+		if policy == NsInvalidError {
+			invalid = append(invalid, fmt.Sprintf("%s（%s）", dstNs, reason))
+			continue
+		}
+		if checkDbName(nsmap.DstDb) != "" {
+			nsmap.DstDb = safeName(nsmap.DstDb, nsmap.DstDb, invalidDbNameChars, maxDbNameLen)
+		}
+		if checkCollName(nsmap.DstColl) != "" || len(nsmap.DstDb)+1+len(nsmap.DstColl) > nsLimit {
+			nsmap.DstColl = safeCollName(nsmap.DstColl, nsLimit-len(nsmap.DstDb)-1)
+		}
+		nsnsMap[nsmap.SrcDb+"."+nsmap.SrcColl] = nsmap.DstDb + "." + nsmap.DstColl
+		dstMongo.logger().Warn("目标ns不符合命名限制，已改名", zap.String("srcNs", nsmap.SrcDb+"."+nsmap.SrcColl),
+			zap.String("dstNs", dstNs), zap.String("renamedNs", nsmap.DstDb+"."+nsmap.DstColl), zap.String("reason", reason))
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("目标ns不符合命名限制：%s", strings.Join(invalid, "; "))
+	}
+	return nil
+}
+
+// 检查库名，合法时返回空字符串
+func checkDbName(name string) string {
+	if name == "" {
+		return "库名为空"
+	}
+	if len(name) > maxDbNameLen {
+		return fmt.Sprintf("库名长度%d超过%d字节", len(name), maxDbNameLen)
+	}
+	if strings.ContainsAny(name, invalidDbNameChars) {
+		return "库名包含非法字符"
+	}
+	return ""
+}
+
+// 检查集合名，合法时返回空字符串
+func checkCollName(name string) string {
+	if name == "" {
+		return "集合名为空"
+	}
+	if strings.ContainsAny(name, invalidCollChars) {
+		return "集合名包含非法字符"
+	}
+	if strings.HasPrefix(name, "system.") {
+		return "集合名以system.开头"
+	}
+	return ""
+}
+
+func safeCollName(name string, maxLen int) string {
+	cleaned := name
+	if strings.HasPrefix(name, "system.") {
+		cleaned = "system_" + strings.TrimPrefix(name, "system.")
+	}
+	return safeName(name, cleaned, invalidCollChars, maxLen)
+}
+
+// 将name中的非法字符替换为"_"，追加原名称original的哈希值，超过maxLen字节时截断名称部分（不截断UTF-8字符）
+func safeName(original, name, invalidChars string, maxLen int) string {
+	sum := sha1.Sum([]byte(original))
+	suffix := "_" + hex.EncodeToString(sum[:])[:renameHashLen]
+	cleaned := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(invalidChars, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	for len(cleaned)+len(suffix) > maxLen && len(cleaned) > 0 {
+		_, size := utf8.DecodeLastRuneInString(cleaned)
+		cleaned = cleaned[:len(cleaned)-size]
+	}
+	return cleaned + suffix
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// 按源ns覆盖全量复制的参数：一个很大的热点集合与大量小集合需要的并发数、批次大小和限流往往相差很大。
+// 未指定的字段（或为0）沿用全局的--range_threads、--batch_docs、--batch_bytes和限流设置；
+// 指定了限流的ns使用自己的令牌桶，不再受全局限流的限制
+type NsOverride struct {
+	RangeThreads int     `json:"range_threads"`
+	BatchDocs    int     `json:"batch_docs"`
+	BatchBytes   int64   `json:"batch_bytes"`
+	SrcReadDocs  float64 `json:"src_read_docs_per_sec"`
+	SrcReadMB    float64 `json:"src_read_mb_per_sec"`
+	DstWriteDocs float64 `json:"dst_write_docs_per_sec"`
+	DstWriteMB   float64 `json:"dst_write_mb_per_sec"`
+	// _id已经存在时的处理方式，同时用于全量复制和重放该ns的insert类型的oplog
+	ConflictPolicy ConflictPolicy `json:"conflict_policy"`
+
+	srcRead, dstWrite *rateLimiter // 指定了限流时该ns使用的令牌桶
+}
+
+var nsOverrides map[string]*NsOverride
+
+// 从JSON文件中加载按源ns覆盖的参数，格式为{"源ns": {字段同NsOverride}}，例如：
+//
+//	{
+//		"GlobalDB.events": {"range_threads": 16, "batch_docs": 2000, "dst_write_mb_per_sec": 200},
+//		"GlobalDB.audit": {"range_threads": 1, "src_read_docs_per_sec": 500, "conflict_policy": "merge"}
+//	}
+func CustLoadNsOverrides(path string) (map[string]*NsOverride, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+	overrides := make(map[string]*NsOverride, len(raw))
+	for ns, value := range raw {
+		var override NsOverride
+		decoder := json.NewDecoder(bytes.NewReader(value))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&override); err != nil {
+			return nil, fmt.Errorf("%s的参数格式错误：%v", ns, err)
+		}
+		if override.RangeThreads < 0 || override.BatchDocs < 0 || override.BatchBytes < 0 || override.SrcReadDocs < 0 ||
+			override.SrcReadMB < 0 || override.DstWriteDocs < 0 || override.DstWriteMB < 0 {
+			return nil, fmt.Errorf("%s的参数不能为负数", ns)
+		}
+		if override.ConflictPolicy != "" {
+			if _, err := CustParseConflictPolicy(string(override.ConflictPolicy)); err != nil {
+				return nil, fmt.Errorf("%s的conflict_policy错误：%v", ns, err)
+			}
+		}
+		overrides[ns] = &override
+	}
+	return overrides, nil
+}
+
+// 设置按源ns覆盖的参数，为nil时全部使用全局设置
+func SetNsOverrides(overrides map[string]*NsOverride) {
+	for _, override := range overrides {
+		if override.SrcReadDocs > 0 || override.SrcReadMB > 0 {
+			override.srcRead = &rateLimiter{}
+			override.srcRead.setRate(override.SrcReadDocs, override.SrcReadMB*1024*1024)
+		}
+		if override.DstWriteDocs > 0 || override.DstWriteMB > 0 {
+			override.dstWrite = &rateLimiter{}
+			override.dstWrite.setRate(override.DstWriteDocs, override.DstWriteMB*1024*1024)
+		}
+	}
+	nsOverrides = overrides
+}
+
+// 源ns并发复制的_id范围数，低内存模式下始终为1
+func rangeThreadsFor(srcNs string) int {
+	if override := nsOverrides[srcNs]; override != nil && override.RangeThreads > 0 && !lowMemory {
+		return override.RangeThreads
+	}
+	return rangeThreads
+}
+
+// 源ns每批写入的文档条数和BSON总字节数上限。设置了--max_memory_mb时字节数不超过内存预算的1/4
+func copyBatchFor(srcNs string) (int, int64) {
+	docs, size := copyBatchDocs, copyBatchBytes
+	override := nsOverrides[srcNs]
+	if override == nil {
+		return docs, size
+	}
+	if override.BatchDocs > 0 {
+		docs = override.BatchDocs
+	}
+	if override.BatchBytes > 0 {
+		size = override.BatchBytes
+		if copyMemory.limit > 0 && size > copyMemory.limit/4 {
+			size = copyMemory.limit / 4
+		}
+	}
+	return docs, size
+}
+
+// 源ns读取源端时使用的限流
+func srcReadLimiterFor(srcNs string) *rateLimiter {
+	if override := nsOverrides[srcNs]; override != nil && override.srcRead != nil {
+		return override.srcRead
+	}
+	return srcReadLimiter
+}
+
+// 源ns写入目标端时使用的限流
+func dstWriteLimiterFor(srcNs string) *rateLimiter {
+	if override := nsOverrides[srcNs]; override != nil && override.dstWrite != nil {
+		return override.dstWrite
+	}
+	return dstWriteLimiter
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// --nsInclude、--nsExclude中ns的匹配模式，支持以下格式（多个模式以逗号分隔，模式中不能包含逗号）：
+//
+//	GlobalDB.users   精确匹配
+//	analytics.*      glob，*匹配任意个字符，?匹配单个字符；库名部分的*不会跨越"."
+//	analytics        只有库名时匹配该库中的所有集合，等同于analytics.*
+//	/^logs\.\d+$/    以/包围的正则表达式，匹配完整的ns（db.coll）
+type nsPattern struct {
+	text string
+	re   *regexp.Regexp
+}
+
+func parseNsPattern(text string) (*nsPattern, error) {
+	if len(text) >= 2 && strings.HasPrefix(text, "/") && strings.HasSuffix(text, "/") {
+		re, err := regexp.Compile(text[1 : len(text)-1])
+		if err != nil {
+			return nil, fmt.Errorf("正则表达式%s错误：%v", text, err)
+		}
+		return &nsPattern{text: text, re: re}, nil
+	}
+	dbPart, collPart := text, "*"
+	if i := strings.Index(text, "."); i >= 0 {
+		dbPart, collPart = text[:i], text[i+1:]
+	}
+	if dbPart == "" || collPart == "" {
+		return nil, fmt.Errorf("ns模式%s错误，格式为<db.coll>", text)
+	}
+	re := regexp.MustCompile("^" + globToRegexp(dbPart, "[^.]") + `\.` + globToRegexp(collPart, ".") + "$")
+	return &nsPattern{text: text, re: re}, nil
+}
+
+// 将glob转换为正则表达式，any为*、?可以匹配的字符
+func globToRegexp(glob, any string) string {
+	var b strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(any + "*")
+		case '?':
+			b.WriteString(any)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return b.String()
+}
+
+func (p *nsPattern) match(ns string) bool {
+	return p.re.MatchString(ns)
+}
+
+// 按--db、--nsInclude、--nsExclude过滤ns，排除优先于包含
+type NsMatcher struct {
+	dbs     map[string]bool // 为空时不限制库
+	include []*nsPattern    // 为空时包含所有ns
+	exclude []*nsPattern
+}
+
+// 解析ns过滤条件，dbs为要同步的库，include、exclude为逗号分隔的ns模式
+func CustParseNsMatcher(dbs []string, include, exclude string) (*NsMatcher, error) {
+	m := &NsMatcher{}
+	if len(dbs) > 0 {
+		m.dbs = make(map[string]bool, len(dbs))
+		for _, db := range dbs {
+			m.dbs[db] = true
+		}
+	}
+	var err error
+	if m.include, err = parseNsPatterns(include); err != nil {
+		return nil, err
+	}
+	if m.exclude, err = parseNsPatterns(exclude); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseNsPatterns(list string) ([]*nsPattern, error) {
+	var patterns []*nsPattern
+	for _, text := range strings.Split(list, ",") {
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		p, err := parseNsPattern(text)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// ns（db.coll）是否需要同步
+func (m *NsMatcher) Match(ns string) bool {
+	if len(m.dbs) > 0 && !m.dbs[CustFilter(ns, nil).SrcDb] {
+		return false
+	}
+	for _, p := range m.exclude {
+		if p.match(ns) {
+			return false
+		}
+	}
+	if len(m.include) == 0 {
+		return true
+	}
+	for _, p := range m.include {
+		if p.match(ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// 没有被任何一个include模式匹配的ns，用于提示可能写错的模式
+func (m *NsMatcher) UnmatchedIncludes(nsSlice []string) []string {
+	var unmatched []string
+	for _, p := range m.include {
+		found := false
+		for _, ns := range nsSlice {
+			if p.match(ns) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unmatched = append(unmatched, p.text)
+		}
+	}
+	return unmatched
+}
+
+// oplog重放时用于匹配同步开始后新建的集合，为nil时只重放开始时确定的ns
+var replayNsMatcher *NsMatcher
+
+// 设置oplog重放时的ns过滤条件，使同步开始后新建的、与模式匹配的集合也能够同步
+func SetReplayNsMatcher(m *NsMatcher) {
+	replayNsMatcher = m
+}
@@ -0,0 +1,414 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+	"go.uber.org/zap"
+)
+
+// 边缘设备到中心集群的单向同步：网络可能长时间中断，目标端不可达期间将待重放的oplog按顺序写入本地磁盘缓冲区，
+// 读取源端oplog的进度不受影响；目标端恢复后先按顺序重放缓冲区中的oplog，全部重放完后再恢复实时重放。
+// 缓冲区由多个段文件组成（seg-<序号>.bson，每条记录为一个BSON文档），总大小有上限，写满时按策略处理：
+//
+//	block        暂停读取源端oplog，直到目标端恢复、缓冲区有空间（源端oplog需要保留足够长的时间）
+//	drop_oldest  删除最早的段文件，丢弃其中的oplog（目标端数据将不一致，需要重新全量同步）
+//
+// 缓冲区中的数据在进程重启后仍然保留，启动时先重放遗留的段文件
+const (
+	OfflineBufferBlock      = "block"
+	OfflineBufferDropOldest = "drop_oldest"
+)
+
+const (
+	offlineSegmentBytes  = int64(16 << 20)  // 单个段文件的大小
+	offlineCheckInterval = 10 * time.Second // 目标端不可达时检查连接的间隔
+)
+
+// 缓冲区中的一条记录
+type offlineOp struct {
+	Ns    NsMap `bson:"ns"`
+	Oplog OPLOG `bson:"oplog"`
+}
+
+type offlineBuffer struct {
+	dir      string
+	maxBytes int64
+	policy   string
+
+	lock       sync.Mutex
+	space      *sync.Cond      // 缓冲区有空间或重放完成时通知
+	segments   []int64         // 已写完的段文件序号，从早到晚
+	sizes      map[int64]int64 // 已写完的段文件大小
+	writer     *os.File        // 正在写入的段文件，为nil时表示还没有打开
+	writeSeq   int64
+	writeBytes int64
+	totalBytes int64
+	drainSeq   int64 // 正在重放的段文件序号，为0时表示没有
+	draining   bool  // 后台重放协程是否在运行
+	dropped    int64 // drop_oldest策略丢弃的oplog数
+}
+
+var offlineBuf *offlineBuffer
+
+// 启用本地磁盘缓冲区。dir为缓冲区目录，maxMB为缓冲区大小上限（MB），policy为写满时的处理策略；dir为空时不启用
+func SetOfflineBuffer(dir string, maxMB int, policy string) error {
+	if dir == "" {
+		return nil
+	}
+	if policy != OfflineBufferBlock && policy != OfflineBufferDropOldest {
+		return fmt.Errorf("不支持的缓冲区策略%s，可选值为%s、%s", policy, OfflineBufferBlock, OfflineBufferDropOldest)
+	}
+	if maxMB <= 0 {
+		return errors.New("缓冲区大小必须大于0")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	b := &offlineBuffer{dir: dir, maxBytes: int64(maxMB) << 20, policy: policy, sizes: make(map[int64]int64)}
+	b.space = sync.NewCond(&b.lock)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	// 上次运行遗留的段文件，启动后先重放
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "seg-") || !strings.HasSuffix(name, ".bson") {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, "seg-"), ".bson"), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		b.segments = append(b.segments, seq)
+		b.sizes[seq] = info.Size()
+		b.totalBytes += info.Size()
+	}
+	sort.Slice(b.segments, func(i, j int) bool { return b.segments[i] < b.segments[j] })
+	if n := len(b.segments); n > 0 {
+		b.writeSeq = b.segments[n-1]
+		log.Printf("本地缓冲区%s中有%d个未重放的段文件（%dMB），将在目标端可达后先行重放\n", dir, n, b.totalBytes>>20)
+	}
+	offlineBuf = b
+	return nil
+}
+
+// 执行oplog；缓冲区中有未重放的数据时写入缓冲区以保证顺序，目标端不可达时写入缓冲区并开始后台重放
+func applyOrBuffer(dstMongo *MongoArgs, nsStruct *NsMap, oplog OPLOG) error {
+	b := offlineBuf
+	if b == nil {
+		return applyOplog(dstMongo.Context(), dstMongo.Client(), nsStruct, oplog)
+	}
+	if b.active() {
+		return b.push(dstMongo, nsStruct, oplog)
+	}
+	err := applyOplog(dstMongo.Context(), dstMongo.Client(), nsStruct, oplog)
+	if isUnreachableError(dstMongo.Context(), err) {
+		dstMongo.logger().Warn("目标端不可达，oplog写入本地缓冲区", zap.String("dir", b.dir), zap.Error(err))
+		return b.push(dstMongo, nsStruct, oplog)
+	}
+	return err
+}
+
+// 缓冲区是否启用且有未重放的数据
+func offlineBufferActive() bool {
+	return offlineBuf != nil && offlineBuf.active()
+}
+
+// 启动时缓冲区中有遗留数据的，开始后台重放
+func startOfflineBuffer(dstMongo *MongoArgs) {
+	if b := offlineBuf; b != nil {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if len(b.segments) > 0 {
+			b.startDrain(dstMongo)
+		}
+	}
+}
+
+// 等待缓冲区中的数据全部重放完，用于指定结束位置的重放在退出前确保数据写入目标端
+func waitOfflineBuffer(dstMongo *MongoArgs) {
+	b := offlineBuf
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.draining {
+		dstMongo.logger().Info("等待本地缓冲区中的oplog重放完成", zap.Int64("bufferedMB", (b.totalBytes+b.writeBytes)>>20))
+	}
+	for b.draining {
+		b.space.Wait()
+	}
+}
+
+// 判断err是否表示目标端不可达：网络错误、连接或选择服务器超时
+func isUnreachableError(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	var selErr topology.ServerSelectionError
+	return mongo.IsNetworkError(err) || mongo.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &selErr)
+}
+
+func (b *offlineBuffer) active() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.segments) > 0 || b.writeBytes > 0
+}
+
+// 将oplog追加到缓冲区，必要时启动后台重放
+func (b *offlineBuffer) push(dstMongo *MongoArgs, nsStruct *NsMap, oplog OPLOG) error {
+	record, err := bson.Marshal(offlineOp{Ns: *nsStruct, Oplog: oplog})
+	if err != nil {
+		return err
+	}
+	size := int64(len(record))
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.startDrain(dstMongo)
+	for b.totalBytes+b.writeBytes+size > b.maxBytes {
+		if b.policy == OfflineBufferBlock {
+			if dstMongo.Context().Err() != nil {
+				return dstMongo.Context().Err()
+			}
+			dstMongo.logger().Warn("本地缓冲区已满，暂停读取源端oplog", zap.Int64("maxMB", b.maxBytes>>20))
+			b.space.Wait()
+			continue
+		}
+		if !b.dropOldest(dstMongo) {
+			// 只剩正在重放的段文件，丢弃当前的oplog
+			b.dropped++
+			return fmt.Errorf("本地缓冲区已满，丢弃oplog，累计丢弃%d条", b.dropped)
+		}
+	}
+	if b.writer == nil {
+		b.writeSeq++
+		b.writer, err = os.OpenFile(b.segmentPath(b.writeSeq), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := b.writer.Write(record); err != nil {
+		return err
+	}
+	b.writeBytes += size
+	if b.writeBytes >= offlineSegmentBytes {
+		return b.rotate()
+	}
+	return nil
+}
+
+// 关闭正在写入的段文件，加入待重放的列表。调用时需要持有lock
+func (b *offlineBuffer) rotate() error {
+	if b.writer == nil {
+		return nil
+	}
+	err := b.writer.Sync()
+	if closeErr := b.writer.Close(); err == nil {
+		err = closeErr
+	}
+	b.writer = nil
+	b.segments = append(b.segments, b.writeSeq)
+	b.sizes[b.writeSeq] = b.writeBytes
+	b.totalBytes += b.writeBytes
+	b.writeBytes = 0
+	return err
+}
+
+// 删除最早的、不在重放中的段文件，返回false表示没有可删除的段文件。调用时需要持有lock
+func (b *offlineBuffer) dropOldest(dstMongo *MongoArgs) bool {
+	i := 0
+	if len(b.segments) > 0 && b.segments[0] == b.drainSeq {
+		i = 1
+	}
+	if i >= len(b.segments) {
+		// 关闭正在写入的段文件后再删除
+		if err := b.rotate(); err != nil || i >= len(b.segments) {
+			return false
+		}
+	}
+	seq := b.segments[i]
+	num, _ := countSegmentOps(b.segmentPath(seq))
+	b.removeSegment(i)
+	b.dropped += num
+	dstMongo.logger().Error("本地缓冲区已满，丢弃最早的oplog，目标端数据将不一致，需要重新全量同步",
+		zap.Int64("segment", seq), zap.Int64("droppedNum", num), zap.Int64("totalDroppedNum", b.dropped))
+	notifyProgress(func(listener ProgressListener) {
+		listener.OnError("", fmt.Errorf("本地缓冲区已满，丢弃了%d条oplog", num))
+	})
+	return true
+}
+
+// 删除第i个已写完的段文件。调用时需要持有lock
+func (b *offlineBuffer) removeSegment(i int) {
+	seq := b.segments[i]
+	os.Remove(b.segmentPath(seq))
+	b.totalBytes -= b.sizes[seq]
+	delete(b.sizes, seq)
+	b.segments = append(b.segments[:i], b.segments[i+1:]...)
+	b.space.Broadcast()
+}
+
+func (b *offlineBuffer) segmentPath(seq int64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("seg-%020d.bson", seq))
+}
+
+// 启动后台重放协程。调用时需要持有lock
+func (b *offlineBuffer) startDrain(dstMongo *MongoArgs) {
+	if b.draining {
+		return
+	}
+	b.draining = true
+	go b.drain(dstMongo)
+}
+
+// 后台重放：等待目标端可达，按顺序重放段文件；重放时目标端再次不可达则继续等待。
+// 缓冲区中没有数据时退出，之后的oplog直接执行
+func (b *offlineBuffer) drain(dstMongo *MongoArgs) {
+	ctx := dstMongo.Context()
+	logger := dstMongo.logger()
+	var offset int64 // 正在重放的段文件中已经执行的字节数
+	for wait := time.Duration(0); ; wait = offlineCheckInterval {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if err := pingMongo(dstMongo); err != nil {
+			logger.Debug("目标端不可达，等待后重试", zap.Error(err))
+			continue
+		}
+		for {
+			b.lock.Lock()
+			if len(b.segments) == 0 {
+				if b.writeBytes == 0 {
+					b.draining = false
+					b.space.Broadcast()
+					b.lock.Unlock()
+					logger.Info("本地缓冲区中的oplog已全部重放，恢复实时重放")
+					return
+				}
+				if err := b.rotate(); err != nil {
+					logger.Error("关闭缓冲区段文件失败", zap.Error(err))
+				}
+			}
+			seq := b.segments[0]
+			if seq != b.drainSeq {
+				b.drainSeq, offset = seq, 0
+			}
+			b.lock.Unlock()
+
+			num, next, err := b.drainSegment(dstMongo, seq, offset)
+			offset = next
+			if err != nil {
+				logger.Warn("重放本地缓冲区时目标端不可达，等待后继续", zap.Int64("segment", seq), zap.Int64("appliedNum", num), zap.Error(err))
+				break
+			}
+			b.lock.Lock()
+			b.drainSeq = 0
+			b.removeSegment(0)
+			remaining := b.totalBytes + b.writeBytes
+			b.lock.Unlock()
+			logger.Info("本地缓冲区段文件重放完成", zap.Int64("segment", seq), zap.Int64("appliedNum", num), zap.Int64("remainingMB", remaining>>20))
+		}
+	}
+}
+
+// 从offset开始执行段文件中的oplog，返回执行的条数和下一条记录的位置。目标端不可达时返回错误，其他错误记录后继续
+func (b *offlineBuffer) drainSegment(dstMongo *MongoArgs, seq, offset int64) (int64, int64, error) {
+	file, err := os.Open(b.segmentPath(seq))
+	if err != nil {
+		return 0, offset, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, offset, err
+	}
+	ctx := dstMongo.Context()
+	reader := bufio.NewReader(file)
+	var num int64
+	for {
+		record, err := readBsonRecord(reader)
+		if err == io.EOF {
+			return num, offset, nil
+		} else if err != nil {
+			// 进程异常退出时最后一条记录可能不完整，忽略之后的内容
+			dstMongo.logger().Warn("缓冲区段文件不完整，忽略剩余内容", zap.Int64("segment", seq), zap.Int64("offset", offset), zap.Error(err))
+			return num, offset, nil
+		}
+		var op offlineOp
+		if err := bson.Unmarshal(record, &op); err != nil {
+			return num, offset, err
+		}
+		dstWriteLimiter.wait(ctx, 1, int64(len(record)))
+		if err := applyOplog(ctx, dstMongo.Client(), &op.Ns, op.Oplog); err != nil {
+			if isUnreachableError(ctx, err) || ctx.Err() != nil {
+				return num, offset, err
+			}
+			log.Println(fmt.Sprintf("重放本地缓冲区中的oplog执行'%s'操作失败：", op.Oplog.OP), err, "\toplog内容：", truncateDoc(bson.Raw(record).String()))
+			notifyProgress(func(listener ProgressListener) { listener.OnError(op.Oplog.NS, err) })
+		}
+		num++
+		offset += int64(len(record))
+	}
+}
+
+// 读取一个BSON文档
+func readBsonRecord(reader *bufio.Reader) ([]byte, error) {
+	header, err := reader.Peek(4)
+	if err == io.EOF && len(header) == 0 {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	size := int(binary.LittleEndian.Uint32(header))
+	if size < 5 {
+		return nil, fmt.Errorf("BSON文档长度%d错误", size)
+	}
+	record := make([]byte, size)
+	if _, err := io.ReadFull(reader, record); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return record, nil
+}
+
+// 段文件中的记录数
+func countSegmentOps(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var num int64
+	for {
+		if _, err := readBsonRecord(reader); err != nil {
+			if err == io.EOF {
+				return num, nil
+			}
+			return num, err
+		}
+		num++
+	}
+}
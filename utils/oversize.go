@@ -0,0 +1,233 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+// 超过目标端限制的文档和批次：单个BSON文档最大16MB，一次写入命令的消息最大48MB。写入前按文档大小将一批文档
+// 切分为多次写入，超过16MB的单个文档不再导致整批写入失败，按--oversized_docs处理：
+//
+//	skip      跳过该文档，记录到本次运行的报告中（完整内容保存在--error_artifacts_dir），不计入写入失败
+//	truncate  按顺序删除--oversized_truncate_fields中的字段，直到文档不超过16MB后写入；删除所有字段后仍然超过时跳过
+//	fail      按写入失败处理
+const (
+	OversizedSkip     = "skip"
+	OversizedTruncate = "truncate"
+	OversizedFail     = "fail"
+)
+
+const (
+	maxDstDocBytes   = 16 * 1024 * 1024 // 目标端单个BSON文档的大小限制
+	maxDstBatchBytes = 46 * 1024 * 1024 // 一次写入的文档总字节数，为48MB的消息限制留出命令本身的空间
+)
+
+// 报告中最多记录的超大文档数，超过时只计数
+const maxOversizedReports = 1000
+
+var (
+	oversizedMode           = OversizedSkip
+	oversizedTruncateFields [][]string // 按"."拆分的字段路径
+)
+
+// 设置超大文档的处理方式，fields为truncate时依次删除的字段（可以为嵌套字段a.b）
+func SetOversizedDocs(mode string, fields []string) error {
+	switch mode {
+	case OversizedSkip, OversizedFail:
+	case OversizedTruncate:
+		if len(fields) == 0 {
+			return fmt.Errorf("%s需要通过--oversized_truncate_fields指定删除的字段", mode)
+		}
+	default:
+		return fmt.Errorf("不支持的模式%s，可选值为%s、%s、%s", mode, OversizedSkip, OversizedTruncate, OversizedFail)
+	}
+	oversizedMode = mode
+	oversizedTruncateFields = nil
+	for _, field := range fields {
+		if field = strings.TrimSpace(field); field == "" || field == "_id" || strings.HasPrefix(field, "_id.") {
+			return fmt.Errorf("不能删除的字段%q", field)
+		}
+		oversizedTruncateFields = append(oversizedTruncateFields, strings.Split(field, "."))
+	}
+	return nil
+}
+
+// 运行报告中的一个超大文档
+type OversizedDocReport struct {
+	Ns        string    `bson:"ns" json:"ns"`
+	ID        string    `bson:"id" json:"id"` // _id的扩展JSON
+	Bytes     int       `bson:"bytes" json:"bytes"`
+	Action    string    `bson:"action" json:"action"` // skip、truncate或fail
+	Removed   []string  `bson:"removed,omitempty" json:"removed,omitempty"`
+	FinalSize int       `bson:"finalBytes,omitempty" json:"finalBytes,omitempty"`
+	Artifact  string    `bson:"artifact,omitempty" json:"artifact,omitempty"`
+	Time      time.Time `bson:"time" json:"time"`
+}
+
+// 本次运行中的超大文档
+var oversizedDocs struct {
+	sync.Mutex
+	reports []OversizedDocReport
+	num     int64
+}
+
+func recordOversizedDoc(report OversizedDocReport) {
+	oversizedDocs.Lock()
+	defer oversizedDocs.Unlock()
+	oversizedDocs.num++
+	if len(oversizedDocs.reports) < maxOversizedReports {
+		oversizedDocs.reports = append(oversizedDocs.reports, report)
+	}
+}
+
+// 取出本次运行中记录的超大文档及总数
+func takeOversizedDocs() ([]OversizedDocReport, int64) {
+	oversizedDocs.Lock()
+	defer oversizedDocs.Unlock()
+	reports, num := oversizedDocs.reports, oversizedDocs.num
+	oversizedDocs.reports, oversizedDocs.num = nil, 0
+	return reports, num
+}
+
+// 文档的BSON字节数，非bson.Raw的文档需要编码一次
+func docBSON(doc interface{}) (bson.Raw, error) {
+	if raw, ok := doc.(bson.Raw); ok {
+		return raw, nil
+	}
+	return bson.Marshal(doc)
+}
+
+// 删除文档中的字段，path为按"."拆分的路径，只处理嵌套的文档（不进入数组）
+func removeDocField(d bson.D, path []string) (bson.D, bool) {
+	for i, e := range d {
+		if e.Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return append(d[:i:i], d[i+1:]...), true
+		}
+		var sub bson.D
+		switch v := e.Value.(type) {
+		case bson.D:
+			sub = v
+		case bson.Raw:
+			if err := bson.Unmarshal(v, &sub); err != nil {
+				return d, false
+			}
+		default:
+			return d, false
+		}
+		sub, removed := removeDocField(sub, path[1:])
+		if removed {
+			d[i].Value = sub
+		}
+		return d, removed
+	}
+	return d, false
+}
+
+// 按配置的字段截断超大文档，返回截断后的文档、删除的字段和截断后的大小；删除所有字段后仍然超过限制时返回nil
+func truncateOversizedDoc(raw bson.Raw) (bson.Raw, []string, int) {
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		return nil, nil, len(raw)
+	}
+	var removed []string
+	size := len(raw)
+	for _, path := range oversizedTruncateFields {
+		var ok bool
+		if d, ok = removeDocField(d, path); !ok {
+			continue
+		}
+		removed = append(removed, strings.Join(path, "."))
+		out, err := bson.Marshal(d)
+		if err != nil {
+			return nil, removed, size
+		}
+		if size = len(out); size <= maxDstDocBytes {
+			return out, removed, size
+		}
+	}
+	return nil, removed, size
+}
+
+// 写入前检查文档大小：超大文档按--oversized_docs处理，其余文档按总字节数切分为多批。
+// 返回切分后的批次和按写入失败处理的文档数
+func splitInsertDocs(ctx context.Context, ns string, docs []interface{}) ([][]interface{}, int64) {
+	var batches [][]interface{}
+	var batch []interface{}
+	var batchBytes int
+	var failNum int64
+	for _, doc := range docs {
+		raw, err := docBSON(doc)
+		if err != nil {
+			// 无法编码的文档交给写入时报错
+			batch = append(batch, doc)
+			continue
+		}
+		size := len(raw)
+		if size > maxDstDocBytes {
+			var ok bool
+			if doc, size, ok = handleOversizedDoc(ctx, ns, raw); !ok {
+				if oversizedMode == OversizedFail {
+					failNum++
+				}
+				continue
+			}
+		}
+		if len(batch) > 0 && batchBytes+size > maxDstBatchBytes {
+			batches = append(batches, batch)
+			batch, batchBytes = nil, 0
+		}
+		batch = append(batch, doc)
+		batchBytes += size
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches, failNum
+}
+
+// 处理超过16MB的文档，返回截断后需要写入的文档及其大小，不写入时ok为false
+func handleOversizedDoc(ctx context.Context, ns string, raw bson.Raw) (doc interface{}, size int, ok bool) {
+	report := OversizedDocReport{Ns: ns, Bytes: len(raw), Action: oversizedMode, Time: time.Now()}
+	if id, err := raw.LookupErr("_id"); err == nil {
+		report.ID = id.String()
+	}
+	if oversizedMode == OversizedTruncate {
+		var out bson.Raw
+		out, report.Removed, report.FinalSize = truncateOversizedDoc(raw)
+		if out != nil {
+			recordOversizedDoc(report)
+			loggerFrom(ctx).Warn("文档超过16MB，已删除配置的字段后写入", zap.String("NS", ns), zap.String("_id", report.ID),
+				zap.Int("bytes", report.Bytes), zap.Int("finalBytes", report.FinalSize), zap.Strings("removed", report.Removed))
+			return out, len(out), true
+		}
+		report.Action = OversizedSkip
+	}
+	// 跳过或失败的文档保存完整内容，便于手工处理
+	_, path, artifactErr := failedDoc(ns, raw)
+	report.Artifact = path
+	recordOversizedDoc(report)
+	fields := []zap.Field{zap.String("NS", ns), zap.String("_id", report.ID), zap.Int("bytes", report.Bytes), zap.String("action", report.Action)}
+	if path != "" {
+		fields = append(fields, zap.String("artifact", path))
+	} else if artifactErr != nil {
+		fields = append(fields, zap.NamedError("artifactError", artifactErr))
+	}
+	err := fmt.Errorf("文档_id %s超过16MB（%d字节）", report.ID, report.Bytes)
+	if report.Action == OversizedFail {
+		recordWriteError(ns, 10334, 1, err) // BSONObjectTooLarge
+		loggerFrom(ctx).Error("文档超过16MB，写入失败", fields...)
+	} else {
+		loggerFrom(ctx).Warn("文档超过16MB，已跳过", fields...)
+	}
+	notifyProgress(func(listener ProgressListener) { listener.OnError(ns, err) })
+	return nil, 0, false
+}
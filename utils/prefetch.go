@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"context"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// 部分oplog执行前需要读取目标端当前的文档（如替换操作转换为差异更新）。目标端往返延迟较高时逐条FindOne很慢，
+// 批量执行一批oplog之前，按目标ns将这些文档的_id汇总，以一次{_id: {$in: [...]}}查询预读，执行时直接使用预读的文档。
+// 同一批中先被其他oplog修改过的文档不预读，命令等无法确定影响范围的oplog之后的部分不预读，避免使用过期的文档
+
+// 预读的目标端文档：目标ns -> _id的BSON编码 -> 文档，文档为nil表示目标端不存在
+type prefetchedDocs map[string]map[string]bson.Raw
+
+type prefetchKey struct{}
+
+// 执行前是否需要读取目标端的文档
+func needsTargetDoc(oplog OPLOG) bool {
+	return oplog.OP == "u" && useReplaceDiff(oplog)
+}
+
+// oplog操作的文档的_id，无法确定单个_id时返回false
+func oplogDocId(oplog OPLOG) (interface{}, bool) {
+	var doc interface{}
+	switch oplog.OP {
+	case "i":
+		doc = oplog.O
+	case "u":
+		doc = oplog.O2
+	case "d":
+		filter, expected, err := deleteFilter(oplog)
+		if err != nil || expected != 1 {
+			return nil, false
+		}
+		doc = filter
+	default:
+		return nil, false
+	}
+	d, ok := doc.(bson.D)
+	if !ok {
+		return nil, false
+	}
+	id, exists := d.Map()["_id"]
+	if !exists {
+		return nil, false
+	}
+	if cond, ok := id.(bson.D); ok && len(cond) > 0 && strings.HasPrefix(cond[0].Key, "$") {
+		return nil, false
+	}
+	return id, true
+}
+
+// _id在预读结果中的键。$in中的正则表达式会按模式匹配，不作为_id预读
+func docIdKey(id interface{}) (string, bool) {
+	t, data, err := bson.MarshalValue(id)
+	if err != nil || t == bsontype.Regex {
+		return "", false
+	}
+	return string(t) + string(data), true
+}
+
+// 预读一批oplog需要的目标端文档，返回携带预读结果的ctx。预读失败时不影响执行，逐条读取
+func prefetchTargetDocs(ctx context.Context, dstClient *mongo.Client, ops []laneOp) context.Context {
+	ids := make(map[string][]interface{}) // 目标ns -> 需要预读的_id
+	colls := make(map[string]*mongo.Collection)
+	touched := make(map[string]bool) // 同一批中已经出现过的文档
+	for _, op := range ops {
+		id, ok := oplogDocId(op.oplog)
+		if !ok {
+			break
+		}
+		key, ok := docIdKey(id)
+		if !ok {
+			break
+		}
+		ns := op.nsStruct.DstDb + "." + op.nsStruct.DstColl
+		if needsTargetDoc(op.oplog) && !touched[ns+"\x00"+key] {
+			ids[ns] = append(ids[ns], id)
+			colls[ns] = dstClient.Database(op.nsStruct.DstDb).Collection(op.nsStruct.DstColl)
+		}
+		touched[ns+"\x00"+key] = true
+	}
+	if len(ids) == 0 {
+		return ctx
+	}
+	docs := make(prefetchedDocs, len(ids))
+	for ns, list := range ids {
+		coll := colls[ns]
+		var found []bson.Raw
+		err := doWithRetry(ctx, findTimeout, "find "+ns, func(ctx context.Context) error {
+			cur, err := coll.Find(ctx, bson.D{{"_id", bson.D{{"$in", list}}}})
+			if err != nil {
+				return err
+			}
+			found = found[:0]
+			return cur.All(ctx, &found)
+		})
+		if err != nil {
+			loggerFrom(ctx).Warn("预读目标端文档失败，执行时逐条读取", zap.String("NS", ns), zap.Int("num", len(list)), zap.Error(err))
+			continue
+		}
+		byId := make(map[string]bson.Raw, len(list))
+		for _, id := range list {
+			key, _ := docIdKey(id)
+			byId[key] = nil
+		}
+		for _, doc := range found {
+			value := doc.Lookup("_id")
+			byId[string(value.Type)+string(value.Value)] = doc
+		}
+		docs[ns] = byId
+		loggerFrom(ctx).Debug("预读目标端文档", zap.String("NS", ns), zap.Int("num", len(list)), zap.Int("foundNum", len(found)))
+	}
+	return context.WithValue(ctx, prefetchKey{}, docs)
+}
+
+// 取出预读的文档，每个文档只使用一次。ok为false表示没有预读该文档，需要自行读取；doc为nil表示目标端不存在
+func takePrefetched(ctx context.Context, ns string, id interface{}) (doc bson.Raw, ok bool) {
+	docs, _ := ctx.Value(prefetchKey{}).(prefetchedDocs)
+	key, valid := docIdKey(id)
+	if docs == nil || !valid {
+		return nil, false
+	}
+	doc, ok = docs[ns][key]
+	delete(docs[ns], key)
+	return doc, ok
+}
@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// 预检查写入目标端时使用的集合，检查完成后删除
+const preflightCollName = "preflight"
+
+// 单项预检查的结果
+type CheckResult struct {
+	Name   string
+	OK     bool
+	Detail string
+}
+
+// 预检查：连通性、源端读取oplog和replSetGetStatus（主从复制时为读取最新的oplog）的权限、目标端的写入权限，并计算源端oplog的时间窗口，
+// 用于在长时间的同步开始之前发现配置问题。源端为mongos时对每个分片分别检查oplog
+func CustPreflightCheck(srcMongo, dstMongo *MongoArgs) []CheckResult {
+	var results []CheckResult
+	add := func(name string, err error, detail string) bool {
+		result := CheckResult{Name: name, OK: err == nil, Detail: detail}
+		if err != nil {
+			result.Detail = err.Error()
+		}
+		results = append(results, result)
+		return err == nil
+	}
+
+	srcOK := add("源端连接", pingMongo(srcMongo), "")
+	dstOK := add("目标端连接", pingMongo(dstMongo), "")
+
+	if srcOK {
+		srcClient := srcMongo.Client()
+		err := doWithRetry(srcMongo.Context(), commandTimeout, "listDatabases", func(ctx context.Context) error {
+			_, err := srcClient.ListDatabaseNames(ctx, bson.M{})
+			return err
+		})
+		add("源端listDatabases", err, "")
+
+		names, sources := []string{"源端"}, []*MongoArgs{srcMongo}
+		if changeStreamMode {
+			// change stream模式不需要local库和replSetGetStatus的权限
+			_, err := latestClusterTime(srcMongo)
+			add("源端获取$clusterTime", err, "")
+			if changeStreamScope == ChangeStreamScopeCluster {
+				add("源端打开change stream", checkChangeStream(srcMongo), "")
+			}
+			names, sources = nil, nil
+		} else if srcMongo.IsMongos() {
+			shards, err := CustGetShards(srcMongo)
+			add("源端读取config.shards", err, fmt.Sprintf("%d个分片", len(shards)))
+			names, sources = nil, nil
+			for _, shard := range shards {
+				names = append(names, "分片"+shard.ID)
+				sources = append(sources, shard.Mongo)
+			}
+		}
+		for i, source := range sources {
+			_, err := getLatestOplogTimestamp(source)
+			add(names[i]+"replSetGetStatus", err, "")
+			window, err := oplogWindow(source)
+			add(names[i]+"读取"+source.OplogNamespace(), err, window)
+		}
+	}
+
+	if dstOK {
+		add("目标端写入"+mongosyncDbName+"."+preflightCollName, checkWrite(dstMongo), "")
+	}
+	return results
+}
+
+// ping实例，失败时返回错误。预检查需要尽快给出结果，不进行重试
+func pingMongo(mc *MongoArgs) error {
+	ctx, cancel := withTimeout(mc.Context(), commandTimeout)
+	defer cancel()
+	return mc.Client().Ping(ctx, readpref.Primary())
+}
+
+// 读取最早和最新的oplog，返回oplog的时间窗口和oplog集合的大小
+func oplogWindow(mc *MongoArgs) (string, error) {
+	oplogDbName, oplogCollName := splitOplogNamespace(mc.OplogNamespace())
+	oplogColl := mc.Client().Database(oplogDbName).Collection(oplogCollName)
+	var first, last struct {
+		TS primitive.Timestamp `bson:"ts"`
+	}
+	err := doWithRetry(mc.Context(), findTimeout, "find "+mc.OplogNamespace(), func(ctx context.Context) error {
+		if err := oplogColl.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{"$natural", 1}})).Decode(&first); err != nil {
+			return err
+		}
+		return oplogColl.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{"$natural", -1}})).Decode(&last)
+	})
+	if err != nil {
+		return "", err
+	}
+	window := time.Duration(int64(last.TS.T)-int64(first.TS.T)) * time.Second
+	detail := fmt.Sprintf("oplog时间窗口%s（%s ~ %s）", window, time.Unix(int64(first.TS.T), 0).Format("2006-01-02 15:04:05"), time.Unix(int64(last.TS.T), 0).Format("2006-01-02 15:04:05"))
+
+	var stats struct {
+		MaxSize int64 `bson:"maxSize"`
+		Size    int64 `bson:"size"`
+	}
+	err = doWithRetry(mc.Context(), commandTimeout, "collStats", func(ctx context.Context) error {
+		return mc.Client().Database(oplogDbName).RunCommand(ctx, bson.D{{"collStats", oplogCollName}}).Decode(&stats)
+	})
+	if err == nil && stats.MaxSize > 0 {
+		detail += fmt.Sprintf("，已用%s/%s", formatBytes(stats.Size), formatBytes(stats.MaxSize))
+	}
+	return detail, nil
+}
+
+// 在目标端写入并删除一条文档，检查写入权限
+func checkWrite(dstMongo *MongoArgs) error {
+	coll := dstMongo.Client().Database(mongosyncDbName).Collection(preflightCollName)
+	return doWithRetry(dstMongo.Context(), writeTimeout, "insert "+mongosyncDbName+"."+preflightCollName, func(ctx context.Context) error {
+		res, err := coll.InsertOne(ctx, bson.M{"time": time.Now()})
+		if err != nil {
+			return err
+		}
+		if _, err := coll.DeleteOne(ctx, bson.M{"_id": res.InsertedID}); err != nil {
+			return err
+		}
+		return coll.Drop(ctx)
+	})
+}
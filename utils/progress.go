@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ProgressListener用于嵌入mongosync的程序获取同步进度，与日志输出解耦，可以用来实现自定义的界面或监控。
+// 回调在同步协程中同步执行，多个集合并发同步时会被并发调用，实现需要保证并发安全并尽快返回
+type ProgressListener interface {
+	// 单个集合开始导入数据（索引已经同步）
+	OnCollectionStart(ns NsMap)
+	// 单个集合每批数据写入目标端后调用，copiedNum为该集合累计导入的文档数
+	OnCollectionProgress(ns NsMap, copiedNum int64)
+	// 单个集合导入完成，skippedNum为启用chunk缓存时未变化跳过的文档数
+	OnCollectionDone(ns NsMap, copiedNum, skippedNum int64, duration time.Duration)
+	// 单个集合导入完成后核对文档数，mismatch表示复制期间源端文档数没有变化但与目标端不一致
+	OnCollectionCounts(ns NsMap, srcCount, dstCount int64, mismatch bool)
+	// oplog同步的进度已经持久化到目标端，source为oplog来源的ns
+	OnCheckpoint(source string, ts primitive.Timestamp)
+	// 文档写入或oplog重放失败。文档写入失败时ns为目标ns，oplog重放失败时为oplog中的源ns
+	OnError(ns string, err error)
+}
+
+// NopProgressListener实现了ProgressListener的所有方法但不做任何处理，
+// 只关心部分事件时可以嵌入该类型，只实现需要的方法
+type NopProgressListener struct{}
+
+func (NopProgressListener) OnCollectionStart(NsMap) {}
+
+func (NopProgressListener) OnCollectionProgress(NsMap, int64) {}
+
+func (NopProgressListener) OnCollectionDone(NsMap, int64, int64, time.Duration) {}
+
+func (NopProgressListener) OnCollectionCounts(NsMap, int64, int64, bool) {}
+
+func (NopProgressListener) OnCheckpoint(string, primitive.Timestamp) {}
+
+func (NopProgressListener) OnError(string, error) {}
+
+var (
+	progressListeners    []ProgressListener
+	progressListenerLock sync.RWMutex
+)
+
+// 注册进度监听器，需要在开始同步之前调用
+func AddProgressListener(listener ProgressListener) {
+	progressListenerLock.Lock()
+	defer progressListenerLock.Unlock()
+	progressListeners = append(progressListeners, listener)
+}
+
+// 注销进度监听器
+func RemoveProgressListener(listener ProgressListener) {
+	progressListenerLock.Lock()
+	defer progressListenerLock.Unlock()
+	for i, l := range progressListeners {
+		if l == listener {
+			progressListeners = append(progressListeners[:i:i], progressListeners[i+1:]...)
+			return
+		}
+	}
+}
+
+// 依次通知所有已注册的监听器
+func notifyProgress(notify func(listener ProgressListener)) {
+	progressListenerLock.RLock()
+	defer progressListenerLock.RUnlock()
+	for _, listener := range progressListeners {
+		notify(listener)
+	}
+}
@@ -0,0 +1,223 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// 按源ns指定的投影，同步时排除（或只保留）部分字段，例如不复制大的二进制字段。
+// 全量同步时作为find的projection，oplog重放时对插入、替换的文档以及更新操作中的字段做同样的处理
+var nsProjections map[string]*projection
+
+// 投影只支持字段路径的0/1（排除/包含），不支持投影操作符；_id总是保留
+type projection struct {
+	spec    bson.D
+	include bool // true为包含模式，只保留指定的字段；false为排除模式
+	paths   []string
+}
+
+// 从JSON文件中加载投影，格式为{"源ns": {"字段路径": 0或1, ...}}，例如：
+//
+//	{"GlobalDB.attachments": {"payload": 0, "meta.thumbnail": 0}}
+func CustLoadProjections(path string) (map[string]bson.D, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+	projections := make(map[string]bson.D, len(raw))
+	for ns, value := range raw {
+		var spec bson.D
+		if err := bson.UnmarshalExtJSON(value, false, &spec); err != nil {
+			return nil, fmt.Errorf("%s的投影格式错误：%v", ns, err)
+		}
+		if _, err := parseProjection(spec); err != nil {
+			return nil, fmt.Errorf("%s的投影错误：%v", ns, err)
+		}
+		projections[ns] = spec
+	}
+	return projections, nil
+}
+
+// 设置按源ns的投影，为nil时同步全部字段
+func SetProjections(projections map[string]bson.D) error {
+	parsed := make(map[string]*projection, len(projections))
+	for ns, spec := range projections {
+		p, err := parseProjection(spec)
+		if err != nil {
+			return fmt.Errorf("%s的投影错误：%v", ns, err)
+		}
+		parsed[ns] = p
+	}
+	nsProjections = parsed
+	return nil
+}
+
+func parseProjection(spec bson.D) (*projection, error) {
+	p := &projection{spec: spec}
+	mode := 0 // 1为包含模式，-1为排除模式
+	for _, e := range spec {
+		var keep bool
+		switch v := e.Value.(type) {
+		case int:
+			keep = v != 0
+		case int32:
+			keep = v != 0
+		case int64:
+			keep = v != 0
+		case float64:
+			keep = v != 0
+		case bool:
+			keep = v
+		default:
+			return nil, fmt.Errorf("字段%s的值只能为0或1", e.Key)
+		}
+		if e.Key == "_id" {
+			if !keep {
+				return nil, fmt.Errorf("不能排除_id")
+			}
+			continue
+		}
+		current := -1
+		if keep {
+			current = 1
+		}
+		if mode != 0 && mode != current {
+			return nil, fmt.Errorf("不能同时包含和排除字段")
+		}
+		mode = current
+		p.paths = append(p.paths, e.Key)
+	}
+	p.include = mode == 1
+	return p, nil
+}
+
+// 获取源ns的投影，没有时返回nil
+func projectionFor(srcNs string) *projection {
+	return nsProjections[srcNs]
+}
+
+// path是否为投影中某个路径本身或其子字段
+func (p *projection) covers(path string) bool {
+	for _, value := range p.paths {
+		if path == value || strings.HasPrefix(path, value+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// 投影中是否有path的子字段，此时需要进入path的子文档处理
+func (p *projection) nested(path string) bool {
+	for _, value := range p.paths {
+		if strings.HasPrefix(value, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// 处理路径为path、值为value的字段，返回处理后的值以及是否保留该字段
+func (p *projection) field(path string, value interface{}) (interface{}, bool) {
+	if path == "_id" {
+		return value, true
+	}
+	if p.covers(path) {
+		return value, p.include
+	}
+	if p.nested(path) {
+		if sub, ok := value.(bson.D); ok {
+			return p.apply(sub, path+"."), true
+		}
+	}
+	return value, !p.include
+}
+
+// 对文档应用投影，prefix为文档在整个文档中的路径前缀
+func (p *projection) apply(doc bson.D, prefix string) bson.D {
+	projected := make(bson.D, 0, len(doc))
+	for _, e := range doc {
+		if value, keep := p.field(prefix+e.Key, e.Value); keep {
+			projected = append(projected, bson.E{e.Key, value})
+		}
+	}
+	return projected
+}
+
+// 对$set、$unset等更新操作应用投影，去掉被排除的字段。所有字段都被去掉时返回nil，该操作不需要执行
+func (p *projection) applyUpdate(update bson.D) bson.D {
+	var projected bson.D
+	opNum := 0
+	for _, op := range update {
+		fields, ok := op.Value.(bson.D)
+		if !ok {
+			projected = append(projected, op)
+			continue
+		}
+		var kept bson.D
+		for _, e := range fields {
+			if value, keep := p.field(e.Key, e.Value); keep {
+				kept = append(kept, bson.E{e.Key, value})
+			}
+		}
+		if len(kept) > 0 {
+			projected = append(projected, bson.E{op.Key, kept})
+			opNum++
+		}
+	}
+	if opNum == 0 {
+		return nil
+	}
+	return projected
+}
+
+// 对oplog中的文档或更新操作应用源ns的投影。返回false表示投影后没有需要执行的内容
+func projectOplog(nsStruct *NsMap, oplog OPLOG) (OPLOG, bool) {
+	p := projectionFor(nsStruct.SrcDb + "." + nsStruct.SrcColl)
+	if p == nil {
+		return oplog, true
+	}
+	o, ok := oplog.O.(bson.D)
+	if !ok {
+		return oplog, true
+	}
+	switch oplog.OP {
+	case "i":
+		if _, exists := o.Map()["_id"]; exists {
+			oplog.O = p.apply(o, "")
+		}
+	case "u":
+		if diff, ok := oplogUpdateDiff(o); ok {
+			// 5.0+的$v:2格式先转换为$set、$unset；需要分两次执行时截短同样投影，保存在oplog.truncate中先执行
+			update, truncate := diffToUpdate(diff)
+			if truncate != nil {
+				oplog.truncate = p.applyUpdate(truncate)
+				if update = p.applyUpdate(update); update == nil {
+					update = bson.D{}
+				}
+				oplog.O = update
+				return oplog, oplog.truncate != nil || len(update) > 0
+			} else if len(update) == 0 {
+				return oplog, false
+			}
+			o = update
+		}
+		if isUpdateModifier(o) {
+			update := p.applyUpdate(o)
+			if len(update) == 0 {
+				return oplog, false
+			}
+			oplog.O = update
+		} else {
+			oplog.O = p.apply(o, "")
+		}
+	}
+	return oplog, true
+}
@@ -0,0 +1,334 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// 通过SSH跳板机或SOCKS5代理连接MongoDB。代理地址的格式为ssh://[user[:password]@]host[:port]（默认端口22）
+// 或socks5://[user[:password]@]host[:port]（默认端口1080）。到各个节点（包括副本集发现的其他成员）的连接都由代理建立，节点地址在跳板机/代理一侧解析
+var (
+	sshKeyFile        string // SSH私钥文件，为空或不存在时不使用私钥认证
+	sshKnownHostsFile string // SSH known_hosts文件，为空时不校验跳板机的host key
+)
+
+// SSH握手和SOCKS5握手的超时时间
+const proxyHandshakeTimeout = 30 * time.Second
+
+// 设置SSH跳板机认证使用的私钥文件和known_hosts文件。ssh-agent（SSH_AUTH_SOCK）可用时同时使用
+func SetSshAuth(keyFile, knownHostsFile string) {
+	sshKeyFile = keyFile
+	sshKnownHostsFile = knownHostsFile
+}
+
+// 解析并校验代理地址，空字符串表示不使用代理
+func CustParseProxy(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("代理地址缺少host：%s", proxy)
+	}
+	switch u.Scheme {
+	case "ssh":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "22")
+		}
+	case "socks5":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "1080")
+		}
+	default:
+		return nil, fmt.Errorf("不支持的代理类型：%s，应为ssh或socks5", u.Scheme)
+	}
+	return u, nil
+}
+
+// 设置连接使用的代理
+func (mc *MongoArgs) SetProxy(proxy *url.URL) *MongoArgs {
+	mc.proxy = proxy
+	return mc
+}
+
+// 代理拨号器，作为mongo-driver的Dialer使用
+type proxyDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	Close() error
+}
+
+// 获取该实例共享的代理拨号器，首次调用时创建。SSH跳板机的连接由同一个实例的所有连接复用
+func (mc *MongoArgs) proxyDialer() (proxyDialer, error) {
+	mc.conn.dialerLock.Lock()
+	defer mc.conn.dialerLock.Unlock()
+	if mc.conn.dialer != nil {
+		return mc.conn.dialer, nil
+	}
+	switch mc.proxy.Scheme {
+	case "ssh":
+		config, err := newSshClientConfig(mc.proxy, mc.logger())
+		if err != nil {
+			return nil, err
+		}
+		mc.conn.dialer = &sshDialer{addr: mc.proxy.Host, config: config, keepAlive: mc.keepAlive, logger: mc.logger()}
+	case "socks5":
+		password, _ := mc.proxy.User.Password()
+		mc.conn.dialer = &socks5Dialer{addr: mc.proxy.Host, username: mc.proxy.User.Username(), password: password, keepAlive: mc.keepAlive}
+	}
+	return mc.conn.dialer, nil
+}
+
+// 关闭共享的代理拨号器
+func (mc *MongoArgs) closeProxyDialer() {
+	mc.conn.dialerLock.Lock()
+	defer mc.conn.dialerLock.Unlock()
+	if mc.conn.dialer != nil {
+		mc.conn.dialer.Close()
+		mc.conn.dialer = nil
+	}
+}
+
+// 生成SSH客户端配置：依次尝试ssh-agent、私钥文件和地址中的密码
+func newSshClientConfig(proxy *url.URL, logger *zap.Logger) (*ssh.ClientConfig, error) {
+	user := proxy.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	var auths []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			auths = append(auths, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		} else {
+			logger.Warn("连接ssh-agent失败", zap.String("SSH_AUTH_SOCK", sock), zap.Error(err))
+		}
+	}
+	if sshKeyFile != "" {
+		key, err := os.ReadFile(sshKeyFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			signer, err := ssh.ParsePrivateKey(key)
+			if err != nil {
+				return nil, fmt.Errorf("解析SSH私钥%s失败：%v", sshKeyFile, err)
+			}
+			auths = append(auths, ssh.PublicKeys(signer))
+		}
+	}
+	if password, ok := proxy.User.Password(); ok {
+		auths = append(auths, ssh.Password(password))
+	}
+	if len(auths) == 0 {
+		return nil, fmt.Errorf("没有可用的SSH认证方式，请指定私钥文件、启动ssh-agent或在代理地址中指定密码")
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if sshKnownHostsFile != "" {
+		callback, err := knownhosts.New(sshKnownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("加载known_hosts文件%s失败：%v", sshKnownHostsFile, err)
+		}
+		hostKeyCallback = callback
+	} else {
+		logger.Warn("未指定known_hosts文件，不校验SSH跳板机的host key", zap.String("proxy", proxy.Host))
+	}
+	return &ssh.ClientConfig{User: user, Auth: auths, HostKeyCallback: hostKeyCallback, Timeout: proxyHandshakeTimeout}, nil
+}
+
+// 通过SSH跳板机的direct-tcpip通道建立连接，跳板机连接断开后自动重连
+type sshDialer struct {
+	sync.Mutex
+	addr      string
+	config    *ssh.ClientConfig
+	keepAlive time.Duration // 与跳板机之间的TCP keepalive间隔，为0时使用默认值
+	logger    *zap.Logger
+	client    *ssh.Client
+}
+
+func (d *sshDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, err := d.getClient()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.Dial(network, address)
+	if err == nil {
+		return conn, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	// 跳板机连接可能已经断开，重新连接后再试一次
+	d.reset(client)
+	if client, err = d.getClient(); err != nil {
+		return nil, err
+	}
+	return client.Dial(network, address)
+}
+
+func (d *sshDialer) getClient() (*ssh.Client, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.client != nil {
+		return d.client, nil
+	}
+	dialer := net.Dialer{Timeout: d.config.Timeout, KeepAlive: d.keepAlive}
+	conn, err := dialer.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("连接SSH跳板机%s失败：%v", d.addr, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, d.addr, d.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("连接SSH跳板机%s失败：%v", d.addr, err)
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	d.logger.Info("已连接SSH跳板机", zap.String("proxy", d.addr))
+	d.client = client
+	return client, nil
+}
+
+// 丢弃已经失效的跳板机连接。其他协程已经重连时不做处理
+func (d *sshDialer) reset(client *ssh.Client) {
+	d.Lock()
+	defer d.Unlock()
+	if d.client == client {
+		d.client.Close()
+		d.client = nil
+	}
+}
+
+func (d *sshDialer) Close() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.client == nil {
+		return nil
+	}
+	err := d.client.Close()
+	d.client = nil
+	return err
+}
+
+// 通过SOCKS5代理（RFC 1928）建立连接，支持无认证和用户名/密码认证（RFC 1929）
+type socks5Dialer struct {
+	addr      string
+	username  string
+	password  string
+	keepAlive time.Duration // 与代理之间的TCP keepalive间隔，为0时使用默认值
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := net.Dialer{KeepAlive: d.keepAlive}
+	conn, err := dialer.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("连接SOCKS5代理%s失败：%v", d.addr, err)
+	}
+	deadline := time.Now().Add(proxyHandshakeTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	if err := d.handshake(conn, address); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5代理%s连接%s失败：%v", d.addr, address, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (d *socks5Dialer) handshake(conn net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	if len(host) > 255 || len(d.username) > 255 || len(d.password) > 255 {
+		return errors.New("地址或用户名、密码过长")
+	}
+
+	// 协商认证方式：0x00无认证，0x02用户名/密码
+	methods := []byte{0x00}
+	if d.username != "" {
+		methods = []byte{0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != methods[0] {
+		return fmt.Errorf("代理不支持的认证方式：%#x", reply[1])
+	}
+	if methods[0] == 0x02 {
+		req := []byte{0x01, byte(len(d.username))}
+		req = append(req, d.username...)
+		req = append(req, byte(len(d.password)))
+		req = append(req, d.password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("用户名或密码错误")
+		}
+	}
+
+	// CONNECT请求，地址使用域名类型，由代理解析
+	req := []byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("代理返回错误码%#x", header[1])
+	}
+	// 跳过响应中的绑定地址和端口
+	var addrLen int
+	switch header[3] {
+	case 0x01:
+		addrLen = net.IPv4len
+	case 0x04:
+		addrLen = net.IPv6len
+	case 0x03:
+		lenByte := make([]byte, 1)
+		if _, err := io.ReadFull(conn, lenByte); err != nil {
+			return err
+		}
+		addrLen = int(lenByte[0])
+	default:
+		return fmt.Errorf("代理返回未知的地址类型%#x", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+func (d *socks5Dialer) Close() error {
+	return nil
+}
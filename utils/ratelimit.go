@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 吞吐量限制：全量复制读取源端的文档，以及全量复制、oplog重放写入目标端的文档，分别按文档数/秒和MB/秒通过令牌桶限流，
+// 避免同步影响生产集群上业务的延迟。限制可以在运行中通过限流文件修改
+type RateLimits struct {
+	SrcReadDocs  float64 `json:"src_read_docs_per_sec"` // <=0表示不限制，下同
+	SrcReadMB    float64 `json:"src_read_mb_per_sec"`
+	DstWriteDocs float64 `json:"dst_write_docs_per_sec"`
+	DstWriteMB   float64 `json:"dst_write_mb_per_sec"`
+}
+
+var (
+	srcReadLimiter  = &rateLimiter{}
+	dstWriteLimiter = &rateLimiter{}
+)
+
+// 检查限流文件是否被修改的间隔
+const rateLimitFilePoll = 5 * time.Second
+
+// 设置源端读取和目标端写入的吞吐量限制，运行中可以再次调用修改
+func SetRateLimits(limits RateLimits) {
+	srcReadLimiter.setRate(limits.SrcReadDocs, limits.SrcReadMB*1024*1024)
+	dstWriteLimiter.setRate(limits.DstWriteDocs, limits.DstWriteMB*1024*1024)
+}
+
+// 令牌桶，容量为1秒的令牌数。令牌不足时先扣除（允许为负），调用方等待欠下的令牌补足的时间，
+// 单次请求的令牌数大于桶的容量（如大批次写入）时也能按平均速率执行
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64 // 每秒补充的令牌数，<=0表示不限制
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate float64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.rate = rate
+	b.last = time.Now()
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+}
+
+// 取出n个令牌，返回需要等待的时间
+func (b *tokenBucket) take(n float64) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// 同时按文档数和字节数限流
+type rateLimiter struct {
+	docs  tokenBucket
+	bytes tokenBucket
+}
+
+func (l *rateLimiter) setRate(docs, bytes float64) {
+	l.docs.setRate(docs)
+	l.bytes.setRate(bytes)
+}
+
+// 处理docs个、共bytes字节的文档之前调用，超过限制时等待，ctx结束时立即返回
+func (l *rateLimiter) wait(ctx context.Context, docs, bytes int64) {
+	delay := l.docs.take(float64(docs))
+	if d := l.bytes.take(float64(bytes)); d > delay {
+		delay = d
+	}
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// 读取限流文件（JSON格式，字段同RateLimits）
+func loadRateLimitFile(path string) (RateLimits, error) {
+	var limits RateLimits
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return limits, err
+	}
+	err = json.Unmarshal(content, &limits)
+	return limits, err
+}
+
+// 从限流文件设置吞吐量限制，并在后台定期检查文件，修改后重新设置。返回停止检查的函数
+func CustWatchRateLimitFile(ctx context.Context, path string) (func(), error) {
+	limits, err := loadRateLimitFile(path)
+	if err != nil {
+		return nil, err
+	}
+	SetRateLimits(limits)
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(rateLimitFilePoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			info, err := os.Stat(path)
+			if err != nil || !info.ModTime().After(modTime) {
+				continue
+			}
+			modTime = info.ModTime()
+			limits, err := loadRateLimitFile(path)
+			if err != nil {
+				loggerFrom(ctx).Warn("读取限流文件失败，沿用当前的限制", zap.String("file", path), zap.Error(err))
+				continue
+			}
+			SetRateLimits(limits)
+			loggerFrom(ctx).Info("吞吐量限制已修改", zap.Float64("srcReadDocsPerSec", limits.SrcReadDocs), zap.Float64("srcReadMBPerSec", limits.SrcReadMB),
+				zap.Float64("dstWriteDocsPerSec", limits.DstWriteDocs), zap.Float64("dstWriteMBPerSec", limits.DstWriteMB))
+		}
+	}()
+	return func() { close(done) }, nil
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// 全量复制读取源集合的方式。旧版本使用的find的snapshot选项在4.0中已经移除，在新版本上会报错，改为按源端版本选择：
+//
+//	id        hint _id索引按_id顺序读取，每个文档只会读到一次，中断后从最后读取的_id继续，支持按_id范围并发复制
+//	natural   hint $natural按存储顺序扫描，按_id去重（需要在内存中保存已读取的_id），用于没有_id索引的集合（autoIndexId: false）
+//	snapshot  在_id顺序读取的基础上使用snapshot readConcern的会话（5.0+），每个游标读取同一时间点的数据；
+//	          超过服务端保留的快照时间窗口（minSnapshotHistoryWindowInSeconds）后，从最后读取的_id处以新的时间点继续
+//	auto      源端为5.0+时使用snapshot，否则使用id；没有_id索引的集合使用natural
+const (
+	ReadStrategyAuto     = "auto"
+	ReadStrategyId       = "id"
+	ReadStrategyNatural  = "natural"
+	ReadStrategySnapshot = "snapshot"
+)
+
+var readStrategy = ReadStrategyAuto
+
+// 设置全量复制读取源集合的方式
+func SetReadStrategy(strategy string) error {
+	switch strategy {
+	case ReadStrategyAuto, ReadStrategyId, ReadStrategyNatural, ReadStrategySnapshot:
+		readStrategy = strategy
+		return nil
+	}
+	return fmt.Errorf("不支持的读取方式%s，可选值为%s、%s、%s、%s", strategy, ReadStrategyAuto, ReadStrategyId, ReadStrategyNatural, ReadStrategySnapshot)
+}
+
+// 确定源集合的读取方式
+func resolveReadStrategy(srcMongo *MongoArgs, dbName, collName string, clustered bool) string {
+	ns := dbName + "." + collName
+	strategy := readStrategy
+	info, err := srcMongo.ServerInfo()
+	snapshotOK := err == nil && info.FeatureAtLeast(5, 0)
+	// 聚簇集合按聚簇键（_id）有序扫描，没有单独的_id索引也可以按_id顺序读取
+	idIndex := clustered || hasIdIndex(srcMongo, dbName, collName)
+	switch strategy {
+	case ReadStrategyAuto:
+		strategy = ReadStrategyId
+		if !idIndex {
+			strategy = ReadStrategyNatural
+		} else if snapshotOK {
+			strategy = ReadStrategySnapshot
+		}
+	case ReadStrategySnapshot:
+		if !snapshotOK {
+			srcMongo.logger().Warn("源端版本低于5.0，不支持snapshot readConcern的读取，改为按_id顺序读取", zap.String("NS", ns))
+			strategy = ReadStrategyId
+		}
+	}
+	if strategy != ReadStrategyNatural && !idIndex {
+		srcMongo.logger().Warn("集合没有_id索引，改为按$natural顺序读取", zap.String("NS", ns))
+		strategy = ReadStrategyNatural
+	}
+	srcMongo.logger().Debug("源集合的读取方式", zap.String("NS", ns), zap.String("strategy", strategy))
+	return strategy
+}
+
+// 集合是否有_id索引，只有4.0之前创建集合时指定autoIndexId: false的集合没有
+func hasIdIndex(srcMongo *MongoArgs, dbName, collName string) bool {
+	spec, err := srcMongo.collectionSpec(dbName, collName)
+	if err != nil || spec == nil || len(spec.Options) == 0 {
+		return true
+	}
+	autoIndexId, ok := spec.Options.Lookup("autoIndexId").BooleanOK()
+	return !ok || autoIndexId
+}
+
+// err是否表示snapshot读取的时间点已经超出服务端保留的快照时间窗口
+func isSnapshotExpired(err error) bool {
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
+	}
+	return serverErr.HasErrorCode(239) || serverErr.HasErrorCode(246) // SnapshotTooOld、SnapshotUnavailable
+}
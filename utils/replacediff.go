@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// 替换形式的u操作（o为整个文档）重放时会传输并写入整个文档。对于大文档，可以先读取目标端当前的文档，
+// 计算差异后只执行$set/$unset，以CPU和一次读取换取写入量，适用于目标端带宽受限的情况。
+// 注意$set新增的字段位于文档末尾，字段顺序可能与源端不同
+var replaceDiffMinBytes int
+
+// 设置转换为差异更新的文档大小下限（字节），<=0表示不转换
+func SetReplaceDiff(minBytes int) {
+	replaceDiffMinBytes = minBytes
+}
+
+// 替换形式的u操作是否需要转换为差异更新
+func useReplaceDiff(oplog OPLOG) bool {
+	if replaceDiffMinBytes <= 0 {
+		return false
+	}
+	o, ok := oplog.O.(bson.D)
+	if !ok || isUpdateModifier(o) {
+		return false
+	}
+	raw, err := bson.Marshal(o)
+	return err == nil && len(raw) >= replaceDiffMinBytes
+}
+
+// 读取目标端当前的文档，计算差异后执行$set/$unset。目标端文档不存在或无法计算差异时按原样替换
+func applyReplaceDiff(ctx context.Context, dstColl *mongo.Collection, oplog OPLOG) error {
+	newDoc, err := bson.Marshal(oplog.O)
+	if err != nil {
+		return err
+	}
+	var current bson.Raw
+	id, _ := oplogDocId(oplog)
+	if doc, ok := takePrefetched(ctx, dstColl.Database().Name()+"."+dstColl.Name(), id); ok {
+		// 使用批量执行前预读的文档
+		current = doc
+		if current == nil {
+			err = mongo.ErrNoDocuments
+		}
+	} else {
+		err = doWithRetry(ctx, findTimeout, "FindOne", func(ctx context.Context) error {
+			var err error
+			current, err = dstColl.FindOne(ctx, oplog.O2).DecodeBytes()
+			return err
+		})
+	}
+	var update bson.D
+	if err == nil {
+		update = replaceDiff(current, newDoc)
+	} else if err != mongo.ErrNoDocuments {
+		return err
+	}
+	hint := upsertHint(ctx, dstColl, oplog.O2)
+	if update == nil {
+		replaceOpts := options.Replace().SetUpsert(true)
+		if hint != nil {
+			replaceOpts.SetHint(hint)
+		}
+		return doWithRetry(ctx, writeTimeout, "ReplaceOne", func(ctx context.Context) error {
+			_, err := dstColl.ReplaceOne(ctx, oplog.O2, oplog.O, replaceOpts)
+			return err
+		})
+	}
+	if len(update) == 0 {
+		return nil
+	}
+	loggerFrom(ctx).Debug("替换操作转换为差异更新", zap.String("ns", dstColl.Database().Name()+"."+dstColl.Name()), zap.Int("docBytes", len(newDoc)))
+	updateOpts := options.Update()
+	if hint != nil {
+		updateOpts.SetHint(hint)
+	}
+	return doWithRetry(ctx, writeTimeout, "UpdateOne", func(ctx context.Context) error {
+		_, err := dstColl.UpdateOne(ctx, oplog.O2, update, updateOpts)
+		return err
+	})
+}
+
+// 计算将文档current更新为newDoc的$set/$unset。没有差异时返回空的bson.D；字段名无法作为更新路径，
+// 或差异不小于文档本身时返回nil，需要整个替换
+func replaceDiff(current, newDoc bson.Raw) bson.D {
+	var set, unset bson.D
+	if !diffDocs(current, newDoc, "", &set, &unset) {
+		return nil
+	}
+	update := bson.D{}
+	if len(set) > 0 {
+		update = append(update, bson.E{"$set", set})
+	}
+	if len(unset) > 0 {
+		update = append(update, bson.E{"$unset", unset})
+	}
+	if raw, err := bson.Marshal(update); err != nil || len(raw) >= len(newDoc) {
+		return nil
+	}
+	return update
+}
+
+// 比较两个文档，将差异追加到set、unset中。返回false表示无法用字段路径表示差异
+func diffDocs(current, newDoc bson.Raw, prefix string, set, unset *bson.D) bool {
+	newElems, err := newDoc.Elements()
+	if err != nil {
+		return false
+	}
+	curElems, err := current.Elements()
+	if err != nil {
+		return false
+	}
+	curValues := make(map[string]bson.RawValue, len(curElems))
+	for _, e := range curElems {
+		curValues[e.Key()] = e.Value()
+	}
+	for _, e := range newElems {
+		key := e.Key()
+		if key == "" || strings.HasPrefix(key, "$") || strings.Contains(key, ".") {
+			return false
+		}
+		path := prefix + key
+		value := e.Value()
+		old, exists := curValues[key]
+		delete(curValues, key)
+		if exists && old.Type == value.Type && bytes.Equal(old.Value, value.Value) {
+			continue
+		}
+		if path == "_id" {
+			return false
+		}
+		if exists && old.Type == bsontype.EmbeddedDocument && value.Type == bsontype.EmbeddedDocument {
+			var subSet, subUnset bson.D
+			if diffDocs(old.Document(), value.Document(), path+".", &subSet, &subUnset) {
+				*set = append(*set, subSet...)
+				*unset = append(*unset, subUnset...)
+				continue
+			}
+		}
+		*set = append(*set, bson.E{path, value})
+	}
+	for _, e := range curElems {
+		if _, removed := curValues[e.Key()]; removed {
+			if strings.HasPrefix(e.Key(), "$") || strings.Contains(e.Key(), ".") {
+				return false
+			}
+			*unset = append(*unset, bson.E{prefix + e.Key(), ""})
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// oplog重放的进度：重放过程中每replayCheckpointInterval将最后处理的oplog的ts保存到目标端的--checkpoint_ns集合中，
+// 每个oplog来源（副本集、分片或syncoplog）一个文档，_id为"<来源地址>/<oplog集合>"。低优先级ns的后台通道有积压时不保存，
+// 保证进度之前的oplog都已经写入目标端（本地缓冲区中的oplog重启后会继续重放）。
+// 使用--resume时从各个来源保存的位置继续重放，边界上的一条oplog会重放两次，oplog重复执行的结果相同
+var (
+	replayCheckpointNs       = mongosyncDbName + ".replay_checkpoint"
+	replayCheckpointInterval = 10 * time.Second // 为0时不保存
+	replayResume             bool
+)
+
+// 设置保存重放进度的集合、间隔以及是否从保存的进度继续
+func SetReplayCheckpoint(ns string, interval time.Duration, resume bool) error {
+	if parts := strings.SplitN(ns, ".", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("集合%s的格式应为<db>.<collection>", ns)
+	}
+	replayCheckpointNs, replayCheckpointInterval, replayResume = ns, interval, resume
+	return nil
+}
+
+func replayCheckpointColl(dstMongo *MongoArgs) *mongo.Collection {
+	db, coll := splitOplogNamespace(replayCheckpointNs)
+	return dstMongo.Client().Database(db).Collection(coll)
+}
+
+func replayCheckpointId(srcMongo *MongoArgs, srcOplogNamespace string) string {
+	return srcMongo.uri() + "/" + srcOplogNamespace
+}
+
+// 返回srcMongo中srcOplogNamespace（为空或local.oplog.rs时为各个分片的oplog）保存的重放进度中最早的位置，没有进度时ok为false。
+// 用于--resume时确定重放的起点，之后各个来源从各自的进度继续
+func CustReplayCheckpointStart(srcMongo, dstMongo *MongoArgs, srcOplogNamespace string) (ts primitive.Timestamp, ok bool, err error) {
+	sources := []*MongoArgs{srcMongo}
+	oplogNs := srcOplogNamespace == "" || srcOplogNamespace == replSetOplogNs
+	if oplogNs {
+		if sources, err = custOplogSources(srcMongo); err != nil {
+			return ts, false, err
+		}
+	}
+	coll := replayCheckpointColl(dstMongo)
+	for _, source := range sources {
+		ns := srcOplogNamespace
+		if oplogNs {
+			ns = source.OplogNamespace()
+		}
+		checkpoint, err := loadCheckpoint(dstMongo.Context(), coll, replayCheckpointId(source, ns))
+		if err != nil {
+			return ts, false, err
+		}
+		if checkpoint == nil {
+			continue
+		}
+		if !ok || primitive.CompareTimestamp(checkpoint.TS, ts) < 0 {
+			ts = checkpoint.TS
+		}
+		ok = true
+	}
+	return ts, ok, nil
+}
+
+// 单个oplog来源的重放进度
+type replayCheckpoint struct {
+	srcMongo *MongoArgs
+	dstMongo *MongoArgs
+	id       string
+	oplogNs  string
+	startTS  primitive.Timestamp // 本次重放最初的起点
+	savedTS  primitive.Timestamp
+	lastSave time.Time
+}
+
+func newReplayCheckpoint(srcMongo, dstMongo *MongoArgs, srcOplogNamespace string, startTS primitive.Timestamp) *replayCheckpoint {
+	if replayCheckpointInterval <= 0 && !replayResume {
+		return nil
+	}
+	return &replayCheckpoint{
+		srcMongo: srcMongo,
+		dstMongo: dstMongo,
+		id:       replayCheckpointId(srcMongo, srcOplogNamespace),
+		oplogNs:  srcOplogNamespace,
+		startTS:  startTS,
+		lastSave: time.Now(),
+	}
+}
+
+// --resume时返回保存的比startTS新的进度
+func (c *replayCheckpoint) resumeFrom(startTS primitive.Timestamp) (primitive.Timestamp, bool) {
+	if c == nil || !replayResume {
+		return startTS, false
+	}
+	checkpoint, err := loadCheckpoint(c.dstMongo.Context(), replayCheckpointColl(c.dstMongo), c.id)
+	if err != nil {
+		log.Fatalln("读取oplog重放进度失败：", err)
+	}
+	if checkpoint == nil || primitive.CompareTimestamp(checkpoint.TS, startTS) <= 0 {
+		return startTS, false
+	}
+	if !checkpoint.StartTS.IsZero() {
+		c.startTS = checkpoint.StartTS
+	}
+	c.savedTS = checkpoint.TS
+	c.srcMongo.logger().Info("从保存的进度继续重放oplog", zap.String("oplogNs", c.oplogNs), zap.Uint32("T", checkpoint.TS.T), zap.Uint32("I", checkpoint.TS.I), zap.Time("updateTime", checkpoint.UpdateTime))
+	return checkpoint.TS, true
+}
+
+// 处理完ts之前的oplog后调用，到达间隔并且低优先级ns的后台通道没有积压时保存
+func (c *replayCheckpoint) advance(ts primitive.Timestamp, lane *lowPriorityLane, force bool) {
+	if c == nil || replayCheckpointInterval <= 0 || ts.IsZero() || ts.Equal(c.savedTS) {
+		return
+	}
+	if !force && time.Since(c.lastSave) < replayCheckpointInterval {
+		return
+	}
+	if lane != nil && lane.pendingNum() > 0 {
+		return
+	}
+	checkpoint := &Checkpoint{ID: c.id, TS: ts, OplogNs: c.oplogNs, StartTS: c.startTS}
+	if err := saveCheckpoint(c.dstMongo.Context(), replayCheckpointColl(c.dstMongo), checkpoint); err != nil {
+		c.srcMongo.logger().Warn("保存oplog重放进度失败", zap.Error(err))
+		return
+	}
+	c.savedTS, c.lastSave = ts, time.Now()
+}
@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// 重放i、u操作时的upsert（ReplaceOne/UpdateOne）按过滤条件查找目标文档。目标端的查询计划器选错索引时，
+// 可以为指定的目标ns强制使用某个索引（如_id_）。同时检查过滤条件的字段在目标端是否有可用的索引
+// （索引的第一个字段出现在过滤条件中），没有时输出警告和建议创建的索引，避免每次upsert都扫描整个集合
+
+// 目标ns -> 索引名，键为空字符串时为所有ns的默认值
+var replayHints map[string]string
+
+// 设置重放时upsert使用的索引，格式为逗号分隔的<索引名>或<目标ns>=<索引名>
+func SetReplayHints(spec string) error {
+	replayHints = nil
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		ns, name := "", item
+		if i := strings.LastIndex(item, "="); i >= 0 {
+			ns, name = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+			if !strings.Contains(ns, ".") {
+				return fmt.Errorf("%s中的ns格式错误，格式为<db.coll>=<索引名>", item)
+			}
+		}
+		if name == "" {
+			return fmt.Errorf("%s中的索引名为空", item)
+		}
+		if replayHints == nil {
+			replayHints = make(map[string]string)
+		}
+		replayHints[ns] = name
+	}
+	return nil
+}
+
+// update、replace的hint需要4.2+，目标端版本较低时不使用hint
+func checkReplayHints(dstMongo *MongoArgs) {
+	if len(replayHints) == 0 {
+		return
+	}
+	if info, err := dstMongo.ServerInfo(); err == nil && !info.FeatureAtLeast(4, 2) {
+		dstMongo.logger().Warn("目标端版本低于4.2，不支持update的hint，忽略--replay_hint", zap.String("dstVersion", info.String()))
+		replayHints = nil
+	}
+}
+
+// 目标ns索引信息的缓存时间，过期后重新读取
+const targetIndexTTL = 10 * time.Minute
+
+// 目标ns的索引信息
+type targetIndexInfo struct {
+	names     map[string]bool
+	firstKeys map[string]bool // 各个索引的第一个字段
+	fetched   time.Time
+}
+
+var targetIndexes = struct {
+	sync.Mutex
+	colls  map[string]*targetIndexInfo
+	warned map[string]bool // 已经输出过警告的ns+字段或ns+索引名
+}{colls: make(map[string]*targetIndexInfo), warned: make(map[string]bool)}
+
+// 读取目标ns的索引信息，集合不存在或读取失败时返回nil
+func targetIndexInfoFor(ctx context.Context, coll *mongo.Collection) *targetIndexInfo {
+	ns := coll.Database().Name() + "." + coll.Name()
+	targetIndexes.Lock()
+	info := targetIndexes.colls[ns]
+	targetIndexes.Unlock()
+	if info != nil && time.Since(info.fetched) < targetIndexTTL {
+		return info
+	}
+	var specs []*mongo.IndexSpecification
+	err := doWithRetry(ctx, commandTimeout, "listIndexes "+ns, func(ctx context.Context) error {
+		var err error
+		specs, err = coll.Indexes().ListSpecifications(ctx)
+		return err
+	})
+	info = &targetIndexInfo{names: make(map[string]bool), firstKeys: make(map[string]bool), fetched: time.Now()}
+	if err == nil {
+		for _, spec := range specs {
+			info.names[spec.Name] = true
+			if elems, err := spec.KeysDocument.Elements(); err == nil && len(elems) > 0 {
+				info.firstKeys[elems[0].Key()] = true
+			}
+		}
+	}
+	targetIndexes.Lock()
+	targetIndexes.colls[ns] = info
+	targetIndexes.Unlock()
+	if len(info.names) == 0 {
+		return nil
+	}
+	return info
+}
+
+// 每个ns的每种问题只警告一次
+func warnTargetIndexOnce(ctx context.Context, key, msg string, fields ...zap.Field) {
+	targetIndexes.Lock()
+	warned := targetIndexes.warned[key]
+	targetIndexes.warned[key] = true
+	targetIndexes.Unlock()
+	if !warned {
+		loggerFrom(ctx).Warn(msg, fields...)
+	}
+}
+
+// 过滤条件中的顶层字段，不包括$and等操作符
+func filterFields(filter interface{}) []string {
+	var fields []string
+	switch f := filter.(type) {
+	case bson.D:
+		for _, e := range f {
+			fields = append(fields, e.Key)
+		}
+	case bson.M:
+		for key := range f {
+			fields = append(fields, key)
+		}
+		sort.Strings(fields)
+	}
+	result := fields[:0]
+	for _, field := range fields {
+		if !strings.HasPrefix(field, "$") {
+			result = append(result, field)
+		}
+	}
+	return result
+}
+
+// 返回upsert使用的hint，没有配置或目标端不存在该索引时返回nil。同时检查过滤条件在目标端是否有可用的索引
+func upsertHint(ctx context.Context, coll *mongo.Collection, filter interface{}) interface{} {
+	ns := coll.Database().Name() + "." + coll.Name()
+	info := targetIndexInfoFor(ctx, coll)
+	if info == nil {
+		// 集合还不存在，upsert时创建，此时只有_id索引
+		return nil
+	}
+	if fields := filterFields(filter); len(fields) > 0 {
+		supported := false
+		for _, field := range fields {
+			if info.firstKeys[field] {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			spec := make(bson.D, 0, len(fields))
+			for _, field := range fields {
+				spec = append(spec, bson.E{field, 1})
+			}
+			warnTargetIndexOnce(ctx, ns+"\x00"+strings.Join(fields, ","), "重放upsert的过滤条件在目标端没有可用的索引，每次执行都会扫描集合，建议在目标端创建索引",
+				zap.String("NS", ns), zap.Strings("fields", fields), zap.String("index", fmt.Sprint(spec)))
+		}
+	}
+	name, ok := replayHints[ns]
+	if !ok {
+		name = replayHints[""]
+	}
+	if name == "" {
+		return nil
+	}
+	if !info.names[name] {
+		warnTargetIndexOnce(ctx, ns+"\x00hint:"+name, "--replay_hint指定的索引在目标端不存在，不使用hint", zap.String("NS", ns), zap.String("index", name))
+		return nil
+	}
+	return name
+}
+
+// 为BulkWrite中的upsert设置hint
+func setModelHint(ctx context.Context, coll *mongo.Collection, model mongo.WriteModel) {
+	switch m := model.(type) {
+	case *mongo.ReplaceOneModel:
+		if hint := upsertHint(ctx, coll, m.Filter); hint != nil {
+			m.SetHint(hint)
+		}
+	case *mongo.UpdateOneModel:
+		if hint := upsertHint(ctx, coll, m.Filter); hint != nil {
+			m.SetHint(hint)
+		}
+	}
+}
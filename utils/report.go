@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// 运行报告：每次运行结束时将汇总结果保存在目标实例的mongosync.reports集合中，作为历次同步的审计记录。
+// 报告按expireAt上的TTL索引自动过期删除
+const reportsCollName = "reports"
+
+// 运行报告的保留时间，<=0表示永久保留
+var reportRetention = 30 * 24 * time.Hour
+
+// 设置运行报告的保留时间
+func SetReportRetention(retention time.Duration) {
+	reportRetention = retention
+}
+
+// 运行模式
+const (
+	ReportModeFull      = "full"        // 全量同步
+	ReportModeOplog     = "oplog"       // 全量同步后重放oplog
+	ReportModeSyncOplog = "sync_oplog"  // 全量同步后将oplog同步到目标端
+	ReportModeReplay    = "replayoplog" // 手动重放oplog
+	ReportModeSchedule  = "schedule"    // 定时同步中的一次运行
+)
+
+// 运行结果
+const (
+	ReportStateDone   = "done"
+	ReportStateFailed = "failed"
+)
+
+// 单个集合在一次运行中的结果
+type CollectionReport struct {
+	SrcNs           string  `bson:"srcNs" json:"srcNs"`
+	DstNs           string  `bson:"dstNs" json:"dstNs"`
+	CopiedNum       int64   `bson:"copiedNum" json:"copiedNum"`
+	SkippedNum      int64   `bson:"skippedNum" json:"skippedNum"`
+	EstimatedNum    int64   `bson:"estimatedNum" json:"estimatedNum"`
+	SrcCount        int64   `bson:"srcCount,omitempty" json:"srcCount,omitempty"`
+	DstCount        int64   `bson:"dstCount,omitempty" json:"dstCount,omitempty"`
+	CountMismatch   bool    `bson:"countMismatch,omitempty" json:"countMismatch,omitempty"`
+	DurationSeconds float64 `bson:"durationSeconds" json:"durationSeconds"`
+}
+
+func newCollectionReports(statuses []CollectionStatus) []CollectionReport {
+	reports := make([]CollectionReport, 0, len(statuses))
+	for _, status := range statuses {
+		reports = append(reports, CollectionReport{
+			SrcNs:           status.Ns.SrcDb + "." + status.Ns.SrcColl,
+			DstNs:           status.Ns.DstDb + "." + status.Ns.DstColl,
+			CopiedNum:       status.CopiedNum,
+			SkippedNum:      status.SkippedNum,
+			EstimatedNum:    status.EstimatedNum,
+			SrcCount:        status.SrcCount,
+			DstCount:        status.DstCount,
+			CountMismatch:   status.CountMismatch,
+			DurationSeconds: status.Duration.Seconds(),
+		})
+	}
+	return reports
+}
+
+// mongosync.reports中的文档，每次运行一个
+type RunReport struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	Source      string             `bson:"source" json:"source"`
+	ToolVersion string             `bson:"toolVersion" json:"toolVersion"`
+	Mode        string             `bson:"mode" json:"mode"`
+	State       string             `bson:"state" json:"state"`
+	StartTime   time.Time          `bson:"startTime" json:"startTime"`
+	EndTime     time.Time          `bson:"endTime" json:"endTime"`
+	CopiedNum   int64              `bson:"copiedNum" json:"copiedNum"`
+	SkippedNum  int64              `bson:"skippedNum" json:"skippedNum"`
+	ErrorNum    int64              `bson:"errorNum" json:"errorNum"` // 文档写入和oplog重放失败的次数
+	Error       string             `bson:"error,omitempty" json:"error,omitempty"`
+	Collections []CollectionReport `bson:"collections" json:"collections"`
+	// 超过16MB被跳过、截断或写入失败的文档，最多记录maxOversizedReports个
+	OversizedNum  int64                `bson:"oversizedNum,omitempty" json:"oversizedNum,omitempty"`
+	OversizedDocs []OversizedDocReport `bson:"oversizedDocs,omitempty" json:"oversizedDocs,omitempty"`
+	// 按ns和分类统计的写入失败
+	WriteErrors []WriteErrorStat `bson:"writeErrors,omitempty" json:"writeErrors,omitempty"`
+	ExpireAt    time.Time        `bson:"expireAt,omitempty" json:"expireAt,omitempty"`
+
+	errors *reportErrorCounter
+}
+
+// 统计运行中的错误数
+type reportErrorCounter struct {
+	NopProgressListener
+	num int64
+}
+
+func (c *reportErrorCounter) OnError(string, error) {
+	atomic.AddInt64(&c.num, 1)
+}
+
+// 开始记录一次运行，需要在同步开始之前调用，并在结束时调用CustFinishReport
+func CustStartReport(srcMongo *MongoArgs, mode string) *RunReport {
+	report := &RunReport{
+		ID:          primitive.NewObjectID(),
+		Source:      srcMongo.uri(),
+		ToolVersion: ToolVersion,
+		Mode:        mode,
+		StartTime:   time.Now(),
+		errors:      &reportErrorCounter{},
+	}
+	AddProgressListener(report.errors)
+	return report
+}
+
+// 记录全量同步各个集合的结果
+func (r *RunReport) AddCollections(statuses []CollectionStatus) {
+	for _, collection := range newCollectionReports(statuses) {
+		r.CopiedNum += collection.CopiedNum
+		r.SkippedNum += collection.SkippedNum
+		r.Collections = append(r.Collections, collection)
+	}
+}
+
+// 结束本次运行并将报告保存到目标端，runErr为运行失败的原因。保存失败时只记录警告，不影响同步
+func CustFinishReport(dstMongo *MongoArgs, report *RunReport, runErr error) {
+	RemoveProgressListener(report.errors)
+	report.EndTime = time.Now()
+	report.ErrorNum = atomic.LoadInt64(&report.errors.num)
+	report.OversizedDocs, report.OversizedNum = takeOversizedDocs()
+	report.WriteErrors = takeWriteErrorStats()
+	report.State = ReportStateDone
+	if runErr != nil {
+		report.State = ReportStateFailed
+		report.Error = runErr.Error()
+	}
+	if reportRetention > 0 {
+		report.ExpireAt = report.EndTime.Add(reportRetention)
+	}
+
+	coll := dstMongo.Client().Database(mongosyncDbName).Collection(reportsCollName)
+	err := doWithRetry(dstMongo.Context(), writeTimeout, "save run report", func(ctx context.Context) error {
+		// expireAt为空的报告不会过期
+		_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{"expireAt", 1}}, Options: options.Index().SetExpireAfterSeconds(0)})
+		if err != nil {
+			return err
+		}
+		_, err = coll.ReplaceOne(ctx, bson.M{"_id": report.ID}, report, options.Replace().SetUpsert(true))
+		return err
+	})
+	if err != nil {
+		dstMongo.logger().Warn("保存运行报告失败", zap.String("reportId", report.ID.Hex()), zap.Error(err))
+		return
+	}
+	dstMongo.logger().Info("运行报告已保存", zap.String("reportId", report.ID.Hex()), zap.String("mode", report.Mode), zap.String("state", report.State),
+		zap.Int("collNum", len(report.Collections)), zap.Int64("copiedNum", report.CopiedNum), zap.Int64("errorNum", report.ErrorNum))
+}
+
+// 按开始时间倒序返回最近limit个运行报告，source不为空时只返回该源实例的报告
+func CustListReports(dstMongo *MongoArgs, source string, limit int64) ([]RunReport, error) {
+	coll := dstMongo.Client().Database(mongosyncDbName).Collection(reportsCollName)
+	filter := bson.M{}
+	if source != "" {
+		filter["source"] = source
+	}
+	var reports []RunReport
+	err := doWithRetry(dstMongo.Context(), findTimeout, "find "+mongosyncDbName+"."+reportsCollName, func(ctx context.Context) error {
+		// 列表中不需要各个集合的结果
+		opts := options.Find().SetSort(bson.D{{"startTime", -1}}).SetLimit(limit).SetProjection(bson.M{"collections": 0})
+		cur, err := coll.Find(ctx, filter, opts)
+		if err != nil {
+			return err
+		}
+		reports = nil
+		return cur.All(ctx, &reports)
+	})
+	return reports, err
+}
+
+// 获取指定id的运行报告
+func CustGetReport(dstMongo *MongoArgs, id string) (*RunReport, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("报告id格式错误：%s", id)
+	}
+	coll := dstMongo.Client().Database(mongosyncDbName).Collection(reportsCollName)
+	var report RunReport
+	err = doWithRetry(dstMongo.Context(), findTimeout, "find "+mongosyncDbName+"."+reportsCollName, func(ctx context.Context) error {
+		return coll.FindOne(ctx, bson.M{"_id": oid}).Decode(&report)
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("报告%s不存在或已过期", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// change stream的进度：每个change stream每处理resumeTokenInterval个事件（以及空闲时每replayProgressInterval）保存一次
+// 最后处理的resume token，默认保存在目标端的mongosync.resume_tokens中，指定--resume_token_file时保存在本地文件中。
+// 重新启动后，保存的位置不早于本次的起点（同一个任务，见CustCheckManifest）时从该位置继续，不会重复处理或遗漏事件；
+// 更早的位置属于之前的任务，忽略
+const resumeTokenCollName = "resume_tokens"
+
+var (
+	resumeTokenInterval int64 = 100 // 为0时不保存
+	resumeTokenFile     string
+)
+
+// 设置保存resume token的间隔事件数和本地文件，file为空时保存在目标端
+func SetResumeTokens(interval int, file string) {
+	resumeTokenInterval, resumeTokenFile = int64(interval), file
+}
+
+// resume token的保存位置
+type resumeTokenStore interface {
+	load(id string) (*Checkpoint, error)
+	save(checkpoint *Checkpoint) error
+}
+
+func newResumeTokenStore(dstMongo *MongoArgs) resumeTokenStore {
+	if resumeTokenInterval <= 0 {
+		return nil
+	}
+	if resumeTokenFile != "" {
+		return fileTokenStore
+	}
+	return &dstResumeTokenStore{dstMongo: dstMongo}
+}
+
+// 保存在目标端的mongosync.resume_tokens中，格式与oplog的同步进度相同
+type dstResumeTokenStore struct {
+	dstMongo *MongoArgs
+}
+
+func (s *dstResumeTokenStore) load(id string) (*Checkpoint, error) {
+	coll := s.dstMongo.Client().Database(mongosyncDbName).Collection(resumeTokenCollName)
+	return loadCheckpoint(s.dstMongo.Context(), coll, id)
+}
+
+func (s *dstResumeTokenStore) save(checkpoint *Checkpoint) error {
+	coll := s.dstMongo.Client().Database(mongosyncDbName).Collection(resumeTokenCollName)
+	return saveCheckpoint(s.dstMongo.Context(), coll, checkpoint)
+}
+
+// 保存在本地文件中：扩展JSON格式的{id: 进度}，先写入临时文件再重命名，中断时不会留下不完整的文件。
+// 所有change stream共用一个文件
+type fileResumeTokenStore struct {
+	lock sync.Mutex
+}
+
+var fileTokenStore = &fileResumeTokenStore{}
+
+func (s *fileResumeTokenStore) read() (map[string]Checkpoint, error) {
+	checkpoints := make(map[string]Checkpoint)
+	data, err := os.ReadFile(resumeTokenFile)
+	if os.IsNotExist(err) {
+		return checkpoints, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := bson.UnmarshalExtJSON(data, true, &checkpoints); err != nil {
+		return nil, fmt.Errorf("解析%s失败：%v", resumeTokenFile, err)
+	}
+	return checkpoints, nil
+}
+
+func (s *fileResumeTokenStore) load(id string) (*Checkpoint, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	checkpoints, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint, exists := checkpoints[id]; exists {
+		return &checkpoint, nil
+	}
+	return nil, nil
+}
+
+func (s *fileResumeTokenStore) save(checkpoint *Checkpoint) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	checkpoints, err := s.read()
+	if err != nil {
+		return err
+	}
+	checkpoint.Version, checkpoint.MinReaderVersion, checkpoint.UpdateTime = checkpointVersion, checkpointMinReaderVersion, time.Now()
+	checkpoints[checkpoint.ID] = *checkpoint
+	data, err := bson.MarshalExtJSONIndent(checkpoints, true, false, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(resumeTokenFile), filepath.Base(resumeTokenFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), resumeTokenFile)
+}
+
+// 一个change stream的进度记录
+type resumeTokenTracker struct {
+	store     resumeTokenStore
+	id        string
+	pending   int64 // 上次保存之后处理的事件数
+	lastSave  time.Time
+	lastToken bson.Raw
+	logger    *zap.Logger
+}
+
+func newResumeTokenTracker(srcMongo, dstMongo *MongoArgs, source changeStreamSource) *resumeTokenTracker {
+	store := newResumeTokenStore(dstMongo)
+	if store == nil {
+		return nil
+	}
+	return &resumeTokenTracker{
+		store:    store,
+		id:       srcMongo.uri() + "/" + changeStreamScope + "/" + source.name,
+		lastSave: time.Now(),
+		logger:   srcMongo.logger().With(zap.String("stream", source.name)),
+	}
+}
+
+// 本次起点为startTS时可以继续的resume token，没有时返回nil
+func (t *resumeTokenTracker) resumeToken(startTS primitive.Timestamp) bson.Raw {
+	if t == nil {
+		return nil
+	}
+	checkpoint, err := t.store.load(t.id)
+	if err != nil {
+		log.Fatalln("读取change stream的resume token失败：", err)
+	}
+	if checkpoint == nil || checkpoint.ResumeToken == nil {
+		return nil
+	}
+	if primitive.CompareTimestamp(checkpoint.TS, startTS) < 0 {
+		t.logger.Info("保存的resume token早于本次的起点，忽略", zap.Uint32("T", checkpoint.TS.T), zap.Uint32("I", checkpoint.TS.I))
+		return nil
+	}
+	t.logger.Info("从保存的resume token继续", zap.Uint32("T", checkpoint.TS.T), zap.Uint32("I", checkpoint.TS.I), zap.Time("updateTime", checkpoint.UpdateTime))
+	t.lastToken = checkpoint.ResumeToken
+	return checkpoint.ResumeToken
+}
+
+// 处理完一个事件后调用，每resumeTokenInterval个事件保存一次
+func (t *resumeTokenTracker) processed(token bson.Raw, ts primitive.Timestamp) {
+	if t == nil {
+		return
+	}
+	t.pending++
+	if t.pending >= resumeTokenInterval {
+		t.save(token, ts)
+	}
+}
+
+// 没有新的事件时调用：之前的事件都已处理，resume token有变化时每replayProgressInterval保存一次
+func (t *resumeTokenTracker) idle(token bson.Raw, ts primitive.Timestamp) {
+	if t == nil || token == nil || bytes.Equal(token, t.lastToken) {
+		return
+	}
+	if t.pending > 0 || time.Since(t.lastSave) >= replayProgressInterval {
+		t.save(token, ts)
+	}
+}
+
+// 不保存token（如失效事件的token），之后出现新的token时才保存
+func (t *resumeTokenTracker) skipToken(token bson.Raw) {
+	if t != nil {
+		t.lastToken = token
+	}
+}
+
+func (t *resumeTokenTracker) save(token bson.Raw, ts primitive.Timestamp) {
+	if token == nil {
+		return
+	}
+	if tokenTS, ok := resumeTokenTime(token); ok {
+		ts = tokenTS
+	}
+	checkpoint := &Checkpoint{ID: t.id, TS: ts, OplogNs: "changestream", ResumeToken: append(bson.Raw(nil), token...)}
+	if err := t.store.save(checkpoint); err != nil {
+		t.logger.Warn("保存change stream的resume token失败", zap.Error(err))
+		return
+	}
+	t.pending, t.lastSave, t.lastToken = 0, time.Now(), checkpoint.ResumeToken
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// mongo.Client在服务端重启后会自动重建连接池，这里只需要重试失败的操作、重新打开游标。
+var (
+	maxRetries      = 10               // 可重试错误的最大连续重试次数，为0表示不重试
+	retryBackoffMin = time.Second      // 第一次重试前的等待时间，之后每次翻倍
+	retryBackoffMax = 30 * time.Second // 重试等待时间的上限
+)
+
+// 服务端重启、主从切换期间返回的错误码
+var retryableErrorCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	43,    // CursorNotFound：服务端重启后游标失效
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	262,   // ExceededTimeLimit
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// 命令已经执行过时返回的错误码。网络中断后重试、从checkpoint继续重放时，同一条c类型的oplog可能被执行多次，
+// 这些错误表示目标端已经是命令执行后的状态，视为执行成功
+var alreadyAppliedCodes = map[string][]int32{
+	"create":           {48},     // NamespaceExists
+	"drop":             {26},     // NamespaceNotFound
+	"dropDatabase":     {26},     // NamespaceNotFound
+	"renameCollection": {26, 48}, // NamespaceNotFound、NamespaceExists
+	"dropIndexes":      {26, 27}, // NamespaceNotFound、IndexNotFound
+	"deleteIndexes":    {26, 27}, // NamespaceNotFound、IndexNotFound
+}
+
+// 判断执行命令cmd返回的err是否表示命令已经执行过
+func isAlreadyApplied(cmd bson.D, err error) bool {
+	var cmdErr mongo.CommandError
+	if len(cmd) == 0 || !errors.As(err, &cmdErr) {
+		return false
+	}
+	for _, code := range alreadyAppliedCodes[cmd[0].Key] {
+		if cmdErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// 设置可重试错误的最大连续重试次数和重试等待时间的上限
+func SetRetry(retries int, maxBackoff time.Duration) {
+	maxRetries = retries
+	if maxBackoff > 0 {
+		retryBackoffMax = maxBackoff
+	}
+}
+
+// 判断err是否为网络断开、服务端重启、单次操作超时等可以通过重试恢复的错误。ctx被取消时不重试
+func isRetryableError(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		for _, code := range retryableErrorCodes {
+			if serverErr.HasErrorCode(code) {
+				return true
+			}
+		}
+		return serverErr.HasErrorLabel("RetryableWriteError") || serverErr.HasErrorLabel("ResumableChangeStreamError")
+	}
+	return false
+}
+
+// 第attempt次重试（从1开始）之前等待，返回false表示不应该继续重试：重试次数用完或ctx被取消
+func retryWait(ctx context.Context, attempt int, desc string, err error) bool {
+	if attempt > maxRetries {
+		return false
+	}
+	backoff := retryBackoffMin << uint(attempt-1)
+	if backoff <= 0 || backoff > retryBackoffMax {
+		backoff = retryBackoffMax
+	}
+	loggerFrom(ctx).Warn("操作失败，等待后重试", zap.String("op", desc), zap.Int("attempt", attempt), zap.Int("maxRetries", maxRetries), zap.Duration("backoff", backoff), zap.Error(err))
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(backoff):
+		return true
+	}
+}
+
+// 执行单个操作，每次尝试单独应用timeout，遇到可重试错误时等待后重试。返回最后一次尝试的错误
+func doWithRetry(ctx context.Context, timeout time.Duration, desc string, op func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		opCtx, cancel := withTimeout(ctx, timeout)
+		err := op(opCtx)
+		cancel()
+		if !isRetryableError(ctx, err) || !retryWait(ctx, attempt, desc, err) {
+			return err
+		}
+	}
+}
+
+// oplog游标中断后，确认lastTS对应的oplog仍然存在（没有因为中断时间过长而被覆盖），
+// 返回从lastTS之后继续读取的filter。endTS为空时表示不限制结束位置
+func oplogResumeFilter(ctx context.Context, oplogColl *mongo.Collection, lastTS, endTS primitive.Timestamp) (bson.D, error) {
+	if err := checkOplogRollover(ctx, oplogColl, lastTS, true); err != nil {
+		return nil, err
+	}
+	if endTS.T == 0 && endTS.I == 0 {
+		return bson.D{{"ts", bson.D{{"$gt", lastTS}}}}, nil
+	}
+	return bson.D{{"ts", bson.D{{"$gt", lastTS}, {"$lte", endTS}}}}, nil
+}
@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// 清单中各个集合的结果：集合开始复制时为running，复制完成后没有写入失败、文档数核对一致时为done，否则为failed。
+// 进程异常退出时正在复制的集合停留在running，尚未开始的集合为pending，--retry_failed将这些集合与failed一样重新同步
+const (
+	ManifestNsPending = "pending"
+	ManifestNsRunning = "running"
+	ManifestNsDone    = "done"
+	ManifestNsFailed  = "failed"
+)
+
+// 清单中单个集合的结果
+type ManifestCollection struct {
+	SrcNs      string    `bson:"srcNs"`
+	DstNs      string    `bson:"dstNs"`
+	State      string    `bson:"state"`
+	ErrorNum   int64     `bson:"errorNum,omitempty"`
+	Error      string    `bson:"error,omitempty"` // 最后一个错误
+	UpdateTime time.Time `bson:"updateTime,omitempty"`
+}
+
+// 继续任务时，用之前运行中记录的结果替换collections中相同映射的集合
+func mergeManifestCollections(collections, previous []ManifestCollection) {
+	byNs := make(map[string]ManifestCollection, len(previous))
+	for _, c := range previous {
+		byNs[c.SrcNs+"->"+c.DstNs] = c
+	}
+	for i, c := range collections {
+		if p, exists := byNs[c.SrcNs+"->"+c.DstNs]; exists {
+			collections[i] = p
+		}
+	}
+}
+
+// 将各个集合的结果记录到清单中
+type manifestRecorder struct {
+	NopProgressListener
+	lock     sync.Mutex
+	dstMongo *MongoArgs
+	id       string                      // 清单的_id（源端地址）
+	errors   map[string]*manifestNsError // 目标ns -> 本次运行中的写入错误
+}
+
+type manifestNsError struct {
+	num  int64
+	last string
+}
+
+var (
+	nsRecorder     = &manifestRecorder{}
+	nsRecorderOnce sync.Once
+)
+
+// 开始将各个集合的结果记录到srcMongo对应的清单中
+func startManifestRecorder(srcMongo, dstMongo *MongoArgs) {
+	nsRecorder.lock.Lock()
+	nsRecorder.dstMongo, nsRecorder.id = dstMongo, srcMongo.uri()
+	nsRecorder.errors = make(map[string]*manifestNsError)
+	nsRecorder.lock.Unlock()
+	nsRecorderOnce.Do(func() { AddProgressListener(nsRecorder) })
+}
+
+// 更新清单中一个集合的结果，失败时只记录警告
+func (r *manifestRecorder) save(ns NsMap, state string, nsErr *manifestNsError) {
+	if r.dstMongo == nil {
+		return
+	}
+	fields := bson.D{{"collections.$.state", state}, {"collections.$.updateTime", time.Now()}}
+	update := bson.D{{"$set", fields}}
+	if nsErr != nil {
+		update[0].Value = append(fields, bson.E{"collections.$.errorNum", nsErr.num}, bson.E{"collections.$.error", nsErr.last})
+	} else {
+		update = append(update, bson.E{"$unset", bson.D{{"collections.$.errorNum", ""}, {"collections.$.error", ""}}})
+	}
+	filter := bson.D{{"_id", r.id}, {"collections", bson.D{{"$elemMatch", bson.D{{"srcNs", ns.SrcDb + "." + ns.SrcColl}, {"dstNs", ns.DstDb + "." + ns.DstColl}}}}}}
+	coll := r.dstMongo.Client().Database(mongosyncDbName).Collection(manifestCollName)
+	err := doWithRetry(r.dstMongo.Context(), writeTimeout, "update manifest", func(ctx context.Context) error {
+		_, err := coll.UpdateOne(ctx, filter, update)
+		return err
+	})
+	if err != nil {
+		r.dstMongo.logger().Warn("记录集合的同步结果失败", zap.String("NS", ns.SrcDb+"."+ns.SrcColl), zap.String("state", state), zap.Error(err))
+	}
+}
+
+func (r *manifestRecorder) OnCollectionStart(ns NsMap) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.save(ns, ManifestNsRunning, nil)
+}
+
+func (r *manifestRecorder) OnCollectionDone(ns NsMap, copiedNum, skippedNum int64, duration time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if nsErr := r.errors[ns.DstDb+"."+ns.DstColl]; nsErr != nil {
+		r.save(ns, ManifestNsFailed, nsErr)
+	} else {
+		r.save(ns, ManifestNsDone, nil)
+	}
+}
+
+func (r *manifestRecorder) OnCollectionCounts(ns NsMap, srcCount, dstCount int64, mismatch bool) {
+	if !mismatch {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	nsErr := r.addError(ns.DstDb+"."+ns.DstColl, fmt.Sprintf("文档数不一致，源端：%d，目标端：%d", srcCount, dstCount))
+	r.save(ns, ManifestNsFailed, nsErr)
+}
+
+func (r *manifestRecorder) OnError(ns string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.errors != nil {
+		r.addError(ns, err.Error())
+	}
+}
+
+func (r *manifestRecorder) addError(ns, msg string) *manifestNsError {
+	nsErr := r.errors[ns]
+	if nsErr == nil {
+		nsErr = &manifestNsError{}
+		r.errors[ns] = nsErr
+	}
+	nsErr.num++
+	nsErr.last = msg
+	return nsErr
+}
+
+// --retry_failed：读取同一源端的清单，返回nsStructSlice中之前没有同步成功的集合，并清空这些集合的复制进度，
+// 其他集合保持之前的结果。配置必须与清单中的任务相同，否则集合的映射可能不同
+func CustRetryFailedManifest(srcMongo, dstMongo *MongoArgs, config ManifestConfig, nsStructSlice []*NsMap) ([]*NsMap, error) {
+	config = config.withFileHashes()
+	coll := dstMongo.Client().Database(mongosyncDbName).Collection(manifestCollName)
+	var previous Manifest
+	err := doWithRetry(dstMongo.Context(), findTimeout, "find "+mongosyncDbName+"."+manifestCollName, func(ctx context.Context) error {
+		return coll.FindOne(ctx, bson.M{"_id": srcMongo.uri()}).Decode(&previous)
+	})
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("目标端没有%s的任务清单", srcMongo.uri())
+	} else if err != nil {
+		return nil, err
+	}
+	if previous.ConfigHash != config.hash() {
+		return nil, fmt.Errorf("本次的配置与%s开始的任务不同：%s", previous.StartTime.Format("2006-01-02 15:04:05"), diffManifestConfig(previous.Config, config))
+	}
+	if len(previous.Collections) == 0 {
+		return nil, fmt.Errorf("%s开始的任务（mongosync %s）没有记录各个集合的结果", previous.StartTime.Format("2006-01-02 15:04:05"), previous.ToolVersion)
+	}
+	states := make(map[string]ManifestCollection, len(previous.Collections))
+	for _, c := range previous.Collections {
+		states[c.SrcNs+"->"+c.DstNs] = c
+	}
+	var retry []*NsMap
+	var added []ManifestCollection // 之前的任务中没有的集合（如之后在源端新建的集合）
+	progress := dstMongo.Client().Database(mongosyncDbName).Collection(copyProgressCollName)
+	for _, nsmap := range nsStructSlice {
+		srcNs, dstNs := nsmap.SrcDb+"."+nsmap.SrcColl, nsmap.DstDb+"."+nsmap.DstColl
+		c, exists := states[srcNs+"->"+dstNs]
+		if exists && c.State == ManifestNsDone {
+			continue
+		}
+		retry = append(retry, nsmap)
+		if !exists {
+			c.State = ManifestNsPending
+			added = append(added, ManifestCollection{SrcNs: srcNs, DstNs: dstNs, State: ManifestNsPending})
+		}
+		srcMongo.logger().Info("重新同步之前没有成功的集合", zap.String("NS", srcNs), zap.String("state", c.State), zap.String("error", c.Error))
+		err := doWithRetry(dstMongo.Context(), writeTimeout, "delete copy progress", func(ctx context.Context) error {
+			_, err := progress.DeleteOne(ctx, bson.M{"_id": dstNs, "source": srcMongo.uri()})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	update := bson.M{"$set": bson.M{"state": ManifestStateRunning, "updateTime": time.Now()}}
+	if len(added) > 0 {
+		update["$push"] = bson.M{"collections": bson.M{"$each": added}}
+	}
+	err = doWithRetry(dstMongo.Context(), writeTimeout, "update manifest", func(ctx context.Context) error {
+		_, err := coll.UpdateOne(ctx, bson.M{"_id": previous.ID}, update)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	startManifestRecorder(srcMongo, dstMongo)
+	return retry, nil
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 重放落后太多时，需要的oplog可能已经被固定集合覆盖，无法再通过重放追上源端：
+// 开始重放时起点对应的oplog已经不存在，或者游标因为CappedPositionLost中断、重新打开游标时最后处理的oplog已经被覆盖
+// （读取到的第一条oplog晚于期望的位置）。此时replayOplog返回ErrOplogRolledOver，由调用方决定退出或者重新全量同步
+var ErrOplogRolledOver = errors.New("需要的oplog已经被覆盖")
+
+// 需要的oplog已经被覆盖，errors.Is(err, ErrOplogRolledOver)为true
+type OplogRolledOverError struct {
+	OplogNs  string
+	Expected primitive.Timestamp // 期望读取的oplog的ts
+	First    primitive.Timestamp // 现存最早的oplog的ts，oplog集合为空时为0
+}
+
+func (e *OplogRolledOverError) Error() string {
+	return fmt.Sprintf("%s中ts为(%d,%d)的oplog已经被覆盖，现存最早的oplog为(%d,%d)", e.OplogNs, e.Expected.T, e.Expected.I, e.First.T, e.First.I)
+}
+
+func (e *OplogRolledOverError) Is(target error) bool {
+	return target == ErrOplogRolledOver
+}
+
+// 游标读取的位置已经被覆盖（CappedPositionLost），需要从最后处理的oplog之后重新打开游标
+func isCappedPositionLost(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(136)
+}
+
+// 检查oplogColl中是否还能从expected开始读取：exact为true时要求ts为expected的oplog存在，
+// 否则只要求最早的oplog不晚于expected。oplog已经被覆盖时返回*OplogRolledOverError
+func checkOplogRollover(ctx context.Context, oplogColl *mongo.Collection, expected primitive.Timestamp, exact bool) error {
+	var first struct {
+		TS primitive.Timestamp `bson:"ts"`
+	}
+	var err error
+	if exact {
+		err = doWithRetry(ctx, findTimeout, "find "+oplogColl.Name(), func(ctx context.Context) error {
+			return oplogColl.FindOne(ctx, bson.M{"ts": bson.M{"$gte": expected}}).Decode(&first)
+		})
+		if err == nil && first.TS.Equal(expected) {
+			return nil
+		}
+	}
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	// 现存最早的oplog，固定集合按插入顺序，syncoplog等普通集合按ts排序
+	oplogNs := oplogColl.Database().Name() + "." + oplogColl.Name()
+	sort := bson.D{{"ts", 1}}
+	if isOplogNamespace(oplogNs) {
+		sort = bson.D{{"$natural", 1}}
+	}
+	first.TS = primitive.Timestamp{}
+	err = doWithRetry(ctx, findTimeout, "find "+oplogColl.Name(), func(ctx context.Context) error {
+		return oplogColl.FindOne(ctx, bson.M{}, options.FindOne().SetSort(sort)).Decode(&first)
+	})
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	if !exact && err == nil && primitive.CompareTimestamp(first.TS, expected) <= 0 {
+		return nil
+	}
+	return &OplogRolledOverError{OplogNs: oplogNs, Expected: expected, First: first.TS}
+}
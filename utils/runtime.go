@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// Runtime是一次同步任务的运行环境：上下文和日志。
+// 每个Runtime的上下文和日志相互独立：取消上下文只会中断使用该Runtime的操作，日志也互不影响。
+// 其他任务状态仍然是包级别的全局变量，由Set函数设置或在运行中累积，同一进程中的多个任务共享，例如
+// 名称空间的过滤、覆盖和投影（nsFilters、nsOverrides、nsProjections）、重放的名称空间匹配（replayNsMatcher）、
+// 离线缓冲区（offlineBuf）、延迟创建的索引（deferredIndexes）、missingDocSource、deleteStats、oversizedDocs、syncOplogReplayed，
+// 因此同一进程中不能同时运行配置不同的多个任务
+type Runtime struct {
+	Ctx    context.Context
+	Logger *zap.Logger
+}
+
+// Runtime的构造函数，ctx为nil时使用context.Background()，logger为nil时使用NewLogger()
+func NewRuntime(ctx context.Context, logger *zap.Logger) *Runtime {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if logger == nil {
+		logger = NewLogger()
+	}
+	return &Runtime{Ctx: ctx, Logger: logger}
+}
+
+type loggerKey struct{}
+
+// 返回携带logger的上下文。各组件通过传入的ctx或MongoArgs的Context()获取logger，不使用包级别的全局变量
+func (rt *Runtime) Context() context.Context {
+	return context.WithValue(rt.Ctx, loggerKey{}, rt.Logger)
+}
+
+// 获取ctx中的logger。ctx不是由Runtime创建时使用zap的全局logger（默认不输出日志，可通过zap.ReplaceGlobals设置）
+func loggerFrom(ctx context.Context) *zap.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+		return logger
+	}
+	return zap.L()
+}
+
+// 设置运行环境，同时替换SetContext设置的上下文
+func (mc *MongoArgs) SetRuntime(rt *Runtime) *MongoArgs {
+	mc.ctx = rt.Context()
+	return mc
+}
+
+// 返回运行环境中的logger
+func (mc *MongoArgs) logger() *zap.Logger {
+	return loggerFrom(mc.Context())
+}
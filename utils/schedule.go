@@ -0,0 +1,243 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// 定时同步：按cron表达式（分 时 日 月 周，如"0 2 * * 6"）周期性地执行全量同步，进程常驻运行。
+// 每次运行的结果记录在目标实例的mongosync.schedule_history集合中，可以通过HTTP接口查看
+const scheduleHistoryCollName = "schedule_history"
+
+// 单次运行的状态
+const (
+	ScheduleRunRunning = "running"
+	ScheduleRunDone    = "done"
+	ScheduleRunFailed  = "failed"
+)
+
+// cron表达式的各个字段。日和周同时指定时，满足其中之一即可（与cron相同）
+type CronSchedule struct {
+	expr           string
+	minute         [60]bool
+	hour           [24]bool
+	dom            [32]bool
+	month          [13]bool
+	dow            [7]bool
+	domAny, dowAny bool
+}
+
+// 解析cron表达式，支持*、数字、a-b范围、/步长以及逗号分隔的列表，周的取值为0-7（0和7均表示周日）
+func CustParseCron(expr string) (*CronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron表达式需要5个字段（分 时 日 月 周）：%q", expr)
+	}
+	c := &CronSchedule{expr: expr}
+	var dow [8]bool
+	for _, field := range []struct {
+		value    string
+		min, max int
+		set      []bool
+	}{
+		{fields[0], 0, 59, c.minute[:]},
+		{fields[1], 0, 23, c.hour[:]},
+		{fields[2], 1, 31, c.dom[:]},
+		{fields[3], 1, 12, c.month[:]},
+		{fields[4], 0, 7, dow[:]},
+	} {
+		if err := parseCronField(field.value, field.min, field.max, field.set); err != nil {
+			return nil, fmt.Errorf("cron表达式%q错误：%v", expr, err)
+		}
+	}
+	copy(c.dow[:], dow[:7])
+	c.dow[0] = c.dow[0] || dow[7]
+	c.domAny = fields[2] == "*"
+	c.dowAny = fields[4] == "*"
+	return c, nil
+}
+
+func parseCronField(field string, min, max int, set []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return fmt.Errorf("步长错误：%q", part)
+			}
+			rangePart = part[:i]
+		}
+		lo, hi := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return fmt.Errorf("取值错误：%q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return fmt.Errorf("取值错误：%q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return fmt.Errorf("取值超出范围%d-%d：%q", min, max, part)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+func (c *CronSchedule) String() string {
+	return c.expr
+}
+
+func (c *CronSchedule) dayMatch(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[t.Weekday()]
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// 返回t之后（不包括t所在的分钟）下一次运行的时间，5年内没有满足条件的时间时返回零值
+func (c *CronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !c.month[t.Month()]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatch(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case !c.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case !c.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// mongosync.schedule_history中的文档，每次运行一个
+type ScheduleRun struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	Source      string             `bson:"source" json:"source"`
+	Schedule    string             `bson:"schedule" json:"schedule"`
+	State       string             `bson:"state" json:"state"`
+	StartTime   time.Time          `bson:"startTime" json:"startTime"`
+	EndTime     time.Time          `bson:"endTime,omitempty" json:"endTime"`
+	CopiedNum   int64              `bson:"copiedNum" json:"copiedNum"`
+	SkippedNum  int64              `bson:"skippedNum" json:"skippedNum"`
+	Error       string             `bson:"error,omitempty" json:"error,omitempty"`
+	Collections []CollectionReport `bson:"collections" json:"collections"`
+}
+
+// 按schedule周期性地执行job，不会返回。job返回本次运行各个集合的同步状态
+func CustRunSchedule(srcMongo, dstMongo *MongoArgs, schedule *CronSchedule, job func() ([]CollectionStatus, error)) {
+	coll := dstMongo.Client().Database(mongosyncDbName).Collection(scheduleHistoryCollName)
+	for {
+		next := schedule.Next(time.Now())
+		if next.IsZero() {
+			srcMongo.logger().Fatal("cron表达式没有可以运行的时间", zap.String("schedule", schedule.String()))
+		}
+		srcMongo.logger().Info("等待下一次定时同步", zap.String("schedule", schedule.String()), zap.Time("next", next))
+		select {
+		case <-time.After(time.Until(next)):
+		case <-srcMongo.Context().Done():
+			return
+		}
+
+		run := ScheduleRun{ID: primitive.NewObjectID(), Source: srcMongo.uri(), Schedule: schedule.String(), State: ScheduleRunRunning, StartTime: time.Now()}
+		saveScheduleRun(dstMongo, coll, run)
+		srcMongo.logger().Info("开始定时同步", zap.String("runId", run.ID.Hex()))
+
+		report := CustStartReport(srcMongo, ReportModeSchedule)
+		statuses, err := job()
+		report.AddCollections(statuses)
+		CustFinishReport(dstMongo, report, err)
+		run.EndTime = time.Now()
+		run.State = ScheduleRunDone
+		if err != nil {
+			run.State = ScheduleRunFailed
+			run.Error = err.Error()
+		}
+		for _, collection := range newCollectionReports(statuses) {
+			run.CopiedNum += collection.CopiedNum
+			run.SkippedNum += collection.SkippedNum
+			run.Collections = append(run.Collections, collection)
+		}
+		saveScheduleRun(dstMongo, coll, run)
+		srcMongo.logger().Info("定时同步完成", zap.String("runId", run.ID.Hex()), zap.String("state", run.State), zap.Int("collNum", len(run.Collections)),
+			zap.Int64("copiedNum", run.CopiedNum), zap.Int64("skippedNum", run.SkippedNum), zap.Duration("duration", run.EndTime.Sub(run.StartTime)))
+	}
+}
+
+// 保存运行记录，失败时只记录警告，不影响同步
+func saveScheduleRun(dstMongo *MongoArgs, coll *mongo.Collection, run ScheduleRun) {
+	err := doWithRetry(dstMongo.Context(), writeTimeout, "save schedule history", func(ctx context.Context) error {
+		_, err := coll.ReplaceOne(ctx, bson.M{"_id": run.ID}, run, options.Replace().SetUpsert(true))
+		return err
+	})
+	if err != nil {
+		dstMongo.logger().Warn("保存定时同步的运行记录失败", zap.String("runId", run.ID.Hex()), zap.Error(err))
+	}
+}
+
+// 在addr上提供HTTP接口，GET /history?limit=N 按开始时间倒序返回最近N次（默认20）运行记录
+func CustServeScheduleHistory(addr string, srcMongo, dstMongo *MongoArgs) error {
+	coll := dstMongo.Client().Database(mongosyncDbName).Collection(scheduleHistoryCollName)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		limit := int64(20)
+		if value := r.URL.Query().Get("limit"); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				http.Error(w, "limit参数错误", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		runs := []ScheduleRun{}
+		err := doWithRetry(r.Context(), findTimeout, "find "+mongosyncDbName+"."+scheduleHistoryCollName, func(ctx context.Context) error {
+			cur, err := coll.Find(ctx, bson.M{"source": srcMongo.uri()}, options.Find().SetSort(bson.D{{"startTime", -1}}).SetLimit(limit))
+			if err != nil {
+				return err
+			}
+			runs = []ScheduleRun{}
+			return cur.All(ctx, &runs)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(runs)
+	})
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,258 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 集合同步状态的输出间隔
+var collectionStatusInterval = 30 * time.Second
+
+// 单个集合的同步状态
+const (
+	CollectionPending = "pending" // 等待同步
+	CollectionRunning = "running" // 正在同步索引或数据
+	CollectionDone    = "done"    // 同步完成
+)
+
+// 单个集合的同步状态和进度
+type CollectionStatus struct {
+	Ns            NsMap
+	State         string
+	CopiedNum     int64
+	SkippedNum    int64
+	EstimatedNum  int64 // 开始同步时源端集合的预估文档数（estimatedDocumentCount），获取失败时为0
+	SrcCount      int64 // 导入完成后源端和目标端的文档数，不核对或核对失败时为0
+	DstCount      int64
+	CountMismatch bool // 复制期间源端没有变化但文档数不一致
+	StartTime     time.Time
+	Duration      time.Duration
+
+	rateStartNum  int64 // 计算复制速度的起点：第一次收到进度时的文档数，继续中断的复制时包括之前运行写入的文档
+	rateStartTime time.Time
+}
+
+// 已复制的文档数占预估文档数的百分比，预估文档数未知时返回-1。集合正在写入时预估值可能偏小，未完成时最多为99.9
+func (status CollectionStatus) Percent() float64 {
+	if status.State == CollectionDone {
+		return 100
+	}
+	if status.EstimatedNum <= 0 {
+		return -1
+	}
+	percent := float64(status.CopiedNum) * 100 / float64(status.EstimatedNum)
+	if percent > 99.9 {
+		percent = 99.9
+	}
+	return percent
+}
+
+// 按开始复制以来的平均速度估算剩余时间，无法估算时返回-1
+func (status CollectionStatus) ETA() time.Duration {
+	if status.State != CollectionRunning || status.EstimatedNum <= 0 || status.rateStartTime.IsZero() {
+		return -1
+	}
+	copied := status.CopiedNum - status.rateStartNum
+	elapsed := time.Since(status.rateStartTime)
+	if copied <= 0 || elapsed <= 0 {
+		return -1
+	}
+	remaining := status.EstimatedNum - status.CopiedNum
+	if remaining < 0 {
+		remaining = 0
+	}
+	return time.Duration(float64(elapsed) * float64(remaining) / float64(copied))
+}
+
+// 集合同步调度器：通过ProgressListener更新各个集合的进度
+type collectionScheduler struct {
+	NopProgressListener
+	lock     sync.Mutex
+	statuses []*CollectionStatus
+	byNs     map[NsMap]*CollectionStatus
+}
+
+func (s *collectionScheduler) OnCollectionProgress(ns NsMap, copiedNum int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if status, exists := s.byNs[ns]; exists {
+		if status.rateStartTime.IsZero() {
+			status.rateStartNum, status.rateStartTime = copiedNum, time.Now()
+		}
+		status.CopiedNum = copiedNum
+	}
+}
+
+func (s *collectionScheduler) OnCollectionDone(ns NsMap, copiedNum, skippedNum int64, duration time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if status, exists := s.byNs[ns]; exists {
+		status.CopiedNum, status.SkippedNum = copiedNum, skippedNum
+	}
+}
+
+func (s *collectionScheduler) OnCollectionCounts(ns NsMap, srcCount, dstCount int64, mismatch bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if status, exists := s.byNs[ns]; exists {
+		status.SrcCount, status.DstCount, status.CountMismatch = srcCount, dstCount, mismatch
+	}
+}
+
+// 设置集合的状态
+func (s *collectionScheduler) setState(status *CollectionStatus, state string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status.State = state
+	switch state {
+	case CollectionRunning:
+		status.StartTime = time.Now()
+	case CollectionDone:
+		status.Duration = time.Since(status.StartTime)
+	}
+}
+
+// 返回所有集合状态的副本
+func (s *collectionScheduler) snapshot() []CollectionStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	statuses := make([]CollectionStatus, 0, len(s.statuses))
+	for _, status := range s.statuses {
+		statuses = append(statuses, *status)
+	}
+	return statuses
+}
+
+// 设置集合的预估文档数
+func (s *collectionScheduler) setEstimated(status *CollectionStatus, estimated int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status.EstimatedNum = estimated
+}
+
+// 输出各状态的集合数量，以及正在同步的集合的进度、完成百分比和预计剩余时间
+func (s *collectionScheduler) report(logger *zap.Logger) {
+	counts := make(map[string]int)
+	var running []string
+	for _, status := range s.snapshot() {
+		counts[status.State]++
+		if status.State != CollectionRunning {
+			continue
+		}
+		ns := status.Ns.SrcDb + "." + status.Ns.SrcColl
+		elapsed := time.Since(status.StartTime).Truncate(time.Second)
+		percent := status.Percent()
+		if percent < 0 {
+			running = append(running, fmt.Sprintf("%s(%d, %s)", ns, status.CopiedNum, elapsed))
+			continue
+		}
+		eta := "未知"
+		if d := status.ETA(); d >= 0 {
+			eta = d.Truncate(time.Second).String()
+		}
+		running = append(running, fmt.Sprintf("%s(%d/%d %.1f%%, %s, ETA %s)", ns, status.CopiedNum, status.EstimatedNum, percent, elapsed, eta))
+		fmt.Printf("%s导入进度：%v/%v（%.1f%%），已耗时：%v，预计剩余：%v\n", ns, status.CopiedNum, status.EstimatedNum, percent, elapsed, eta)
+	}
+	logger.Info("集合同步状态", zap.Int("pending", counts[CollectionPending]), zap.Int("running", counts[CollectionRunning]), zap.Int("done", counts[CollectionDone]), zap.Strings("runningNs", running))
+}
+
+// 使用workers个协程并发同步nsStructSlice中的集合，每个集合由一个协程完成，
+// 同步过程中定期输出各集合的状态，返回所有集合最终的状态
+func CustSyncCollections(srcMongo, dstMongo *MongoArgs, nsStructSlice []*NsMap, workers int, policy ConflictPolicy, noIndex bool) []CollectionStatus {
+	scheduler := &collectionScheduler{byNs: make(map[NsMap]*CollectionStatus)}
+	mapping := make(map[string]NsMap, len(nsStructSlice))
+	for _, nsmap := range nsStructSlice {
+		mapping[nsmap.SrcDb+"."+nsmap.SrcColl] = *nsmap
+	}
+	for _, nsmap := range nsStructSlice {
+		status := &CollectionStatus{Ns: *nsmap, State: CollectionPending}
+		scheduler.statuses = append(scheduler.statuses, status)
+		scheduler.byNs[*nsmap] = status
+	}
+	AddProgressListener(scheduler)
+	defer RemoveProgressListener(scheduler)
+
+	if workers <= 0 {
+		workers = 1
+	}
+	// GridFS bucket的.chunks集合与.files集合一起同步，不单独排队
+	buckets := gridfsBuckets(nsStructSlice)
+	bucketsByFiles := make(map[NsMap]*gridfsBucket, len(buckets))
+	for _, bucket := range buckets {
+		bucketsByFiles[bucket.files] = bucket
+	}
+	queue := make(chan *CollectionStatus, len(scheduler.statuses))
+	for _, status := range scheduler.statuses {
+		if buckets[status.Ns] == nil {
+			queue <- status
+		}
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for status := range queue {
+				scheduler.setState(status, CollectionRunning)
+				scheduler.setEstimated(status, estimateDocs(srcMongo, status.Ns.SrcDb, status.Ns.SrcColl))
+				// 视图按定义重新创建，不复制文档
+				if bucket := bucketsByFiles[status.Ns]; bucket != nil {
+					chunksStatus := scheduler.byNs[bucket.chunks]
+					scheduler.setState(chunksStatus, CollectionRunning)
+					scheduler.setEstimated(chunksStatus, estimateDocs(srcMongo, bucket.chunks.SrcDb, bucket.chunks.SrcColl))
+					custSyncGridFSBucket(srcMongo, dstMongo, bucket, policy, noIndex)
+					scheduler.setState(chunksStatus, CollectionDone)
+				} else if spec, err := srcMongo.collectionSpec(status.Ns.SrcDb, status.Ns.SrcColl); err == nil && spec != nil && spec.Type == "view" {
+					viewStart := time.Now()
+					notifyProgress(func(listener ProgressListener) { listener.OnCollectionStart(status.Ns) })
+					if err := syncView(srcMongo, dstMongo, status.Ns, spec, mapping); err != nil {
+						srcMongo.logger().Error("同步视图失败", zap.String("NS", status.Ns.SrcDb+"."+status.Ns.SrcColl), zap.Error(err))
+						notifyProgress(func(listener ProgressListener) { listener.OnError(status.Ns.DstDb+"."+status.Ns.DstColl, err) })
+					}
+					notifyProgress(func(listener ProgressListener) { listener.OnCollectionDone(status.Ns, 0, 0, time.Since(viewStart)) })
+				} else {
+					CustSyncCollection(srcMongo, status.Ns.SrcDb, status.Ns.SrcColl, dstMongo, status.Ns.DstDb, status.Ns.DstColl, policy, noIndex)
+				}
+				scheduler.setState(status, CollectionDone)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		buildDeferredIndexes(dstMongo)
+		close(done)
+	}()
+	ticker := time.NewTicker(collectionStatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			scheduler.report(srcMongo.logger())
+		case <-done:
+			scheduler.report(srcMongo.logger())
+			return scheduler.snapshot()
+		}
+	}
+}
+
+// 源端集合的预估文档数，从集合元数据中读取，不扫描集合。视图或获取失败时返回0
+func estimateDocs(srcMongo *MongoArgs, dbName, collName string) int64 {
+	if isView(srcMongo, dbName, collName) {
+		return 0
+	}
+	ctx, cancel := withTimeout(srcMongo.Context(), commandTimeout)
+	defer cancel()
+	count, err := srcMongo.Client().Database(dbName).Collection(collName).EstimatedDocumentCount(ctx)
+	if err != nil {
+		srcMongo.logger().Debug("获取集合的预估文档数失败，不计算完成百分比", zap.String("NS", dbName+"."+collName), zap.Error(err))
+		return 0
+	}
+	return count
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+// 分片集群（mongos）源端：全量同步直接通过mongos读取；mongos上没有local.oplog.rs，
+// 增量同步时从config.shards获取各个分片的副本集地址，分别直接连接各个分片读取其oplog并重放。
+// 直接连接分片时使用与mongos相同的用户名和密码，需要在各个分片上创建同名的分片本地用户
+type Shard struct {
+	ID    string
+	Mongo *MongoArgs
+}
+
+// 判断是否连接的是mongos
+func (mc *MongoArgs) IsMongos() bool {
+	info, err := mc.ServerInfo()
+	if err != nil {
+		mc.logger().Warn("获取服务端版本失败，按非mongos处理", zap.Error(err))
+		return false
+	}
+	return info.IsMongos
+}
+
+// 获取mongos对应的各个分片，首次调用时读取config.shards，之后复用各个分片的连接
+func CustGetShards(srcMongo *MongoArgs) ([]*Shard, error) {
+	srcMongo.conn.Lock()
+	shards := srcMongo.conn.shards
+	srcMongo.conn.Unlock()
+	if shards != nil {
+		return shards, nil
+	}
+
+	var docs []struct {
+		ID   string `bson:"_id"`
+		Host string `bson:"host"`
+	}
+	err := doWithRetry(srcMongo.Context(), findTimeout, "find config.shards", func(ctx context.Context) error {
+		cur, err := srcMongo.Client().Database("config").Collection("shards").Find(ctx, bson.M{})
+		if err != nil {
+			return err
+		}
+		docs = nil
+		return cur.All(ctx, &docs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("config.shards中没有分片")
+	}
+	for _, doc := range docs {
+		// host格式为rs/host1:port1,host2:port2，3.4以下的非副本集分片没有rs/前缀
+		replicaSet, hosts := "", doc.Host
+		if i := strings.Index(hosts, "/"); i >= 0 {
+			replicaSet, hosts = hosts[:i], hosts[i+1:]
+		}
+		shardMongo := srcMongo.Clone().SetHosts(strings.Split(hosts, ",")).SetReplicaSet(replicaSet)
+		shards = append(shards, &Shard{ID: doc.ID, Mongo: shardMongo})
+		srcMongo.logger().Info("发现分片", zap.String("shard", doc.ID), zap.String("host", doc.Host))
+	}
+
+	srcMongo.conn.Lock()
+	defer srcMongo.conn.Unlock()
+	if srcMongo.conn.shards != nil {
+		// 其他协程已经获取过，丢弃本次创建的分片（尚未建立连接）
+		return srcMongo.conn.shards, nil
+	}
+	srcMongo.conn.shards = shards
+	return shards, nil
+}
+
+// 返回读取oplog的实例：mongos返回各个分片，其他情况返回自身
+func custOplogSources(srcMongo *MongoArgs) ([]*MongoArgs, error) {
+	if !srcMongo.IsMongos() {
+		return []*MongoArgs{srcMongo}, nil
+	}
+	shards, err := CustGetShards(srcMongo)
+	if err != nil {
+		return nil, err
+	}
+	var sources []*MongoArgs
+	for _, shard := range shards {
+		sources = append(sources, shard.Mongo)
+	}
+	return sources, nil
+}
+
+// 关闭各个分片的连接
+func (mc *MongoArgs) closeShards() {
+	for _, shard := range mc.conn.shards {
+		shard.Mongo.Close()
+	}
+	mc.conn.shards = nil
+}
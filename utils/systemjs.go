@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+// 服务端保存的JavaScript函数：每个库的system.js中保存的函数（{_id: 函数名, value: Code}）在全量同步之前按--dbFrom_To
+// 复制到目标库的system.js，已经存在的同名函数被替换；重放oplog时同样重放同步的库中system.js的修改。
+// system.js不再作为普通集合复制（--include_system_ns时会被--ns_invalid当作非法的集合名处理）
+const systemJsColl = "system.js"
+
+var syncSystemJs = true
+
+// 设置是否同步system.js
+func SetSyncSystemJs(sync bool) {
+	syncSystemJs = sync
+}
+
+// ns是否为system.js
+func isSystemJsNs(ns string) bool {
+	return strings.HasSuffix(ns, "."+systemJsColl) && strings.Count(ns, ".") == 2
+}
+
+// 重放oplog时是否重放ns（<db>.system.js）的修改：db中有同步的集合
+func containsSystemJsNs(ns string, nsSlice []string) bool {
+	if !syncSystemJs || !isSystemJsNs(ns) {
+		return false
+	}
+	prefix := strings.TrimSuffix(ns, systemJsColl)
+	for _, value := range nsSlice {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// 将dbs中各个库的system.js复制到按nsnsMap映射后的目标库
+func CustSyncSystemJs(srcMongo, dstMongo *MongoArgs, dbs []string, nsnsMap map[string]string) error {
+	for _, db := range dbs {
+		if db == "admin" || db == "local" || db == "config" {
+			continue
+		}
+		srcColl := srcMongo.Client().Database(db).Collection(systemJsColl)
+		var docs []bson.Raw
+		err := doWithRetry(srcMongo.Context(), findTimeout, "find "+db+"."+systemJsColl, func(ctx context.Context) error {
+			cur, err := srcColl.Find(ctx, bson.D{})
+			if err != nil {
+				return err
+			}
+			docs = nil
+			return cur.All(ctx, &docs)
+		})
+		if err != nil {
+			return fmt.Errorf("读取源端%s.%s失败：%v", db, systemJsColl, err)
+		}
+		if len(docs) == 0 {
+			continue
+		}
+		dstDb := CustFilter(db+".$cmd", nsnsMap).DstDb
+		values := make([]interface{}, len(docs))
+		var names []string
+		for i, doc := range docs {
+			values[i] = doc
+			names = append(names, doc.Lookup("_id").String())
+		}
+		dstColl := dstMongo.Client().Database(dstDb).Collection(systemJsColl)
+		if _, failNum := CustInsertMany(dstMongo.Context(), dstColl, values, ConflictOverwrite); failNum != 0 {
+			return fmt.Errorf("写入目标端%s.%s失败的函数数：%d", dstDb, systemJsColl, failNum)
+		}
+		dstMongo.logger().Info("已同步服务端JavaScript函数", zap.String("srcNs", db+"."+systemJsColl), zap.String("dstNs", dstDb+"."+systemJsColl), zap.Strings("names", names))
+	}
+	return nil
+}
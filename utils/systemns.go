@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"strings"
+)
+
+// 系统名称空间默认不复制：system.profile（慢查询记录）等system.开头的集合（system.js见CustSyncSystemJs），以及config库中的会话、事务表等内部数据，
+// 直接写入目标端会失败或破坏目标端的内部状态。视图按定义在目标端重新创建，system.views等保存内部元数据的集合即使指定
+// --include_system_ns也不复制。admin、local库始终不复制
+var includeSystemNs = false
+
+// 始终不复制的系统集合
+var internalSystemColls = map[string]bool{
+	"system.views":      true, // 视图的定义
+	"system.indexes":    true, // MMAPv1的索引元数据
+	"system.namespaces": true, // MMAPv1的名称空间元数据
+}
+
+// 设置是否复制默认排除的系统名称空间
+func SetIncludeSystemNs(include bool) {
+	includeSystemNs = include
+}
+
+// ns（db.coll）是否为不复制的系统名称空间
+func IsSystemNs(ns string) bool {
+	db, coll := ns, ""
+	if i := strings.Index(ns, "."); i >= 0 {
+		db, coll = ns[:i], ns[i+1:]
+	}
+	if db == "admin" || db == "local" || internalSystemColls[coll] || strings.HasPrefix(coll, "system.buckets.") {
+		return true
+	}
+	// system.js由CustSyncSystemJs单独同步
+	if syncSystemJs && coll == systemJsColl {
+		return true
+	}
+	if includeSystemNs {
+		return false
+	}
+	return db == "config" || strings.HasPrefix(coll, "system.")
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// 单次操作的超时时间，为0表示不超时。超时的context都基于MongoArgs的ctx创建，取消ctx会同时中断正在执行的操作
+var (
+	findTimeout    time.Duration // find以及每次getMore
+	writeTimeout   time.Duration // insert、update、replace、delete
+	commandTimeout time.Duration // 其他命令：创建索引、列出库和集合、管理命令等
+)
+
+// 设置find、写入、命令的单次操作超时时间，为0表示不超时
+func SetOpTimeouts(find, write, command time.Duration) {
+	findTimeout = find
+	writeTimeout = write
+	commandTimeout = command
+}
+
+// 返回MongoArgs的上下文
+func (mc *MongoArgs) Context() context.Context {
+	if mc.ctx == nil {
+		return context.Background()
+	}
+	return mc.ctx
+}
+
+// 基于parent创建单次操作使用的context，timeout<=0时不设置超时
+func withTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// 读取游标的下一条文档，每次getMore单独应用findTimeout。
+// tailable游标没有新文档时会一直等待，直到parent被取消或者getMore超时
+func cursorNext(parent context.Context, cur *mongo.Cursor, tailable bool) bool {
+	for {
+		opCtx, cancel := withTimeout(parent, findTimeout)
+		if !tailable {
+			ok := cur.Next(opCtx)
+			cancel()
+			return ok
+		}
+		// TryNext最多执行一次getMore，没有新文档时返回false，此时重新计算超时继续等待
+		ok := cur.TryNext(opCtx)
+		cancel()
+		if ok || cur.Err() != nil || cur.ID() == 0 {
+			return ok
+		}
+	}
+}
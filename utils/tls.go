@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// 根据TLS参数生成tls.Config，enabled为false且没有指定任何文件时返回nil（不使用TLS）。
+// caFile为校验服务端证书的CA证书，为空时使用系统的CA；certKeyFile为同时包含客户端证书和私钥的PEM文件，
+// 用于服务端要求客户端证书或MONGODB-X509认证；insecure为true时不校验服务端证书和主机名
+func CustParseTLS(enabled bool, caFile, certKeyFile string, insecure bool) (*tls.Config, error) {
+	if !enabled && caFile == "" && certKeyFile == "" {
+		if insecure {
+			return nil, errors.New("未启用TLS时不能指定不校验服务端证书")
+		}
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		content, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("%s中没有PEM格式的证书", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certKeyFile != "" {
+		content, err := ioutil.ReadFile(certKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair(content, content)
+		if err != nil {
+			return nil, fmt.Errorf("%s中需要同时包含PEM格式的证书和未加密的私钥：%v", certKeyFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// 设置TLS，为nil时不使用TLS。源端和目标端分别设置，互不影响
+func (mc *MongoArgs) SetTLSConfig(config *tls.Config) *MongoArgs {
+	mc.tlsConfig = config
+	return mc
+}
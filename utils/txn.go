@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+// 多文档事务（以及applyOps命令）在oplog中为一条command类型的oplog：
+//
+//	{op: "c", ns: "admin.$cmd", o: {applyOps: [{op, ns, ui, o, o2}, ...]}, lsid, txnNumber, prevOpTime}
+//
+// 大事务（4.2+）分为多条oplog，之前的oplog带partialTxn: true，最后一条不带partialTxn时提交；
+// 预提交的事务（分片集群的跨分片事务）最后一条带prepare: true，之后由commitTransaction或abortTransaction决定提交或回滚。
+// 重放时将applyOps中的操作拆开，逐条按所属的ns过滤、映射后执行；未提交的事务的操作缓存在内存中，提交时执行，回滚时丢弃
+type txnBuffer struct {
+	pending map[string][]bson.Raw // 未提交的事务的操作，key为lsid和txnNumber
+	logger  *zap.Logger
+}
+
+func newTxnBuffer(logger *zap.Logger) *txnBuffer {
+	return &txnBuffer{pending: make(map[string][]bson.Raw), logger: logger}
+}
+
+// 是否有未提交的事务。有未提交的事务时不保存重放进度，否则从进度继续时会丢失事务之前的操作
+func (b *txnBuffer) empty() bool {
+	return len(b.pending) == 0
+}
+
+// 返回事务相关的oplog中需要执行的操作及其原始内容，ok为false表示不是事务相关的oplog。
+// 事务中的操作没有ts，使用提交事务的oplog的ts
+func (b *txnBuffer) ops(oplog OPLOG, raw bson.Raw) (ops []OPLOG, opRaws []bson.Raw, ok bool) {
+	cmd, isCmd := oplog.O.(bson.D)
+	if oplog.OP != "c" || !isCmd || len(cmd) == 0 {
+		return nil, nil, false
+	}
+	key := txnKey(raw)
+	var raws []bson.Raw
+	switch cmd[0].Key {
+	case "applyOps":
+		inner, err := raw.LookupErr("o", "applyOps")
+		if err != nil {
+			return nil, nil, false
+		}
+		values, err := inner.Array().Values()
+		if err != nil {
+			b.logger.Error("解析applyOps失败", zap.Error(err), zap.String("oplog", raw.String()))
+			return nil, nil, true
+		}
+		for _, value := range values {
+			if doc, ok := value.DocumentOK(); ok {
+				raws = append(raws, append(bson.Raw(nil), doc...)) // 游标的缓冲区会被复用
+			}
+		}
+		cmdMap := cmd.Map()
+		// 大事务之前的oplog早于重放起点时，只能读取到事务的后半部分，不能只执行一半的事务
+		_, started := b.pending[key]
+		missed := key != "" && !started && hasPrevOpTime(raw)
+		if key != "" && (cmdMap["partialTxn"] == true || cmdMap["prepare"] == true) {
+			if !missed {
+				b.pending[key] = append(b.pending[key], raws...)
+			}
+			return nil, nil, true
+		}
+		if missed {
+			b.logger.Warn("事务开始于重放起点之前，跳过", zap.Uint32("T", oplog.TS.T), zap.Uint32("I", oplog.TS.I))
+			return nil, nil, true
+		}
+		raws = append(b.pending[key], raws...)
+	case "commitTransaction":
+		pending, exists := b.pending[key]
+		if !exists {
+			b.logger.Warn("提交的事务开始于重放起点之前，跳过", zap.Uint32("T", oplog.TS.T), zap.Uint32("I", oplog.TS.I))
+			return nil, nil, true
+		}
+		raws = pending
+	case "abortTransaction":
+		delete(b.pending, key)
+		return nil, nil, true
+	default:
+		return nil, nil, false
+	}
+	delete(b.pending, key)
+	for _, opRaw := range raws {
+		var op OPLOG
+		if err := bson.Unmarshal(opRaw, &op); err != nil {
+			b.logger.Error("解析事务中的操作失败", zap.Error(err), zap.String("op", opRaw.String()))
+			continue
+		}
+		op.TS = oplog.TS
+		ops, opRaws = append(ops, op), append(opRaws, opRaw)
+	}
+	return ops, opRaws, true
+}
+
+// 事务的标识：lsid和txnNumber，不是事务（applyOps命令）时为空
+func txnKey(raw bson.Raw) string {
+	lsid, err := raw.LookupErr("lsid")
+	if err != nil {
+		return ""
+	}
+	var txnNumber int64
+	if value, err := raw.LookupErr("txnNumber"); err == nil {
+		txnNumber, _ = value.AsInt64OK()
+	}
+	return fmt.Sprintf("%x/%d", lsid.Value, txnNumber)
+}
+
+// oplog是否有之前的oplog：同一个事务中的第一条oplog的prevOpTime.ts为0
+func hasPrevOpTime(raw bson.Raw) bool {
+	value, err := raw.LookupErr("prevOpTime", "ts")
+	if err != nil {
+		return false
+	}
+	t, i, ok := value.TimestampOK()
+	return ok && (t != 0 || i != 0)
+}
@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// 用户和角色：从源端的admin.system.users、admin.system.roles读取同步的库中定义的用户和自定义角色，按--dbFrom_To
+// 映射库名（用户、角色所在的库以及授予的角色、权限涉及的库）后，与mongorestore相同，写入目标端admin库的临时集合，
+// 再通过_mergeAuthzCollections合并到目标端的用户和角色中。SCRAM凭据与库名无关，迁移后应用可以使用原密码认证。
+// 需要源端的backup角色（读取system.users）和目标端的restore角色。模式：
+//
+//	db   只同步在同步的库中定义的用户和角色
+//	all  还同步在admin库中定义的用户和角色，不包括目标端同步任务使用的用户
+const (
+	SyncUsersDb  = "db"
+	SyncUsersAll = "all"
+)
+
+// 写入目标端的临时集合
+const (
+	tempUsersColl = "mongosync_tempusers"
+	tempRolesColl = "mongosync_temproles"
+)
+
+// 检查用户、角色的同步模式
+func CustCheckSyncUsers(mode string) error {
+	if mode != "" && mode != SyncUsersDb && mode != SyncUsersAll {
+		return fmt.Errorf("不支持的模式%s，可选值为%s、%s", mode, SyncUsersDb, SyncUsersAll)
+	}
+	return nil
+}
+
+// 用户、角色文档中库名的映射
+type authzDbMapper struct {
+	dbs     map[string]bool // 同步的源端库
+	nsnsMap map[string]string
+}
+
+func (m *authzDbMapper) mapDb(db string) string {
+	if !m.dbs[db] {
+		return db
+	}
+	return CustFilter(db+".$cmd", m.nsnsMap).DstDb
+}
+
+// 映射文档中指定字段的库名
+func (m *authzDbMapper) mapField(doc bson.D, key string) {
+	for i := range doc {
+		if doc[i].Key == key {
+			if db, ok := doc[i].Value.(string); ok {
+				doc[i].Value = m.mapDb(db)
+			}
+		}
+	}
+}
+
+// 映射角色列表（[{role, db}]）中的库名
+func (m *authzDbMapper) mapRoles(doc bson.D, key string) {
+	for _, e := range doc {
+		if e.Key != key {
+			continue
+		}
+		roles, _ := e.Value.(bson.A)
+		for _, role := range roles {
+			if role, ok := role.(bson.D); ok {
+				m.mapField(role, "db")
+			}
+		}
+	}
+}
+
+// 映射用户或角色文档：_id为<db>.<name>，db为所在的库，roles为授予的角色，privileges中的resource.db为权限涉及的库
+func (m *authzDbMapper) mapDoc(doc bson.D, nameKey string) bson.D {
+	var db, name string
+	for _, e := range doc {
+		switch e.Key {
+		case "db":
+			db, _ = e.Value.(string)
+		case nameKey:
+			name, _ = e.Value.(string)
+		}
+	}
+	dstDb := m.mapDb(db)
+	for i := range doc {
+		switch doc[i].Key {
+		case "_id":
+			doc[i].Value = dstDb + "." + name
+		case "db":
+			doc[i].Value = dstDb
+		case "privileges":
+			privileges, _ := doc[i].Value.(bson.A)
+			for _, privilege := range privileges {
+				privilege, _ := privilege.(bson.D)
+				for _, e := range privilege {
+					if resource, ok := e.Value.(bson.D); ok && e.Key == "resource" {
+						m.mapField(resource, "db")
+					}
+				}
+			}
+		}
+	}
+	m.mapRoles(doc, "roles")
+	return doc
+}
+
+// 读取源端admin库中的用户或角色
+func readAuthzDocs(srcMongo *MongoArgs, collName string, dbs []string) ([]bson.D, error) {
+	var docs []bson.D
+	err := doWithRetry(srcMongo.Context(), findTimeout, "find admin."+collName, func(ctx context.Context) error {
+		cur, err := srcMongo.Client().Database("admin").Collection(collName).Find(ctx, bson.D{{"db", bson.D{{"$in", dbs}}}})
+		if err != nil {
+			return err
+		}
+		docs = nil
+		return cur.All(ctx, &docs)
+	})
+	return docs, err
+}
+
+// 同步dbs中定义的用户和角色，mode为all时包括admin库中定义的
+func CustSyncUsers(srcMongo, dstMongo *MongoArgs, dbs []string, nsnsMap map[string]string, mode string) error {
+	mapper := &authzDbMapper{dbs: make(map[string]bool, len(dbs)), nsnsMap: nsnsMap}
+	sourceDbs := append([]string(nil), dbs...)
+	for _, db := range dbs {
+		mapper.dbs[db] = true
+	}
+	if mode == SyncUsersAll {
+		sourceDbs = append(sourceDbs, "admin")
+	}
+	users, err := readAuthzDocs(srcMongo, "system.users", sourceDbs)
+	if err != nil {
+		return fmt.Errorf("读取源端的用户失败，需要backup角色：%v", err)
+	}
+	roles, err := readAuthzDocs(srcMongo, "system.roles", sourceDbs)
+	if err != nil {
+		return fmt.Errorf("读取源端的角色失败，需要backup角色：%v", err)
+	}
+
+	var userDocs, roleDocs []interface{}
+	var names []string
+	for _, user := range users {
+		user = mapper.mapDoc(user, "user")
+		id := user.Map()["_id"]
+		// 不覆盖目标端同步任务使用的用户，避免修改其密码导致连接失败
+		if dstMongo.username != "" && id == dstAuthDb(dstMongo)+"."+dstMongo.username {
+			dstMongo.logger().Warn("跳过目标端同步任务使用的用户", zap.Any("user", id))
+			continue
+		}
+		userDocs = append(userDocs, user)
+		names = append(names, fmt.Sprint(id))
+	}
+	for _, role := range roles {
+		role = mapper.mapDoc(role, "role")
+		roleDocs = append(roleDocs, role)
+		names = append(names, fmt.Sprint(role.Map()["_id"]))
+	}
+	if len(userDocs) == 0 && len(roleDocs) == 0 {
+		dstMongo.logger().Info("源端同步的库中没有用户和自定义角色")
+		return nil
+	}
+
+	adminDb := dstMongo.Client().Database("admin")
+	dropTemp := func() {
+		for _, name := range []string{tempUsersColl, tempRolesColl} {
+			coll := adminDb.Collection(name)
+			doWithRetry(dstMongo.Context(), commandTimeout, "drop admin."+name, func(ctx context.Context) error {
+				return coll.Drop(ctx)
+			})
+		}
+	}
+	dropTemp()
+	defer dropTemp()
+	for name, docs := range map[string][]interface{}{tempUsersColl: userDocs, tempRolesColl: roleDocs} {
+		if len(docs) == 0 {
+			continue
+		}
+		coll := adminDb.Collection(name)
+		err := doWithRetry(dstMongo.Context(), writeTimeout, "insert admin."+name, func(ctx context.Context) error {
+			_, err := coll.InsertMany(ctx, docs)
+			if mongo.IsDuplicateKeyError(err) {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("写入目标端的临时集合admin.%s失败：%v", name, err)
+		}
+	}
+	cmd := bson.D{{"_mergeAuthzCollections", 1}, {"db", ""}, {"drop", false}}
+	if len(userDocs) > 0 {
+		cmd = append(cmd, bson.E{"tempUsersCollection", "admin." + tempUsersColl})
+	}
+	if len(roleDocs) > 0 {
+		cmd = append(cmd, bson.E{"tempRolesCollection", "admin." + tempRolesColl})
+	}
+	err = doWithRetry(dstMongo.Context(), commandTimeout, "_mergeAuthzCollections", func(ctx context.Context) error {
+		return adminDb.RunCommand(ctx, cmd).Err()
+	})
+	if err != nil {
+		return fmt.Errorf("合并用户和角色失败，需要目标端的restore角色：%v", err)
+	}
+	dstMongo.logger().Info("已同步用户和角色", zap.Int("userNum", len(userDocs)), zap.Int("roleNum", len(roleDocs)), zap.Strings("names", names))
+	return nil
+}
+
+// 目标端同步任务的用户所在的库
+func dstAuthDb(dstMongo *MongoArgs) string {
+	if dstMongo.authenticationDatabase == "" {
+		return "admin"
+	}
+	return dstMongo.authenticationDatabase
+}
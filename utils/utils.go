@@ -2,12 +2,16 @@ package utils
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"log"
+	"net"
+	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,16 +20,12 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/tag"
 )
 
-var (
-	logger *zap.Logger
-	ctx    = context.Background() // 永不超时
-)
-
-func init() {
-	logger = NewLogger()
-}
+// 创建输出到标准输出和./mongosync.log的logger，通过NewRuntime传给各组件
 func NewLogger() *zap.Logger {
 	cfg := zap.Config{
 		Level:       zap.NewAtomicLevelAt(zap.InfoLevel),
@@ -65,6 +65,37 @@ type MongoArgs struct {
 	username               string
 	password               string
 	authenticationDatabase string
+	authMechanism          string // 认证机制，为空时沿用SCRAM-SHA-1
+	awsSessionToken        string // MONGODB-AWS认证使用的临时会话token
+	gssapiServiceName      string // GSSAPI认证的服务名，默认为mongodb
+	gssapiServiceRealm     string // GSSAPI认证的服务所在的realm
+	readPreference         *readpref.ReadPref
+	writeConcern           *writeconcern.WriteConcern
+	compressors            []string      // 网络压缩算法，按优先级排列
+	proxy                  *url.URL      // SSH跳板机或SOCKS5代理，为nil时直接连接
+	hosts                  []string      // 种子节点列表（host:port），不为空时忽略host和port
+	replicaSet             string        // 副本集名称，为空时由驱动自动发现
+	connectTimeout         time.Duration // 建立连接的超时时间，为0时使用驱动默认值（30秒）
+	socketTimeout          time.Duration // 单次socket读写的超时时间，为0时不超时
+	heartbeatInterval      time.Duration // 服务端监控的心跳间隔，为0时使用驱动默认值（10秒）
+	keepAlive              time.Duration // TCP keepalive间隔，为0时使用默认值
+	retryReads             bool          // 驱动的可重试读，主从切换时驱动自动重试一次读操作
+	retryWrites            bool          // 驱动的可重试写，主从切换时驱动自动重试一次写操作，服务端保证不会重复执行
+	direct                 bool          // 直接连接指定的节点，不发现副本集的其他成员
+	tlsConfig              *tls.Config   // TLS配置，为nil时不使用TLS
+	conn                   *sharedClient
+}
+
+// MongoArgs共享的mongo.Client，同一个实例的所有操作复用同一个连接池
+type sharedClient struct {
+	sync.Mutex
+	client  *mongo.Client
+	info    *ServerInfo   // 服务端版本信息，首次调用ServerInfo()时获取
+	shards  []*Shard      // mongos对应的各个分片，首次调用CustGetShards()时获取
+	catalog *catalogCache // 库、集合列表的缓存，首次获取列表时创建
+
+	dialerLock sync.Mutex
+	dialer     proxyDialer // 使用代理时共享的拨号器
 }
 
 type OPLOG struct {
@@ -76,6 +107,10 @@ type OPLOG struct {
 	NS string              `bson:"ns"`
 	O2 interface{}         `bson:"o2"`
 	O  interface{}         `bson:"o"`
+
+	FromMigrate bool `bson:"fromMigrate,omitempty"` // 分片间chunk迁移产生的oplog，重放时跳过
+
+	truncate bson.D // $v:2的更新投影后需要在O之前执行的数组截短，见projectOplog
 }
 
 // MongoArgs的构造函数
@@ -87,9 +122,35 @@ func NewMongoArgs() *MongoArgs {
 		username:               "",
 		password:               "",
 		authenticationDatabase: "",
+		authMechanism:          "",
+		awsSessionToken:        "",
+		gssapiServiceName:      "",
+		gssapiServiceRealm:     "",
+		readPreference:         nil,
+		writeConcern:           nil,
+		compressors:            nil,
+		proxy:                  nil,
+		hosts:                  nil,
+		replicaSet:             "",
+		connectTimeout:         0,
+		socketTimeout:          0,
+		heartbeatInterval:      0,
+		keepAlive:              0,
+		retryReads:             true,
+		retryWrites:            true,
+		direct:                 false,
+		tlsConfig:              nil,
+		conn:                   &sharedClient{},
 	}
 }
 
+// 复制一份MongoArgs，用于同一个实例在不同阶段使用不同的参数（如写关注）。复制出的MongoArgs使用独立的连接
+func (mc *MongoArgs) Clone() *MongoArgs {
+	clone := *mc
+	clone.conn = &sharedClient{}
+	return &clone
+}
+
 // 设置上下文
 func (mc *MongoArgs) SetContext(ctx context.Context) *MongoArgs {
 	mc.ctx = ctx
@@ -108,6 +169,58 @@ func (mc *MongoArgs) SetPort(port int) *MongoArgs {
 	return mc
 }
 
+// 设置多个种子节点（host:port），设置后忽略SetHost、SetPort的值。
+// 驱动从任意一个可用的种子节点发现整个副本集，长时间同步过程中某个节点宕机也不影响连接
+func (mc *MongoArgs) SetHosts(hosts []string) *MongoArgs {
+	mc.hosts = hosts
+	return mc
+}
+
+// 设置是否直接连接指定的节点（只能有一个节点），用于读取从节点或隐藏节点
+func (mc *MongoArgs) SetDirect(direct bool) *MongoArgs {
+	mc.direct = direct
+	return mc
+}
+
+// 设置副本集名称，驱动只连接属于该副本集的节点
+func (mc *MongoArgs) SetReplicaSet(replicaSet string) *MongoArgs {
+	mc.replicaSet = replicaSet
+	return mc
+}
+
+// 解析逗号分隔的host列表，未指定端口的host使用defaultPort。
+// 只有一个host并且未指定端口时返回nil，沿用SetHost、SetPort
+func CustParseHosts(hosts string, defaultPort int) ([]string, error) {
+	list := strings.Split(hosts, ",")
+	if len(list) == 1 && !strings.Contains(hosts, ":") {
+		return nil, nil
+	}
+	var result []string
+	for _, host := range list {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			return nil, fmt.Errorf("host列表中存在空的host：%s", hosts)
+		}
+		if !strings.Contains(host, ":") {
+			host = net.JoinHostPort(host, strconv.Itoa(defaultPort))
+		} else if _, port, err := net.SplitHostPort(host); err != nil {
+			return nil, err
+		} else if _, err := strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("端口格式错误：%s", host)
+		}
+		result = append(result, host)
+	}
+	return result, nil
+}
+
+// 连接使用的URI
+func (mc *MongoArgs) uri() string {
+	if len(mc.hosts) > 0 {
+		return "mongodb://" + strings.Join(mc.hosts, ",")
+	}
+	return fmt.Sprintf("mongodb://%s:%d", mc.host, mc.port)
+}
+
 // 设置认证用户名
 func (mc *MongoArgs) SetUsername(username string) *MongoArgs {
 	mc.username = username
@@ -126,7 +239,239 @@ func (mc *MongoArgs) SetAuthenticationDatabase(authdb string) *MongoArgs {
 	return mc
 }
 
-//创建一个数据库连接，返回一个mongo.Client对象的指针
+// 设置认证机制，如：SCRAM-SHA-1、SCRAM-SHA-256、MONGODB-AWS、GSSAPI、PLAIN
+func (mc *MongoArgs) SetAuthMechanism(mechanism string) *MongoArgs {
+	mc.authMechanism = strings.ToUpper(mechanism)
+	return mc
+}
+
+// 设置MONGODB-AWS认证的会话token（使用STS临时凭证时需要）
+func (mc *MongoArgs) SetAwsSessionToken(token string) *MongoArgs {
+	mc.awsSessionToken = token
+	return mc
+}
+
+// 设置GSSAPI(Kerberos)认证的服务名和realm，服务名为空时使用默认的mongodb
+func (mc *MongoArgs) SetGssapiService(serviceName, serviceRealm string) *MongoArgs {
+	mc.gssapiServiceName = serviceName
+	mc.gssapiServiceRealm = serviceRealm
+	return mc
+}
+
+// 设置读偏好，为nil时使用驱动默认的primary。全量同步的查询和oplog的读取都使用该读偏好
+func (mc *MongoArgs) SetReadPreference(readPreference *readpref.ReadPref) *MongoArgs {
+	mc.readPreference = readPreference
+	return mc
+}
+
+// 解析读偏好参数。mode为空时返回nil；tags格式为"k1:v1,k2:v2;k3:v3"，分号分隔多个tag set，按顺序匹配
+func CustParseReadPreference(mode string, tags string) (*readpref.ReadPref, error) {
+	if mode == "" {
+		if tags != "" {
+			return nil, errors.New("指定tag时必须同时指定读偏好模式")
+		}
+		return nil, nil
+	}
+	readMode, err := readpref.ModeFromString(mode)
+	if err != nil {
+		return nil, err
+	}
+	var opts []readpref.Option
+	if tags != "" {
+		var tagSets []map[string]string
+		for _, tagSet := range strings.Split(tags, ";") {
+			tagMap := make(map[string]string)
+			for _, kv := range strings.Split(tagSet, ",") {
+				pair := strings.SplitN(kv, ":", 2)
+				if len(pair) != 2 || pair[0] == "" {
+					return nil, fmt.Errorf("读偏好tag格式错误：%s", kv)
+				}
+				tagMap[pair[0]] = pair[1]
+			}
+			tagSets = append(tagSets, tagMap)
+		}
+		opts = append(opts, readpref.WithTagSets(tag.NewTagSetsFromMaps(tagSets)...))
+	}
+	return readpref.New(readMode, opts...)
+}
+
+// 设置写关注，为nil时使用驱动默认的写关注。所有写入该实例的操作都使用该写关注
+func (mc *MongoArgs) SetWriteConcern(writeConcern *writeconcern.WriteConcern) *MongoArgs {
+	mc.writeConcern = writeConcern
+	return mc
+}
+
+// 解析写关注参数，为空时返回nil。格式为"w:<number|majority|tag>,j:<true|false>,wtimeout:<毫秒>"，各项均可省略
+func CustParseWriteConcern(concern string) (*writeconcern.WriteConcern, error) {
+	if concern == "" {
+		return nil, nil
+	}
+	var opts []writeconcern.Option
+	for _, kv := range strings.Split(concern, ",") {
+		pair := strings.SplitN(kv, ":", 2)
+		if len(pair) != 2 || pair[1] == "" {
+			return nil, fmt.Errorf("写关注格式错误：%s", kv)
+		}
+		switch pair[0] {
+		case "w":
+			if pair[1] == "majority" {
+				opts = append(opts, writeconcern.WMajority())
+			} else if w, err := strconv.Atoi(pair[1]); err == nil {
+				opts = append(opts, writeconcern.W(w))
+			} else {
+				opts = append(opts, writeconcern.WTagSet(pair[1]))
+			}
+		case "j":
+			j, err := strconv.ParseBool(pair[1])
+			if err != nil {
+				return nil, fmt.Errorf("写关注j的值错误：%s", pair[1])
+			}
+			opts = append(opts, writeconcern.J(j))
+		case "wtimeout":
+			ms, err := strconv.Atoi(pair[1])
+			if err != nil {
+				return nil, fmt.Errorf("写关注wtimeout的值错误：%s", pair[1])
+			}
+			opts = append(opts, writeconcern.WTimeout(time.Duration(ms)*time.Millisecond))
+		default:
+			return nil, fmt.Errorf("未知的写关注参数：%s", pair[0])
+		}
+	}
+	return writeconcern.New(opts...), nil
+}
+
+// 设置网络压缩算法，可选值：snappy、zlib、zstd，按优先级排列，由服务端选择第一个支持的算法
+func (mc *MongoArgs) SetCompressors(compressors []string) *MongoArgs {
+	mc.compressors = compressors
+	return mc
+}
+
+// 设置连接的超时时间、socket读写超时时间、心跳间隔和TCP keepalive间隔，为0的项使用默认值。
+// 经过不稳定的网络（如VPN）长时间读取oplog时，可以调小keepalive和心跳间隔，及早发现并重建断开的连接
+func (mc *MongoArgs) SetSocketOptions(connectTimeout, socketTimeout, heartbeatInterval, keepAlive time.Duration) *MongoArgs {
+	mc.connectTimeout = connectTimeout
+	mc.socketTimeout = socketTimeout
+	mc.heartbeatInterval = heartbeatInterval
+	mc.keepAlive = keepAlive
+	return mc
+}
+
+// 设置是否启用驱动的可重试读、可重试写（默认都启用）。驱动重试一次仍然失败时，再按SetRetry的参数由mongosync重试
+func (mc *MongoArgs) SetRetryable(retryReads, retryWrites bool) *MongoArgs {
+	mc.retryReads = retryReads
+	mc.retryWrites = retryWrites
+	return mc
+}
+
+// 解析网络压缩算法参数，格式为"snappy,zlib,zstd"，为空时返回nil
+func CustParseCompressors(compressors string) ([]string, error) {
+	if compressors == "" {
+		return nil, nil
+	}
+	var result []string
+	for _, compressor := range strings.Split(compressors, ",") {
+		compressor = strings.ToLower(strings.TrimSpace(compressor))
+		switch compressor {
+		case "snappy", "zlib", "zstd":
+			result = append(result, compressor)
+		default:
+			return nil, fmt.Errorf("不支持的网络压缩算法：%s", compressor)
+		}
+	}
+	return result, nil
+}
+
+// 根据认证机制生成认证参数，第二个返回值表示是否需要认证
+func (mc *MongoArgs) credential() (options.Credential, bool) {
+	switch mc.authMechanism {
+	case "MONGODB-AWS":
+		// username/password对应AWS的access key id/secret access key。
+		// 两者都为空时，由驱动从环境变量、ECS或EC2实例角色中获取凭证
+		cred := options.Credential{
+			AuthMechanism: "MONGODB-AWS",
+			AuthSource:    "$external",
+			Username:      mc.username,
+			Password:      mc.password,
+		}
+		if mc.awsSessionToken != "" {
+			cred.AuthMechanismProperties = map[string]string{"AWS_SESSION_TOKEN": mc.awsSessionToken}
+		}
+		return cred, true
+	case "GSSAPI":
+		// username为Kerberos principal；password可选，为空时使用票据缓存或KRB5_CLIENT_KTNAME指定的keytab
+		cred := options.Credential{
+			AuthMechanism: "GSSAPI",
+			AuthSource:    "$external",
+			Username:      mc.username,
+			Password:      mc.password,
+			PasswordSet:   mc.password != "",
+		}
+		props := map[string]string{}
+		if mc.gssapiServiceName != "" {
+			props["SERVICE_NAME"] = mc.gssapiServiceName
+		}
+		if mc.gssapiServiceRealm != "" {
+			props["SERVICE_REALM"] = mc.gssapiServiceRealm
+		}
+		if len(props) > 0 {
+			cred.AuthMechanismProperties = props
+		}
+		return cred, true
+	case "MONGODB-X509":
+		// 使用TLS客户端证书认证，需要同时指定客户端证书。username为证书的subject，为空时由服务端从证书中获取（3.4+）
+		return options.Credential{
+			AuthMechanism: "MONGODB-X509",
+			AuthSource:    "$external",
+			Username:      mc.username}, true
+	case "PLAIN":
+		// LDAP代理认证，认证库固定为$external
+		if mc.username == "" || mc.password == "" {
+			return options.Credential{}, false
+		}
+		return options.Credential{
+			AuthMechanism: "PLAIN",
+			AuthSource:    "$external",
+			Username:      mc.username,
+			Password:      mc.password}, true
+	default:
+		if mc.username == "" || mc.password == "" || mc.authenticationDatabase == "" {
+			return options.Credential{}, false
+		}
+		mechanism := mc.authMechanism
+		if mechanism == "" {
+			mechanism = "SCRAM-SHA-1"
+		}
+		return options.Credential{
+			AuthMechanism: mechanism,
+			AuthSource:    mc.authenticationDatabase,
+			Username:      mc.username,
+			Password:      mc.password}, true
+	}
+}
+
+// 获取该实例共享的mongo.Client，首次调用时建立连接。建立连接后再修改MongoArgs的参数不会生效
+func (mc *MongoArgs) Client() *mongo.Client {
+	mc.conn.Lock()
+	defer mc.conn.Unlock()
+	if mc.conn.client == nil {
+		mc.conn.client = mc.Connect()
+	}
+	return mc.conn.client
+}
+
+// 断开共享的连接
+func (mc *MongoArgs) Close() {
+	mc.conn.Lock()
+	defer mc.conn.Unlock()
+	if mc.conn.client != nil {
+		mc.conn.client.Disconnect(mc.ctx)
+		mc.conn.client = nil
+	}
+	mc.closeShards()
+	mc.closeProxyDialer()
+}
+
+//创建一个新的数据库连接，返回一个mongo.Client对象的指针。一般情况下应该使用Client()复用共享的连接
 func (mc *MongoArgs) Connect() *mongo.Client {
 	// 设置ctx的默认值
 	if mc.ctx == nil {
@@ -142,41 +487,99 @@ func (mc *MongoArgs) Connect() *mongo.Client {
 	}
 	//认证参数设置，否则连不上
 	opts := &options.ClientOptions{}
-	opts.ApplyURI(fmt.Sprintf("mongodb://%s:%d", mc.host, mc.port))
-	if mc.username != "" && mc.password != "" && mc.authenticationDatabase != "" {
-		opts.SetAuth(options.Credential{
-			AuthMechanism: "SCRAM-SHA-1",
-			AuthSource:    mc.authenticationDatabase,
-			Username:      mc.username,
-			Password:      mc.password})
+	opts.ApplyURI(mc.uri())
+	if mc.replicaSet != "" {
+		opts.SetReplicaSet(mc.replicaSet)
+	}
+	if mc.direct {
+		opts.SetDirect(true)
+	}
+	if cred, ok := mc.credential(); ok {
+		opts.SetAuth(cred)
+	}
+	if mc.readPreference != nil {
+		opts.SetReadPreference(mc.readPreference)
+	}
+	if mc.writeConcern != nil {
+		opts.SetWriteConcern(mc.writeConcern)
+	}
+	if len(mc.compressors) > 0 {
+		opts.SetCompressors(mc.compressors)
+	}
+	if mc.connectTimeout > 0 {
+		opts.SetConnectTimeout(mc.connectTimeout)
+	}
+	if mc.socketTimeout > 0 {
+		opts.SetSocketTimeout(mc.socketTimeout)
+	}
+	if mc.heartbeatInterval > 0 {
+		opts.SetHeartbeatInterval(mc.heartbeatInterval)
+	}
+	if mc.tlsConfig != nil {
+		opts.SetTLSConfig(mc.tlsConfig)
+	}
+	opts.SetRetryReads(mc.retryReads)
+	opts.SetRetryWrites(mc.retryWrites)
+	if mc.proxy != nil {
+		dialer, err := mc.proxyDialer()
+		if err != nil {
+			log.Fatal(mc.proxy.Redacted(), "创建代理连接失败：", err)
+		}
+		opts.SetDialer(dialer)
+	} else if mc.keepAlive > 0 {
+		opts.SetDialer(&net.Dialer{KeepAlive: mc.keepAlive})
 	}
 	conn, err := mongo.Connect(mc.ctx, opts)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("mongodb://%s:%d", mc.host, mc.port), "连接MongoDB失败：", err)
+		log.Fatal(mc.uri(), "连接MongoDB失败：", err)
 	}
 	return conn
 }
 
 func CustSyncIndex(srcMongo *MongoArgs, srcDbName string, srcCollName string, dstMongo *MongoArgs, dstDbName string, dstCollName string) {
+	dstColl := dstMongo.Client().Database(dstDbName).Collection(dstCollName)
+	for _, indexmodel := range srcIndexModels(srcMongo, srcDbName, srcCollName, dstMongo, dstDbName, dstCollName) {
+		// TODO: 使用bulk 批量顺序写入，对于批量写入失败的，再使用单条写入
+		err := doWithRetry(dstMongo.Context(), commandTimeout, "createIndex", func(ctx context.Context) error {
+			_, err := dstColl.Indexes().CreateOne(ctx, indexmodel)
+			return err
+		})
+		if err != nil {
+			log.Fatalf("db[%s].coll[%s]索引[%s]添加失败：%v\n", dstDbName, dstCollName, *(indexmodel.Options.Name), err)
+		}
+	}
+}
+
+// 读取源集合的索引，按目标端的版本转换为目标集合的索引（不包括聚簇索引）
+func srcIndexModels(srcMongo *MongoArgs, srcDbName string, srcCollName string, dstMongo *MongoArgs, dstDbName string, dstCollName string) []mongo.IndexModel {
 	// 查看索引
-	srcClient := srcMongo.Connect()
-	defer srcClient.Disconnect(srcMongo.ctx)
+	srcClient := srcMongo.Client()
 	srcColl := srcClient.Database(srcDbName).Collection(srcCollName)
-	// ctx:=srcMongo.ctx
-	//ctx, _ := context.WithTimeout(context.Background(), 30*time.Second)
-	cur, err := srcColl.Indexes().List(ctx) // 查看所有的索引
+	dstNs := dstDbName + "." + dstCollName
+	// 目标端版本较低时跳过不支持的索引选项
+	dstInfo, err := dstMongo.ServerInfo()
+	if err != nil {
+		srcMongo.logger().Warn("获取目标端版本失败，不检查索引选项的兼容性", zap.Error(err))
+	}
+	listCtx, cancel := withTimeout(srcMongo.Context(), commandTimeout)
+	defer cancel()
+	cur, err := srcColl.Indexes().List(listCtx) // 查看所有的索引
 	if err != nil {
 		log.Fatal("查看索引失败：", err)
 	}
-	defer cur.Close(ctx)
-	// 遍历索引，处理索引，插入索引
-	for cur.Next(ctx) {
-		// TODO: 使用bulk 批量顺序写入，对于批量写入失败的，再使用单条写入
+	defer cur.Close(context.Background())
+	// 遍历索引，处理索引
+	var models []mongo.IndexModel
+	for cur.Next(listCtx) {
 		var indexresult bson.M
 		err := cur.Decode(&indexresult)
 		if err != nil {
 			log.Fatal(err)
 		}
+		// 聚簇集合的聚簇索引在创建集合时已经指定，不能通过createIndexes创建
+		if value, exists := indexresult["clustered"]; exists && value == true {
+			continue
+		}
 
 		indexopt := options.Index()
 		//通过在创建索引时加 background:true 的选项，让创建工作在后台执行。
@@ -194,9 +597,18 @@ func CustSyncIndex(srcMongo *MongoArgs, srcDbName string, srcCollName string, ds
 		if value, exists := indexresult["expireAfterSeconds"]; exists {
 			indexopt.SetExpireAfterSeconds(value.(int32)) // TTL indexes
 		}
-		if value, exists := indexresult["partialFilterExpression"]; exists {
+		if value, exists := indexresult["partialFilterExpression"]; exists && indexOptionSupported(dstMongo.Context(), dstInfo, "partialFilterExpression", dstNs, *indexopt.Name) {
 			indexopt.SetPartialFilterExpression(value) // 部分索引
 		}
+		if value, exists := indexresult["collation"]; exists && indexOptionSupported(dstMongo.Context(), dstInfo, "collation", dstNs, *indexopt.Name) {
+			indexopt.SetCollation(collationFromDoc(value.(bson.M))) // 排序规则
+		}
+		if value, exists := indexresult["wildcardProjection"]; exists && indexOptionSupported(dstMongo.Context(), dstInfo, "wildcardProjection", dstNs, *indexopt.Name) {
+			indexopt.SetWildcardProjection(value) // 通配符索引
+		}
+		if value, exists := indexresult["hidden"]; exists && indexOptionSupported(dstMongo.Context(), dstInfo, "hidden", dstNs, *indexopt.Name) {
+			indexopt.SetHidden(value.(bool)) // 隐藏索引
+		}
 
 		// Changed in version 3.0: The dropDups option is no longer available.
 		// 在建立唯一索引时是否删除重复记录,指定 true 创建唯一索引。默认值为 false.
@@ -217,192 +629,484 @@ func CustSyncIndex(srcMongo *MongoArgs, srcDbName string, srcCollName string, ds
 		if value, exists := indexresult["language_override"]; exists {
 			indexopt.SetLanguageOverride(value.(string))
 		}
-		indexmodel := mongo.IndexModel{}
+		indexmodel := mongo.IndexModel{Options: indexopt}
 		if value, exists := indexresult["key"]; exists {
 			indexmodel.Keys = value
-			indexmodel.Options = indexopt
 		}
-		//ctx, _ = context.WithTimeout(context.Background(), 30*time.Second)
-		dstClient := dstMongo.Connect()
-		defer dstClient.Disconnect(dstMongo.ctx)
-		dstColl := dstClient.Database(dstDbName).Collection(dstCollName)
-		_, err = dstColl.Indexes().CreateOne(ctx, indexmodel)
-		if err != nil {
-			log.Fatalf("db[%s].coll[%s]索引[%s]添加失败：%v\n", dstDbName, dstCollName, *(indexopt.Name), err)
+		models = append(models, indexmodel)
+	}
+	if err := cur.Err(); err != nil {
+		log.Fatal("查看索引失败：", err)
+	}
+	return models
+}
+
+// 全量复制时每批写入目标端的文档条数和BSON总大小上限，任一达到上限即写入一批
+var (
+	copyBatchDocs  = 10000
+	copyBatchBytes = int64(64 * 1024 * 1024) // <=0表示不限制
+)
+
+// 设置全量复制每批写入的文档条数和BSON总字节数上限
+func SetCopyBatch(docs int, bytes int64) {
+	if docs > 0 {
+		copyBatchDocs = docs
+	}
+	copyBatchBytes = bytes
+}
+
+// 按$natural顺序读取时，记录一个已读取的_id占用的内存（不含_id本身），用于计入内存预算
+const seenEntrySize = 48
+
+// 按_id顺序复制范围r内的文档，返回写入的文档数。每批写入后通过tracker记录复制进度，r.lastId不为空时从r.lastId之后继续复制。
+// strategy为natural时按$natural顺序读取整个集合并按_id去重，忽略r的范围
+func copyIdRange(srcMongo, dstMongo *MongoArgs, srcColl, dstColl *mongo.Collection, r idRange, clustered bool, strategy string, policy ConflictPolicy, sizes *DocSizeHistogram, tracker *copyTracker) int64 {
+	//创建findoptions参数
+	// 使用_id索引按_id顺序读取（取代已经移除的snapshot选项），网络断开或源端重启后从最后读取的_id处重新打开游标
+	natural := strategy == ReadStrategyNatural
+	findOpts := limitCursorBatch(options.Find())
+	findOpts.SetCursorType(options.NonTailable)
+	if natural {
+		findOpts.SetHint(bson.D{{"$natural", 1}})
+	} else {
+		if !clustered {
+			findOpts.SetHint(bson.D{{"_id", 1}})
+		}
+		findOpts.SetSort(bson.D{{"_id", 1}})
+	}
+	findOpts.SetNoCursorTimeout(true)
+	if p := projectionFor(srcColl.Database().Name() + "." + srcColl.Name()); p != nil {
+		findOpts.SetProjection(p.spec)
+	}
+	if r.min.Type != 0 && !natural {
+		findOpts.SetMin(bson.D{{"_id", r.min}})
+	}
+	if r.max.Type != 0 && !natural {
+		findOpts.SetMax(bson.D{{"_id", r.max}})
+	}
+	ns := srcColl.Database().Name() + "." + srcColl.Name()
+	filter := withNsFilter(ns, bson.M{}) // 指定了该ns的过滤条件时只复制满足条件的文档
+	batchDocs, batchLimit := copyBatchFor(ns)
+	readLimiter, writeLimiter := srcReadLimiterFor(ns), dstWriteLimiterFor(ns)
+	lastId := r.lastId // 最后读取的文档的_id
+	// 按$natural顺序读取时，文档移动后可能被读到两次，按_id去重；游标中断后从头重新扫描。
+	// 已读取的_id在复制完成前一直保存在内存中，占用的内存计入全量复制的内存预算
+	var seen map[string]struct{}
+	var seenMemory int64
+	if natural {
+		seen = make(map[string]struct{})
+		lastId = bson.RawValue{}
+		defer func() { copyMemory.unreserve(seenMemory) }()
+		if copyMemory.limit <= 0 {
+			opCtx, cancel := withTimeout(srcMongo.Context(), commandTimeout)
+			count, err := srcColl.EstimatedDocumentCount(opCtx)
+			cancel()
+			if err == nil {
+				srcMongo.logger().Warn("按$natural顺序读取时在内存中记录所有已读取的_id，未限制内存，可以使用--max_memory_mb限制", zap.String("NS", ns), zap.Int64("count", count), zap.Int64("expectedMB", count*(seenEntrySize+16)>>20))
+			}
+		}
+	}
+	// 从lastId（包括lastId）开始读取
+	seekLastId := func() {
+		if natural {
+			return
+		}
+		if lastId.Type != 0 && clustered {
+			// 聚簇集合没有单独的_id索引，不能使用min()，通过_id范围过滤（按聚簇键有序扫描）。
+			// 与min()不同，$gte只匹配与lastId类型相同的_id，聚簇集合的_id一般为同一类型（如ObjectId、时间）
+			filter = withNsFilter(ns, bson.M{"_id": bson.M{"$gte": lastId}})
+		} else if lastId.Type != 0 {
+			findOpts.SetMin(bson.D{{"_id", lastId}})
+		}
+	}
+	seekLastId()
+	srcCtx := srcMongo.Context()
+	// snapshot方式下每次打开游标使用新的snapshot会话，游标读取会话第一次读取时的时间点的数据
+	var sess mongo.Session
+	defer func() {
+		if sess != nil {
+			sess.EndSession(context.Background())
+		}
+	}()
+	var cur *mongo.Cursor
+	// 因果一致的会话在整个范围内使用同一个，保证重新打开游标后读取的数据不回退（见causal.go）
+	openCursor := func() error {
+		for attempt := 1; ; attempt++ {
+			if sess == nil || strategy == ReadStrategySnapshot {
+				if sess != nil {
+					sess.EndSession(context.Background())
+				}
+				var err error
+				if sess, err = newCopySession(srcMongo, strategy); err != nil {
+					return err
+				}
+			}
+			err := doWithRetry(srcCtx, findTimeout, "find "+ns, func(ctx context.Context) error {
+				if sess != nil {
+					ctx = mongo.NewSessionContext(ctx, sess)
+				}
+				var err error
+				cur, err = srcColl.Find(ctx, filter, findOpts)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			// snapshot的时间点早于增量同步的起点（从落后的节点读取）时，等待后以新的时间点重新读取。
+			// 多次重试后仍然过早时关闭游标返回错误，不能从该snapshot复制，否则会丢失snapshot与起点之间的修改
+			if err = checkSnapshotTime(sess, strategy); err == nil {
+				return nil
+			}
+			cur.Close(context.Background())
+			if attempt >= staleSnapshotRetries {
+				return err
+			}
+			srcMongo.logger().Info("snapshot读取的时间点早于增量同步的起点，等待后重新读取", zap.String("NS", ns), zap.Error(err))
+			time.Sleep(time.Second)
 		}
 	}
+	if err := openCursor(); err != nil {
+		srcMongo.logger().Fatal("打开源集合游标失败", zap.String("NS", ns), zap.Error(err))
+	}
+	defer func() { cur.Close(context.Background()) }()
+
+	//处理cur，并插入。文档以bson.Raw原样写入目标端，不经过解码和重新编码
+	var docs []interface{}
+	var insertedNum, batchBytes, batchMemory int64
+
+	// 读取和写入并行：读取的一批文档交给写入协程，最多积压一批（低内存模式不积压），目标端写入跟不上时读取暂停
+	type copyBatch struct {
+		docs          []interface{}
+		bytes, memory int64
+		lastId        bson.RawValue
+	}
+	depth := 1
+	if lowMemory {
+		depth = 0
+	}
+	batches := make(chan copyBatch, depth)
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		for batch := range batches {
+			writeLimiter.wait(dstMongo.Context(), int64(len(batch.docs)), batch.bytes)
+			sucessNum, failNum := CustInsertMany(dstMongo.Context(), dstColl, batch.docs, policy)
+			copyMemory.release(batch.memory)
+			if failNum != 0 {
+				srcMongo.logger().Fatal("insert data err！")
+			}
+			insertedNum += sucessNum
+			tracker.batchDone(r, batch.lastId, sucessNum)
+		}
+	}()
+	flush := func() {
+		if len(docs) == 0 {
+			return
+		}
+		batches <- copyBatch{docs: docs, bytes: batchBytes, memory: batchMemory, lastId: lastId}
+		docs = []interface{}{}
+		batchBytes, batchMemory = 0, 0
+	}
+
+	for attempt := 1; ; attempt++ {
+		for cursorNext(srcCtx, cur, false) {
+			// 重新打开或继续复制的游标从lastId（包括lastId）开始，跳过已经读取过的lastId
+			id := cur.Current.Lookup("_id")
+			if natural {
+				key := string(id.Type) + string(id.Value)
+				if _, exists := seen[key]; exists {
+					continue
+				}
+				if n := int64(len(key)) + seenEntrySize; copyMemory.reserve(n) {
+					seenMemory += n
+				} else {
+					srcMongo.logger().Fatal("按$natural顺序读取时记录已读取的_id超过内存预算（--max_memory_mb或--low_memory的软内存上限的1/4），请增大--max_memory_mb，或者为集合创建_id索引后使用--read_strategy id",
+						zap.String("NS", ns), zap.Int("num", len(seen)), zap.Int64("memoryMB", seenMemory>>20))
+				}
+				seen[key] = struct{}{}
+			}
+			// 内存预算不足时先写入已经读取的文档，再等待写入完成释放预算
+			size := int64(len(cur.Current))
+			memory, ok := copyMemory.tryAcquire(size)
+			if !ok {
+				flush()
+				memory = copyMemory.acquire(size)
+			}
+			if !natural {
+				if lastId.Type != 0 && id.Equal(lastId) {
+					copyMemory.release(memory)
+					continue
+				}
+				lastId = bson.RawValue{Type: id.Type, Value: append([]byte(nil), id.Value...)}
+			}
+			attempt = 1
+			sizes.add(size)
+			addCopiedBytes(size)
+			readLimiter.wait(srcCtx, 1, size)
+			// cur.Current在读取下一条文档后失效，需要复制
+			doc := make(bson.Raw, len(cur.Current))
+			copy(doc, cur.Current)
+			docs = append(docs, doc)
+			batchBytes += size
+			batchMemory += memory
+			if len(docs) >= batchDocs || (batchLimit > 0 && batchBytes >= batchLimit) { // 批量插入，条数或BSON总大小达到上限时写入一批
+				flush()
+			}
+		}
+		err := cur.Err()
+		if err == nil {
+			break
+		}
+		cur.Close(context.Background())
+		if strategy == ReadStrategySnapshot && isSnapshotExpired(err) {
+			// 读取时间超过了快照时间窗口，从最后读取的_id处以新的时间点继续
+			srcMongo.logger().Info("snapshot读取超出快照时间窗口，以新的时间点继续读取", zap.String("NS", ns), zap.Error(err))
+		} else if !isRetryableError(srcCtx, err) || !retryWait(srcCtx, attempt, "读取"+ns, err) {
+			srcMongo.logger().Fatal("读取源集合失败", zap.String("NS", ns), zap.Error(err))
+		}
+		seekLastId()
+		if err := openCursor(); err != nil {
+			srcMongo.logger().Fatal("重新打开源集合游标失败", zap.String("NS", ns), zap.Error(err))
+		}
+		srcMongo.logger().Info("重新打开源集合游标", zap.String("NS", ns), zap.String("lastId", lastId.String()))
+	}
+	flush()
+	close(batches)
+	<-writeDone
+	tracker.rangeDone(r)
+	return insertedNum
 }
 
-func CustSyncCollection(srcMongo *MongoArgs, srcDbName string, srcCollName string, dstMongo *MongoArgs, dstDbName string, dstCollName string, updateOverwrite bool, noIndex bool) {
+func CustSyncCollection(srcMongo *MongoArgs, srcDbName string, srcCollName string, dstMongo *MongoArgs, dstDbName string, dstCollName string, policy ConflictPolicy, noIndex bool) {
 	start := time.Now()
-	// TODO: 处理网络断开，自动重连——比如dbserver重启后自动重连
+	nsmap := NsMap{SrcDb: srcDbName, SrcColl: srcCollName, DstDb: dstDbName, DstColl: dstCollName}
+	policy = conflictPolicyFor(srcDbName+"."+srcCollName, policy)
 
-	// 同步索引
+	// 继续未完成的任务时，跳过之前的运行中已经复制完成的集合
+	tracker := loadCopyTracker(srcMongo, dstMongo, nsmap)
+	if tracker.done() {
+		// 延后创建索引时，之前的运行可能在创建索引之前中断，仍然记录该集合的索引
+		if !noIndex && indexBuildMode == IndexBuildAfter {
+			syncOrDeferIndex(srcMongo, dstMongo, nsmap)
+		}
+		fmt.Printf("%s已在之前的运行中导入完成，跳过，导入数量：%v\n", srcDbName+"."+srcCollName, tracker.total)
+		notifyProgress(func(listener ProgressListener) { listener.OnCollectionStart(nsmap) })
+		notifyProgress(func(listener ProgressListener) { listener.OnCollectionDone(nsmap, 0, tracker.total, time.Since(start)) })
+		return
+	}
+
+	// 新开始复制的集合，按--drop_dst先删除或重命名目标集合
+	if !tracker.resumed {
+		if err := clearDstColl(dstMongo, dstDbName, dstCollName); err != nil {
+			dstMongo.logger().Fatal("全量同步前清理目标集合失败", zap.Error(err))
+		}
+	}
+	// 按源端集合的选项（固定集合、排序规则、校验规则、聚簇集合等）在目标端创建集合
+	clustered, capped := syncCollectionOptions(srcMongo, srcDbName, srcCollName, dstMongo, dstDbName, dstCollName)
+	// 目标端为分片集群时按源端的分片键分片，在写入文档之前完成
+	if !tracker.resumed {
+		if err := shardDstCollection(srcMongo, srcDbName, srcCollName, dstMongo, dstDbName, dstCollName); err != nil {
+			dstMongo.logger().Fatal("对目标集合分片失败", zap.Error(err))
+		}
+	}
+	// 同步索引，--index_build after时只记录源端的索引，全部集合复制完成后再创建
 	if !noIndex {
-		CustSyncIndex(srcMongo, srcDbName, srcCollName, dstMongo, dstDbName, dstCollName)
+		syncOrDeferIndex(srcMongo, dstMongo, nsmap)
 	}
+	CustRunHooks(HookPhaseAfterSchema, dstMongo, dstDbName, dstCollName)
+	notifyProgress(func(listener ProgressListener) { listener.OnCollectionStart(nsmap) })
+	// 从从节点读取时，等待复制延迟降低到--src_max_lag以内
+	waitFullSyncMemberLag(srcMongo.Context())
 	// 同步文档
 	// 连接src数据库
-	srcClient := srcMongo.Connect()
-	defer srcClient.Disconnect(srcMongo.ctx)
+	srcClient := srcMongo.Client()
 	srcColl := srcClient.Database(srcDbName).Collection(srcCollName)
 	// 连接dst数据库
-	dstClient := dstMongo.Connect()
-	defer dstClient.Disconnect(dstMongo.ctx)
+	dstClient := dstMongo.Client()
 	dstColl := dstClient.Database(dstDbName).Collection(dstCollName)
-	//ctx:=srcMongo.ctx
-	//ctx, _ := context.WithTimeout(context.Background(), 30*time.Second)
-	//创建findoptions参数
-	findOpts := options.Find()
-	findOpts.SetCursorType(options.NonTailable)
-	findOpts.SetSnapshot(true)
-	findOpts.SetNoCursorTimeout(true)
-	filter := bson.M{}
-	cur, err := srcColl.Find(ctx, filter, findOpts)
-	CheckErr(err)
-	defer cur.Close(ctx)
 
-	//处理cur，并插入
-	var doc interface{}
-	var docs []interface{}
-	var docNum, insertedNum int64
-
-	for cur.Next(ctx) {
-		err := cur.Decode(&doc)
-		// cur.Current // bson.Raw数据类型
-		// cur.Current.Lookup("key1", "key2") //判断是否含有某个键
-		// instock, err := cur.Current.LookupErr()
-		// instock.Value()
-		// instock.Array().Values()
+	// 复制前源端的文档数，复制完成后与目标端核对
+	srcBefore := countSrcBefore(srcMongo, srcColl)
+
+	// 增量补齐时只复制目标端缺少或内容不同的文档
+	if deltaMode != "" {
+		copiedNum, skippedNum, err := custSyncCollectionDelta(srcMongo.Context(), dstMongo.Context(), srcColl, dstColl)
 		if err != nil {
-			logger.Fatal(err.Error())
-		} else {
-			docNum++
-			docs = append(docs, doc)
-		}
-		if docNum%10000 == 0 { // 插入  ,此处可以控制批量插入的条数。可以设置1w/次
-			sucessNum, failNum := CustInsertMany(dstColl, docs, updateOverwrite)
-			if failNum != 0 {
-				logger.Fatal("insert data err！")
-			} else {
-				insertedNum += sucessNum
-				docs = []interface{}{}
-			}
+			dstMongo.logger().Fatal("增量补齐失败", zap.String("NS", srcDbName+"."+srcCollName), zap.Error(err))
 		}
+		duration := fmt.Sprintf("%.2f", time.Since(start).Seconds())
+		fmt.Printf("%s数据补齐完成，复制数量：%v，一致跳过数量：%v，耗时：%v秒\n", srcDbName+"."+srcCollName, copiedNum, skippedNum, duration)
+		notifyProgress(func(listener ProgressListener) {
+			listener.OnCollectionDone(nsmap, copiedNum, skippedNum, time.Since(start))
+		})
+		reconcileCounts(srcMongo, dstMongo, nsmap, srcColl, dstColl, srcBefore)
+		CustRunHooks(HookPhaseAfterCopy, dstMongo, dstDbName, dstCollName)
+		tracker.finish()
+		return
 	}
-	if len(docs) > 0 {
-		sucessNum, failNum := CustInsertMany(dstColl, docs, updateOverwrite)
-		if failNum != 0 {
-			logger.Fatal("insert data err！")
-		} else {
-			insertedNum += sucessNum
-			docs = []interface{}{}
+	// 启用chunk缓存时，跳过内容未发生变化的chunk
+	if chunkCacheEnabled {
+		copiedNum, skippedNum := custSyncCollectionByChunk(srcMongo.Context(), dstMongo.Context(), srcColl, dstColl)
+		duration := fmt.Sprintf("%.2f", time.Since(start).Seconds())
+		fmt.Printf("%s数据导入完成，导入数量：%v，未变化跳过数量：%v，耗时：%v秒\n", srcDbName+"."+srcCollName, copiedNum, skippedNum, duration)
+		notifyProgress(func(listener ProgressListener) {
+			listener.OnCollectionDone(nsmap, copiedNum, skippedNum, time.Since(start))
+		})
+		reconcileCounts(srcMongo, dstMongo, nsmap, srcColl, dstColl, srcBefore)
+		CustRunHooks(HookPhaseAfterCopy, dstMongo, dstDbName, dstCollName)
+		tracker.finish()
+		return
+	}
+	ns := srcDbName + "." + srcCollName
+	sizes := newDocSizeHistogram(ns)
+	var insertedNum int64
+	// 继续之前中断的复制时使用之前切分的_id范围，只复制未完成的范围
+	strategy := resolveReadStrategy(srcMongo, srcDbName, srcCollName, clustered)
+	ranges, resumed := tracker.pending()
+	if resumed && strategy == ReadStrategyNatural && len(ranges) != 1 {
+		// 按$natural顺序读取时不切分，重新复制整个集合
+		resumed = false
+	}
+	if !resumed {
+		ranges = nil
+		// 聚簇集合没有单独的_id索引，不能使用min()/max()，不切分；固定集合按_id顺序写入，避免并发写入打乱顺序；
+		// 按$natural顺序读取时无法按_id范围切分
+		if !clustered && !capped && strategy != ReadStrategyNatural {
+			ranges = splitIdRanges(srcMongo, srcColl)
 		}
+		if len(ranges) == 0 {
+			ranges = []idRange{{}}
+		}
+		tracker.start(ranges)
+	}
+	if len(ranges) > 1 {
+		// 大集合按_id范围切分后并发复制
+		insertedNum = copyIdRanges(srcMongo, dstMongo, srcColl, dstColl, ranges, strategy, policy, sizes, tracker)
+	} else if len(ranges) == 1 {
+		insertedNum = copyIdRange(srcMongo, dstMongo, srcColl, dstColl, ranges[0], clustered, strategy, policy, sizes, tracker)
 	}
+	mergeDocSizeHistogram(srcMongo.Context(), sizes)
 	end := time.Now()
 	duration := fmt.Sprintf("%.2f", end.Sub(start).Seconds())
 	fmt.Printf("%s数据导入完成，导入数量：%v，耗时：%v秒\n", srcDbName+"."+srcCollName, insertedNum, duration)
+	notifyProgress(func(listener ProgressListener) { listener.OnCollectionDone(nsmap, insertedNum, 0, end.Sub(start)) })
+	reconcileCounts(srcMongo, dstMongo, nsmap, srcColl, dstColl, srcBefore)
+	CustRunHooks(HookPhaseAfterCopy, dstMongo, dstDbName, dstCollName)
+	tracker.finish()
+}
+
+// 文档的_id，doc为bson.Raw或bson.D
+func docId(doc interface{}) interface{} {
+	switch d := doc.(type) {
+	case bson.Raw:
+		return d.Lookup("_id")
+	case bson.D:
+		return d.Map()["_id"]
+	}
+	return nil
 }
 
-// 对mongo.Collection对象进行批量插入，如果批量插入失败，则转换为逐条插入
-func CustInsertMany(coll *mongo.Collection, docs []interface{}, updateOverwrite bool) (sucessNum int64, failNum int64) {
+// 对mongo.Collection对象进行批量插入，如果批量插入失败，则以无序的BulkWrite只重新写入失败的文档。每次写入单独应用writeTimeout。
+// docs中的文档为bson.Raw或bson.D
+func CustInsertMany(ctx context.Context, coll *mongo.Collection, docs []interface{}, policy ConflictPolicy) (sucessNum int64, failNum int64) {
 	// 设置	InsertMany相关参数
-	//ctx, _ := context.WithTimeout(context.Background(), 30*time.Second)
 	insertManyOpts := options.InsertMany()
-	insertManyOpts.SetOrdered(true)                   // true:按docs顺序逐条插入，遇到错误，终止插入；  false：:按docs顺序逐条插入，遇到错误，跳过错误的记录，继续插入后面的记录
-	insertManyOpts.SetBypassDocumentValidation(false) //Mongodb提供了在插入和更新时验证文档的功能。就是一种约束条件
+	insertManyOpts.SetOrdered(insertOrdered)                     // true:按docs顺序逐条插入，遇到错误，终止插入；  false：:按docs顺序逐条插入，遇到错误，跳过错误的记录，继续插入后面的记录
+	insertManyOpts.SetBypassDocumentValidation(bypassValidation) //Mongodb提供了在插入和更新时验证文档的功能。就是一种约束条件
 
 	docsNum := int64(len(docs))
-	_, err := coll.InsertMany(context.Background(), docs, insertManyOpts) // insertManyResult无论是否插入成功，都会显示docs中所有的_id
-	if err != nil {
-		var docsChan = make(chan interface{}, 1000)
-		var lock sync.Mutex
-		// 生产者
-		go func(docsChan chan interface{}) {
-			for _, doc := range docs {
-				docsChan <- doc
-			}
-			close(docsChan)
-		}(docsChan)
-
-		// 业务
-		insertManyErrHandler := func(doc interface{}) {
-			if updateOverwrite { // 采用replaceOne方式，覆盖已经存在的_id记录
-				ReplaceOneOpts := options.Replace()
-				ReplaceOneOpts.SetBypassDocumentValidation(false) //Mongodb提供了在插入和更新时验证文档的功能。就是一种约束条件
-				ReplaceOneOpts.SetUpsert(true)                    // 如果未查询到，则新建
-				filter := bson.M{"_id": doc.(bson.D).Map()["_id"]}
-				replaceOne, err := coll.ReplaceOne(ctx, filter, doc, ReplaceOneOpts)
-				if err != nil { // ReplaceOne操作失败，failNum加1
-					lock.Lock()
+	// 目标端磁盘空间不足时等待
+	if err := waitForCapacity(ctx); err != nil {
+		loggerFrom(ctx).Error("等待目标端磁盘空间时中断", zap.String("NS", coll.Database().Name()+"."+coll.Name()), zap.Error(err))
+		return 0, docsNum
+	}
+	// 超过16MB的文档按--oversized_docs处理，超过48MB消息限制的批次切分为多次写入
+	batches, oversizedFailNum := splitInsertDocs(ctx, coll.Database().Name()+"."+coll.Name(), docs)
+	failNum = oversizedFailNum
+	for _, batch := range batches {
+		batchSucessNum, batchFailNum := insertManyBatch(ctx, coll, batch, insertManyOpts, policy)
+		sucessNum += batchSucessNum
+		failNum += batchFailNum
+	}
+	loggerFrom(ctx).Info("InsertMany批量插入数据", zap.String("NS", coll.Database().Name()+"."+coll.Name()), zap.Int64("docsNum", docsNum), zap.Int64("sucessNum", sucessNum), zap.Int64("failNum", failNum))
+	return sucessNum, failNum
+}
+
+// 以一次InsertMany写入一批文档，失败时以无序的BulkWrite只重新写入失败的文档
+func insertManyBatch(ctx context.Context, coll *mongo.Collection, docs []interface{}, insertManyOpts *options.InsertManyOptions, policy ConflictPolicy) (sucessNum int64, failNum int64) {
+	// 网络断开等可重试错误时重试InsertMany；重试前已经写入的文档会导致重复_id错误，由下面的BulkWrite视为已写入
+	err := doWithRetry(ctx, writeTimeout, "InsertMany", func(ctx context.Context) error {
+		_, err := coll.InsertMany(ctx, docs, insertManyOpts) // insertManyResult无论是否插入成功，都会显示docs中所有的_id
+		return err
+	})
+	if err == nil { // InsertMany批量插入成功
+		return int64(len(docs)), 0
+	}
+	// 批量插入失败（如部分_id已经存在）时，有序插入中出错文档之前的文档已经写入，其余文档以无序的BulkWrite按policy重新写入，
+	// 按每个文档的错误分类处理，只重试确实失败的文档
+	rest := docs
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && len(bulkErr.WriteErrors) > 0 {
+		if insertOrdered {
+			sucessNum = int64(bulkErr.WriteErrors[0].Index)
+			rest = docs[sucessNum:]
+		} else {
+			// 无序插入中没有出错的文档都已经写入，只重新写入重复_id和临时错误的文档，校验失败、超过16MB等错误重新写入也不会成功
+			sucessNum = int64(len(docs) - len(bulkErr.WriteErrors))
+			rest = nil
+			ns := coll.Database().Name() + "." + coll.Name()
+			for _, writeErr := range bulkErr.WriteErrors {
+				switch classifyWriteError(writeErr.Code) {
+				case WriteErrorDuplicateKey, WriteErrorTransient:
+					rest = append(rest, docs[writeErr.Index])
+				default:
 					failNum++
-					lock.Unlock()
-					logger.Error(err.Error(), zap.String("NS", coll.Database().Name()+"."+coll.Name()), zap.String("doc", fmt.Sprintf("%v", doc)))
-				} else {
-					lock.Lock()
-					sucessNum++
-					lock.Unlock()
-					logger.Debug("ReplaceOne操作成功", zap.String("NS", coll.Database().Name()+"."+coll.Name()), zap.String("UpsertedID", fmt.Sprintf("%v", replaceOne.UpsertedID)), zap.String("doc", fmt.Sprintf("%v", doc)))
-				}
-			} else { // 采用insertOne方式，忽略_id已经存在的记录，不做任何操作
-				insertOneOpts := options.InsertOne()
-				insertOneOpts.SetBypassDocumentValidation(true)
-				insertOneResult, err := coll.InsertOne(ctx, doc, insertOneOpts)
-				if err != nil {
-					if strings.Contains(err.Error(), "E11000 duplicate key error") { // 1、违反唯一约束错误，忽略错误
-						lock.Lock()
-						sucessNum++
-						lock.Unlock()
-						logger.Debug(err.Error(), zap.String("NS", coll.Database().Name()+"."+coll.Name()), zap.String("doc", fmt.Sprintf("%v", doc)))
-					} else { // 2、除唯一约束错误之外的其他错误
-						lock.Lock()
-						failNum++
-						lock.Unlock()
-						logger.Error(err.Error(), zap.String("NS", coll.Database().Name()+"."+coll.Name()), zap.String("doc", fmt.Sprintf("%v", doc)))
-					}
-				} else { // 3、没有错误
-					lock.Lock()
-					sucessNum++
-					lock.Unlock()
-					logger.Debug("InsertOne操作成功", zap.String("NS", coll.Database().Name()+"."+coll.Name()), zap.String("UpsertedID", fmt.Sprintf("%v", insertOneResult.InsertedID)), zap.String("doc", fmt.Sprintf("%v", doc)))
+					failWrite(ctx, ns, docs[writeErr.Index], writeErr.Code, writeErr)
 				}
 			}
 		}
+	}
+	batchSucessNum, batchFailNum := bulkWriteDocs(ctx, coll, rest, policy)
+	return sucessNum + batchSucessNum, failNum + batchFailNum
+}
 
-		// 消费者：
-		worker := func(wg *sync.WaitGroup) {
-			for doc := range docsChan { // channel是线程安全的，多个消费者可以同时操作channel
-				insertManyErrHandler(doc)
-			}
-			wg.Done()
+// 获取当前最新的oplog对应的timestamp：需要访问admin权限。
+// srcMongo为mongos时返回各个分片最新timestamp中最小的一个，从该位置开始重放各个分片的oplog不会遗漏。
+// change stream模式下返回$clusterTime，不需要admin权限
+func CustGetLatestOplogTimestamp(srcMongo *MongoArgs) (primitive.Timestamp, error) {
+	if changeStreamMode {
+		return latestClusterTime(srcMongo)
+	}
+	sources, err := custOplogSources(srcMongo)
+	if err != nil {
+		return primitive.Timestamp{}, err
+	}
+	var minTS primitive.Timestamp
+	for i, source := range sources {
+		ts, err := getLatestOplogTimestamp(source)
+		if err != nil {
+			return primitive.Timestamp{}, err
+		}
+		if i == 0 || primitive.CompareTimestamp(ts, minTS) < 0 {
+			minTS = ts
 		}
-
-		//WorkerPool
-		func(numOfWorkers int) {
-			var wg sync.WaitGroup
-			for i := 0; i < numOfWorkers; i++ {
-				wg.Add(1)
-				go worker(&wg)
-			}
-			wg.Wait()
-		}(500)
-	} else { // InsertMany批量插入成功
-		sucessNum = int64(docsNum)
 	}
-	logger.Info("InsertMany批量插入数据", zap.String("NS", coll.Database().Name()+"."+coll.Name()), zap.Int64("docsNum", docsNum), zap.Int64("sucessNum", sucessNum), zap.Int64("failNum", failNum))
-	return sucessNum, failNum
+	return minTS, nil
 }
 
-// 获取当前最新的oplog对应的timestamp：需要访问admin权限
-func CustGetLatestOplogTimestamp(srcMongo *MongoArgs) (primitive.Timestamp, error) {
+func getLatestOplogTimestamp(srcMongo *MongoArgs) (primitive.Timestamp, error) {
+	if srcMongo.OplogNamespace() == masterSlaveOplogNs {
+		return latestOplogTimestampByFind(srcMongo)
+	}
 	// TODO ：是否有访问admin库的权限
 	// 从3.2版本开始，oplog中的ts表示发生了变化：。
 	// Refer to https://docs.mongodb.com/manual/reference/command/replSetGetStatus/
-	srcClient := srcMongo.Connect()
-	defer srcClient.Disconnect(srcMongo.ctx)
+	srcClient := srcMongo.Client()
 
 	var res bson.M
-	err := srcClient.Database("admin").RunCommand(context.Background(), bson.D{{"replSetGetStatus", 1}}).Decode(&res)
+	err := doWithRetry(srcMongo.Context(), commandTimeout, "replSetGetStatus", func(ctx context.Context) error {
+		return srcClient.Database("admin").RunCommand(ctx, bson.D{{"replSetGetStatus", 1}}).Decode(&res)
+	})
 	if err != nil {
 		return primitive.Timestamp{}, err
 	}
@@ -423,41 +1127,98 @@ func CustGetLatestOplogTimestamp(srcMongo *MongoArgs) (primitive.Timestamp, erro
 // srcOplogNamespace表示oplog存放的collection，如果为空字符串，则表示使用默认的"local.oplog.rs"
 // nsSlice表示仅对这些ns进行oplog replay；
 // nsnsMap 表示对这里面的ns进行名称空间映射；
-func CustReplayOplog(srcMongo, dstMongo *MongoArgs, startTS, endTS primitive.Timestamp, srcOplogNamespace string, nsSlice []string, nsnsMap map[string]string) {
-	var err error
+// srcMongo为mongos并且oplog来自local.oplog.rs时，并发重放各个分片的oplog。
+// 需要的oplog已经被覆盖时返回ErrOplogRolledOver（类型为*OplogRolledOverError）
+func CustReplayOplog(srcMongo, dstMongo *MongoArgs, startTS, endTS primitive.Timestamp, srcOplogNamespace string, nsSlice []string, nsnsMap map[string]string) error {
+	// 后台预热目标端的索引缓存
+	var dstNsSlice []string
+	for _, ns := range nsSlice {
+		nsStruct := CustFilter(ns, nsnsMap)
+		dstNsSlice = append(dstNsSlice, nsStruct.DstDb+"."+nsStruct.DstColl)
+	}
+	warmIndexCache(dstMongo, dstNsSlice)
+	checkReplayHints(dstMongo)
+
 	//oplog来源集合，srcOplogNsSlice格式为：[local,oplog.rs]
-	if srcOplogNamespace == "" {
-		srcOplogNamespace = "local.oplog.rs"
+	// change stream模式下通过change stream读取变更
+	if changeStreamMode && (srcOplogNamespace == "" || srcOplogNamespace == replSetOplogNs) {
+		CustWatchChangeStream(srcMongo, dstMongo, startTS, endTS, nsSlice, nsnsMap)
+		return nil
+	}
+	// 主从复制的主节点使用local.oplog.$main
+	if srcOplogNamespace == "" || srcOplogNamespace == replSetOplogNs {
+		srcOplogNamespace = srcMongo.OplogNamespace()
+	}
+	if srcOplogNamespace != replSetOplogNs || !srcMongo.IsMongos() {
+		return replayOplog(srcMongo, dstMongo, startTS, endTS, srcOplogNamespace, nsSlice, nsnsMap, true)
 	}
+	shards, err := CustGetShards(srcMongo)
+	if err != nil {
+		log.Fatalln("获取分片列表失败：", err)
+	}
+	// 同一个文档只会位于一个分片上（chunk迁移产生的oplog会被跳过），各个分片的oplog分别按顺序重放即可。
+	// 一个分片的oplog被覆盖时停止所有分片的重放
+	ctx, cancel := context.WithCancel(srcMongo.Context())
+	defer cancel()
+	var (
+		wg          sync.WaitGroup
+		once        sync.Once
+		rolloverErr error
+	)
+	for _, shard := range shards {
+		wg.Add(1)
+		go func(shard *Shard) {
+			defer wg.Done()
+			shardMongo := shard.Mongo.Clone().SetContext(ctx)
+			defer shardMongo.Close()
+			srcMongo.logger().Info("开始重放分片的oplog", zap.String("shard", shard.ID))
+			if err := replayOplog(shardMongo, dstMongo, startTS, endTS, srcOplogNamespace, nsSlice, nsnsMap, false); errors.Is(err, ErrOplogRolledOver) {
+				srcMongo.logger().Error("分片的oplog已经被覆盖，停止重放", zap.String("shard", shard.ID), zap.Error(err))
+				once.Do(func() { rolloverErr = err })
+				cancel()
+			}
+		}(shard)
+	}
+	wg.Wait()
+	return rolloverErr
+}
+
+// 重放srcMongo对应实例中srcOplogNamespace集合中的oplog。
+// exactStart为true时要求startTS对应的oplog存在；分片的startTS是各个分片中最小的timestamp，不一定对应某条oplog，
+// 此时只要求最早的oplog不晚于startTS。需要的oplog已经被覆盖时返回ErrOplogRolledOver，srcMongo的上下文被取消时返回其错误
+func replayOplog(srcMongo, dstMongo *MongoArgs, startTS, endTS primitive.Timestamp, srcOplogNamespace string, nsSlice []string, nsnsMap map[string]string, exactStart bool) error {
 	srcOplogNsSlice := strings.SplitN(srcOplogNamespace, ".", 2)
 	if len(srcOplogNsSlice) != 2 {
 		log.Fatalln("srcOplogNamespace默认oplog名称空间格式有误!")
 	}
 	// 连接src、dst数据库
-	srcClient := srcMongo.Connect()
-	defer srcClient.Disconnect(srcMongo.ctx)
-	dstClient := dstMongo.Connect()
-	defer dstClient.Disconnect(context.Background())
+	srcClient := srcMongo.Client()
+	dstClient := dstMongo.Client()
 
 	srcColl := srcClient.Database(srcOplogNsSlice[0]).Collection(srcOplogNsSlice[1])
-	// 验证startTS有效性，如果失效，直接退出。
-	var firstoplog bson.M
-	err = srcColl.FindOne(context.Background(), bson.M{"ts": bson.M{"$gte": startTS}}).Decode(&firstoplog)
-	if err != nil {
+	// --resume时从保存的重放进度继续，该位置的oplog一定存在
+	checkpoint := newReplayCheckpoint(srcMongo, dstMongo, srcOplogNamespace, startTS)
+	if ts, ok := checkpoint.resumeFrom(startTS); ok {
+		startTS, exactStart = ts, true
+	}
+	// 验证startTS有效性：由于固定集合的size太小或者全量备份时间太长，startTS指定的那条oplog记录可能已经被覆盖
+	if err := checkOplogRollover(srcMongo.Context(), srcColl, startTS, exactStart); errors.Is(err, ErrOplogRolledOver) {
+		return err
+	} else if err != nil {
 		log.Fatalln("验证startTS有效性时，查询失败：", err)
-	} else if !firstoplog["ts"].(primitive.Timestamp).Equal(startTS) {
-		log.Fatalf("由于固定集合%s的size太小或者全量备份时间太长，导致startTS指定的那条oplog记录已经被覆盖，终止oplog重放操作!请使用--sync_oplog参数重新进行同步操作，此时会将oplog记录到目标mongodb中的syncoplog.oplog.rs中，然后使用--replayoplog参数手动重放", srcOplogNamespace)
 	}
-	// Tailable游标只能用在固定集合上,如果oplog来源自local.oplog.rs，则使用Tailable，否则使用NonTailable
+	// Tailable游标只能用在固定集合上,如果oplog来源自local.oplog.rs或local.oplog.$main，则使用Tailable，否则使用NonTailable
 	// 判断endTS是否为空,如果为空，则或者从startTS开始的所有记录
 	var filter bson.D
-	findOpts := options.Find()
-	if srcOplogNamespace == "local.oplog.rs" {
+	findOpts := limitCursorBatch(options.Find())
+	tailable := isOplogNamespace(srcOplogNamespace)
+	if tailable {
 		findOpts.SetCursorType(options.TailableAwait) //Tailable游标只能用在固定集合上
 		findOpts.SetNoCursorTimeout(true)
 	} else {
 		findOpts.SetCursorType(options.NonTailable)
 		findOpts.SetNoCursorTimeout(true)
+		findOpts.SetSort(bson.D{{"ts", 1}}) // CustSyncOplog无序批量写入，需要按ts排序重放
 	}
 	if endTS.T == 0 && endTS.I == 0 {
 		filter = bson.D{{"ts", bson.D{{"$gte", startTS}}}}
@@ -465,128 +1226,305 @@ func CustReplayOplog(srcMongo, dstMongo *MongoArgs, startTS, endTS primitive.Tim
 		filter = bson.D{{"$and", bson.D{{"ts", bson.M{"$gte": startTS}}, {"ts", bson.M{"$lte": endTS}}}}}
 	}
 
-	// 判断 nsSlice中是否存在指定的 ns。
-	// 如果ns为db.$cmd类型的，只判断db部分，如果db存在指定列表中，则CustContainsNs为true。
-	CustContainsNs := func(oplogns string, nsSlice []string) bool {
-		// 如果CustReplayOplog指定nsSlice参数为空，则默认对所有ns的oplog进行重放
-		// if len(nsSlice) == 0 {
-		// 	return true
-		// }
-		for _, value := range nsSlice {
-			if oplogns == value {
-				return true
-			}
-			if strings.HasPrefix(value, strings.TrimSuffix(oplogns, "$cmd")) {
-				// 如果指定collection，重放c类型的oplog可能会报错:因为u操作对应的collection可能不存在
-				return true
-			}
-		}
-		return false
+	// 获取cursor。网络断开或源端重启导致游标中断时，从最后处理的oplog之后重新打开游标
+	srcCtx := srcMongo.Context()
+	var cur *mongo.Cursor
+	openCursor := func(filter bson.D) error {
+		return doWithRetry(srcCtx, findTimeout, "find "+srcOplogNamespace, func(ctx context.Context) error {
+			var err error
+			cur, err = srcColl.Find(ctx, filter, findOpts)
+			return err
+		})
 	}
-
-	// 获取cursor
-	cur, err := srcColl.Find(context.Background(), filter, findOpts)
-	if err != nil {
+	if err := openCursor(filter); err != nil {
 		log.Fatal(err)
 	}
-	defer cur.Close(context.Background())
+	defer func() { cur.Close(context.Background()) }()
+
+	// 实时重放时定期在源端写入心跳noop，保证空闲时重放进度也能推进
+	tailing := tailable && endTS.T == 0 && endTS.I == 0
+	if tailing {
+		stopHeartbeat := startOplogHeartbeat(srcMongo)
+		defer stopHeartbeat()
+	}
 
 	var (
-		oplog      OPLOG
-		oplogBsonD primitive.D
+		lastTS     primitive.Timestamp // 已处理的最新oplog的ts，包括noop和被过滤掉的oplog
+		appliedNum int64
+		lastReport = time.Now()
+		dstCtx     = dstMongo.Context()
+		lane       = newLowPriorityLane(dstCtx, dstClient) // 低优先级ns的后台通道，未设置时为nil
 	)
+	if lane != nil {
+		defer lane.close()
+	}
+	// 先重放本地缓冲区中遗留的oplog；指定结束位置时，退出前等待缓冲区重放完
+	startOfflineBuffer(dstMongo)
+	defer waitOfflineBuffer(dstMongo)
 	//var oplog_bsonD bson.D // TODO: bson.D格式的处理
-	for cur.Next(context.Background()) {
-		// 获取oplog记录
-		if err := cur.Err(); err != nil {
-			log.Fatal(err)
+	batch := newOplogBatch(dstMongo)
+	txns := newTxnBuffer(srcMongo.logger())
+	// 重放一条oplog：同一个集合连续的增删改批量执行，其他oplog逐条执行
+	replay := func(oplog OPLOG, raw bson.Raw) {
+		// 跳过chunk迁移产生的oplog，以及主从复制中声明数据库的"db"类型的oplog
+		if oplog.FromMigrate || oplog.OP == "db" {
+			return
 		}
-		err := cur.Decode(&oplog)
-		if err != nil {
-			log.Fatal(err)
+		dstDbName, dstCollName := CustGetOplogNs(oplog)
+		if !containsOplogNs(fmt.Sprintf("%s.%s", dstDbName, dstCollName), nsSlice) { // 仅对指定的ns相关的oplog进行重放
+			return
 		}
-		err = cur.Decode(&oplogBsonD)
-		if err != nil {
-			log.Fatal(err)
+		nsStruct := CustFilter(fmt.Sprintf("%s.%s", dstDbName, dstCollName), nsnsMap) //  对ns进行名称空间映射处理
+		oplog = mapDDLOplog(nsStruct, oplog, nsnsMap)
+		appliedNum++
+		dstWriteLimiter.wait(dstCtx, 1, int64(len(raw)))
+		if lane != nil && !offlineBufferActive() {
+			if oplog.OP == "c" {
+				// 命令可能影响低优先级ns（如drop、renameCollection），先等待后台通道执行完
+				batch.flush()
+				lane.wait()
+			} else if isLowPriorityNs(fmt.Sprintf("%s.%s", dstDbName, dstCollName)) {
+				lane.submit(nsStruct, oplog, append(bson.Raw(nil), raw...))
+				return
+			}
+		}
+		if batch.add(nsStruct, oplog, raw) {
+			return
+		}
+		batch.flush()
+		if err := applyOrBuffer(dstMongo, nsStruct, oplog); err != nil {
+			log.Println(fmt.Sprintf("oplog执行'%s'操作失败：", oplog.OP), err, "\toplog内容：", failedDocString(oplog.NS, raw))
+			notifyProgress(func(listener ProgressListener) { listener.OnError(oplog.NS, err) })
 		}
-		// 测试当前oplog是不是当前最新的oplog（新产生的oplog）。
-		// 只适用于固定集合local.oplog.rs。对于指定endTS的情况（不为空）无需进行判断
-		if srcOplogNamespace == "local.oplog.rs" && endTS.T == 0 && endTS.I == 0 {
-			currentTS, err := CustGetLatestOplogTimestamp(srcMongo)
+	}
+	for attempt := 1; ; attempt++ {
+		for ; cursorNext(srcCtx, cur, tailable); batch.flushIfDrained(cur) {
+			attempt = 1
+			// 获取oplog记录。每条oplog使用新的变量解码，避免沿用上一条oplog中的o2等字段
+			var oplog OPLOG
+			err := cur.Decode(&oplog)
 			if err != nil {
-				log.Println("获取当前最新的oplog对应的timestamp失败：", err)
-			} else if currentTS.Equal(oplog.TS) {
-				//} else if currentTS.Equal(oplog[0].Value.(primitive.Timestamp)) {
-				// 比较oplog中的timestamp和当前最新的timestamp是否相等
-				log.Println("正在实时重放当前最新生成的oplog，您可以\"ctrl+c\"手动终止程序!  当前oplog为:", oplogBsonD)
-			} else {
+				log.Fatal(err)
 			}
-		}
-
-		// oplog replay 逐条进行，TODO：使用bulk提高写入效率
-		dstDbName, dstCollName := CustGetOplogNs(oplog)
-		if CustContainsNs(fmt.Sprintf("%s.%s", dstDbName, dstCollName), nsSlice) { // 仅对指定的ns相关的oplog进行重放
-			nsStruct := CustFilter(fmt.Sprintf("%s.%s", dstDbName, dstCollName), nsnsMap) //  对ns进行名称空间映射处理
-			dstDb := dstClient.Database(nsStruct.DstDb)
-			dstColl := dstDb.Collection(nsStruct.DstColl)
-			switch oplog.OP {
-			case "i":
-				if _, exists := oplog.O.(bson.D).Map()["_id"]; exists {
-					ReplaceOneOpts := options.Replace()
-					ReplaceOneOpts.SetUpsert(true)
-					_, err := dstColl.ReplaceOne(context.Background(), bson.M{"_id": oplog.O.(bson.D).Map()["_id"]}, oplog.O, ReplaceOneOpts)
-					if err != nil {
-						log.Println("oplog执行'i'操作失败：", err, "\toplog内容：", oplogBsonD)
-					}
+			// 之前的oplog都已经执行，定期保存重放进度
+			if batch.empty() && txns.empty() {
+				checkpoint.advance(lastTS, lane, false)
+			}
+			// 任何oplog（包括noop）都会推进重放进度，定期输出进度和延迟。
+			// 只有实时重放local.oplog.rs时才计算延迟，对于指定endTS的情况（不为空）无需进行判断
+			lastTS = oplog.TS
+			if time.Since(lastReport) >= replayProgressInterval {
+				lastReport = time.Now()
+				if tailing {
+					reportReplayProgress(srcMongo, lastTS, appliedNum)
 				} else {
-					// 创建索引的oplog
-					indexopt := options.Index()
-					indexopt.SetName(oplog.O.(bson.D).Map()["name"].(string))
-					indexopt.SetBackground(true)
-
-					indexmodel := mongo.IndexModel{}
-					indexmodel.Keys = oplog.O.(bson.D).Map()["key"]
-					indexmodel.Options = indexopt
-					_, err := dstColl.Indexes().CreateOne(context.Background(), indexmodel)
-					if err != nil {
-						log.Println("oplog创建索引失败：", err, "\toplog内容：", oplogBsonD)
-					}
+					srcMongo.logger().Info("oplog重放进度", zap.Uint32("T", lastTS.T), zap.Uint32("I", lastTS.I), zap.Int64("appliedNum", appliedNum))
 				}
-			case "u":
-				if _, exists := oplog.O.(bson.D).Map()["$set"]; exists {
-					UpdateOpts := options.Update()
-					UpdateOpts.SetUpsert(true)
-					UpdateOpts.SetBypassDocumentValidation(false)
-
-					_, err := dstColl.UpdateOne(context.Background(), oplog.O2, oplog.O, UpdateOpts) // update操作
-					if err != nil {
-						log.Println("oplog执行'u'操作失败：", err, "\toplog内容：", oplogBsonD)
-					}
-				} else {
-					ReplaceOneOpts := options.Replace()
-					ReplaceOneOpts.SetUpsert(true)
-					_, err := dstColl.ReplaceOne(context.Background(), oplog.O2, oplog.O, ReplaceOneOpts) // replace操作
-					if err != nil {
-						log.Println("oplog执行'u'操作失败：", err, "\toplog内容：", oplogBsonD)
-					}
+				logDeleteStats(srcMongo.logger())
+				if lane != nil {
+					srcMongo.logger().Info("低优先级ns后台通道积压", zap.Int64("pendingNum", lane.pendingNum()))
 				}
-			case "d":
-				_, err := dstColl.DeleteOne(context.Background(), oplog.O)
-				if err != nil {
-					log.Println("oplog执行'd'操作失败：", err, "\toplog内容：", oplogBsonD)
+			}
+
+			// 事务：applyOps中的操作拆开后逐条重放，未提交的事务先缓存
+			if ops, raws, ok := txns.ops(oplog, cur.Current); ok {
+				for i, op := range ops {
+					replay(op, raws[i])
 				}
-			case "c": // command,集合映射时，可能导致失败
-				res := dstDb.RunCommand(context.Background(), oplog.O)
-				if err := res.Err(); err != nil {
-					log.Println("oplog执行'c'操作失败：", err, "\toplog内容：", oplogBsonD)
+				continue
+			}
+			replay(oplog, cur.Current)
+		}
+		batch.flush()
+		err := cur.Err()
+		if err == nil {
+			if txns.empty() {
+				checkpoint.advance(lastTS, lane, true)
+			}
+			return nil
+		}
+		cur.Close(context.Background())
+		if srcCtx.Err() != nil {
+			// 其他分片的oplog已经被覆盖，停止重放
+			return srcCtx.Err()
+		}
+		// 读取的位置被覆盖时重新打开游标，由oplogResumeFilter确认是否丢失了oplog
+		if !isRetryableError(srcCtx, err) && !isCappedPositionLost(err) || !retryWait(srcCtx, attempt, "读取"+srcOplogNamespace, err) {
+			log.Fatalln("读取oplog失败：", err)
+		}
+		// 还没有读取到oplog时沿用原来的filter
+		if lastTS.T != 0 || lastTS.I != 0 {
+			if filter, err = oplogResumeFilter(srcCtx, srcColl, lastTS, endTS); errors.Is(err, ErrOplogRolledOver) {
+				return err
+			} else if err != nil {
+				log.Fatalln("oplog重放中断后无法继续：", err)
+			}
+		}
+		if err := openCursor(filter); err != nil {
+			log.Fatalln("重新打开oplog游标失败：", err)
+		}
+		srcMongo.logger().Info("重新打开oplog游标", zap.Uint32("T", lastTS.T), zap.Uint32("I", lastTS.I))
+	}
+}
+
+// 判断 nsSlice中是否存在指定的 ns。
+// 如果ns为db.$cmd类型的，只判断db部分，如果db存在指定列表中，则返回true。
+func containsOplogNs(oplogns string, nsSlice []string) bool {
+	if origNs, _, ok := convertToCappedOrigin(oplogns); ok {
+		oplogns = origNs // convertToCapped的临时集合按原集合判断
+	}
+	if containsSystemJsNs(oplogns, nsSlice) {
+		return true
+	}
+	if !strings.HasSuffix(oplogns, ".$cmd") && IsSystemNs(oplogns) {
+		return false
+	}
+	for _, value := range nsSlice {
+		if oplogns == value {
+			return true
+		}
+		if strings.HasPrefix(value, strings.TrimSuffix(oplogns, "$cmd")) {
+			// 如果指定collection，重放c类型的oplog可能会报错:因为u操作对应的collection可能不存在
+			return true
+		}
+	}
+	// 同步开始后新建的集合，与--nsInclude、--nsExclude的模式匹配时同样重放
+	if replayNsMatcher != nil && !strings.HasSuffix(oplogns, ".$cmd") {
+		return replayNsMatcher.Match(oplogns)
+	}
+	return false
+}
+
+// 在目标端执行单条oplog，nsStruct为oplog所属ns映射后的结果。可重试的错误会按retry参数重试
+func applyOplog(ctx context.Context, dstClient *mongo.Client, nsStruct *NsMap, oplog OPLOG) error {
+	oplog, ok := projectOplog(nsStruct, oplog)
+	if !ok {
+		return nil
+	}
+	dstDb := dstClient.Database(nsStruct.DstDb)
+	dstColl := dstDb.Collection(nsStruct.DstColl)
+	switch oplog.OP {
+	case "i":
+		if _, exists := oplog.O.(bson.D).Map()["_id"]; exists {
+			if policy := oplogConflictPolicy(oplog.NS); policy != ConflictOverwrite {
+				return applyConflictInsert(ctx, dstColl, policy, oplog.O)
+			}
+			filter := bson.M{"_id": oplog.O.(bson.D).Map()["_id"]}
+			ReplaceOneOpts := options.Replace()
+			ReplaceOneOpts.SetUpsert(true)
+			if hint := upsertHint(ctx, dstColl, filter); hint != nil {
+				ReplaceOneOpts.SetHint(hint)
+			}
+			return doWithRetry(ctx, writeTimeout, "ReplaceOne", func(ctx context.Context) error {
+				_, err := dstColl.ReplaceOne(ctx, filter, oplog.O, ReplaceOneOpts)
+				return err
+			})
+		} else {
+			// 创建索引的oplog（插入system.indexes），按完整的索引定义创建，保留unique等选项
+			return createIndexes(ctx, dstDb, nsStruct.DstColl, bson.A{oplog.O})
+		}
+	case "u":
+		// $v:2格式转换为$set、$unset，数组截短与其他修改冲突时先截短。投影时已经转换的截短在oplog.truncate中
+		diff, isDiff := oplogUpdateDiff(oplog.O.(bson.D))
+		if isDiff || oplog.truncate != nil {
+			update, truncate := oplog.O.(bson.D), oplog.truncate
+			if isDiff {
+				update, truncate = diffToUpdate(diff)
+			}
+			if truncate != nil {
+				err := doWithRetry(ctx, writeTimeout, "UpdateOne", func(ctx context.Context) error {
+					_, err := dstColl.UpdateOne(ctx, oplog.O2, truncate)
+					return err
+				})
+				if err != nil {
+					return err
 				}
-			case "n":
-				// noop：do nothing
-			default:
-				log.Println("未识别的oplog操作：", "\toplog内容：", oplogBsonD)
 			}
+			if len(update) == 0 {
+				return nil
+			}
+			oplog.O = update
+		}
+		if isUpdateModifier(oplog.O.(bson.D)) {
+			if missingDocSource != nil {
+				return applyUpdateOrFetch(ctx, dstColl, nsStruct, oplog)
+			}
+			UpdateOpts := options.Update()
+			UpdateOpts.SetUpsert(true)
+			UpdateOpts.SetBypassDocumentValidation(false)
+			if hint := upsertHint(ctx, dstColl, oplog.O2); hint != nil {
+				UpdateOpts.SetHint(hint)
+			}
+
+			return doWithRetry(ctx, writeTimeout, "UpdateOne", func(ctx context.Context) error {
+				_, err := dstColl.UpdateOne(ctx, oplog.O2, oplog.O, UpdateOpts) // update操作
+				return err
+			})
+		} else if useReplaceDiff(oplog) {
+			// 大文档的替换操作转换为差异更新
+			return applyReplaceDiff(ctx, dstColl, oplog)
+		} else {
+			ReplaceOneOpts := options.Replace()
+			ReplaceOneOpts.SetUpsert(true)
+			if hint := upsertHint(ctx, dstColl, oplog.O2); hint != nil {
+				ReplaceOneOpts.SetHint(hint)
+			}
+			return doWithRetry(ctx, writeTimeout, "ReplaceOne", func(ctx context.Context) error {
+				_, err := dstColl.ReplaceOne(ctx, oplog.O2, oplog.O, ReplaceOneOpts) // replace操作
+				return err
+			})
+		}
+	case "d":
+		return applyDelete(ctx, dstColl, oplog)
+	case "c": // command,集合映射时，可能导致失败
+		cmd := oplog.O.(bson.D)
+		if _, ok := indexBuildColl(cmd); ok {
+			return applyIndexBuild(ctx, dstDb, nsStruct.DstColl, cmd)
+		}
+		if _, ok := indexDropColl(cmd); ok {
+			return applyDropIndexes(ctx, dstDb, nsStruct.DstColl, cmd)
+		}
+		if len(cmd) > 0 && cmd[0].Key == "collMod" {
+			return applyCollMod(ctx, dstDb, cmd)
+		}
+		// 集合已经存在时跳过create命令
+		cache := indexCacheFor(dstClient)
+		createdNs := ""
+		if len(cmd) == 0 {
+			return errors.New("command类型的oplog内容为空")
+		}
+		if coll, ok := cmd[0].Value.(string); ok && cmd[0].Key == "create" {
+			if createdNs = nsStruct.DstDb + "." + coll; cache.hasColl(createdNs) {
+				return nil
+			}
+		}
+		// 先使缓存失效再执行命令，避免与预热并发时保留命令执行前的结果
+		cache.invalidate(nsStruct.DstDb, cmd)
+		cmdDb := dstDb
+		if cmd[0].Key == "renameCollection" {
+			cmdDb = dstClient.Database("admin") // renameCollection只能在admin库执行
 		}
+		err := doWithRetry(ctx, commandTimeout, "RunCommand", func(ctx context.Context) error {
+			return cmdDb.RunCommand(ctx, oplog.O).Err()
+		})
+		if isAlreadyApplied(cmd, err) {
+			err = nil
+		}
+		if err == nil && createdNs != "" {
+			cache.add(createdNs)
+		}
+		return err
+	case "n":
+		// noop：do nothing
+	default:
+		return errors.New("未识别的oplog操作")
 	}
+	return nil
+}
+
+// 判断u类型oplog的o是否为$set、$unset等更新操作符，否则为整个文档的替换
+func isUpdateModifier(o bson.D) bool {
+	return len(o) > 0 && strings.HasPrefix(o[0].Key, "$")
 }
 
 //根据oplog获取oplog对应的Namespace。
@@ -601,7 +1539,10 @@ func CustGetOplogNs(oplog OPLOG) (string, string) {
 	if oplog.NS != "" { // 非o="n"的oplog,其ns为空
 		var NS []string
 		_, exists := oplog.O.(bson.D).Map()["_id"] //如果oplog["o"]中存在"_id"字段，表示普通类型的insert操作；否则为创建索引的操作
-		if oplog.OP == "i" && !exists {
+		if coll, ok := commandColl(oplog.O.(bson.D)); oplog.OP == "c" && ok {
+			// 索引创建、集合DDL命令返回命令涉及的集合，按集合进行过滤和名称空间映射
+			NS = []string{strings.SplitN(oplog.NS, ".", 2)[0], coll}
+		} else if oplog.OP == "i" && !exists {
 			// 针对于创建索引的i类型的oplog。
 			NS = strings.SplitN(oplog.O.(bson.D).Map()["ns"].(string), ".", 2)
 			// 	例如：
@@ -721,25 +1662,81 @@ func CustGetOplogNs(oplog OPLOG) (string, string) {
 	// }
 }
 
+// CustSyncOplog使用的目标库、集合名称
+const (
+	syncOplogDbName         = "syncoplog"
+	syncOplogCollName       = "oplog.rs"
+	syncOplogCheckpointColl = "checkpoint" // 保存CustSyncOplog的同步进度
+)
+
+// CustSyncOplog每批写入的oplog条数
+var syncOplogBatchSize = 1000
+
+// 获取CustSyncOplog记录的同步进度（最后一条已写入dst的oplog的ts），不存在时返回primitive.Timestamp{}
+func CustGetSyncOplogCheckpoint(dstMongo *MongoArgs) (primitive.Timestamp, error) {
+	_, lastTS, err := CustGetSyncOplogProgress(dstMongo)
+	return lastTS, err
+}
+
+// 获取CustSyncOplog最初开始同步的位置和最后一条已写入dst的oplog的ts，不存在时返回primitive.Timestamp{}。
+// 旧版本记录的同步进度中没有最初的位置，startTS为空
+func CustGetSyncOplogProgress(dstMongo *MongoArgs) (startTS, lastTS primitive.Timestamp, err error) {
+	checkpointColl := dstMongo.Client().Database(syncOplogDbName).Collection(syncOplogCheckpointColl)
+	checkpoint, err := loadCheckpoint(dstMongo.Context(), checkpointColl, syncOplogDbName)
+	if err != nil || checkpoint == nil {
+		return primitive.Timestamp{}, primitive.Timestamp{}, err
+	}
+	return checkpoint.StartTS, checkpoint.TS, nil
+}
+
 // 从src库同步oplog到dst的库中，用于手动重放
+// oplog按批次无序写入，ts+h重复的oplog视为已经同步过，直接跳过；每批写入成功后记录同步进度，
+// 重启后如果进度比startTS新，则从进度处继续同步
+// 网络断开或源端重启导致游标中断时，从最后读取的oplog之后重新打开游标
 func CustSyncOplog(srcMongo *MongoArgs, dstMongo *MongoArgs, startTS primitive.Timestamp) {
-	// TODO: 处理网络断开，自动重连——比如dbserver重启后自动重连
-	// TODO:  判断如果syncoplog库存在数据，退出
-
-	const (
-		srcDbName   string = "local"
-		srcCollName string = "oplog.rs"
-		dstDbName   string = "syncoplog"
-		dstCollName string = "oplog.rs"
-	)
-	srcClient := srcMongo.Connect()
-	defer srcClient.Disconnect(srcMongo.ctx)
-	dstClient := dstMongo.Connect()
-	defer dstClient.Disconnect(dstMongo.ctx)
+	if srcMongo.IsMongos() {
+		log.Fatalln("源端为mongos时不支持--sync_oplog，请使用--oplog直接重放各个分片的oplog")
+	}
+	if changeStreamMode {
+		log.Fatalln("change stream模式不支持--sync_oplog，请使用--oplog")
+	}
+	srcDbName, srcCollName := splitOplogNamespace(srcMongo.OplogNamespace())
+	srcClient := srcMongo.Client()
+	dstClient := dstMongo.Client()
+
+	dstColl := dstClient.Database(syncOplogDbName).Collection(syncOplogCollName)
+	checkpointColl := dstClient.Database(syncOplogDbName).Collection(syncOplogCheckpointColl)
+
+	// ts+h唯一索引，用于识别重复写入的oplog
+	indexmodel := mongo.IndexModel{
+		Keys:    bson.D{{"ts", 1}, {"h", 1}},
+		Options: options.Index().SetName("ts_1_h_1").SetUnique(true),
+	}
+	err := doWithRetry(dstMongo.Context(), commandTimeout, "createIndex", func(ctx context.Context) error {
+		_, err := dstColl.Indexes().CreateOne(ctx, indexmodel)
+		return err
+	})
+	if err != nil {
+		log.Fatalf("%s.%s创建ts_1_h_1唯一索引失败：%v\n", syncOplogDbName, syncOplogCollName, err)
+	}
+
+	// 存在比startTS新的同步进度时，从同步进度处继续，并沿用之前最初开始同步的位置
+	originTS := startTS
+	checkpointStart, checkpointTS, err := CustGetSyncOplogProgress(dstMongo)
+	if err != nil {
+		log.Fatalln("获取syncoplog同步进度失败：", err)
+	}
+	if primitive.CompareTimestamp(checkpointTS, startTS) > 0 {
+		log.Printf("检测到syncoplog同步进度(%d,%d)，从该位置继续同步oplog\n", checkpointTS.T, checkpointTS.I)
+		startTS = checkpointTS
+		if checkpointStart.T != 0 || checkpointStart.I != 0 {
+			originTS = checkpointStart
+		}
+	}
 
 	srcColl := srcClient.Database(srcDbName).Collection(srcCollName)
 	//创建findoptions参数
-	findOpts := options.Find()
+	findOpts := limitCursorBatch(options.Find())
 	findOpts.SetCursorType(options.TailableAwait)
 	findOpts.SetNoCursorTimeout(true)
 	filter := bson.D{{"ts", bson.D{{"$gte", startTS}}}}
@@ -747,56 +1744,125 @@ func CustSyncOplog(srcMongo *MongoArgs, dstMongo *MongoArgs, startTS primitive.T
 	// 验证startTS有效性，如果失效，直接退出。
 	var firstoplog bson.M
 	time.Sleep(5e9)
-	err := srcColl.FindOne(context.Background(), filter).Decode(&firstoplog)
+	findCtx, cancel := withTimeout(srcMongo.Context(), findTimeout)
+	err = srcColl.FindOne(findCtx, filter).Decode(&firstoplog)
+	cancel()
 	if err != nil {
 		log.Fatalln("验证startTS有效性时，查询失败：", err)
 	} else if !firstoplog["ts"].(primitive.Timestamp).Equal(startTS) {
 		log.Fatalln("startTS指定的oplog已经失效，终止syncoplog操作")
 	}
 
-	cur, err := srcColl.Find(context.Background(), filter, findOpts)
-	if err != nil {
+	srcCtx := srcMongo.Context()
+	var cur *mongo.Cursor
+	openCursor := func(filter bson.D) error {
+		return doWithRetry(srcCtx, findTimeout, "find "+srcDbName+"."+srcCollName, func(ctx context.Context) error {
+			var err error
+			cur, err = srcColl.Find(ctx, filter, findOpts)
+			return err
+		})
+	}
+	if err := openCursor(filter); err != nil {
 		log.Fatal(err)
 	}
-	defer cur.Close(context.Background())
+	defer func() { cur.Close(context.Background()) }()
+	// 定期在源端写入心跳noop，保证空闲时同步进度也能推进
+	stopHeartbeat := startOplogHeartbeat(srcMongo)
+	defer stopHeartbeat()
 
-	var oplog bson.M
-	for cur.Next(context.Background()) {
-		if err := cur.Err(); err != nil {
-			log.Fatal(err)
+	insertManyOpts := options.InsertMany()
+	insertManyOpts.SetOrdered(false) // 无序写入：重复的oplog不影响同批次其他oplog的写入
+	insertManyOpts.SetBypassDocumentValidation(false)
+
+	// 批量写入oplog并记录同步进度
+	var batch []interface{}
+	var lastTS primitive.Timestamp
+	flush := func() {
+		if len(batch) == 0 {
+			return
 		}
-		err := cur.Decode(&oplog)
+		err := doWithRetry(dstMongo.Context(), writeTimeout, "InsertMany", func(ctx context.Context) error {
+			_, err := dstColl.InsertMany(ctx, batch, insertManyOpts)
+			return err
+		})
 		if err != nil {
-			log.Fatal("Decode oplog into variable err:", err)
+			bulkErr, ok := err.(mongo.BulkWriteException)
+			if !ok || bulkErr.WriteConcernError != nil {
+				log.Fatalln("syncoplog批量插入oplog失败：", err)
+			}
+			for _, writeErr := range bulkErr.WriteErrors {
+				if writeErr.Code != 11000 { // 11000：ts+h重复，表示该oplog已经同步过
+					log.Fatalln("syncoplog批量插入oplog失败：", writeErr.Message)
+				}
+			}
+			srcMongo.logger().Debug("跳过已经同步过的oplog", zap.Int("dupNum", len(bulkErr.WriteErrors)))
+		}
+		if err := saveCheckpoint(dstMongo.Context(), checkpointColl, &Checkpoint{ID: syncOplogDbName, TS: lastTS, OplogNs: srcDbName + "." + srcCollName, StartTS: originTS}); err != nil {
+			log.Println("syncoplog记录同步进度失败：", err)
+		} else {
+			notifyProgress(func(listener ProgressListener) { listener.OnCheckpoint(srcDbName+"."+srcCollName, lastTS) })
 		}
+		batch = batch[:0]
 
 		currentTS, err := CustGetLatestOplogTimestamp(srcMongo)
 		if err != nil {
 			log.Println("获取当前最新的oplog对应的timestamp失败：", err)
-		} else if currentTS.Equal(oplog["ts"].(primitive.Timestamp)) {
+		} else if currentTS.Equal(lastTS) {
 			// 比较oplog中的timestamp和当前最新的timestamp是否相等
-			log.Printf("正在实时同步最新生成的oplog到%s.%s，您可以'ctrl+c'手动终止程序!当前同步的oplog为%s:", dstDbName, dstCollName, oplog)
+			log.Printf("正在实时同步最新生成的oplog到%s.%s，您可以'ctrl+c'手动终止程序!当前同步的oplog的ts为(%d,%d)", syncOplogDbName, syncOplogCollName, lastTS.T, lastTS.I)
 		}
+	}
 
-		dstColl := dstClient.Database(dstDbName).Collection(dstCollName)
-		insertOneOpts := options.InsertOne()
-		insertOneOpts.SetBypassDocumentValidation(false)
-		_, err = dstColl.InsertOne(context.Background(), oplog, insertOneOpts)
-		if err != nil {
-			log.Fatalln("syncoplog插入oplog失败：", err)
+	for attempt := 1; ; attempt++ {
+		for cursorNext(srcCtx, cur, true) {
+			attempt = 1
+			// 直接使用原始bson，保持oplog字段顺序不变
+			oplog := make(bson.Raw, len(cur.Current))
+			copy(oplog, cur.Current)
+			t, i, ok := oplog.Lookup("ts").TimestampOK()
+			if !ok {
+				log.Fatalln("oplog中缺少ts字段：", oplog)
+			}
+			lastTS = primitive.Timestamp{T: t, I: i}
+			batch = append(batch, oplog)
+
+			// 批次已满，或者当前游标批次已经读完（即将等待新的oplog）时写入
+			if len(batch) >= syncOplogBatchSize || cur.RemainingBatchLength() == 0 {
+				flush()
+			}
+		}
+		flush()
+		err := cur.Err()
+		if err == nil {
+			break
+		}
+		cur.Close(context.Background())
+		if !isRetryableError(srcCtx, err) || !retryWait(srcCtx, attempt, "读取"+srcDbName+"."+srcCollName, err) {
+			log.Fatalln("读取oplog失败：", err)
+		}
+		if lastTS.T != 0 || lastTS.I != 0 {
+			if filter, err = oplogResumeFilter(srcCtx, srcColl, lastTS, primitive.Timestamp{}); err != nil {
+				log.Fatalln("syncoplog中断后无法继续：", err)
+			}
 		}
+		if err := openCursor(filter); err != nil {
+			log.Fatalln("重新打开oplog游标失败：", err)
+		}
+		srcMongo.logger().Info("重新打开oplog游标", zap.Uint32("T", lastTS.T), zap.Uint32("I", lastTS.I))
 	}
 }
 
-// 获取指定mongodb实例的数据库列表,排查admin和local库
+// 获取指定mongodb实例的数据库列表,排查admin和local库。mongos的config库保存的是集群元数据，同样排除；
+// 副本集的config库保存会话、事务表等内部数据，指定--include_system_ns时才复制
 func CustGetDbs(src *MongoArgs) []string {
-	dbs, err := src.Connect().ListDatabaseNames(context.Background(), bson.M{})
+	isMongos := src.IsMongos()
+	dbs, err := src.listDatabaseNames()
 	if err != nil {
 		log.Fatalln("获取mongodb实例中的数据库列表失败：", err)
 	}
 	i := 0
 	for _, db := range dbs {
-		if db != "local" && db != "admin" {
+		if !IsSystemNs(db+".") && !(isMongos && db == "config") {
 			dbs[i] = db
 			i++
 		}
@@ -808,21 +1874,22 @@ func CustGetDbs(src *MongoArgs) []string {
 	return newdbs
 }
 
-// 获取指定数据库中的集合列表
+// 获取指定数据库中的集合列表，不包括默认排除的系统集合
 func CustGetColls(src *MongoArgs, dbName string) []string {
-	srcClient := src.Connect()
-	defer srcClient.Disconnect(context.Background())
-	cur, err := srcClient.Database(dbName).ListCollections(context.Background(), bson.M{})
+	specs, err := src.listCollectionSpecs(dbName)
 	if err != nil {
 		log.Fatalln("获取指定数据库中的集合列表失败：", err)
 	}
-	defer cur.Close(context.Background())
-	var doc bson.M
-	var collnames []string
-	for cur.Next(context.Background()) {
-		err := cur.Decode(&doc)
-		CheckErr(err)
-		collnames = append(collnames, doc["name"].(string))
+	var collnames, skipped []string
+	for _, spec := range specs {
+		if IsSystemNs(dbName + "." + spec.Name) {
+			skipped = append(skipped, spec.Name)
+			continue
+		}
+		collnames = append(collnames, spec.Name)
+	}
+	if len(skipped) > 0 {
+		src.logger().Info("跳过系统集合", zap.String("db", dbName), zap.Strings("colls", skipped))
 	}
 	return collnames
 }
@@ -848,8 +1915,83 @@ func CustStringSliceHas(slice []string, element string) bool {
 	return false
 }
 
+// 多个源ns映射到同一个目标ns时的处理策略
+const (
+	NsCollisionError  = "error"            // 报错退出
+	NsCollisionMerge  = "merge"            // 合并到同一个目标集合，_id冲突时按--overwrite参数处理
+	NsCollisionSuffix = "suffix-by-source" // 目标集合名加上源库名（必要时再加上源集合名）作为后缀
+)
+
+// 检测多个源ns映射到同一个目标ns的情况，并按照policy进行处理。
+// suffix-by-source策略会修改nsStructSlice中的目标集合名，并同步更新nsnsMap，保证oplog重放使用相同的映射
+func CustResolveNsCollisions(ctx context.Context, nsStructSlice []*NsMap, nsnsMap map[string]string, policy string) error {
+	groups := make(map[string][]*NsMap) // key为目标ns
+	var dstNsList []string
+	for _, nsmap := range nsStructSlice {
+		dstNs := nsmap.DstDb + "." + nsmap.DstColl
+		if _, exists := groups[dstNs]; !exists {
+			dstNsList = append(dstNsList, dstNs)
+		}
+		groups[dstNs] = append(groups[dstNs], nsmap)
+	}
+
+	var collisions []string
+	for _, dstNs := range dstNsList {
+		group := groups[dstNs]
+		if len(group) < 2 {
+			continue
+		}
+		var srcNsList []string
+		for _, nsmap := range group {
+			srcNsList = append(srcNsList, nsmap.SrcDb+"."+nsmap.SrcColl)
+		}
+		collisions = append(collisions, fmt.Sprintf("%s <- [%s]", dstNs, strings.Join(srcNsList, ",")))
+
+		switch policy {
+		case NsCollisionMerge:
+			loggerFrom(ctx).Warn("多个源ns合并到同一个目标ns", zap.String("dstNs", dstNs), zap.Strings("srcNs", srcNsList))
+		case NsCollisionSuffix:
+			// 组内源库名不重复时只使用源库名作为后缀，否则使用源库名和源集合名
+			srcDbs := make(map[string]int)
+			for _, nsmap := range group {
+				srcDbs[nsmap.SrcDb]++
+			}
+			for _, nsmap := range group {
+				if srcDbs[nsmap.SrcDb] == 1 {
+					nsmap.DstColl = fmt.Sprintf("%s_%s", nsmap.DstColl, nsmap.SrcDb)
+				} else {
+					nsmap.DstColl = fmt.Sprintf("%s_%s_%s", nsmap.DstColl, nsmap.SrcDb, nsmap.SrcColl)
+				}
+				nsnsMap[nsmap.SrcDb+"."+nsmap.SrcColl] = nsmap.DstDb + "." + nsmap.DstColl
+			}
+		case NsCollisionError:
+		default:
+			return fmt.Errorf("未知的ns冲突处理策略：%s", policy)
+		}
+	}
+
+	if len(collisions) > 0 && policy == NsCollisionError {
+		return fmt.Errorf("存在多个源ns映射到同一个目标ns的情况：%s", strings.Join(collisions, "; "))
+	}
+	// 加上后缀后仍然可能与其他目标ns冲突
+	if len(collisions) > 0 && policy == NsCollisionSuffix {
+		return CustResolveNsCollisions(ctx, nsStructSlice, nsnsMap, NsCollisionError)
+	}
+	return nil
+}
+
 //NsMap是一个key为srcNs，value为dstNs的字典。传入一个ns，返回一个*NsMap结构体
 func CustFilter(ns string, nsnsMap map[string]string) *NsMap {
+	if origNs, tmpPrefix, ok := convertToCappedOrigin(ns); ok {
+		// convertToCapped的临时集合，按原集合映射
+		orig := CustFilter(origNs, nsnsMap)
+		return &NsMap{
+			SrcDb:   orig.SrcDb,
+			SrcColl: strings.SplitN(ns, ".", 2)[1],
+			DstDb:   orig.DstDb,
+			DstColl: tmpPrefix + orig.DstColl,
+		}
+	}
 	if _, exist := nsnsMap[ns]; exist {
 		return &NsMap{
 			SrcDb:   strings.SplitN(ns, ".", 2)[0],
@@ -857,6 +1999,14 @@ func CustFilter(ns string, nsnsMap map[string]string) *NsMap {
 			DstDb:   strings.SplitN(nsnsMap[ns], ".", 2)[0],
 			DstColl: strings.SplitN(nsnsMap[ns], ".", 2)[1],
 		}
+	} else if dbTo, exist := nsnsMap[strings.SplitN(ns, ".", 2)[0]+".$cmd"]; exist {
+		// 同步开始后新建的集合不在nsnsMap中，按--dbFrom_To的库名映射
+		return &NsMap{
+			SrcDb:   strings.SplitN(ns, ".", 2)[0],
+			SrcColl: strings.SplitN(ns, ".", 2)[1],
+			DstDb:   strings.SplitN(dbTo, ".", 2)[0],
+			DstColl: strings.SplitN(ns, ".", 2)[1],
+		}
 	} else {
 		return &NsMap{
 			SrcDb:   strings.SplitN(ns, ".", 2)[0],
@@ -867,8 +2017,8 @@ func CustFilter(ns string, nsnsMap map[string]string) *NsMap {
 	}
 }
 
-func CheckErr(err error) {
+func CheckErr(ctx context.Context, err error) {
 	if err != nil {
-		logger.Error(err.Error())
+		loggerFrom(ctx).Error(err.Error())
 	}
 }
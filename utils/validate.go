@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// 校验模式使用的目标端临时库，目标ns db.coll对应临时库中名为db.coll的集合
+const DefaultValidateDbName = "mongosync_validate"
+
+// 单个ns的校验结果
+type ValidateResult struct {
+	SrcNs       string
+	ScratchNs   string
+	SampledNum  int64 // 导入临时库的样本文档数
+	OpsNum      int64 // 重放到临时库的oplog数
+	OpErrorNum  int64 // 重放失败的oplog数
+	MismatchNum int64 // 临时库与源端内容不一致的样本文档数
+	MissingNum  int64 // 只存在于源端或临时库一端的样本文档数
+}
+
+// 校验模式：不写入真正的目标ns，而是将选定ns的样本文档按全量同步的方式（包括索引）导入目标端的临时库validateDb，
+// 再将window时间内这些ns的真实oplog重放到临时库，最后按_id逐条比较临时库与源端的样本文档，用于提前发现名称映射、数据转换等问题。
+// 为了避免影响真实的目标库，c类型的oplog（命令）不会重放。校验期间源端仍有写入时，可能会有少量误报
+func CustValidate(srcMongo, dstMongo *MongoArgs, nsStructSlice []*NsMap, validateDb string, sampleSize int, window time.Duration) []ValidateResult {
+	srcClient := srcMongo.Client()
+	dstClient := dstMongo.Client()
+	srcCtx := srcMongo.Context()
+	dstCtx := dstMongo.Context()
+
+	// 源ns到临时库ns的映射
+	scratch := make(map[string]*NsMap)
+	var srcNsList []string
+	for _, nsmap := range nsStructSlice {
+		if nsmap.DstDb == validateDb {
+			srcMongo.logger().Fatal("校验使用的临时库不能是同步的目标库", zap.String("validateDb", validateDb))
+		}
+		srcNs := nsmap.SrcDb + "." + nsmap.SrcColl
+		scratch[srcNs] = &NsMap{SrcDb: nsmap.SrcDb, SrcColl: nsmap.SrcColl, DstDb: validateDb, DstColl: nsmap.DstDb + "." + nsmap.DstColl}
+		srcNsList = append(srcNsList, srcNs)
+	}
+
+	// oplog从window之前开始重放，与正常同步时先记录start_ts再导入数据的顺序一致
+	startTS := primitive.Timestamp{T: uint32(time.Now().Add(-window).Unix())}
+
+	// 1、导入样本文档
+	results := make(map[string]*ValidateResult)
+	sampledIds := make(map[string][]bson.RawValue)
+	for _, srcNs := range srcNsList {
+		nsmap := scratch[srcNs]
+		result := &ValidateResult{SrcNs: srcNs, ScratchNs: nsmap.DstDb + "." + nsmap.DstColl}
+		results[srcNs] = result
+		scratchColl := dstClient.Database(nsmap.DstDb).Collection(nsmap.DstColl)
+		err := doWithRetry(dstCtx, commandTimeout, "drop", func(ctx context.Context) error {
+			return scratchColl.Drop(ctx)
+		})
+		if err != nil {
+			srcMongo.logger().Fatal("清空临时集合失败", zap.String("NS", result.ScratchNs), zap.Error(err))
+		}
+		CustSyncIndex(srcMongo, nsmap.SrcDb, nsmap.SrcColl, dstMongo, nsmap.DstDb, nsmap.DstColl)
+
+		findOpts := options.Find().SetSort(bson.D{{"_id", 1}}).SetLimit(int64(sampleSize))
+		var docs []interface{}
+		err = doWithRetry(srcCtx, findTimeout, "find "+srcNs, func(ctx context.Context) error {
+			cur, err := srcClient.Database(nsmap.SrcDb).Collection(nsmap.SrcColl).Find(ctx, bson.M{}, findOpts)
+			if err != nil {
+				return err
+			}
+			defer cur.Close(context.Background())
+			docs, sampledIds[srcNs] = nil, nil
+			for cur.Next(ctx) {
+				var doc bson.D
+				if err := cur.Decode(&doc); err != nil {
+					return err
+				}
+				id := cur.Current.Lookup("_id")
+				docs = append(docs, doc)
+				sampledIds[srcNs] = append(sampledIds[srcNs], bson.RawValue{Type: id.Type, Value: append([]byte(nil), id.Value...)})
+			}
+			return cur.Err()
+		})
+		if err != nil {
+			srcMongo.logger().Fatal("读取样本文档失败", zap.String("NS", srcNs), zap.Error(err))
+		}
+		if len(docs) > 0 {
+			result.SampledNum, _ = CustInsertMany(dstCtx, scratchColl, docs, ConflictOverwrite)
+		}
+	}
+
+	// 2、重放window时间内的oplog
+	if window > 0 {
+		endTS, err := CustGetLatestOplogTimestamp(srcMongo)
+		if err != nil {
+			srcMongo.logger().Warn("获取当前最新的oplog对应的timestamp失败，跳过oplog重放校验", zap.Error(err))
+		} else if changeStreamMode {
+			srcMongo.logger().Warn("change stream模式不读取oplog，跳过oplog重放校验")
+		} else if sources, err := custOplogSources(srcMongo); err != nil {
+			srcMongo.logger().Warn("获取oplog来源失败，跳过oplog重放校验", zap.Error(err))
+		} else {
+			// 源端为mongos时依次重放各个分片的oplog，分片间chunk迁移产生的oplog跳过
+			filter := bson.D{{"ts", bson.D{{"$gt", startTS}, {"$lte", endTS}}}, {"ns", bson.D{{"$in", srcNsList}}}, {"fromMigrate", bson.D{{"$ne", true}}}}
+			for _, source := range sources {
+				oplogDbName, oplogCollName := splitOplogNamespace(source.OplogNamespace())
+				oplogColl := source.Client().Database(oplogDbName).Collection(oplogCollName)
+				err := doWithRetry(source.Context(), findTimeout, "find "+source.OplogNamespace(), func(ctx context.Context) error {
+					cur, err := oplogColl.Find(ctx, filter)
+					if err != nil {
+						return err
+					}
+					defer cur.Close(context.Background())
+					for cur.Next(ctx) {
+						var oplog OPLOG
+						if err := cur.Decode(&oplog); err != nil {
+							return err
+						}
+						result := results[oplog.NS]
+						if result == nil {
+							continue
+						}
+						result.OpsNum++
+						if err := applyOplog(dstCtx, dstClient, scratch[oplog.NS], oplog); err != nil {
+							result.OpErrorNum++
+							srcMongo.logger().Error(fmt.Sprintf("校验时oplog执行'%s'操作失败", oplog.OP), append(failedDocFields(oplog.NS, cur.Current.String()), zap.Error(err))...)
+						}
+					}
+					return cur.Err()
+				})
+				if err != nil {
+					srcMongo.logger().Fatal("读取oplog失败", zap.Error(err))
+				}
+			}
+		}
+	}
+
+	// 3、按_id比较临时库与源端的样本文档
+	var list []ValidateResult
+	for _, srcNs := range srcNsList {
+		nsmap := scratch[srcNs]
+		result := results[srcNs]
+		srcColl := srcClient.Database(nsmap.SrcDb).Collection(nsmap.SrcColl)
+		scratchColl := dstClient.Database(nsmap.DstDb).Collection(nsmap.DstColl)
+		for _, id := range sampledIds[srcNs] {
+			srcDoc, srcErr := findRawById(srcCtx, srcColl, id)
+			scratchDoc, scratchErr := findRawById(dstCtx, scratchColl, id)
+			if srcErr != nil && srcErr != mongo.ErrNoDocuments {
+				srcMongo.logger().Fatal("读取源端文档失败", zap.String("NS", srcNs), zap.Error(srcErr))
+			}
+			if scratchErr != nil && scratchErr != mongo.ErrNoDocuments {
+				srcMongo.logger().Fatal("读取临时库文档失败", zap.String("NS", result.ScratchNs), zap.Error(scratchErr))
+			}
+			switch {
+			case srcErr == mongo.ErrNoDocuments && scratchErr == mongo.ErrNoDocuments:
+				// 源端已经删除，并且删除操作已经重放
+			case srcErr == mongo.ErrNoDocuments || scratchErr == mongo.ErrNoDocuments:
+				result.MissingNum++
+				srcMongo.logger().Warn("样本文档只存在于一端", zap.String("NS", srcNs), zap.String("_id", id.String()), zap.Bool("inSource", srcErr == nil), zap.Bool("inScratch", scratchErr == nil))
+			case !bytes.Equal(srcDoc, scratchDoc):
+				result.MismatchNum++
+				srcMongo.logger().Warn("样本文档内容不一致", append(failedDocFields(result.ScratchNs, scratchDoc.String()), zap.String("source", truncateDoc(srcDoc.String())))...)
+			}
+		}
+		list = append(list, *result)
+	}
+	return list
+}
+
+// 按_id读取原始文档
+func findRawById(ctx context.Context, coll *mongo.Collection, id bson.RawValue) (bson.Raw, error) {
+	var doc bson.Raw
+	err := doWithRetry(ctx, findTimeout, "findOne", func(ctx context.Context) error {
+		var err error
+		doc, err = coll.FindOne(ctx, bson.D{{"_id", id}}).DecodeBytes()
+		return err
+	})
+	return doc, err
+}
@@ -0,0 +1,201 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// 服务端哈希校验：在源端和目标端分别通过聚合计算集合的文档数和内容哈希（每个文档哈希值之和），
+// 只传输哈希值而不传输文档。哈希值之和与文档顺序无关，同一个文档的字段顺序不同时哈希值不同。
+// 集合不一致时，再按源端的_id分布（$bucketAuto）切分范围，用$bucket在两端分别计算每个范围的哈希，找出不一致的_id范围
+type VerifyResult struct {
+	SrcNs          string
+	DstNs          string
+	SrcCount       int64
+	DstCount       int64
+	Match          bool
+	Method         string   // 计算文档哈希使用的表达式
+	MismatchRanges []string // 不一致的_id范围
+	Err            error
+}
+
+// 计算单个文档哈希值的聚合表达式，按顺序尝试：
+// $toHashedIndexKey与哈希索引使用相同的哈希函数；不支持时使用$function（4.4+，需要启用服务端JavaScript）计算md5
+var docHashExprs = []struct {
+	name string
+	expr bson.D
+}{
+	{"$toHashedIndexKey", bson.D{{"$toDecimal", bson.D{{"$toHashedIndexKey", "$$ROOT"}}}}},
+	{"$function", bson.D{{"$toDecimal", bson.D{{"$function", bson.D{
+		{"body", "function(doc) { return NumberLong(parseInt(hex_md5(tojson(doc)).substring(0, 15), 16)); }"},
+		{"args", bson.A{"$$ROOT"}},
+		{"lang", "js"},
+	}}}}}},
+}
+
+// 表达式不被支持时的错误码：InvalidPipelineOperator、JavaScript被禁用等
+var unsupportedExprCodes = map[int32]bool{168: true, 15999: true, 31264: true, 31325: true, 2: true}
+
+// 集合或_id范围的文档数和哈希值
+type verifyDigest struct {
+	ID    bson.RawValue        `bson:"_id"`
+	Count int64                `bson:"count"`
+	Hash  primitive.Decimal128 `bson:"hash"`
+}
+
+// 对nsStructSlice中的每个ns进行服务端哈希校验，buckets为集合不一致时切分的_id范围数，为0时不切分
+func CustVerify(srcMongo, dstMongo *MongoArgs, nsStructSlice []*NsMap, buckets int) []VerifyResult {
+	var results []VerifyResult
+	for _, nsmap := range nsStructSlice {
+		result := VerifyResult{SrcNs: nsmap.SrcDb + "." + nsmap.SrcColl, DstNs: nsmap.DstDb + "." + nsmap.DstColl}
+		srcColl := srcMongo.Client().Database(nsmap.SrcDb).Collection(nsmap.SrcColl)
+		dstColl := dstMongo.Client().Database(nsmap.DstDb).Collection(nsmap.DstColl)
+		result.Err = verifyCollection(srcMongo.Context(), dstMongo.Context(), srcColl, dstColl, buckets, &result)
+		results = append(results, result)
+	}
+	return results
+}
+
+func verifyCollection(srcCtx, dstCtx context.Context, srcColl, dstColl *mongo.Collection, buckets int, result *VerifyResult) error {
+	// 选择两端都支持的哈希表达式
+	var srcDigest, dstDigest *verifyDigest
+	var hashExpr bson.D
+	for _, candidate := range docHashExprs {
+		pipeline := mongo.Pipeline{{{"$group", bson.D{{"_id", nil}, {"count", bson.D{{"$sum", 1}}}, {"hash", bson.D{{"$sum", candidate.expr}}}}}}}
+		var srcErr, dstErr error
+		srcDigest, srcErr = aggregateDigest(srcCtx, srcColl, pipeline)
+		if srcErr == nil {
+			dstDigest, dstErr = aggregateDigest(dstCtx, dstColl, pipeline)
+		}
+		if srcErr == nil && dstErr == nil {
+			result.Method, hashExpr = candidate.name, candidate.expr
+			break
+		}
+		if !isUnsupportedExprError(srcErr) && !isUnsupportedExprError(dstErr) {
+			if srcErr != nil {
+				return srcErr
+			}
+			return dstErr
+		}
+	}
+	if hashExpr == nil {
+		return errors.New("源端或目标端不支持$toHashedIndexKey和$function，无法在服务端计算哈希")
+	}
+	result.SrcCount, result.DstCount = srcDigest.Count, dstDigest.Count
+	result.Match = srcDigest.Count == dstDigest.Count && srcDigest.Hash == dstDigest.Hash
+	if result.Match || buckets <= 0 || srcDigest.Count == 0 {
+		return nil
+	}
+
+	// 按源端的_id分布切分范围。$bucket要求所有边界的类型相同，_id类型不一致时不再切分
+	var bounds []struct {
+		ID struct {
+			Min bson.RawValue `bson:"min"`
+			Max bson.RawValue `bson:"max"`
+		} `bson:"_id"`
+	}
+	err := doWithRetry(srcCtx, findTimeout, "aggregate $bucketAuto", func(ctx context.Context) error {
+		cur, err := srcColl.Aggregate(ctx, mongo.Pipeline{{{"$bucketAuto", bson.D{{"groupBy", "$_id"}, {"buckets", buckets}}}}})
+		if err != nil {
+			return err
+		}
+		return cur.All(ctx, &bounds)
+	})
+	if err != nil {
+		return err
+	}
+	var boundaries bson.A
+	for i, bound := range bounds {
+		if bound.ID.Min.Type != bounds[0].ID.Min.Type || bound.ID.Max.Type != bounds[0].ID.Min.Type {
+			result.MismatchRanges = []string{"_id类型不一致，无法切分范围"}
+			return nil
+		}
+		boundaries = append(boundaries, bound.ID.Min)
+		if i == len(bounds)-1 {
+			// $bucket的上界不包含在范围内，最后一个范围的上界之后的文档落在default中
+			boundaries = append(boundaries, bound.ID.Max)
+		}
+	}
+	if len(boundaries) < 2 {
+		return nil
+	}
+	pipeline := mongo.Pipeline{{{"$bucket", bson.D{
+		{"groupBy", "$_id"},
+		{"boundaries", boundaries},
+		{"default", nil}, // null小于其他类型的_id，最后一个边界之后的文档也落在该范围中
+		{"output", bson.D{{"count", bson.D{{"$sum", 1}}}, {"hash", bson.D{{"$sum", hashExpr}}}}},
+	}}}}
+	srcBuckets, err := aggregateDigests(srcCtx, srcColl, pipeline)
+	if err != nil {
+		return err
+	}
+	dstBuckets, err := aggregateDigests(dstCtx, dstColl, pipeline)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(boundaries); i++ {
+		var key, desc string
+		if i < len(boundaries)-1 {
+			key, desc = rawValueKey(boundaries[i].(bson.RawValue)), fmt.Sprintf("[%v, %v)", boundaries[i], boundaries[i+1])
+		} else {
+			// 最后一个边界（包括）之后以及其他类型的_id
+			key, desc = rawValueKey(bson.RawValue{Type: bsontype.Null}), "其他"
+		}
+		src, dst := srcBuckets[key], dstBuckets[key]
+		if src.Count != dst.Count || src.Hash != dst.Hash {
+			result.MismatchRanges = append(result.MismatchRanges, fmt.Sprintf("%s 源:%d 目标:%d", desc, src.Count, dst.Count))
+		}
+	}
+	return nil
+}
+
+// 执行按null分组的聚合并返回唯一的一条结果，集合为空时返回0
+func aggregateDigest(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline) (*verifyDigest, error) {
+	digests, err := aggregateDigests(ctx, coll, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	digest := digests[rawValueKey(bson.RawValue{Type: bsontype.Null})]
+	return &digest, nil
+}
+
+// 执行聚合，返回以_id为key的结果
+func aggregateDigests(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline) (map[string]verifyDigest, error) {
+	var docs []verifyDigest
+	err := doWithRetry(ctx, findTimeout, "aggregate "+coll.Database().Name()+"."+coll.Name(), func(ctx context.Context) error {
+		cur, err := coll.Aggregate(ctx, pipeline)
+		if err != nil {
+			return err
+		}
+		docs = nil
+		return cur.All(ctx, &docs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[string]verifyDigest)
+	for _, doc := range docs {
+		digests[rawValueKey(doc.ID)] = doc
+	}
+	return digests, nil
+}
+
+// 以类型和原始字节作为bson值的key
+func rawValueKey(value bson.RawValue) string {
+	return fmt.Sprintf("%x:%x", byte(value.Type), value.Value)
+}
+
+// 判断是否为表达式不被支持导致的错误
+func isUnsupportedExprError(err error) bool {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		return unsupportedExprCodes[cmdErr.Code]
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// 服务端版本信息，用于按版本启用或跳过部分功能
+type ServerInfo struct {
+	Version  string // buildInfo中的版本号，如4.4.18
+	Major    int
+	Minor    int
+	FCV      string // featureCompatibilityVersion，3.4以下版本、mongos或者没有权限时为空
+	IsMongos bool   // 是否为分片集群的mongos
+	// 是否为主从复制（master-slave）的主节点，oplog位于local.oplog.$main（3.6开始不再支持主从复制）
+	MasterSlave bool
+}
+
+// 获取服务端版本信息，同一个连接只查询一次
+func (mc *MongoArgs) ServerInfo() (*ServerInfo, error) {
+	mc.conn.Lock()
+	info := mc.conn.info
+	mc.conn.Unlock()
+	if info != nil {
+		return info, nil
+	}
+
+	adminDb := mc.Client().Database("admin")
+	var buildInfo struct {
+		Version string `bson:"version"`
+	}
+	err := doWithRetry(mc.Context(), commandTimeout, "buildInfo", func(ctx context.Context) error {
+		return adminDb.RunCommand(ctx, bson.D{{"buildInfo", 1}}).Decode(&buildInfo)
+	})
+	if err != nil {
+		return nil, err
+	}
+	info = &ServerInfo{Version: buildInfo.Version}
+	parts := strings.SplitN(buildInfo.Version, ".", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("无法识别的版本号：%s", buildInfo.Version)
+	}
+	if info.Major, err = strconv.Atoi(parts[0]); err != nil {
+		return nil, fmt.Errorf("无法识别的版本号：%s", buildInfo.Version)
+	}
+	if info.Minor, err = strconv.Atoi(parts[1]); err != nil {
+		return nil, fmt.Errorf("无法识别的版本号：%s", buildInfo.Version)
+	}
+
+	// mongos的isMaster返回msg: "isdbgrid"；副本集成员返回setName
+	var isMaster struct {
+		Msg     string `bson:"msg"`
+		SetName string `bson:"setName"`
+	}
+	err = doWithRetry(mc.Context(), commandTimeout, "isMaster", func(ctx context.Context) error {
+		return adminDb.RunCommand(ctx, bson.D{{"isMaster", 1}}).Decode(&isMaster)
+	})
+	if err != nil {
+		return nil, err
+	}
+	info.IsMongos = isMaster.Msg == "isdbgrid"
+	if !info.IsMongos && isMaster.SetName == "" && !info.AtLeast(3, 6) {
+		// 既不是mongos也不是副本集成员，存在local.oplog.$main时为主从复制的主节点
+		var names []string
+		err = doWithRetry(mc.Context(), commandTimeout, "listCollections", func(ctx context.Context) error {
+			var err error
+			names, err = mc.Client().Database("local").ListCollectionNames(ctx, bson.D{{"name", "oplog.$main"}})
+			return err
+		})
+		if err != nil {
+			mc.logger().Warn("检查local.oplog.$main失败", zap.Error(err))
+		}
+		info.MasterSlave = len(names) > 0
+	}
+
+	// 3.4开始支持featureCompatibilityVersion，3.4中为字符串，3.6以后为{version: "x.y"}
+	var fcv bson.M
+	err = doWithRetry(mc.Context(), commandTimeout, "getParameter", func(ctx context.Context) error {
+		return adminDb.RunCommand(ctx, bson.D{{"getParameter", 1}, {"featureCompatibilityVersion", 1}}).Decode(&fcv)
+	})
+	if err == nil {
+		switch value := fcv["featureCompatibilityVersion"].(type) {
+		case string:
+			info.FCV = value
+		case bson.M:
+			info.FCV, _ = value["version"].(string)
+		}
+	}
+
+	mc.conn.Lock()
+	mc.conn.info = info
+	mc.conn.Unlock()
+	return info, nil
+}
+
+// 判断服务端二进制版本是否不低于major.minor
+func (info *ServerInfo) AtLeast(major, minor int) bool {
+	return info.Major > major || info.Major == major && info.Minor >= minor
+}
+
+// 判断major.minor引入的新功能是否可用：二进制版本不低于major.minor，并且featureCompatibilityVersion（如果有）也不低于major.minor
+func (info *ServerInfo) FeatureAtLeast(major, minor int) bool {
+	if !info.AtLeast(major, minor) {
+		return false
+	}
+	if info.FCV == "" {
+		return true
+	}
+	var fcvMajor, fcvMinor int
+	if _, err := fmt.Sscanf(info.FCV, "%d.%d", &fcvMajor, &fcvMinor); err != nil {
+		return true
+	}
+	return fcvMajor > major || fcvMajor == major && fcvMinor >= minor
+}
+
+// 是否支持change stream（3.6+）
+func (info *ServerInfo) SupportsChangeStreams() bool {
+	return info.FeatureAtLeast(3, 6)
+}
+
+func (info *ServerInfo) String() string {
+	if info.FCV == "" {
+		return info.Version
+	}
+	return fmt.Sprintf("%s(featureCompatibilityVersion=%s)", info.Version, info.FCV)
+}
+
+// 索引选项及其要求的最低版本
+var indexOptionMinVersion = map[string][2]int{
+	"partialFilterExpression": {3, 2},
+	"collation":               {3, 4},
+	"wildcardProjection":      {4, 2},
+	"hidden":                  {4, 4},
+}
+
+// 判断目标端是否支持该索引选项，不支持时输出警告。目标端版本未知时认为支持
+func indexOptionSupported(ctx context.Context, dstInfo *ServerInfo, option, ns, indexName string) bool {
+	minVersion, exists := indexOptionMinVersion[option]
+	if !exists || dstInfo == nil || dstInfo.FeatureAtLeast(minVersion[0], minVersion[1]) {
+		return true
+	}
+	loggerFrom(ctx).Warn("目标端版本不支持该索引选项，已忽略", zap.String("NS", ns), zap.String("index", indexName), zap.String("option", option), zap.String("dstVersion", dstInfo.String()), zap.String("requires", fmt.Sprintf("%d.%d", minVersion[0], minVersion[1])))
+	return false
+}
+
+// 输出源端和目标端的版本信息
+func CustLogServerInfo(name string, mc *MongoArgs) {
+	info, err := mc.ServerInfo()
+	if err != nil {
+		mc.logger().Warn("获取服务端版本失败", zap.String("server", name), zap.Error(err))
+		return
+	}
+	mc.logger().Info("服务端版本", zap.String("server", name), zap.String("version", info.Version), zap.String("featureCompatibilityVersion", info.FCV), zap.Bool("changeStreams", info.SupportsChangeStreams()), zap.Bool("mongos", info.IsMongos), zap.Bool("masterSlave", info.MasterSlave))
+}
+
+// 将listIndexes返回的collation文档转换为options.Collation
+func collationFromDoc(doc bson.M) *options.Collation {
+	collation := &options.Collation{}
+	collation.Locale, _ = doc["locale"].(string)
+	collation.CaseLevel, _ = doc["caseLevel"].(bool)
+	collation.CaseFirst, _ = doc["caseFirst"].(string)
+	if strength, ok := doc["strength"].(int32); ok {
+		collation.Strength = int(strength)
+	}
+	collation.NumericOrdering, _ = doc["numericOrdering"].(bool)
+	collation.Alternate, _ = doc["alternate"].(string)
+	collation.MaxVariable, _ = doc["maxVariable"].(string)
+	collation.Normalization, _ = doc["normalization"].(bool)
+	collation.Backwards, _ = doc["backwards"].(bool)
+	return collation
+}
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// 视图（listCollections中type为view）没有自己的数据，按文档复制会报错或生成物化的快照。
+// 视图按原定义（viewOn + pipeline）在目标端重新创建，viewOn以及pipeline中$lookup、$graphLookup、$unionWith
+// 引用的集合按名称空间映射改为目标端的集合名
+
+// 视图的定义
+type viewOptions struct {
+	ViewOn    string   `bson:"viewOn"`
+	Pipeline  bson.A   `bson:"pipeline"`
+	Collation bson.Raw `bson:"collation,omitempty"`
+}
+
+// 源端的ns是否为视图
+func isView(srcMongo *MongoArgs, dbName, collName string) bool {
+	spec, err := srcMongo.collectionSpec(dbName, collName)
+	return err == nil && spec != nil && spec.Type == "view"
+}
+
+// 在目标端创建视图nsmap。mapping为所有要同步的ns（源ns到映射结果），用于映射视图引用的集合
+func syncView(srcMongo, dstMongo *MongoArgs, nsmap NsMap, spec *collSpec, mapping map[string]NsMap) error {
+	start := time.Now()
+	notifyProgress(func(listener ProgressListener) { listener.OnCollectionStart(nsmap) })
+	defer notifyProgress(func(listener ProgressListener) { listener.OnCollectionDone(nsmap, 0, 0, time.Since(start)) })
+
+	var view viewOptions
+	if err := bson.Unmarshal(spec.Options, &view); err != nil {
+		return fmt.Errorf("解析视图%s.%s的定义失败：%v", nsmap.SrcDb, nsmap.SrcColl, err)
+	}
+	// 视图与引用的集合必须在同一个库中
+	mapColl := func(coll string) (string, error) {
+		target, ok := mapping[nsmap.SrcDb+"."+coll]
+		if !ok {
+			return coll, nil
+		}
+		if target.DstDb != nsmap.DstDb {
+			return "", fmt.Errorf("视图%s.%s引用的集合%s.%s被映射到了不同的库%s", nsmap.SrcDb, nsmap.SrcColl, nsmap.SrcDb, coll, target.DstDb)
+		}
+		return target.DstColl, nil
+	}
+	viewOn, err := mapColl(view.ViewOn)
+	if err != nil {
+		return err
+	}
+	pipeline, err := mapViewPipeline(view.Pipeline, mapColl)
+	if err != nil {
+		return err
+	}
+
+	if err := clearDstColl(dstMongo, nsmap.DstDb, nsmap.DstColl); err != nil {
+		return err
+	}
+	cmd := bson.D{{"create", nsmap.DstColl}, {"viewOn", viewOn}, {"pipeline", pipeline}}
+	if len(view.Collation) > 0 {
+		cmd = append(cmd, bson.E{"collation", view.Collation})
+	}
+	ns := nsmap.DstDb + "." + nsmap.DstColl
+	err = doWithRetry(dstMongo.Context(), commandTimeout, "create", func(ctx context.Context) error {
+		return dstMongo.Client().Database(nsmap.DstDb).RunCommand(ctx, cmd).Err()
+	})
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == 48 { // NamespaceExists：目标端已经存在同名的视图或集合
+		dstMongo.logger().Warn("目标端已经存在同名的视图或集合，未重新创建视图", zap.String("NS", ns))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("创建视图%s失败：%v", ns, err)
+	}
+	dstMongo.logger().Info("已创建视图", zap.String("NS", ns), zap.String("viewOn", viewOn))
+	fmt.Printf("%s视图创建完成，viewOn：%s\n", nsmap.SrcDb+"."+nsmap.SrcColl, viewOn)
+	return nil
+}
+
+// 映射pipeline中各个阶段引用的集合名
+func mapViewPipeline(pipeline bson.A, mapColl func(string) (string, error)) (bson.A, error) {
+	mapped := make(bson.A, 0, len(pipeline))
+	for _, stage := range pipeline {
+		doc, ok := stage.(bson.D)
+		if !ok || len(doc) != 1 {
+			mapped = append(mapped, stage)
+			continue
+		}
+		var err error
+		switch name := doc[0].Key; name {
+		case "$lookup", "$graphLookup":
+			if spec, ok := doc[0].Value.(bson.D); ok {
+				doc = bson.D{{name, spec}}
+				doc[0].Value, err = mapStageColl(spec, "from", mapColl)
+			}
+		case "$unionWith":
+			switch spec := doc[0].Value.(type) {
+			case string:
+				var coll string
+				coll, err = mapColl(spec)
+				doc = bson.D{{name, coll}}
+			case bson.D:
+				doc = bson.D{{name, spec}}
+				doc[0].Value, err = mapStageColl(spec, "coll", mapColl)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		mapped = append(mapped, doc)
+	}
+	return mapped, nil
+}
+
+// 将阶段参数中key字段引用的集合名替换为映射后的名称，返回新的参数
+func mapStageColl(spec bson.D, key string, mapColl func(string) (string, error)) (bson.D, error) {
+	result := make(bson.D, len(spec))
+	copy(result, spec)
+	for i, e := range result {
+		if coll, ok := e.Value.(string); ok && e.Key == key {
+			mappedColl, err := mapColl(coll)
+			if err != nil {
+				return nil, err
+			}
+			result[i].Value = mappedColl
+		}
+	}
+	return result, nil
+}
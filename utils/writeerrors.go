@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// 全量复制写入失败的分类，按ns和分类分别统计，在同步结束时输出并记录到运行报告中：
+//
+//	duplicate_key       _id或唯一索引重复（--conflict_policy fail，或唯一索引与源端数据冲突）
+//	document_too_large  文档超过16MB或更新后超过16MB
+//	validation_failed   不满足目标集合的$jsonSchema等校验规则
+//	transient           主从切换、写冲突等临时错误，重试后仍然失败
+//	other               其他错误，包括整批写入失败（无法区分单个文档）
+const (
+	WriteErrorDuplicateKey = "duplicate_key"
+	WriteErrorTooLarge     = "document_too_large"
+	WriteErrorValidation   = "validation_failed"
+	WriteErrorTransient    = "transient"
+	WriteErrorOther        = "other"
+)
+
+// InsertMany是否有序写入：有序写入遇到第一个错误就停止，之后的文档需要重新写入；
+// 无序写入时其余文档照常写入，只有出错的文档按错误分类处理
+var insertOrdered = true
+
+// 设置InsertMany是否有序写入
+func SetInsertOrdered(ordered bool) {
+	insertOrdered = ordered
+}
+
+// 按错误码分类
+func classifyWriteError(code int) string {
+	switch code {
+	case 11000, 11001, 12582: // DuplicateKey
+		return WriteErrorDuplicateKey
+	case 10334, 17419, 17420: // BSONObjectTooLarge，插入或更新后的文档超过16MB
+		return WriteErrorTooLarge
+	case 121: // DocumentValidationFailure
+		return WriteErrorValidation
+	case 112: // WriteConflict
+		return WriteErrorTransient
+	}
+	for _, retryable := range retryableErrorCodes {
+		if code == retryable {
+			return WriteErrorTransient
+		}
+	}
+	return WriteErrorOther
+}
+
+// 错误中的服务端错误码，没有时为0
+func writeErrorCode(err error) int {
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && len(bulkErr.WriteErrors) > 0 {
+		return bulkErr.WriteErrors[0].Code
+	}
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) && len(writeErr.WriteErrors) > 0 {
+		return writeErr.WriteErrors[0].Code
+	}
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		return int(cmdErr.Code)
+	}
+	return 0
+}
+
+// 一个ns中一类写入失败的统计
+type WriteErrorStat struct {
+	Ns        string `bson:"ns" json:"ns"`
+	Class     string `bson:"class" json:"class"`
+	Num       int64  `bson:"num" json:"num"`
+	LastCode  int    `bson:"lastCode,omitempty" json:"lastCode,omitempty"`
+	LastError string `bson:"lastError" json:"lastError"`
+}
+
+// 本次运行中的写入失败
+var writeErrorStats struct {
+	sync.Mutex
+	stats map[[2]string]*WriteErrorStat
+}
+
+// 记录num个文档写入失败
+func recordWriteError(ns string, code int, num int64, err error) string {
+	class := classifyWriteError(code)
+	writeErrorStats.Lock()
+	defer writeErrorStats.Unlock()
+	if writeErrorStats.stats == nil {
+		writeErrorStats.stats = make(map[[2]string]*WriteErrorStat)
+	}
+	stat := writeErrorStats.stats[[2]string{ns, class}]
+	if stat == nil {
+		stat = &WriteErrorStat{Ns: ns, Class: class}
+		writeErrorStats.stats[[2]string{ns, class}] = stat
+	}
+	stat.Num += num
+	stat.LastCode, stat.LastError = code, err.Error()
+	return class
+}
+
+// 记录单个文档写入失败，输出日志并通知进度监听
+func failWrite(ctx context.Context, ns string, doc interface{}, code int, err error) {
+	class := recordWriteError(ns, code, 1, err)
+	loggerFrom(ctx).Error("写入文档失败", append(failedDocFields(ns, doc), zap.String("class", class), zap.Error(err))...)
+	notifyProgress(func(listener ProgressListener) { listener.OnError(ns, err) })
+}
+
+// 按ns和分类排序的写入失败统计
+func CustWriteErrorStats() []WriteErrorStat {
+	writeErrorStats.Lock()
+	defer writeErrorStats.Unlock()
+	list := make([]WriteErrorStat, 0, len(writeErrorStats.stats))
+	for _, stat := range writeErrorStats.stats {
+		list = append(list, *stat)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Ns != list[j].Ns {
+			return list[i].Ns < list[j].Ns
+		}
+		return list[i].Class < list[j].Class
+	})
+	return list
+}
+
+// 取出本次运行中的写入失败统计
+func takeWriteErrorStats() []WriteErrorStat {
+	list := CustWriteErrorStats()
+	writeErrorStats.Lock()
+	writeErrorStats.stats = nil
+	writeErrorStats.Unlock()
+	return list
+}
+
+// 输出写入失败的分类统计，没有失败时不输出
+func CustPrintWriteErrorReport() {
+	list := CustWriteErrorStats()
+	if len(list) == 0 {
+		return
+	}
+	fmt.Println("写入失败的文档：")
+	fmt.Printf("%-60s%-20s%10s  %s\n", "NS", "分类", "文档数", "最后一个错误")
+	for _, stat := range list {
+		fmt.Printf("%-60s%-20s%10d  %s\n", stat.Ns, stat.Class, stat.Num, stat.LastError)
+	}
+}